@@ -0,0 +1,366 @@
+// Package client is a Go client for pulse.
+//
+//	conn, err := client.Dial(ctx, "ws://localhost:8080", nil)
+//	if err != nil {
+//		return err
+//	}
+//	defer conn.Close()
+//
+//	if err := conn.Subscribe("orders", client.Where("amount > 100")); err != nil {
+//		return err
+//	}
+//
+//	for n := range conn.Notifications() {
+//		order, err := client.Decode[Order](n)
+//		...
+//	}
+//
+// Subscriptions reconnect on their own when the connection drops. With
+// Options.Resume the notifications missed meanwhile are replayed: those after
+// the seq of the last one received, while the server still keeps them, or
+// else those since it was received, which needs the server to persist them
+// (PULSE_EVENTS_RETENTION).
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"nhooyr.io/websocket"
+
+	"pulse/internal/database"
+)
+
+// Notification is a change received from pulse.
+type Notification = database.DBNotification
+
+// Decode unmarshals the row of n into a T, typically a struct with json tags
+// matching the table's columns.
+// It returns an error if the row doesn't fit T, or n has no row, like
+// deletes of the pulse.v1 protocol and control notifications.
+func Decode[T any](n Notification) (T, error) {
+	var row T
+	if n.Data == nil {
+		return row, fmt.Errorf("%s notification has no row", n.Operation)
+	}
+
+	// Numbers were kept as json.Number, they're marshaled back as is
+	data, err := json.Marshal(n.Data)
+	if err != nil {
+		return row, err
+	}
+	if err := json.Unmarshal(data, &row); err != nil {
+		return row, fmt.Errorf("could not decode the row of %s: %w", n.Table, err)
+	}
+	return row, nil
+}
+
+// protocol is the wire contract the client speaks.
+const protocol = "pulse.v2"
+
+// defaultReconnectDelay is how long a subscription waits before reconnecting.
+const defaultReconnectDelay = time.Second
+
+// Options configures a Conn, the zero value is valid.
+type Options struct {
+	// Header is sent with every websocket handshake, e.g. for authentication
+	Header http.Header
+	// ReconnectDelay is the wait between reconnection attempts, 1s if unset
+	ReconnectDelay time.Duration
+	// Resume replays the notifications missed while reconnecting.
+	// Replay starts after the seq of the last notification received. Once
+	// the server no longer keeps it, it starts from when it was received, so
+	// a few may be delivered twice.
+	Resume bool
+	// Buffer is the capacity of the Notifications channel
+	Buffer int
+}
+
+// Filter narrows a subscription down, see Subscribe.
+type Filter func(query url.Values)
+
+// Where only receives the rows matching a filter expression.
+func Where(expr string) Filter {
+	return func(query url.Values) { query.Set("filter", expr) }
+}
+
+// IDs only receives the changes to the given rows.
+func IDs(ids ...string) Filter {
+	return func(query url.Values) { query.Set("ids", strings.Join(ids, ",")) }
+}
+
+// Operations only receives the given operations.
+func Operations(operations ...string) Filter {
+	return func(query url.Values) { query.Set("operations", strings.Join(operations, ",")) }
+}
+
+// Columns only receives the updates changing one of the given columns.
+func Columns(columns ...string) Filter {
+	return func(query url.Values) { query.Set("columns", strings.Join(columns, ",")) }
+}
+
+// Fields projects the rows down to the given columns.
+func Fields(fields ...string) Filter {
+	return func(query url.Values) { query.Set("fields", strings.Join(fields, ",")) }
+}
+
+// Source only receives the changes from one database.
+func Source(source string) Filter {
+	return func(query url.Values) { query.Set("source", source) }
+}
+
+// Conn is a connection to a pulse server, shared by its subscriptions.
+type Conn struct {
+	url  *url.URL
+	opts Options
+
+	notifications chan Notification
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	subs   sync.WaitGroup
+}
+
+// Dial checks the pulse server at url is reachable and returns a Conn to it.
+// url is the server's base URL, ws://, wss://, http:// and https:// work.
+// It returns an error if url is invalid or the server can't be reached.
+func Dial(ctx context.Context, rawURL string, opts *Options) (*Conn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url: %w", err)
+	}
+
+	switch u.Scheme {
+	case "ws":
+		u.Scheme = "http"
+	case "wss":
+		u.Scheme = "https"
+	case "http", "https":
+	default:
+		return nil, fmt.Errorf("invalid url scheme %q", u.Scheme)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+
+	c := &Conn{url: u}
+	if opts != nil {
+		c.opts = *opts
+	}
+	if c.opts.ReconnectDelay <= 0 {
+		c.opts.ReconnectDelay = defaultReconnectDelay
+	}
+	c.notifications = make(chan Notification, c.opts.Buffer)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String()+"/", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not reach %s: %w", u, err)
+	}
+	resp.Body.Close()
+
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+
+	return c, nil
+}
+
+// Subscribe starts receiving the changes to table that match every filter.
+// An empty table subscribes to every table, the server must expose /ws/all.
+// It returns an error if the first connection fails, e.g. the server
+// rejected the filters.
+func (c *Conn) Subscribe(table string, filters ...Filter) error {
+	query := url.Values{}
+	for _, filter := range filters {
+		filter(query)
+	}
+
+	path := "/ws/all"
+	if table != "" {
+		path = "/ws/" + url.PathEscape(table)
+	}
+
+	sub := &subscription{conn: c, path: path, query: query}
+
+	socket, err := sub.dial(time.Time{}, 0)
+	if err != nil {
+		return err
+	}
+
+	c.subs.Add(1)
+	go sub.run(socket)
+
+	return nil
+}
+
+// Notifications returns the channel every subscription delivers to.
+// It's closed by Close.
+func (c *Conn) Notifications() <-chan Notification {
+	return c.notifications
+}
+
+// Close ends every subscription and closes the Notifications channel.
+func (c *Conn) Close() error {
+	c.cancel()
+	c.subs.Wait()
+	close(c.notifications)
+
+	return nil
+}
+
+// subscription is a single websocket, reconnected until the Conn is closed.
+type subscription struct {
+	conn  *Conn
+	path  string
+	query url.Values
+
+	// received is when the last notification arrived, replay resumes from it
+	// unless it had a seq
+	received time.Time
+	// seq is the seq of the last notification, replay resumes after it
+	seq int64
+	// retryAfter is the delay before reconnecting asked by a draining server
+	retryAfter time.Duration
+}
+
+// control is the message the server sends before closing a connection.
+type control struct {
+	Operation string `json:"operation"`
+	Table     string `json:"table"`
+	Reason    string `json:"reason"`
+	// RetryAfterMs is set by the "draining" message of a server shutting down
+	RetryAfterMs int64 `json:"retry_after_ms"`
+}
+
+// errFinished is returned by read when the server ended the subscription.
+var errFinished = errors.New("subscription finished")
+
+func (s *subscription) dial(since time.Time, after int64) (*websocket.Conn, error) {
+	u := *s.conn.url
+	switch u.Scheme {
+	case "https":
+		u.Scheme = "wss"
+	default:
+		u.Scheme = "ws"
+	}
+	u.Path += s.path
+
+	query := url.Values{}
+	for key, values := range s.query {
+		query[key] = values
+	}
+	// The server falls back to since_time once after isn't kept anymore
+	if after > 0 {
+		query.Set("since", strconv.FormatInt(after, 10))
+	}
+	if !since.IsZero() {
+		query.Set("since_time", since.UTC().Format(time.RFC3339Nano))
+	}
+	u.RawQuery = query.Encode()
+
+	socket, resp, err := websocket.Dial(s.conn.ctx, u.String(), &websocket.DialOptions{
+		HTTPHeader:   s.conn.opts.Header,
+		Subprotocols: []string{protocol},
+		// Only used if the server is set up to compress
+		CompressionMode: websocket.CompressionContextTakeover,
+	})
+	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("could not subscribe to %s: %s", s.path, resp.Status)
+		}
+		return nil, fmt.Errorf("could not subscribe to %s: %w", s.path, err)
+	}
+	socket.SetReadLimit(-1)
+
+	return socket, nil
+}
+
+// run reads from socket, reconnecting whenever it drops.
+func (s *subscription) run(socket *websocket.Conn) {
+	defer s.conn.subs.Done()
+
+	s.received = time.Now()
+	for {
+		err := s.read(socket)
+		socket.CloseNow()
+		if errors.Is(err, errFinished) {
+			return
+		}
+
+		// A draining server says when another instance should take over
+		delay := s.conn.opts.ReconnectDelay
+		if s.retryAfter > 0 {
+			delay, s.retryAfter = s.retryAfter, 0
+		}
+
+		for socket = nil; socket == nil; delay = s.conn.opts.ReconnectDelay {
+			select {
+			case <-s.conn.ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+
+			var since time.Time
+			var after int64
+			if s.conn.opts.Resume {
+				since, after = s.received, s.seq
+			}
+			socket, _ = s.dial(since, after)
+		}
+	}
+}
+
+// read delivers the notifications received on socket until it fails.
+func (s *subscription) read(socket *websocket.Conn) error {
+	for {
+		_, data, err := socket.Read(s.conn.ctx)
+		if err != nil {
+			if s.conn.ctx.Err() != nil {
+				return errFinished
+			}
+			return err
+		}
+
+		// Control messages are the only ones without a table
+		var c control
+		if err := json.Unmarshal(data, &c); err != nil {
+			continue
+		}
+		if c.Table == "" && c.Operation == "close" {
+			return errFinished
+		}
+		if c.Table == "" && c.Operation == "error" {
+			return fmt.Errorf("server closed the connection: %s", c.Reason)
+		}
+		// The server still delivers what's queued before closing
+		if c.Table == "" && c.Operation == "draining" {
+			s.retryAfter = time.Duration(c.RetryAfterMs) * time.Millisecond
+			continue
+		}
+
+		var n Notification
+		decoder := json.NewDecoder(strings.NewReader(string(data)))
+		decoder.UseNumber()
+		if err := decoder.Decode(&n); err != nil {
+			continue
+		}
+		s.received = time.Now()
+		if n.Seq > 0 {
+			s.seq = n.Seq
+		}
+
+		select {
+		case s.conn.notifications <- n:
+		case <-s.conn.ctx.Done():
+			return errFinished
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"pulse/internal/database"
+	"strings"
+	"time"
+)
+
+// runDoctor checks that every database can be reached and that the changes of
+// all their watched tables notify, printing a line per check.
+// It returns an error if any check failed.
+func runDoctor(args []string) error {
+	flags := newFlagSet("doctor", "Checks the databases can be reached and the triggers of their tables are installed.")
+	timeout := flags.Duration("timeout", 10*time.Second, "how long the checks of a database may take")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	configs, err := database.ConfigsFromEnv()
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	failed := false
+	for _, cfg := range configs {
+		if !check(cfg, *timeout) {
+			failed = true
+		}
+	}
+
+	if failed {
+		return errors.New("some checks failed")
+	}
+	return nil
+}
+
+// check runs the checks of the database of cfg and reports whether they all
+// passed.
+func check(cfg database.Config, timeout time.Duration) bool {
+	db, err := database.NewWithConfig(cfg)
+	if err != nil {
+		fmt.Printf("FAIL  connect: %v\n", err)
+		return false
+	}
+	defer db.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if _, err := db.Health(ctx); err != nil {
+		fmt.Printf("FAIL  %s: %v\n", db.Source(), err)
+		return false
+	}
+	fmt.Printf("ok    %s is reachable\n", db.Source())
+
+	unwatched, err := db.Unwatched(ctx)
+	if err != nil {
+		fmt.Printf("FAIL  %s: failed to look the triggers up: %v\n", db.Source(), err)
+		return false
+	}
+	if len(unwatched) > 0 {
+		fmt.Printf("FAIL  %s: %d tables don't notify, run pulse sync: %s\n", db.Source(), len(unwatched), strings.Join(unwatched, ", "))
+		return false
+	}
+	fmt.Printf("ok    %s: the triggers of every table are installed\n", db.Source())
+	return true
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"os/signal"
+	"pulse/internal/database"
+	"pulse/internal/server"
+	"syscall"
+)
+
+// runListen prints the notifications of every database matching the
+// subscription of its flags to stdout, one JSON object per line, until it's
+// interrupted. The triggers must have been synced.
+func runListen(args []string) error {
+	flags := newFlagSet("listen", "Prints the notifications of the databases to stdout as JSON lines, until interrupted.\nThe triggers must be synced, see pulse sync.")
+	table := flags.String("table", "", "only print the notifications of this table, or of the tables matching this pattern")
+	id := flags.String("id", "", "only print the notifications of this row of -table")
+	operations := flags.String("operations", "", "only print these comma-separated operations, e.g. insert,update")
+	where := flags.String("where", "", "only print the rows meeting these conditions, e.g. status=eq.paid")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	if *operations != "" {
+		query.Set("operations", *operations)
+	}
+	if *where != "" {
+		query.Set("where", *where)
+	}
+	sub, err := server.NewSubscription(*table, *id, query)
+	if err != nil {
+		return err
+	}
+
+	dbs, err := connect()
+	if err != nil {
+		return err
+	}
+	defer closeAll(dbs)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	notifications := make(chan database.DBNotification)
+	failed := make(chan error, len(dbs))
+	for _, db := range dbs {
+		go func(db database.Service) {
+			if err := db.Watch(ctx, notifications); err != nil {
+				failed <- fmt.Errorf("failed to watch %s: %w", db.Source(), err)
+			}
+		}(db)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	for {
+		select {
+		case msg := <-notifications:
+			if n, ok := sub.Accept(msg); ok {
+				if err := encoder.Encode(n); err != nil {
+					return err
+				}
+			}
+		case err := <-failed:
+			return err
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
@@ -1,16 +1,147 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"pulse/internal/database"
+	"pulse/internal/logging"
 	"pulse/internal/server"
+	"strings"
+	"syscall"
+	"time"
 )
 
+// commands are the subcommands of pulse, serve runs when none is given.
+var commands = map[string]func(args []string) error{
+	"serve":     runServe,
+	"sync":      runSync,
+	"listen":    runListen,
+	"doctor":    runDoctor,
+	"uninstall": runUninstall,
+}
+
+const usage = `Usage: pulse [command] [flags]
+
+Commands:
+  serve       run the server (default)
+  sync        install the triggers on the watched tables and exit
+  listen      print the notifications of the databases as JSON lines
+  doctor      check the databases can be reached and their tables notify
+  uninstall   drop the triggers and functions pulse installed
+
+Run pulse <command> -h for the flags of a command.
+`
+
 func main() {
+	logger, err := logging.FromEnv()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	// Lines still written through the log package go through it too
+	slog.SetDefault(logger)
+
+	args := os.Args[1:]
+	if len(args) > 0 && (args[0] == "help" || args[0] == "-h" || args[0] == "-help" || args[0] == "--help") {
+		fmt.Print(usage)
+		return
+	}
+
+	name := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+
+	command, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", name, usage)
+		os.Exit(2)
+	}
+
+	err = command(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
 
-	server := server.NewServer()
+// newFlagSet returns the flags of command, printing summary above them
+// with -h.
+func newFlagSet(command, summary string) *flag.FlagSet {
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: pulse %s [flags]\n\n%s\n", command, summary)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// runServe runs the server until it's interrupted, then shuts it down
+// gracefully.
+func runServe(args []string) error {
+	flags := newFlagSet("serve", "Syncs the triggers, then serves the websockets until interrupted.")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	server, err := server.NewServer()
+	if err != nil {
+		return fmt.Errorf("failed to start the server: %w", err)
+	}
+
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			panic(fmt.Sprintf("cannot start server: %s", err))
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
 
-	err := server.ListenAndServe()
+	// Give in-flight notifications a chance to reach the clients
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Error("Failed to shut down the server", "error", err)
+	}
+	return nil
+}
+
+// connect connects to every database configured by the environment.
+// It returns an error if the configuration is invalid or a database can't
+// be reached, those connected so far are closed.
+func connect() ([]database.Service, error) {
+	configs, err := database.ConfigsFromEnv()
 	if err != nil {
-		panic(fmt.Sprintf("cannot start server: %s", err))
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	var dbs []database.Service
+	for _, cfg := range configs {
+		db, err := database.NewWithConfig(cfg)
+		if err != nil {
+			closeAll(dbs)
+			return nil, err
+		}
+		dbs = append(dbs, db)
+	}
+	return dbs, nil
+}
+
+func closeAll(dbs []database.Service) {
+	for _, db := range dbs {
+		db.Close()
 	}
 }
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// runSync installs the triggers on the watched tables of every database, as
+// the server does when it starts.
+func runSync(args []string) error {
+	flags := newFlagSet("sync", "Installs the triggers on the watched tables of every database and exits.")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	dbs, err := connect()
+	if err != nil {
+		return err
+	}
+	defer closeAll(dbs)
+
+	// Interrupting rolls the sync in progress back
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	for _, db := range dbs {
+		if err := db.SyncTables(ctx); err != nil {
+			return fmt.Errorf("failed to sync tables on %s: %w", db.Source(), err)
+		}
+		fmt.Printf("synced %s\n", db.Source())
+	}
+	return nil
+}
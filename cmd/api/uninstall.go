@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// runUninstall drops pulse's triggers from the tables of every database, and
+// its functions unless only some tables are selected.
+func runUninstall(args []string) error {
+	flags := newFlagSet("uninstall", "Drops pulse's triggers and functions from every database.\nThe server syncs them back when it starts.")
+	tables := flags.String("tables", "", "only drop the triggers of these comma-separated tables, optionally schema qualified, keeping the functions")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var selected []string
+	if *tables != "" {
+		for _, table := range strings.Split(*tables, ",") {
+			selected = append(selected, strings.TrimSpace(table))
+		}
+	}
+
+	dbs, err := connect()
+	if err != nil {
+		return err
+	}
+	defer closeAll(dbs)
+
+	for _, db := range dbs {
+		removed, err := db.RemoveTriggers(context.Background(), selected...)
+		if err != nil {
+			return fmt.Errorf("failed to remove the triggers on %s: %w", db.Source(), err)
+		}
+		for _, table := range removed {
+			fmt.Printf("removed the triggers of %s on %s\n", table, db.Source())
+		}
+		if len(selected) == 0 {
+			fmt.Printf("removed pulse's functions on %s\n", db.Source())
+		}
+	}
+	return nil
+}
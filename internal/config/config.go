@@ -0,0 +1,101 @@
+// Package config loads the pulse config file, which declares what is
+// watched and how it's exposed, e.g.
+//
+//	capture: trigger
+//	schemas: [public, billing]
+//	exclude:
+//	  - sessions
+//	  - billing.ledger
+//	  - audit_*
+//	tables:
+//	  users:
+//	    columns: [id, email]
+//	  posts:
+//	    condition: NOT OLD.is_published AND NEW.is_published
+//	  audit_log:
+//	    bulk: true
+//	routes:
+//	  firehose: false
+//
+// Files ending in .json are read as JSON, anything else as YAML.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+// File is the content of a config file. Everything is optional.
+type File struct {
+	// Schemas whose tables are watched, public if empty
+	Schemas []string `json:"schemas" yaml:"schemas"`
+	// Include lists the only tables watched, every one if empty, and Exclude
+	// those that aren't, as table or schema.table patterns like audit_*
+	Include []string `json:"include" yaml:"include"`
+	Exclude []string `json:"exclude" yaml:"exclude"`
+	// Tables holds the settings of individual tables, by name
+	Tables map[string]Table `json:"tables" yaml:"tables"`
+	Routes Routes           `json:"routes" yaml:"routes"`
+	// Capture is how changes are captured: trigger, the default, or replication
+	Capture string `json:"capture" yaml:"capture"`
+}
+
+// Table holds how a table notifies.
+type Table struct {
+	// Columns are the only columns its notifications carry
+	Columns []string `json:"columns" yaml:"columns"`
+	// Condition is the SQL condition its updates must meet to notify
+	Condition string `json:"condition" yaml:"condition"`
+	// Bulk notifies once per statement instead of once per row
+	Bulk bool `json:"bulk" yaml:"bulk"`
+}
+
+// Routes holds how the subscription routes are exposed.
+type Routes struct {
+	// Firehose exposes /ws/all and /sse/all, nil leaves the default
+	Firehose *bool `json:"firehose" yaml:"firehose"`
+}
+
+// Load reads the config file at path.
+// It returns an error if the file can't be read or parsed, or holds unknown
+// settings, which are most likely typos.
+func Load(path string) (File, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return File{}, err
+	}
+
+	var file File
+	if filepath.Ext(path) == ".json" {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(&file)
+	} else {
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		// An empty file sets nothing
+		if err = decoder.Decode(&file); errors.Is(err, io.EOF) {
+			err = nil
+		}
+	}
+	if err != nil {
+		return File{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return file, nil
+}
+
+// FromEnv loads the config file set by PULSE_CONFIG, if any.
+func FromEnv() (File, error) {
+	path := os.Getenv("PULSE_CONFIG")
+	if path == "" {
+		return File{}, nil
+	}
+	return Load(path)
+}
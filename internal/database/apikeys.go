@@ -0,0 +1,61 @@
+package database
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// ErrAPIKeysDisabled is returned by LookupAPIKey unless PULSE_API_KEYS_TABLE
+// is set.
+var ErrAPIKeysDisabled = errors.New("API keys aren't stored in the database, set PULSE_API_KEYS_TABLE")
+
+// ErrUnknownAPIKey is returned by LookupAPIKey for keys that don't exist or
+// expired.
+var ErrUnknownAPIKey = errors.New("unknown API key")
+
+// APIKey is a key of pulse_api_keys, granting the subscribers presenting it
+// every row of Tables.
+type APIKey struct {
+	Name   string
+	Tables []string
+}
+
+func (s *service) createAPIKeysTable(ctx context.Context) error {
+	_, err := s.db.Exec(ctx, `CREATE TABLE IF NOT EXISTS pulse_api_keys
+(
+    name       text PRIMARY KEY,
+    key_hash   text UNIQUE NOT NULL,
+    tables     text[]      NOT NULL DEFAULT '{}',
+    expires_at timestamptz,
+    created_at timestamptz NOT NULL DEFAULT now()
+);`)
+
+	return err
+}
+
+// HashAPIKey returns the hash pulse_api_keys stores key as, its hex encoded
+// SHA-256, which is also what encode(sha256('key'), 'hex') computes.
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// LookupAPIKey returns the unexpired key of pulse_api_keys whose hash is
+// key's.
+func (s *service) LookupAPIKey(ctx context.Context, key string) (APIKey, error) {
+	if !s.cfg.APIKeysTable {
+		return APIKey{}, ErrAPIKeysDisabled
+	}
+
+	var apiKey APIKey
+	err := s.db.QueryRow(ctx, `SELECT name, tables FROM pulse_api_keys
+WHERE key_hash = $1 AND (expires_at IS NULL OR expires_at > now())`, HashAPIKey(key)).Scan(&apiKey.Name, &apiKey.Tables)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return APIKey{}, ErrUnknownAPIKey
+	}
+	return apiKey, err
+}
@@ -0,0 +1,96 @@
+package database
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// bulkIDs is how many ids of the affected rows a bulk notification carries.
+const bulkIDs = 100
+
+// syncBulkTables replaces the row triggers of the watched tables named in
+// bulk by statement triggers, which send a single summary of the rows a
+// statement changed through their transition tables: their count and up to
+// bulkIDs of their ids.
+// Statements changing no rows don't notify.
+func syncBulkTables(ctx context.Context, tx pgx.Tx, watched []watchedTable, bulk []string) error {
+	if len(bulk) == 0 {
+		return nil
+	}
+
+	_, err := tx.Exec(ctx, fmt.Sprintf(`CREATE OR REPLACE FUNCTION pulse_bulk_watcher() RETURNS trigger AS
+$$
+DECLARE
+    affected BIGINT;
+    ids      JSON;
+BEGIN
+
+    IF (TG_OP = 'DELETE') THEN
+        SELECT count(*) INTO affected FROM pulse_old;
+        SELECT json_agg(pulse_row_id(to_jsonb(k), TG_ARGV[0]::jsonb)) INTO ids FROM (SELECT * FROM pulse_old LIMIT %[1]d) k;
+    ELSE
+        SELECT count(*) INTO affected FROM pulse_new;
+        SELECT json_agg(pulse_row_id(to_jsonb(k), TG_ARGV[0]::jsonb)) INTO ids FROM (SELECT * FROM pulse_new LIMIT %[1]d) k;
+    END IF;
+
+    IF (affected > 0) THEN
+        PERFORM pulse_notify(json_build_object(
+                'operation', lower(TG_OP),
+                'table', TG_TABLE_NAME,
+                'schema', TG_TABLE_SCHEMA,
+                'txid', txid_current(),
+                'ts', clock_timestamp(),
+                'trace_id', coalesce(nullif(current_setting('pulse.trace_id', true), ''),
+                                     md5(txid_current()::text || transaction_timestamp()::text)),
+                'bulk', true,
+                'count', affected,
+                'ids', ids));
+    END IF;
+
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+`, bulkIDs))
+	if err != nil {
+		return err
+	}
+
+	for _, table := range bulk {
+		t, err := watchedNamed(watched, table)
+		if err != nil {
+			return fmt.Errorf("bulk table %s: %w", table, err)
+		}
+
+		if err := createBulkTriggers(ctx, tx, t); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// createBulkTriggers replaces the row triggers of t by the statement ones.
+func createBulkTriggers(ctx context.Context, tx pgx.Tx, t watchedTable) error {
+	_, err := tx.Exec(ctx, fmt.Sprintf(`DROP TRIGGER IF EXISTS %[2]s ON %[1]s;
+DROP TRIGGER IF EXISTS %[6]s ON %[1]s;
+CREATE TRIGGER %[3]s AFTER INSERT ON %[1]s
+    REFERENCING NEW TABLE AS pulse_new
+    FOR EACH STATEMENT EXECUTE FUNCTION pulse_bulk_watcher(%[7]s);
+CREATE TRIGGER %[4]s AFTER UPDATE ON %[1]s
+    REFERENCING NEW TABLE AS pulse_new
+    FOR EACH STATEMENT EXECUTE FUNCTION pulse_bulk_watcher(%[7]s);
+CREATE TRIGGER %[5]s AFTER DELETE ON %[1]s
+    REFERENCING OLD TABLE AS pulse_old
+    FOR EACH STATEMENT EXECUTE FUNCTION pulse_bulk_watcher(%[7]s);`,
+		t.quoted(),
+		pgx.Identifier{t.name + "_trigger"}.Sanitize(),
+		pgx.Identifier{t.name + "_bulk_insert"}.Sanitize(),
+		pgx.Identifier{t.name + "_bulk_update"}.Sanitize(),
+		pgx.Identifier{t.name + "_bulk_delete"}.Sanitize(),
+		pgx.Identifier{t.name + "_update_trigger"}.Sanitize(),
+		t.primaryKeyArg(),
+	))
+	return err
+}
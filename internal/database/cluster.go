@@ -0,0 +1,238 @@
+package database
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"pulse/internal/tracing"
+)
+
+// ClusterPostgres relays notifications between replicas through Postgres,
+// see Config.Cluster.
+const ClusterPostgres = "postgres"
+
+// ErrClusterDisabled is returned by Relay unless PULSE_CLUSTER is set.
+var ErrClusterDisabled = errors.New("the cluster is disabled, set PULSE_CLUSTER")
+
+const (
+	// clusterPayloadLimit is the largest relay sent as a notification,
+	// Postgres rejects those of 8000 bytes or more. Larger ones go through
+	// pulse_cluster_relay
+	clusterPayloadLimit = 7900
+	// clusterRelayRetention is how long relays are kept in
+	// pulse_cluster_relay for the other replicas to fetch
+	clusterRelayRetention = time.Minute
+	// clusterPruneEvery is how many relays are stored between two prunes
+	clusterPruneEvery = 100
+)
+
+// clusterFromEnv returns the cluster set by PULSE_CLUSTER, empty if disabled.
+func clusterFromEnv() (string, error) {
+	switch cluster := os.Getenv("PULSE_CLUSTER"); cluster {
+	case "", ClusterPostgres:
+		return cluster, nil
+	default:
+		return "", fmt.Errorf("invalid PULSE_CLUSTER %q, must be %s", cluster, ClusterPostgres)
+	}
+}
+
+// clusterMessage is relayed to the other replicas: the notification, or the
+// id of the pulse_cluster_relay row holding it when it's too large, with the
+// W3C traceparent of its span so their fan-out continues the trace.
+type clusterMessage struct {
+	Origin       string          `json:"origin"`
+	Notification *DBNotification `json:"notification,omitempty"`
+	Ref          int64           `json:"ref,omitempty"`
+	Traceparent  string          `json:"traceparent,omitempty"`
+}
+
+// newInstanceID returns a random id telling the replicas apart.
+func newInstanceID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+func (s *service) createClusterTable(ctx context.Context) error {
+	_, err := s.db.Exec(ctx, `CREATE TABLE IF NOT EXISTS pulse_cluster_relay
+(
+    id         bigint GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    payload    jsonb       NOT NULL,
+    created_at timestamptz NOT NULL DEFAULT now()
+);`)
+
+	return err
+}
+
+// Relay sends n to the other replicas watching this database, through
+// pg_notify on the cluster channel. Their Watch sends it on as if they had
+// captured it.
+func (s *service) Relay(ctx context.Context, n DBNotification) error {
+	if s.cfg.Cluster == "" {
+		return ErrClusterDisabled
+	}
+
+	payload, err := json.Marshal(clusterMessage{Origin: s.instance, Notification: &n, Traceparent: tracing.Traceparent(n.Span)})
+	if err != nil {
+		return err
+	}
+
+	if len(payload) > clusterPayloadLimit {
+		if payload, err = s.storeRelay(ctx, n); err != nil {
+			return err
+		}
+	}
+
+	_, err = s.db.Exec(ctx, "SELECT pg_notify($1, $2)", s.cfg.clusterChannel(), string(payload))
+	return err
+}
+
+// storeRelay stores n in pulse_cluster_relay, pruning the relays past
+// retention once in a while. It returns the message referencing it.
+func (s *service) storeRelay(ctx context.Context, n DBNotification) ([]byte, error) {
+	notification, err := json.Marshal(n)
+	if err != nil {
+		return nil, err
+	}
+
+	var id int64
+	if err := s.db.QueryRow(ctx, "INSERT INTO pulse_cluster_relay (payload) VALUES ($1) RETURNING id", notification).Scan(&id); err != nil {
+		return nil, err
+	}
+
+	if id%clusterPruneEvery == 0 {
+		if _, err := s.db.Exec(ctx, "DELETE FROM pulse_cluster_relay WHERE created_at < $1", time.Now().Add(-clusterRelayRetention)); err != nil {
+			slog.Error("Failed to prune the cluster relays", "source", s.source, "error", err)
+		}
+	}
+
+	return json.Marshal(clusterMessage{Origin: s.instance, Ref: id, Traceparent: tracing.Traceparent(n.Span)})
+}
+
+// watchCluster sends the notifications relayed by the other replicas to ch
+// until ctx is done. If the connection is lost it reconnects like Watch,
+// sending a resubscribed notification once it listens again.
+func (s *service) watchCluster(ctx context.Context, ch chan DBNotification) {
+	backoff := minReconnectBackoff
+	resubscribed := false
+	for {
+		listening := make(chan struct{})
+		err := s.listenCluster(ctx, ch, resubscribed, listening)
+		if ctx.Err() != nil {
+			return
+		}
+
+		select {
+		case <-listening:
+			backoff = minReconnectBackoff
+			resubscribed = true
+		default:
+			backoff = min(2*backoff, maxReconnectBackoff)
+		}
+
+		slog.Warn("Lost the cluster channel, reconnecting", "source", s.source, "backoff", backoff, "error", err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// listenCluster LISTENs on the cluster channel and sends what the other
+// replicas relay to ch until the connection fails or ctx is done.
+// listening is closed once LISTEN succeeded, a resubscribed notification is
+// then sent first if it's a reconnection.
+func (s *service) listenCluster(ctx context.Context, ch chan DBNotification, resubscribed bool, listening chan struct{}) error {
+	conn, err := s.listenDB.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to acquire connection: %w", err)
+	}
+	defer conn.Release()
+	defer unlisten(conn)
+
+	pgConn := conn.Conn()
+	if _, err := pgConn.Exec(ctx, "LISTEN "+pgx.Identifier{s.cfg.clusterChannel()}.Sanitize()); err != nil {
+		return fmt.Errorf("unable to start listening: %w", err)
+	}
+	close(listening)
+
+	if resubscribed {
+		select {
+		case ch <- DBNotification{Operation: OperationResubscribed, Source: s.source, EmittedAt: time.Now()}:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+
+	for {
+		raw, err := pgConn.WaitForNotification(ctx)
+		if err != nil {
+			return fmt.Errorf("unable to wait for notification: %w", err)
+		}
+
+		var msg clusterMessage
+		if err := decodeJSON(raw.Payload, &msg); err != nil {
+			slog.Error("Failed to decode a cluster relay", "source", s.source, "error", err)
+			continue
+		}
+		if msg.Origin == s.instance {
+			continue
+		}
+
+		n, err := s.relayed(ctx, msg)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			// Like an undecodable payload, the subscribers must resync
+			slog.Error("Failed to fetch a cluster relay", "source", s.source, "ref", msg.Ref, "error", err)
+			n = DBNotification{Operation: OperationEventLost, Source: s.source, EmittedAt: time.Now()}
+		}
+
+		select {
+		case ch <- n:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// relayed returns the notification msg relays, fetching it from
+// pulse_cluster_relay if it was too large.
+func (s *service) relayed(ctx context.Context, msg clusterMessage) (DBNotification, error) {
+	var n DBNotification
+	if msg.Notification != nil {
+		n = *msg.Notification
+	} else {
+		var payload string
+		if err := s.db.QueryRow(ctx, "SELECT payload::text FROM pulse_cluster_relay WHERE id = $1", msg.Ref).Scan(&payload); err != nil {
+			return DBNotification{}, err
+		}
+		if err := decodeJSON(payload, &n); err != nil {
+			return DBNotification{}, err
+		}
+	}
+
+	if msg.Traceparent != "" {
+		n.Span, _ = tracing.ParseTraceparent(msg.Traceparent)
+	}
+	return n, nil
+}
+
+// decodeJSON decodes payload into v, keeping numbers as they were written.
+func decodeJSON(payload string, v any) error {
+	decoder := json.NewDecoder(strings.NewReader(payload))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
@@ -0,0 +1,101 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// tableColumns returns the allowlists set by PULSE_TABLE_COLUMNS, a JSON
+// object mapping tables to the only columns their notifications carry, e.g.
+// {"users": ["id", "email"]}.
+// It returns an error if the variable isn't such an object.
+func tableColumns() (map[string][]string, error) {
+	raw := os.Getenv("PULSE_TABLE_COLUMNS")
+	if raw == "" {
+		return nil, nil
+	}
+
+	var columns map[string][]string
+	if err := json.Unmarshal([]byte(raw), &columns); err != nil {
+		return nil, fmt.Errorf("invalid PULSE_TABLE_COLUMNS: %w", err)
+	}
+	for table, allowed := range columns {
+		if len(allowed) == 0 {
+			return nil, fmt.Errorf("invalid PULSE_TABLE_COLUMNS: no columns for %s", table)
+		}
+	}
+	return columns, nil
+}
+
+// allowedColumns returns the allowlist of t, and whether it has one.
+func (s *service) allowedColumns(t watchedTable) ([]string, bool) {
+	return tableSetting(s.cfg.TableColumns, t)
+}
+
+func (s *service) ColumnAllowed(table, column string) bool {
+	if schema, name, qualified := strings.Cut(table, "."); qualified {
+		allowed, ok := s.allowedColumns(watchedTable{schema: schema, name: name})
+		return !ok || contains(allowed, column)
+	}
+
+	// Without its schema, it's the table of any of them
+	for key, allowed := range s.cfg.TableColumns {
+		if (key == table || strings.HasSuffix(key, "."+table)) && !contains(allowed, column) {
+			return false
+		}
+	}
+	return true
+}
+
+// leaveColumnsOut removes the columns of row its table's allowlist doesn't
+// have, if there's one, like pulse_watcher does.
+func (s *service) leaveColumnsOut(t watchedTable, row map[string]interface{}) {
+	allowed, ok := s.allowedColumns(t)
+	if !ok {
+		return
+	}
+	for column := range row {
+		if !contains(allowed, column) {
+			delete(row, column)
+		}
+	}
+}
+
+// watcherCall returns the call of pulse_watcher from a row trigger of t,
+// passing it the primary key of t and the allowed columns, if any, as
+// arguments.
+func watcherCall(t watchedTable, columns []string) string {
+	args := []string{t.primaryKeyArg()}
+	for _, column := range columns {
+		args = append(args, quoteLiteral(column))
+	}
+	return "pulse_watcher(" + strings.Join(args, ", ") + ")"
+}
+
+// syncTableColumns recreates the row trigger of every watched table with an
+// allowlist, so pulse_watcher leaves the other columns out of the payload.
+// Tables with a trigger condition are handled by syncTriggerConditions.
+func syncTableColumns(ctx context.Context, tx pgx.Tx, watched []watchedTable, columns map[string][]string) error {
+	for table := range columns {
+		t, err := watchedNamed(watched, table)
+		if err != nil {
+			return fmt.Errorf("columns of %s: %w", table, err)
+		}
+
+		// A table keyed both ways gets the allowlist of its qualified name
+		allowed, _ := tableSetting(columns, t)
+		_, err = tx.Exec(ctx, fmt.Sprintf(`CREATE OR REPLACE TRIGGER %s AFTER INSERT OR UPDATE OR DELETE ON %s
+    FOR EACH ROW EXECUTE FUNCTION %s;`,
+			pgx.Identifier{t.name + "_trigger"}.Sanitize(), t.quoted(), watcherCall(t, allowed)))
+		if err != nil {
+			return fmt.Errorf("columns of %s: %w", table, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,56 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// triggerConditions returns the conditions set by PULSE_TRIGGER_CONDITIONS, a
+// JSON object mapping tables to the SQL condition their updates must meet to
+// notify, e.g. {"posts": "NOT OLD.is_published AND NEW.is_published"}.
+// It returns an error if the variable isn't such an object.
+func triggerConditions() (map[string]string, error) {
+	raw := os.Getenv("PULSE_TRIGGER_CONDITIONS")
+	if raw == "" {
+		return nil, nil
+	}
+
+	var conditions map[string]string
+	if err := json.Unmarshal([]byte(raw), &conditions); err != nil {
+		return nil, fmt.Errorf("invalid PULSE_TRIGGER_CONDITIONS: %w", err)
+	}
+	return conditions, nil
+}
+
+// syncTriggerConditions splits the row trigger of every watched table with a
+// condition in two: inserts and deletes keep notifying, updates only when
+// the condition holds. Postgres evaluates it in the trigger's WHEN clause,
+// so the updates filtered out never reach pulse.
+// Conditions are trusted configuration, they're interpolated as is.
+// Both triggers pass pulse_watcher the table's allowed columns, if any.
+func syncTriggerConditions(ctx context.Context, tx pgx.Tx, watched []watchedTable, conditions map[string]string, columns map[string][]string) error {
+	for table := range conditions {
+		t, err := watchedNamed(watched, table)
+		if err != nil {
+			return fmt.Errorf("condition on %s: %w", table, err)
+		}
+
+		condition, _ := tableSetting(conditions, t)
+		allowed, _ := tableSetting(columns, t)
+		_, err = tx.Exec(ctx, fmt.Sprintf(`DROP TRIGGER IF EXISTS %[2]s ON %[1]s;
+CREATE TRIGGER %[2]s AFTER INSERT OR DELETE ON %[1]s
+    FOR EACH ROW EXECUTE FUNCTION %[5]s;
+CREATE TRIGGER %[3]s AFTER UPDATE ON %[1]s
+    FOR EACH ROW WHEN (%[4]s) EXECUTE FUNCTION %[5]s;`,
+			t.quoted(), pgx.Identifier{t.name + "_trigger"}.Sanitize(), pgx.Identifier{t.name + "_update_trigger"}.Sanitize(), condition, watcherCall(t, allowed)))
+		if err != nil {
+			return fmt.Errorf("condition on %s: %w", table, err)
+		}
+	}
+
+	return nil
+}
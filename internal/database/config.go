@@ -0,0 +1,592 @@
+package database
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"pulse/internal/config"
+)
+
+// defaultChannel is the channel the triggers notify on unless configured.
+const defaultChannel = "pulse_watcher"
+
+// defaultSlot names the replication slot and publication unless configured.
+const defaultSlot = "pulse"
+
+// How changes are captured, see Config.Capture
+const (
+	// CaptureTrigger has triggers notify of every change
+	CaptureTrigger = "trigger"
+	// CaptureReplication decodes the changes from a logical replication slot
+	CaptureReplication = "replication"
+)
+
+// Config describes a database to connect to and how it's watched.
+// ConfigFromEnv fills it from the environment, programs embedding pulse can
+// build it themselves.
+type Config struct {
+	// Name identifies the database, it's the source of its notifications
+	// instead of its host/database, e.g. eu. It's made of letters, digits,
+	// _ and -
+	Name string
+	// URL is a Postgres connection string, the fields up to Schema are
+	// ignored when it's set
+	URL      string
+	Host     string
+	Port     int
+	Username string
+	Password string
+	Database string
+	// Schema is the search_path of the connections
+	Schema string
+
+	// SSLMode is the sslmode the fields connect with, e.g. require or
+	// verify-full, disable by default. URL follows its own
+	SSLMode string
+
+	// TLS secures the connections with the given config. Without it the
+	// fields connect as SSLMode says, while URL follows its sslmode
+	TLS *tls.Config
+	// MaxConns and MinConns size the connection pool, zero keeps pgx's defaults
+	MaxConns int32
+	MinConns int32
+	// MaxConnLifetime and MaxConnIdleTime are how long the connections of
+	// the pool are kept at most, and while idle. HealthCheckPeriod is how
+	// often the idle ones are checked. Zero keeps pgx's defaults
+	MaxConnLifetime   time.Duration
+	MaxConnIdleTime   time.Duration
+	HealthCheckPeriod time.Duration
+	// ListenURL is the connection string of the connections Watch LISTENs
+	// on, and of the replication connection of CaptureReplication, e.g.
+	// straight to the primary when the pool goes through PgBouncer in
+	// transaction mode. It must lead to the primary, standbys can't LISTEN.
+	// Empty uses the pool's
+	ListenURL string
+	// ReplicaURL is the connection string of a read replica, where Snapshot
+	// and Replay read so they don't load the primary. Their rows may lag
+	// behind it. Trigger management and the other queries stay on the
+	// primary. Empty reads from the primary
+	ReplicaURL string
+
+	// Capture is how changes are captured, CaptureTrigger by default.
+	// CaptureReplication lifts the 8000 bytes limit of notifications and
+	// needs no trigger, but needs wal_level = logical
+	Capture string
+	// Channel is the channel the triggers notify on, pulse_watcher by default
+	Channel string
+	// Slot names the replication slot and publication of CaptureReplication,
+	// pulse by default
+	Slot string
+	// Schemas are the schemas whose tables are watched, public if empty
+	Schemas []string
+	// Include lists the only tables watched, every one if empty, and Exclude
+	// those that aren't. Both hold table or schema.table patterns, where *
+	// matches any characters, ? any one and [...] a set, e.g. audit_* or
+	// billing.*
+	Include []string
+	Exclude []string
+	// EventsRetention is how long notifications are persisted to be
+	// replayed, zero disables persistence
+	EventsRetention time.Duration
+	// OutboxRetention has the triggers also write every notification to
+	// pulse_outbox, where they're kept this long, so those written while
+	// pulse was down are delivered once it's back. Zero disables it
+	OutboxRetention time.Duration
+	// ReplayLogSize is how many notifications the replay log keeps in
+	// pulse_replay_log, zero disables it
+	ReplayLogSize int
+	// DeadLetters is the sink of the notifications that couldn't be
+	// delivered, "log" or "postgres", empty disables it
+	DeadLetters string
+	// DeadLettersRetention is how long pulse_dead_letters keeps them, a
+	// week if zero
+	DeadLettersRetention time.Duration
+	// BulkTables notify once per statement instead of once per row
+	BulkTables []string
+	// TriggerConditions maps tables to the SQL condition their updates must
+	// meet to notify
+	TriggerConditions map[string]string
+	// TableColumns maps tables to the only columns their notifications carry
+	TableColumns map[string][]string
+	// DDLEvents installs event triggers notifying of the tables created,
+	// altered and dropped as OperationDDL notifications. It needs a superuser
+	DDLEvents bool
+	// SyncInterval is how often Watch looks for tables created since the
+	// triggers were synced, syncs them and sends an OperationSchema
+	// notification for each. Zero disables it
+	SyncInterval time.Duration
+	// Cluster relays notifications between the replicas watching the
+	// database, ClusterPostgres, so those only one of them sees reach the
+	// clients of every replica. Empty disables it
+	Cluster string
+	// APIKeysTable creates pulse_api_keys, the API keys subscribers may
+	// authenticate with besides those of PULSE_API_KEYS
+	APIKeysTable bool
+	// VisibilityCheck is the SQL condition a subscriber must meet to
+	// receive a row, over claims, data, table_schema, table_name and
+	// operation, e.g. data->>'tenant_id' = claims->>'tenant_id'. Empty
+	// disables it
+	VisibilityCheck string
+	// VisibilityRole is the role VisibilityCheck runs as, so the row level
+	// security policies of the tables it queries apply. Empty runs it as
+	// the connection's user
+	VisibilityRole string
+}
+
+// ConfigFromEnv returns the configuration set by the DB_* and PULSE_*
+// variables, and by the config file set by PULSE_CONFIG. Table settings of
+// the variables win over the file's.
+// It returns an error if any of them is invalid.
+func ConfigFromEnv() (Config, error) {
+	file, err := config.FromEnv()
+	if err != nil {
+		return Config{}, err
+	}
+
+	cfg := Config{
+		Host:            os.Getenv("DB_HOST"),
+		Username:        os.Getenv("DB_USERNAME"),
+		Password:        os.Getenv("DB_PASSWORD"),
+		Database:        os.Getenv("DB_DATABASE"),
+		Schema:          os.Getenv("DB_SCHEMA"),
+		SSLMode:         os.Getenv("DB_SSLMODE"),
+		ListenURL:       os.Getenv("DB_LISTEN_URL"),
+		ReplicaURL:      os.Getenv("DB_REPLICA_URL"),
+		Capture:         os.Getenv("PULSE_CAPTURE"),
+		Slot:            os.Getenv("PULSE_REPLICATION_SLOT"),
+		VisibilityCheck: os.Getenv("PULSE_VISIBILITY_CHECK"),
+		VisibilityRole:  os.Getenv("PULSE_VISIBILITY_ROLE"),
+		Schemas:         file.Schemas,
+		Include:         file.Include,
+		Exclude:         file.Exclude,
+		BulkTables:      listFromEnv("PULSE_BULK_TABLES"),
+	}
+	if include := listFromEnv("PULSE_INCLUDE_TABLES"); include != nil {
+		cfg.Include = include
+	}
+	if exclude := listFromEnv("PULSE_EXCLUDE_TABLES"); exclude != nil {
+		cfg.Exclude = exclude
+	}
+	if cfg.Capture == "" {
+		cfg.Capture = file.Capture
+	}
+
+	if port := os.Getenv("DB_PORT"); port != "" {
+		if cfg.Port, err = strconv.Atoi(port); err != nil {
+			return Config{}, fmt.Errorf("invalid DB_PORT: %w", err)
+		}
+	}
+
+	for name, conns := range map[string]*int32{"DB_MAX_CONNS": &cfg.MaxConns, "DB_MIN_CONNS": &cfg.MinConns} {
+		if value := os.Getenv(name); value != "" {
+			n, err := strconv.ParseInt(value, 10, 32)
+			if err != nil {
+				return Config{}, fmt.Errorf("invalid %s: %w", name, err)
+			}
+			*conns = int32(n)
+		}
+	}
+
+	for name, duration := range map[string]*time.Duration{
+		"DB_MAX_CONN_LIFETIME":   &cfg.MaxConnLifetime,
+		"DB_MAX_CONN_IDLE_TIME":  &cfg.MaxConnIdleTime,
+		"DB_HEALTH_CHECK_PERIOD": &cfg.HealthCheckPeriod,
+	} {
+		if value := os.Getenv(name); value != "" {
+			if *duration, err = time.ParseDuration(value); err != nil {
+				return Config{}, fmt.Errorf("invalid %s: %w", name, err)
+			}
+		}
+	}
+
+	if retention := os.Getenv("PULSE_EVENTS_RETENTION"); retention != "" {
+		if cfg.EventsRetention, err = time.ParseDuration(retention); err != nil {
+			return Config{}, fmt.Errorf("invalid PULSE_EVENTS_RETENTION: %w", err)
+		}
+	}
+
+	if retention := os.Getenv("PULSE_OUTBOX_RETENTION"); retention != "" {
+		if cfg.OutboxRetention, err = time.ParseDuration(retention); err != nil {
+			return Config{}, fmt.Errorf("invalid PULSE_OUTBOX_RETENTION: %w", err)
+		}
+	}
+
+	if ddl := os.Getenv("PULSE_DDL_EVENTS"); ddl != "" {
+		if cfg.DDLEvents, err = strconv.ParseBool(ddl); err != nil {
+			return Config{}, fmt.Errorf("invalid PULSE_DDL_EVENTS: %w", err)
+		}
+	}
+
+	if table := os.Getenv("PULSE_API_KEYS_TABLE"); table != "" {
+		if cfg.APIKeysTable, err = strconv.ParseBool(table); err != nil {
+			return Config{}, fmt.Errorf("invalid PULSE_API_KEYS_TABLE: %w", err)
+		}
+	}
+
+	if interval := os.Getenv("PULSE_SYNC_INTERVAL"); interval != "" {
+		if cfg.SyncInterval, err = time.ParseDuration(interval); err != nil {
+			return Config{}, fmt.Errorf("invalid PULSE_SYNC_INTERVAL: %w", err)
+		}
+	}
+
+	if size := os.Getenv("PULSE_REPLAY_LOG_SIZE"); size != "" {
+		if cfg.ReplayLogSize, err = strconv.Atoi(size); err != nil {
+			return Config{}, fmt.Errorf("invalid PULSE_REPLAY_LOG_SIZE: %w", err)
+		}
+	}
+
+	if retention := os.Getenv("PULSE_DEAD_LETTERS_RETENTION"); retention != "" {
+		if cfg.DeadLettersRetention, err = time.ParseDuration(retention); err != nil {
+			return Config{}, fmt.Errorf("invalid PULSE_DEAD_LETTERS_RETENTION: %w", err)
+		}
+	}
+
+	if cfg.DeadLetters, err = deadLetterSink(); err != nil {
+		return Config{}, err
+	}
+	if cfg.TriggerConditions, err = triggerConditions(); err != nil {
+		return Config{}, err
+	}
+	if cfg.TableColumns, err = tableColumns(); err != nil {
+		return Config{}, err
+	}
+	if cfg.Cluster, err = clusterFromEnv(); err != nil {
+		return Config{}, err
+	}
+
+	for table, settings := range file.Tables {
+		if settings.Bulk && !contains(cfg.BulkTables, table) {
+			cfg.BulkTables = append(cfg.BulkTables, table)
+		}
+
+		if _, set := cfg.TriggerConditions[table]; settings.Condition != "" && !set {
+			if cfg.TriggerConditions == nil {
+				cfg.TriggerConditions = make(map[string]string)
+			}
+			cfg.TriggerConditions[table] = settings.Condition
+		}
+
+		if _, set := cfg.TableColumns[table]; len(settings.Columns) > 0 && !set {
+			if cfg.TableColumns == nil {
+				cfg.TableColumns = make(map[string][]string)
+			}
+			cfg.TableColumns[table] = settings.Columns
+		}
+	}
+
+	return cfg, nil
+}
+
+// ConfigsFromEnv returns the configuration of every database to watch: one
+// per comma-separated URL of DATABASE_URLS, sharing the other settings of
+// ConfigFromEnv, or just ConfigFromEnv's when it's unset. URLs may be named,
+// like eu=postgres://..., see Config.Name.
+// It returns an error if any of the settings is invalid, or two databases
+// have the same name.
+func ConfigsFromEnv() ([]Config, error) {
+	cfg, err := ConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	urls := os.Getenv("DATABASE_URLS")
+	if urls == "" {
+		return []Config{cfg}, nil
+	}
+	// They'd lead every database to the same one
+	if cfg.ListenURL != "" || cfg.ReplicaURL != "" {
+		return nil, fmt.Errorf("DB_LISTEN_URL and DB_REPLICA_URL can't be set along with DATABASE_URLS")
+	}
+
+	var configs []Config
+	names := make(map[string]bool)
+	for _, url := range strings.Split(urls, ",") {
+		cfg.Name, cfg.URL = "", strings.TrimSpace(url)
+		// Names can't hold the :// of URLs
+		if name, rest, ok := strings.Cut(cfg.URL, "="); ok && !strings.ContainsAny(name, ":/") {
+			cfg.Name, cfg.URL = name, rest
+			if !ValidName(name) {
+				return nil, fmt.Errorf("invalid database name %q in DATABASE_URLS", name)
+			}
+			if names[name] {
+				return nil, fmt.Errorf("database name %q is given twice in DATABASE_URLS", name)
+			}
+			names[name] = true
+		}
+		configs = append(configs, cfg)
+	}
+	return configs, nil
+}
+
+// validate checks the settings that aren't checked by Postgres itself.
+func (cfg Config) validate() error {
+	if cfg.Name != "" && !ValidName(cfg.Name) {
+		return fmt.Errorf("invalid name %q, must be made of letters, digits, _ and -", cfg.Name)
+	}
+	if cfg.Channel != "" && !validIdentifier(cfg.Channel) {
+		return fmt.Errorf("invalid channel %q", cfg.Channel)
+	}
+	if cfg.Slot != "" && !validIdentifier(cfg.Slot) {
+		return fmt.Errorf("invalid replication slot %q", cfg.Slot)
+	}
+
+	switch cfg.SSLMode {
+	case "", "disable", "allow", "prefer", "require", "verify-ca", "verify-full":
+	default:
+		return fmt.Errorf("invalid sslmode %q, must be disable, allow, prefer, require, verify-ca or verify-full", cfg.SSLMode)
+	}
+
+	if cfg.MaxConns < 0 || cfg.MinConns < 0 {
+		return fmt.Errorf("pool sizes must not be negative")
+	}
+	if cfg.MaxConns > 0 && cfg.MinConns > cfg.MaxConns {
+		return fmt.Errorf("min conns must not be more than max conns")
+	}
+	if cfg.MaxConnLifetime < 0 || cfg.MaxConnIdleTime < 0 || cfg.HealthCheckPeriod < 0 {
+		return fmt.Errorf("pool durations must not be negative")
+	}
+
+	switch cfg.Capture {
+	case "", CaptureTrigger:
+	case CaptureReplication:
+		// Both are done by triggers
+		if len(cfg.BulkTables) > 0 {
+			return fmt.Errorf("bulk tables need the %s capture", CaptureTrigger)
+		}
+		if len(cfg.TriggerConditions) > 0 {
+			return fmt.Errorf("trigger conditions need the %s capture", CaptureTrigger)
+		}
+		// The slot keeps the changes until they're read already
+		if cfg.OutboxRetention > 0 {
+			return fmt.Errorf("the outbox needs the %s capture", CaptureTrigger)
+		}
+	default:
+		return fmt.Errorf("invalid capture %q, must be %s or %s", cfg.Capture, CaptureTrigger, CaptureReplication)
+	}
+
+	for _, schema := range cfg.Schemas {
+		if !validIdentifier(schema) {
+			return fmt.Errorf("invalid schema %q", schema)
+		}
+	}
+	for _, pattern := range cfg.Include {
+		if !validTablePattern(pattern) {
+			return fmt.Errorf("invalid included table %q", pattern)
+		}
+	}
+	for _, pattern := range cfg.Exclude {
+		if !validTablePattern(pattern) {
+			return fmt.Errorf("invalid excluded table %q", pattern)
+		}
+	}
+
+	switch cfg.DeadLetters {
+	case "", deadLettersLog, deadLettersPostgres:
+	default:
+		return fmt.Errorf("invalid dead letter sink %q, must be %s or %s", cfg.DeadLetters, deadLettersLog, deadLettersPostgres)
+	}
+
+	switch cfg.Cluster {
+	case "", ClusterPostgres:
+	default:
+		return fmt.Errorf("invalid cluster %q, must be %s", cfg.Cluster, ClusterPostgres)
+	}
+
+	for table, allowed := range cfg.TableColumns {
+		if len(allowed) == 0 {
+			return fmt.Errorf("no columns for %s", table)
+		}
+	}
+
+	if cfg.EventsRetention < 0 {
+		return fmt.Errorf("events retention must not be negative")
+	}
+	if cfg.OutboxRetention < 0 {
+		return fmt.Errorf("outbox retention must not be negative")
+	}
+	if cfg.DeadLettersRetention < 0 {
+		return fmt.Errorf("dead letters retention must not be negative")
+	}
+	if cfg.ReplayLogSize < 0 {
+		return fmt.Errorf("replay log size must not be negative")
+	}
+	if cfg.SyncInterval < 0 {
+		return fmt.Errorf("sync interval must not be negative")
+	}
+	if cfg.VisibilityRole != "" && cfg.VisibilityCheck == "" {
+		return fmt.Errorf("the visibility role needs a visibility check")
+	}
+	return nil
+}
+
+// listenConnString returns the connection string of the connections Watch
+// listens on.
+func (cfg Config) listenConnString() string {
+	if cfg.ListenURL != "" {
+		return cfg.ListenURL
+	}
+	return cfg.connString()
+}
+
+// connString returns the connection string described by cfg.
+func (cfg Config) connString() string {
+	if cfg.URL != "" {
+		return cfg.URL
+	}
+
+	host := cfg.Host
+	if cfg.Port != 0 {
+		host = net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port))
+	}
+
+	query := url.Values{}
+	sslMode := cfg.SSLMode
+	if sslMode == "" {
+		sslMode = "disable"
+	}
+	query.Set("sslmode", sslMode)
+	if cfg.Schema != "" {
+		query.Set("search_path", cfg.Schema)
+	}
+
+	u := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(cfg.Username, cfg.Password),
+		Host:     host,
+		Path:     "/" + cfg.Database,
+		RawQuery: query.Encode(),
+	}
+	return u.String()
+}
+
+// channel returns the channel the triggers notify on.
+func (cfg Config) channel() string {
+	if cfg.Channel == "" {
+		return defaultChannel
+	}
+	return cfg.Channel
+}
+
+// clusterChannel returns the channel the replicas relay notifications on.
+func (cfg Config) clusterChannel() string {
+	return cfg.channel() + "_cluster"
+}
+
+// ddlChannel returns the channel the event triggers notify on.
+func (cfg Config) ddlChannel() string {
+	return cfg.channel() + "_ddl"
+}
+
+// replication reports whether changes are captured from a replication slot.
+func (cfg Config) replication() bool {
+	return cfg.Capture == CaptureReplication
+}
+
+// slot returns the name of the replication slot and publication.
+func (cfg Config) slot() string {
+	if cfg.Slot == "" {
+		return defaultSlot
+	}
+	return cfg.Slot
+}
+
+// schemas returns the schemas whose tables are watched.
+func (cfg Config) schemas() []string {
+	if len(cfg.Schemas) == 0 {
+		return []string{"public"}
+	}
+	return cfg.Schemas
+}
+
+// excludes reports whether the table name of schema is excluded, or not
+// included.
+func (cfg Config) excludes(schema, name string) bool {
+	if len(cfg.Include) > 0 && !matchesTable(cfg.Include, schema, name) {
+		return true
+	}
+	return matchesTable(cfg.Exclude, schema, name)
+}
+
+// matchesTable reports whether any of patterns matches the table name of
+// schema, either by name or schema qualified.
+func matchesTable(patterns []string, schema, name string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+		if matched, _ := path.Match(pattern, schema+"."+name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// validTablePattern reports whether pattern is a table or schema.table
+// pattern of matchesTable.
+func validTablePattern(pattern string) bool {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return false
+	}
+
+	schema, name, qualified := strings.Cut(pattern, ".")
+	return schema != "" && (!qualified || (name != "" && !strings.Contains(name, ".")))
+}
+
+// listFromEnv returns the comma-separated items of the variable, nil if
+// there are none.
+func listFromEnv(variable string) []string {
+	var items []string
+	for _, item := range strings.Split(os.Getenv(variable), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func contains(items []string, item string) bool {
+	for _, i := range items {
+		if i == item {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidName reports whether name can name a database: made of ASCII
+// letters, digits, _ and -, and usable in a route, so "all" can't.
+func ValidName(name string) bool {
+	if name == "" || len(name) > 63 || name == "all" {
+		return false
+	}
+
+	for _, r := range name {
+		if !(r == '_' || r == '-' || (r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)))) {
+			return false
+		}
+	}
+	return true
+}
+
+// validIdentifier reports whether name is an unquoted Postgres identifier of
+// at most 63 bytes, safe to interpolate into queries.
+func validIdentifier(name string) bool {
+	if name == "" || len(name) > 63 {
+		return false
+	}
+
+	for i, r := range name {
+		if !(r == '_' || (r < unicode.MaxASCII && unicode.IsLetter(r)) || (i > 0 && unicode.IsDigit(r))) {
+			return false
+		}
+	}
+	return true
+}
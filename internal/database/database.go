@@ -2,73 +2,312 @@ package database
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
-	"os"
+	"log/slog"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	_ "github.com/jackc/pgx/v5/stdlib"
 	_ "github.com/joho/godotenv/autoload"
+	"go.opentelemetry.io/otel/attribute"
+
+	"pulse/internal/tracing"
 )
 
 // Service represents a service that interacts with a database.
 type Service interface {
 	// Health returns a map of health status information.
 	// The keys and values in the map are service-specific.
-	Health() map[string]string
+	// It returns an error, along with the status reporting it, if the
+	// database can't be reached before ctx is done, a second without a
+	// deadline
+	Health(ctx context.Context) (map[string]string, error)
 
 	// Close terminates the database connection.
 	// It returns an error if the connection cannot be closed.
 	Close() error
 
 	// Watch takes a channel to send updates
-	// All tables/rows are monitored
-	Watch(chan DBNotification)
+	// All tables/rows are monitored until ctx is cancelled
+	// It returns an error if it can't start listening
+	Watch(context.Context, chan DBNotification) error
 
 	// SyncTables runs the script to enable Watch to listen to all changes
-	// It returns an error if the query fails
-	SyncTables() error
+	// It returns an error if the query fails or ctx is done first, the
+	// triggers are then left as they were
+	SyncTables(ctx context.Context) error
+
+	// RemoveTriggers drops pulse's triggers from the given tables, named
+	// as is or schema qualified, and returns the schema qualified names of
+	// those it dropped them from. Without tables it drops them from every
+	// table, along with pulse's functions, undoing SyncTables
+	RemoveTriggers(ctx context.Context, tables ...string) ([]string, error)
+
+	// Unwatched returns the tables of the watched schemas that don't notify,
+	// their triggers missing, or with CaptureReplication missing from the
+	// publication, e.g. tables created after SyncTables ran
+	Unwatched(ctx context.Context) ([]string, error)
+
+	// Source identifies the database, it's used to tag every DBNotification
+	Source() string
+
+	// Ready reports whether SyncTables completed and Watch is listening
+	Ready() bool
+
+	// Replay returns the persisted notifications emitted since the given time,
+	// oldest first. An empty table returns the notifications of every table,
+	// a schema qualified one those of that schema only. They're read from
+	// the replica when there's one, numbered with DBNotification.Persisted.
+	// It returns ErrPersistenceDisabled unless PULSE_EVENTS_RETENTION is set
+	Replay(ctx context.Context, table string, since time.Time) ([]DBNotification, error)
+
+	// Snapshot returns up to limit current rows of table, ordered by id and
+	// starting after the given one, for paging through the whole table. The
+	// table may be schema qualified, otherwise the first watched schema
+	// having it wins. They're read from the replica when there's one.
+	// It returns ErrUnknownTable if the table isn't watched
+	Snapshot(ctx context.Context, table, after string, limit int) ([]DBNotification, error)
+
+	// ScanTable hands every current row of table to page, limit at a time,
+	// all read in the same snapshot, and returns that snapshot so the
+	// changes the rows include can be told from the later ones.
+	// It returns ErrUnknownTable if the table isn't watched, or the error
+	// of page
+	ScanTable(ctx context.Context, table string, limit int, page func([]DBNotification) error) (TxSnapshot, error)
+
+	// ColumnAllowed reports whether column of table, as is or schema
+	// qualified, may leave the database: the table has no allowlist in
+	// TableColumns or it lists the column
+	ColumnAllowed(table, column string) bool
+
+	// DeadLetter hands a notification that couldn't be delivered, and why, to
+	// the sink set by PULSE_DEAD_LETTERS. It's a no-op if none is
+	DeadLetter(ctx context.Context, reason string, n DBNotification) error
+
+	// Record appends a notification, numbered by the server, to the replay
+	// log so clients can resume after it even once the server restarted.
+	// It returns ErrReplayLogDisabled unless PULSE_REPLAY_LOG_SIZE is set
+	Record(ctx context.Context, n DBNotification) error
+
+	// Recorded returns the notifications of the replay log numbered after
+	// the given one, oldest first
+	Recorded(ctx context.Context, after int64) ([]DBNotification, error)
+
+	// LastRecorded returns the number of the last notification of the replay
+	// log, zero if it's empty
+	LastRecorded(ctx context.Context) (int64, error)
+
+	// Relay sends a notification to the other replicas watching the
+	// database, their Watch sends it on.
+	// It returns ErrClusterDisabled unless PULSE_CLUSTER is set
+	Relay(ctx context.Context, n DBNotification) error
+
+	// LookupAPIKey returns the API key of pulse_api_keys matching key.
+	// It returns ErrUnknownAPIKey if there's none or it expired, and
+	// ErrAPIKeysDisabled unless PULSE_API_KEYS_TABLE is set
+	LookupAPIKey(ctx context.Context, key string) (APIKey, error)
+
+	// Visible reports, for each of claims, whether the subscribers with
+	// those claims may receive the row of n.
+	// It returns ErrVisibilityDisabled unless PULSE_VISIBILITY_CHECK is set
+	Visible(ctx context.Context, n DBNotification, claims []string) ([]bool, error)
 }
 
 type service struct {
+	// db is the pool of the primary, where the triggers are managed
 	db *pgxpool.Pool
+	// listenDB is the pool of the connections Watch LISTENs on, and replica
+	// that of the reads that may lag. Both are db unless Config.ListenURL
+	// and Config.ReplicaURL are set
+	listenDB *pgxpool.Pool
+	replica  *pgxpool.Pool
+	source   string
+
+	// closed is cancelled by Close, it stops every Watch
+	closed   context.Context
+	close    context.CancelFunc
+	watching sync.WaitGroup
+
+	synced    atomic.Bool
+	listening atomic.Bool
+
+	// retention is how long notifications are persisted, zero disables it
+	retention time.Duration
+	// deadLetters is the sink of the notifications that couldn't be
+	// delivered, empty if disabled
+	deadLetters string
+	// cfg is what the service was created with
+	cfg Config
+	// instance tells the notifications this replica relays apart from the
+	// others'
+	instance string
+	// reconcileNow wakes the reconciliation up, see wakeReconcile
+	reconcileNow chan struct{}
 }
 
-var (
-	database   = os.Getenv("DB_DATABASE")
-	password   = os.Getenv("DB_PASSWORD")
-	username   = os.Getenv("DB_USERNAME")
-	port       = os.Getenv("DB_PORT")
-	host       = os.Getenv("DB_HOST")
-	schema     = os.Getenv("DB_SCHEMA")
-	dbInstance *service
-)
+var dbInstance *service
 
-func New() Service {
+// New connects to the database configured by the DB_* and PULSE_* variables.
+// The connection is reused by later calls once it succeeded.
+// It returns an error if the configuration is invalid or the database can't
+// be reached.
+func New() (Service, error) {
 	// Reuse Connection
 	if dbInstance != nil {
-		return dbInstance
+		return dbInstance, nil
+	}
+
+	cfg, err := ConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := connect(cfg)
+	if err != nil {
+		return nil, err
+	}
+	dbInstance = s
+	return dbInstance, nil
+}
+
+// NewFromURL connects to the database described by url, configured by the
+// PULSE_* variables.
+// Unlike New, every call creates a new connection pool.
+// It returns an error if the configuration is invalid or the database can't
+// be reached.
+func NewFromURL(url string) (Service, error) {
+	cfg, err := ConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	cfg.URL = url
+
+	return NewWithConfig(cfg)
+}
+
+// NewWithConfig connects to the database described by cfg, leaving the
+// environment aside. Every call creates a new connection pool.
+// It returns an error if cfg is invalid or the database can't be reached.
+func NewWithConfig(cfg Config) (Service, error) {
+	s, err := connect(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func connect(cfg Config) (*service, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	s := &service{
+		cfg:         cfg,
+		retention:   cfg.EventsRetention,
+		deadLetters: cfg.DeadLetters,
+		instance:    newInstanceID(),
+
+		reconcileNow: make(chan struct{}, 1),
+	}
+
+	conn, err := newPool(cfg, cfg.connString())
+	if err != nil {
+		return nil, err
+	}
+	s.db, s.listenDB, s.replica = conn, conn, conn
+
+	if cfg.ListenURL != "" {
+		if s.listenDB, err = newPool(cfg, cfg.ListenURL); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("unable to connect to the listen endpoint: %w", err)
+		}
+	}
+	if cfg.ReplicaURL != "" {
+		if s.replica, err = newPool(cfg, cfg.ReplicaURL); err != nil {
+			s.closePools()
+			return nil, fmt.Errorf("unable to connect to the replica: %w", err)
+		}
+	}
+
+	connConfig := conn.Config().ConnConfig
+	s.source = fmt.Sprintf("%s/%s", connConfig.Host, connConfig.Database)
+	if cfg.Name != "" {
+		s.source = cfg.Name
+	}
+	s.closed, s.close = context.WithCancel(context.Background())
+	track(s)
+
+	return s, nil
+}
+
+// newPool connects to connString with the pool settings and TLS of cfg.
+// It returns an error if it can't be reached.
+func newPool(cfg Config, connString string) (*pgxpool.Pool, error) {
+	poolConfig, err := pgxpool.ParseConfig(connString)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.MaxConns > 0 {
+		poolConfig.MaxConns = cfg.MaxConns
+	}
+	if cfg.MinConns > 0 {
+		poolConfig.MinConns = cfg.MinConns
+	}
+	if cfg.MaxConnLifetime > 0 {
+		poolConfig.MaxConnLifetime = cfg.MaxConnLifetime
+	}
+	if cfg.MaxConnIdleTime > 0 {
+		poolConfig.MaxConnIdleTime = cfg.MaxConnIdleTime
 	}
-	connStr := fmt.Sprintf("postgres://%s:%s@%s:%s/%s?sslmode=disable&search_path=%s", username, password, host, port, database, schema)
-	conn, err := pgxpool.New(context.Background(), connStr)
+	if cfg.HealthCheckPeriod > 0 {
+		poolConfig.HealthCheckPeriod = cfg.HealthCheckPeriod
+	}
+	if cfg.TLS != nil {
+		poolConfig.ConnConfig.TLSConfig = cfg.TLS
+		poolConfig.ConnConfig.Fallbacks = nil
+	}
+
+	pool, err := pgxpool.NewWithConfig(context.Background(), poolConfig)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+
+	// The pool connects lazily, unreachable databases would only fail later
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := pool.Ping(ctx); err != nil {
+		pool.Close()
+		return nil, err
 	}
+	return pool, nil
+}
 
-	dbInstance = &service{
-		db: conn,
+// closePools closes the pools of the service, each once.
+func (s *service) closePools() {
+	if s.replica != s.db && s.replica != nil {
+		s.replica.Close()
+	}
+	if s.listenDB != s.db && s.listenDB != nil {
+		s.listenDB.Close()
 	}
-	return dbInstance
+	s.db.Close()
 }
 
 // Health checks the health of the database connection by pinging the database.
 // It returns a map with keys indicating various health statistics.
-func (s *service) Health() map[string]string {
-	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
-	defer cancel()
+// It returns an error too if the ping failed, the map then reports the
+// database down.
+func (s *service) Health(ctx context.Context) (map[string]string, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, 1*time.Second)
+		defer cancel()
+	}
 
 	stats := make(map[string]string)
 
@@ -77,8 +316,18 @@ func (s *service) Health() map[string]string {
 	if err != nil {
 		stats["status"] = "down"
 		stats["error"] = fmt.Sprintf("db down: %v", err)
-		log.Fatalf(fmt.Sprintf("db down: %v", err)) // Log the error and terminate the program
-		return stats
+		return stats, fmt.Errorf("%s is down: %w", s.source, err)
+	}
+
+	// Nothing is watched without the listen endpoint
+	if s.listenDB != s.db {
+		if err := s.listenDB.Ping(ctx); err != nil {
+			stats["status"] = "down"
+			stats["listen_status"] = "down"
+			stats["error"] = fmt.Sprintf("listen endpoint down: %v", err)
+			return stats, fmt.Errorf("the listen endpoint of %s is down: %w", s.source, err)
+		}
+		stats["listen_status"] = "up"
 	}
 
 	// Database is up, add more statistics
@@ -113,103 +362,487 @@ func (s *service) Health() map[string]string {
 		stats["message"] = "Many connections are being closed due to max lifetime, consider increasing max lifetime or revising the connection usage pattern."
 	}
 
-	return stats
+	// Only snapshots and replays fail without the replica, changes are
+	// still streamed
+	if s.replica != s.db {
+		if err := s.replica.Ping(ctx); err != nil {
+			stats["replica_status"] = "down"
+			stats["replica_error"] = fmt.Sprintf("replica down: %v", err)
+			stats["message"] = "The replica is down, snapshots and replays fail."
+		} else {
+			stats["replica_status"] = "up"
+		}
+	}
+
+	return stats, nil
 }
 
 // Close closes the database connection.
+// Every Watch is stopped and has released its connection beforehand.
 // It logs a message indicating the disconnection from the specific database.
 // If the connection is successfully closed, it returns nil.
 // If an error occurs while closing the connection, it returns the error.
 func (s *service) Close() error {
-	log.Printf("Disconnected from database: %s", database)
-	s.db.Close()
+	s.close()
+	s.watching.Wait()
+
+	slog.Info("Disconnected from the database", "source", s.source)
+	untrack(s)
+	s.closePools()
 	return nil
 }
 
 type DBNotification struct {
-	Operation string      `json:"operation"`
-	Table     string      `json:"table"`
-	ID        string      `json:"id"`
+	Operation string `json:"operation"`
+	Table     string `json:"table"`
+	// Schema is the schema of the table, it tells apart tables of the same
+	// name in different watched schemas
+	Schema string `json:"schema,omitempty"`
+	ID     string `json:"id"`
+	// Seq numbers the notifications in the order the server fans them out,
+	// clients resume after the last one they received with ?since=
+	Seq       int64       `json:"seq,omitempty"`
+	Txid      int64       `json:"txid"`
+	Source    string      `json:"source"`
+	Changed   []string    `json:"changed,omitempty"`
+	EmittedAt time.Time   `json:"ts"`
 	Data      interface{} `json:"data"`
+	// Old holds the previous value of the changed columns of an update
+	Old map[string]interface{} `json:"old,omitempty"`
+	// Patch is the update as a JSON Patch, for the clients asking for diffs
+	Patch []PatchOperation `json:"patch,omitempty"`
+	// Bulk notifications summarize a whole statement on a PULSE_BULK_TABLES
+	// table: Count rows changed, IDs holds the first 100 of their ids
+	Bulk  bool     `json:"bulk,omitempty"`
+	Count int64    `json:"count,omitempty"`
+	IDs   []string `json:"ids,omitempty"`
+	// TraceID is shared by the notifications of a transaction, it's taken
+	// from the pulse.trace_id setting when the application sets one
+	TraceID string `json:"trace_id,omitempty"`
+	// Span is the span Watch recorded the notification in, the next ones
+	// along its path are its children
+	Span tracing.SpanContext `json:"-"`
+	// Persisted is the seq pulse_events gave the notification, zero unless
+	// it was persisted. Clients replaying the persisted notifications skip
+	// the live ones they were replayed already
+	Persisted int64 `json:"-"`
+
+	// persist tells the events writer to persist the notification
+	persist bool
 }
 
 // Watch listen for messages from the database
 // It takes a DBNotification channel
-// If it fails to acquire a connections, it kills the app
-// If it fails to LISTEN to a channel, it kills the app
-// If it fails to parse to wait for the notification or to parse the message, will ignore the error and continue
-func (s *service) Watch(ch chan DBNotification) {
-	conn, err := s.db.Acquire(context.Background())
+// It returns nil once ctx is cancelled or the service is closed, after
+// running UNLISTEN and releasing its connection back to the pool
+// If it fails to acquire a connection or to LISTEN, it returns the error
+// If the connection is lost afterwards, e.g. on a failover, it reconnects with
+// an increasing backoff and sends a resubscribed notification once it
+// listens again, since notifications may have been missed meanwhile
+// If it fails to parse the message, an event_lost notification is sent instead
+// Rows too large for a notification are fetched, with fetchRow
+// With CaptureReplication the changes are decoded from the replication slot
+// instead, which keeps them until they're sent: nothing is missed while
+// reconnecting, and no resubscribed notification is sent
+// So is it with Config.OutboxRetention: the notifications of pulse_outbox
+// that weren't delivered yet are sent first, with catchUpOutbox
+// Only committed changes are ever sent: pg_notify is transactional, so
+// Postgres drops the notifications of a rolled back transaction, and they're
+// persisted to pulse_events only after being received here
+// With Config.Cluster the notifications relayed by the other replicas are
+// sent too, and with CaptureReplication the changes are relayed to them:
+// only one replica at a time can read the slot, the others stand by and
+// retry until they can
+func (s *service) Watch(ctx context.Context, ch chan DBNotification) error {
+	s.watching.Add(1)
+	defer s.watching.Done()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(s.closed, cancel)
+	defer stop()
+
+	if s.retention > 0 {
+		go s.prune(ctx)
+
+		// Notifications are persisted in batches, off the receive loop,
+		// before they're sent on to ch
+		events := make(chan DBNotification, eventsBatchSize)
+		var writer sync.WaitGroup
+		writer.Add(1)
+		go func(ch chan DBNotification) {
+			defer writer.Done()
+			s.writeEvents(ctx, events, ch)
+		}(ch)
+		// ch may be closed once Watch returned
+		defer writer.Wait()
+		defer cancel()
+		ch = events
+	}
+	if s.cfg.OutboxRetention > 0 {
+		go s.pruneOutbox(ctx)
+	}
+	if s.deadLetters == deadLettersPostgres {
+		go s.pruneDeadLetters(ctx)
+	}
+
+	if s.cfg.DDLEvents {
+		var ddl sync.WaitGroup
+		ddl.Add(1)
+		go func() {
+			defer ddl.Done()
+			s.watchDDL(ctx, ch)
+		}()
+		// ch may be closed once Watch returned
+		defer ddl.Wait()
+		defer cancel()
+	}
+
+	if s.cfg.SyncInterval > 0 {
+		var reconciler sync.WaitGroup
+		reconciler.Add(1)
+		go func() {
+			defer reconciler.Done()
+			s.reconcile(ctx, ch)
+		}()
+		// ch may be closed once Watch returned
+		defer reconciler.Wait()
+		defer cancel()
+	}
+
+	if s.cfg.Cluster != "" {
+		var relays sync.WaitGroup
+		relays.Add(1)
+		go func() {
+			defer relays.Done()
+			s.watchCluster(ctx, ch)
+		}()
+		// ch may be closed once Watch returned
+		defer relays.Wait()
+		defer cancel()
+	}
+
+	listening := make(chan struct{})
+	err := s.listen(ctx, ch, false, listening)
+	select {
+	case <-listening:
+	default:
+		if ctx.Err() != nil {
+			return nil
+		}
+		// Another replica may be reading the slot, this one stands by
+		if !s.cfg.replication() || s.cfg.Cluster == "" {
+			return err
+		}
+	}
+
+	backoff := minReconnectBackoff
+	for ctx.Err() == nil {
+		slog.Warn("Lost the connection, reconnecting", "source", s.source, "backoff", backoff, "error", err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil
+		}
+
+		listening = make(chan struct{})
+		err = s.listen(ctx, ch, true, listening)
+		select {
+		case <-listening:
+			backoff = minReconnectBackoff
+		default:
+			backoff = min(2*backoff, maxReconnectBackoff)
+		}
+	}
+	return nil
+}
+
+// minReconnectBackoff and maxReconnectBackoff bound how long Watch waits
+// before reconnecting, the wait doubles after every failed attempt
+const (
+	minReconnectBackoff = time.Second
+	maxReconnectBackoff = 30 * time.Second
+)
+
+// listen acquires a connection, LISTENs on the channel and sends the
+// notifications received to ch until the connection fails or ctx is done.
+// listening is closed once LISTEN succeeded, a resubscribed notification is
+// then sent first if it's a reconnection.
+// It returns the error that ended the connection, nil if ctx is done.
+func (s *service) listen(ctx context.Context, ch chan DBNotification, resubscribed bool, listening chan struct{}) error {
+	if s.cfg.replication() {
+		return s.replicate(ctx, ch, listening)
+	}
+
+	conn, err := s.listenDB.Acquire(ctx)
 	if err != nil {
-		log.Fatalf("Unable to acquire connection: %v\n", err)
+		if ctx.Err() != nil {
+			return nil
+		}
+		return fmt.Errorf("unable to acquire connection: %w", err)
 	}
 	defer conn.Release()
+	defer unlisten(conn)
 
 	pgConn := conn.Conn()
-	_, err = pgConn.Exec(context.Background(), "LISTEN pulse_watcher")
+	_, err = pgConn.Exec(ctx, "LISTEN "+pgx.Identifier{s.cfg.channel()}.Sanitize())
 	if err != nil {
-		log.Fatalf("Unable to start listening: %v\n", err)
+		if ctx.Err() != nil {
+			return nil
+		}
+		return fmt.Errorf("unable to start listening: %w", err)
+	}
+	s.listening.Store(true)
+	defer s.listening.Store(false)
+	close(listening)
+
+	// With the outbox nothing is missed while reconnecting, the
+	// notifications written meanwhile are caught up with instead
+	var caughtUp map[int64]bool
+	if s.cfg.OutboxRetention > 0 {
+		if caughtUp, err = s.catchUpOutbox(ctx, ch); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("unable to catch up with the outbox: %w", err)
+		}
+	} else if resubscribed {
+		select {
+		case ch <- DBNotification{Operation: OperationResubscribed, Source: s.source, EmittedAt: time.Now()}:
+		case <-ctx.Done():
+			return nil
+		}
 	}
 
 	for {
-		select {
-		default:
-			rawNotification, err := pgConn.WaitForNotification(context.Background())
-			if err != nil {
-				log.Printf("Error waiting for notification: %v\n", err)
-				time.Sleep(1 * time.Second) // Backoff on error
-				continue
+		rawNotification, err := pgConn.WaitForNotification(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
 			}
+			return fmt.Errorf("unable to wait for notification: %w", err)
+		}
 
-			var dbNotification DBNotification
-			if err := json.Unmarshal([]byte(rawNotification.Payload), &dbNotification); err != nil {
-				log.Printf("Failed to parse Payload into DBNotification: %v | %v", err, rawNotification.Payload)
-				time.Sleep(1 * time.Second) // Backoff on error
+		var id int64
+		if s.cfg.OutboxRetention > 0 {
+			if id = outboxID(rawNotification.Payload); caughtUp[id] {
 				continue
 			}
+		}
+
+		dbNotification, ok := s.receive(ctx, rawNotification.Payload)
+		if !ok || !s.emit(ctx, ch, dbNotification) {
+			return nil
+		}
+		if id != 0 {
+			s.markDelivered(ctx, id)
+		}
+	}
+}
+
+// receive decodes the notification of payload, fetching its row if it was
+// too large to be sent. Those that can't be decoded or fetched are dead
+// lettered and replaced by an event_lost notification.
+// It returns false if ctx is done meanwhile.
+func (s *service) receive(ctx context.Context, payload string) (DBNotification, bool) {
+	dbNotification, key, err := decode(payload)
+	if err != nil {
+		dbNotification = lost(payload, err)
+		if err := s.deadLetter(ctx, DeadLetterDecodeFailed, "", payload); err != nil {
+			slog.Error("Failed to store a dead letter", "source", s.source, "error", err)
+		}
+	}
+	if key != nil {
+		if dbNotification.Data, err = s.fetchRow(ctx, dbNotification, key); err != nil {
+			if ctx.Err() != nil {
+				return DBNotification{}, false
+			}
+			dbNotification = lost(payload, err)
+			if err := s.deadLetter(ctx, DeadLetterFetchFailed, "", payload); err != nil {
+				slog.Error("Failed to store a dead letter", "source", s.source, "error", err)
+			}
+		}
+	}
+	return dbNotification, true
+}
+
+// emit tags n with the source and sends it to ch, through the events writer
+// persisting it if enabled.
+// Changes read from the replication slot are relayed to the other replicas.
+// It returns false if ctx is done before n could be sent.
+func (s *service) emit(ctx context.Context, ch chan DBNotification, n DBNotification) bool {
+	n.Source = s.source
+
+	// The span covers the trip from the database to the broadcast channel
+	span := tracing.StartAt(n.TraceParent(), "pulse.watch", emittedAt(n),
+		attribute.String("pulse.table", n.Table),
+		attribute.String("pulse.operation", n.Operation),
+		attribute.String("pulse.source", s.source))
+	n.Span = span.SpanContext()
+
+	n.persist = s.retention > 0
+
+	select {
+	case ch <- n:
+		span.End()
+	case <-ctx.Done():
+		return false
+	}
 
-			ch <- dbNotification
+	if s.cfg.Cluster != "" && s.cfg.replication() {
+		if err := s.Relay(ctx, n); err != nil && ctx.Err() == nil {
+			slog.Error("Failed to relay a notification", "source", s.source, "table", n.Table, "error", err)
 		}
 	}
+	return true
+}
+
+// TraceParent returns the parent of the next span along the path of n: the
+// last one recorded, or the trace carried by its payload if none was.
+// Notifications without either start a new trace.
+func (n DBNotification) TraceParent() tracing.SpanContext {
+	if n.Span.IsValid() {
+		return n.Span
+	}
+
+	traceID, err := tracing.ParseTraceID(n.TraceID)
+	if err != nil {
+		return tracing.SpanContext{}
+	}
+	return tracing.Root(traceID)
+}
+
+// emittedAt returns when n was emitted, or now if it wasn't timestamped.
+func emittedAt(n DBNotification) time.Time {
+	if n.EmittedAt.IsZero() {
+		return time.Now()
+	}
+	return n.EmittedAt
+}
+
+// unlisten stops conn from receiving notifications, so it can go back to the
+// pool. A connection that fails to is destroyed instead of released.
+func unlisten(conn *pgxpool.Conn) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := conn.Exec(ctx, "UNLISTEN *"); err != nil {
+		slog.Warn("Unable to stop listening", "error", err)
+		conn.Conn().Close(ctx)
+	}
+}
 
+// Source returns the host/database the service is connected to
+func (s *service) Source() string {
+	return s.source
 }
 
-func (s *service) SyncTables() error {
-	_, err := s.db.Exec(context.Background(), `CREATE OR REPLACE FUNCTION pulse_watcher() RETURNS trigger AS
+func (s *service) SyncTables(ctx context.Context) error {
+	// Triggers are swapped atomically, tables never notify twice or not at all
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	// Ids are the values of the primary key columns, joined by commas
+	_, err = tx.Exec(ctx, `CREATE OR REPLACE FUNCTION pulse_row_id(rec jsonb, primary_key jsonb) RETURNS text AS
+$$
+SELECT string_agg(rec ->> p.key, ',' ORDER BY p.position)
+FROM jsonb_array_elements_text(primary_key) WITH ORDINALITY p(key, position);
+$$ LANGUAGE sql IMMUTABLE;`)
+	if err != nil {
+		return err
+	}
+
+	if err := s.syncOutbox(ctx, tx); err != nil {
+		return fmt.Errorf("outbox: %w", err)
+	}
+
+	_, err = tx.Exec(ctx, `CREATE OR REPLACE FUNCTION pulse_watcher() RETURNS trigger AS
 $$
 DECLARE
-    payload JSON;
+    payload     JSON;
+    rec         RECORD;
+    changed     JSON;
+    old         JSON;
+    data        JSON;
+    primary_key JSONB;
 BEGIN
 
-    IF (TG_OP = 'INSERT') THEN
-        payload = json_build_object(
-                'operation', lower(TG_OP),
+    -- Truncates are statement triggers, they have no row
+    IF (TG_OP = 'TRUNCATE') THEN
+        PERFORM pulse_notify(json_build_object(
+                'operation', 'truncate',
                 'table', TG_TABLE_NAME,
-                'id', NEW.id::text,
-                'data', NEW);
-        PERFORM pg_notify('pulse_watcher', payload::text);
-    ELSIF (TG_OP = 'UPDATE') THEN
-        FOR payload IN
-            SELECT json_build_object(
-                           'operation', lower(TG_OP),
-                           'table', TG_TABLE_NAME,
-                           'id', NEW.id::text,
-                           'data', NEW)
-            LOOP
-                PERFORM pg_notify('pulse_watcher', payload::text);
-            END LOOP;
-    ELSIF (TG_OP = 'DELETE') THEN
-        FOR payload IN
-            SELECT json_build_object(
-                           'operation', lower(TG_OP),
-                           'table', TG_TABLE_NAME,
-                           'id', OLD.id::text,
-                           'data', OLD)
-            LOOP
-                PERFORM pg_notify('pulse_watcher', payload::text);
-            END LOOP;
+                'schema', TG_TABLE_SCHEMA,
+                'txid', txid_current(),
+                'ts', clock_timestamp(),
+                'trace_id', coalesce(nullif(current_setting('pulse.trace_id', true), ''),
+                                     md5(txid_current()::text || transaction_timestamp()::text))));
+        RETURN NULL;
     END IF;
 
+    -- Exactly one notification per row change
+    IF (TG_OP = 'DELETE') THEN
+        rec = OLD;
+    ELSE
+        rec = NEW;
+    END IF;
+
+    -- The first argument lists the primary key columns
+    primary_key = TG_ARGV[0]::jsonb;
+
+    -- Tables with a column allowlist pass it as the following arguments, the
+    -- other columns never leave the database
+    IF (TG_NARGS > 1) THEN
+        SELECT coalesce(json_object_agg(r.key, r.value), '{}')
+        INTO data
+        FROM json_each(to_json(rec)) r
+        WHERE r.key = ANY (TG_ARGV[1:]);
+    ELSE
+        data = to_json(rec);
+    END IF;
+
+    -- Columns whose value an update changed, so clients can watch some only,
+    -- along with their previous values
+    IF (TG_OP = 'UPDATE') THEN
+        SELECT coalesce(json_agg(n.key), '[]'), json_object_agg(n.key, to_jsonb(OLD) -> n.key)
+        INTO changed, old
+        FROM jsonb_each(to_jsonb(NEW)) n
+        WHERE to_jsonb(OLD) -> n.key IS DISTINCT FROM n.value
+          AND (TG_NARGS = 1 OR n.key = ANY (TG_ARGV[1:]));
+
+        -- Updates of columns left out only don't notify
+        IF (TG_NARGS > 1 AND json_array_length(changed) = 0) THEN
+            RETURN NULL;
+        END IF;
+    END IF;
+
+    payload = json_build_object(
+            'operation', lower(TG_OP),
+            'table', TG_TABLE_NAME,
+            'schema', TG_TABLE_SCHEMA,
+            'id', pulse_row_id(to_jsonb(rec), primary_key),
+            'txid', txid_current(),
+            'ts', clock_timestamp(),
+            'trace_id', coalesce(nullif(current_setting('pulse.trace_id', true), ''),
+                                 md5(txid_current()::text || transaction_timestamp()::text)),
+            'changed', changed,
+            'old', old,
+            'checksum', md5(data::text),
+            'data', data);
+
+    -- Payloads are limited to 8000 bytes, with room for an outbox id, larger
+    -- rows are left out and fetched by pulse by their key
+    IF (octet_length(payload::text) >= 7950) THEN
+        payload = (payload::jsonb - 'data' - 'old' - 'checksum') || jsonb_build_object(
+                'oversized', true,
+                'key', (SELECT jsonb_object_agg(p.key, to_jsonb(rec) ->> p.key)
+                        FROM jsonb_array_elements_text(primary_key) p(key)));
+    END IF;
+    PERFORM pulse_notify(payload);
+
     RETURN NULL;
 END;
 $$ LANGUAGE plpgsql;
@@ -217,27 +850,92 @@ $$ LANGUAGE plpgsql;
 	if err != nil {
 		return err
 	}
-	_, err = s.db.Exec(context.Background(), `DO
-$$
-    DECLARE
-        rec RECORD;
-    BEGIN
-        FOR rec IN
-            SELECT tablename
-            FROM pg_tables
-            WHERE schemaname = 'public'
-            LOOP
-                EXECUTE format('
-            CREATE OR REPLACE TRIGGER %I_trigger
-            AFTER INSERT OR UPDATE OR DELETE ON %I
-            FOR EACH ROW EXECUTE FUNCTION pulse_watcher();
-        ', rec.tablename, rec.tablename);
-            END LOOP;
-    END
-$$;`)
+	tables, err := s.syncRowTriggers(ctx, tx)
 	if err != nil {
 		return err
 	}
 
+	if err := s.syncDDLEvents(ctx, tx); err != nil {
+		return fmt.Errorf("ddl event triggers: %w", err)
+	}
+
+	if s.cfg.replication() {
+		if err := s.syncPublication(ctx, tx, tables); err != nil {
+			return err
+		}
+
+		// The decoder applies the allowlists, they must name a single table
+		for table := range s.cfg.TableColumns {
+			if _, err := watchedNamed(tables, table); errors.Is(err, ErrAmbiguousTable) {
+				return fmt.Errorf("columns of %s: %w", table, err)
+			}
+		}
+	} else {
+		if err := syncTableColumns(ctx, tx, tables, s.cfg.TableColumns); err != nil {
+			return err
+		}
+
+		if err := syncTriggerConditions(ctx, tx, tables, s.cfg.TriggerConditions, s.cfg.TableColumns); err != nil {
+			return err
+		}
+
+		if err := syncBulkTables(ctx, tx, tables, s.cfg.BulkTables); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	// Slots can't be created by a transaction that wrote
+	if s.cfg.replication() {
+		if err := s.createSlot(ctx); err != nil {
+			return err
+		}
+	}
+
+	if s.retention > 0 {
+		if err := s.createEventsTable(ctx); err != nil {
+			return err
+		}
+	}
+
+	if s.deadLetters == deadLettersPostgres {
+		if err := s.createDeadLettersTable(ctx); err != nil {
+			return err
+		}
+	}
+
+	if s.cfg.ReplayLogSize > 0 {
+		if err := s.createReplayLogTable(ctx); err != nil {
+			return err
+		}
+	}
+
+	if s.cfg.Cluster != "" {
+		if err := s.createClusterTable(ctx); err != nil {
+			return err
+		}
+	}
+
+	if s.cfg.APIKeysTable {
+		if err := s.createAPIKeysTable(ctx); err != nil {
+			return err
+		}
+	}
+
+	if s.cfg.VisibilityCheck != "" {
+		if err := s.prepareVisibilityCheck(ctx); err != nil {
+			return err
+		}
+	}
+
+	s.synced.Store(true)
 	return nil
 }
+
+// Ready reports whether the triggers are synced and Watch is listening
+func (s *service) Ready() bool {
+	return s.synced.Load() && s.listening.Load()
+}
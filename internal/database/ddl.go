@@ -0,0 +1,173 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// OperationDDL is sent when a table of the database is created, altered or
+// dropped, its data holds the command, e.g. {"command":"ALTER TABLE"}.
+const OperationDDL = "ddl"
+
+// ownTablesList returns ownTables as a list of SQL literals.
+func ownTablesList() string {
+	quoted := make([]string, len(ownTables))
+	for i, table := range ownTables {
+		quoted[i] = "'" + table + "'"
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// syncDDLEvents installs the event triggers notifying of the tables created,
+// altered and dropped on the ddl channel, or drops them unless DDLEvents is
+// set. Creating event triggers needs a superuser.
+func (s *service) syncDDLEvents(ctx context.Context, tx pgx.Tx) error {
+	if !s.cfg.DDLEvents {
+		_, err := tx.Exec(ctx, `DROP EVENT TRIGGER IF EXISTS pulse_ddl_end;
+DROP EVENT TRIGGER IF EXISTS pulse_ddl_drop;`)
+		return err
+	}
+
+	// The channel is a validated identifier, safe to interpolate
+	_, err := tx.Exec(ctx, fmt.Sprintf(`CREATE OR REPLACE FUNCTION pulse_ddl_watcher() RETURNS event_trigger AS
+$$
+DECLARE
+    obj RECORD;
+BEGIN
+    IF (TG_EVENT = 'sql_drop') THEN
+        FOR obj IN SELECT schema_name, object_name AS table_name
+                   FROM pg_event_trigger_dropped_objects()
+                   WHERE object_type = 'table' AND NOT is_temporary
+        LOOP
+            PERFORM pulse_ddl_notify(obj.schema_name, obj.table_name, TG_TAG);
+        END LOOP;
+    ELSE
+        FOR obj IN SELECT d.schema_name, c.relname::text AS table_name
+                   FROM pg_event_trigger_ddl_commands() d
+                   JOIN pg_class c ON c.oid = d.objid
+                   WHERE d.object_type = 'table' AND NOT d.in_extension
+        LOOP
+            PERFORM pulse_ddl_notify(obj.schema_name, obj.table_name, TG_TAG);
+        END LOOP;
+    END IF;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION pulse_ddl_notify(schema_name text, table_name text, command text) RETURNS void AS
+$$
+BEGIN
+    -- pulse's own tables are left out, like they aren't watched
+    IF (table_name IN (%[2]s)) THEN
+        RETURN;
+    END IF;
+
+    PERFORM pg_notify('%[1]s', json_build_object(
+            'operation', 'ddl',
+            'table', table_name,
+            'schema', schema_name,
+            'txid', txid_current(),
+            'ts', clock_timestamp(),
+            'data', json_build_object('command', command))::text);
+END;
+$$ LANGUAGE plpgsql;
+
+DROP EVENT TRIGGER IF EXISTS pulse_ddl_end;
+CREATE EVENT TRIGGER pulse_ddl_end ON ddl_command_end
+    WHEN TAG IN ('CREATE TABLE', 'CREATE TABLE AS', 'SELECT INTO', 'ALTER TABLE')
+    EXECUTE FUNCTION pulse_ddl_watcher();
+
+DROP EVENT TRIGGER IF EXISTS pulse_ddl_drop;
+CREATE EVENT TRIGGER pulse_ddl_drop ON sql_drop
+    WHEN TAG IN ('DROP TABLE')
+    EXECUTE FUNCTION pulse_ddl_watcher();`, s.cfg.ddlChannel(), ownTablesList()))
+	return err
+}
+
+// watchDDL sends the ddl notifications to ch until ctx is done, waking the
+// reconciliation up when a table is created. If the connection is lost it
+// reconnects like Watch, sending a resubscribed notification once it
+// listens again.
+func (s *service) watchDDL(ctx context.Context, ch chan DBNotification) {
+	backoff := minReconnectBackoff
+	resubscribed := false
+	for {
+		listening := make(chan struct{})
+		err := s.listenDDL(ctx, ch, resubscribed, listening)
+		if ctx.Err() != nil {
+			return
+		}
+
+		select {
+		case <-listening:
+			backoff = minReconnectBackoff
+			resubscribed = true
+		default:
+			backoff = min(2*backoff, maxReconnectBackoff)
+		}
+
+		slog.Warn("Lost the ddl channel, reconnecting", "source", s.source, "backoff", backoff, "error", err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// listenDDL LISTENs on the ddl channel and sends the notifications to ch
+// until the connection fails or ctx is done.
+// listening is closed once LISTEN succeeded, a resubscribed notification is
+// then sent first if it's a reconnection.
+func (s *service) listenDDL(ctx context.Context, ch chan DBNotification, resubscribed bool, listening chan struct{}) error {
+	conn, err := s.listenDB.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to acquire connection: %w", err)
+	}
+	defer conn.Release()
+	defer unlisten(conn)
+
+	pgConn := conn.Conn()
+	if _, err := pgConn.Exec(ctx, "LISTEN "+pgx.Identifier{s.cfg.ddlChannel()}.Sanitize()); err != nil {
+		return fmt.Errorf("unable to start listening: %w", err)
+	}
+	close(listening)
+
+	if resubscribed {
+		select {
+		case ch <- DBNotification{Operation: OperationResubscribed, Source: s.source, EmittedAt: time.Now()}:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+
+	for {
+		raw, err := pgConn.WaitForNotification(ctx)
+		if err != nil {
+			return fmt.Errorf("unable to wait for notification: %w", err)
+		}
+
+		n := Decode(raw.Payload)
+		if n.Operation == OperationDDL && s.cfg.SyncInterval > 0 {
+			if data, _ := n.Data.(map[string]interface{}); data["command"] != "ALTER TABLE" && data["command"] != "DROP TABLE" {
+				s.wakeReconcile()
+			}
+		}
+		if !s.emit(ctx, ch, n) {
+			return nil
+		}
+	}
+}
+
+// wakeReconcile has the reconciliation look for new tables right away,
+// rather than at its next tick.
+func (s *service) wakeReconcile() {
+	select {
+	case s.reconcileNow <- struct{}{}:
+	default:
+	}
+}
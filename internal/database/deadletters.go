@@ -0,0 +1,112 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// Dead letter sinks, picked with PULSE_DEAD_LETTERS
+const (
+	// deadLettersLog logs the notifications
+	deadLettersLog = "log"
+	// deadLettersPostgres stores them in pulse_dead_letters
+	deadLettersPostgres = "postgres"
+)
+
+// DeadLetterDecodeFailed is the reason of the payloads Watch couldn't decode.
+const DeadLetterDecodeFailed = "decode_failed"
+
+// DeadLetterFetchFailed is the reason of the oversized payloads whose row
+// Watch couldn't fetch, e.g. because it was deleted since.
+const DeadLetterFetchFailed = "fetch_failed"
+
+// deadLetterTimeout bounds storing a single dead letter.
+const deadLetterTimeout = 5 * time.Second
+
+// defaultDeadLettersRetention is how long pulse_dead_letters keeps them
+// unless Config.DeadLettersRetention says otherwise.
+const defaultDeadLettersRetention = 7 * 24 * time.Hour
+
+// deadLetterSink returns the sink set by PULSE_DEAD_LETTERS, empty if disabled.
+func deadLetterSink() (string, error) {
+	switch sink := os.Getenv("PULSE_DEAD_LETTERS"); sink {
+	case "", deadLettersLog, deadLettersPostgres:
+		return sink, nil
+	default:
+		return "", fmt.Errorf("invalid PULSE_DEAD_LETTERS %q, must be %s or %s", sink, deadLettersLog, deadLettersPostgres)
+	}
+}
+
+func (s *service) createDeadLettersTable(ctx context.Context) error {
+	_, err := s.db.Exec(ctx, `CREATE TABLE IF NOT EXISTS pulse_dead_letters
+(
+    id         bigint GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    reason     text        NOT NULL,
+    table_name text,
+    payload    text        NOT NULL,
+    created_at timestamptz NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS pulse_dead_letters_created_at_idx ON pulse_dead_letters (created_at);`)
+
+	return err
+}
+
+// pruneDeadLetters deletes the dead letters past retention until ctx is
+// cancelled.
+func (s *service) pruneDeadLetters(ctx context.Context) {
+	retention := s.cfg.DeadLettersRetention
+	if retention == 0 {
+		retention = defaultDeadLettersRetention
+	}
+
+	ticker := time.NewTicker(pruneInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			cutoff := time.Now().Add(-retention)
+			if _, err := s.db.Exec(ctx, "DELETE FROM pulse_dead_letters WHERE created_at < $1", cutoff); err != nil {
+				slog.Error("Failed to prune the dead letters", "source", s.source, "error", err)
+			}
+		}
+	}
+}
+
+// DeadLetter hands n, which couldn't be delivered for reason, to the sink
+// set by PULSE_DEAD_LETTERS. It's a no-op if none is.
+func (s *service) DeadLetter(ctx context.Context, reason string, n DBNotification) error {
+	if s.deadLetters == "" {
+		return nil
+	}
+
+	payload, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+
+	return s.deadLetter(ctx, reason, n.Table, string(payload))
+}
+
+// deadLetter stores payload, a notification from table if known, with reason.
+func (s *service) deadLetter(ctx context.Context, reason, table, payload string) error {
+	switch s.deadLetters {
+	case deadLettersLog:
+		slog.Warn("Dead letter", "reason", reason, "source", s.source, "table", table, "payload", payload)
+	case deadLettersPostgres:
+		ctx, cancel := context.WithTimeout(ctx, deadLetterTimeout)
+		defer cancel()
+
+		_, err := s.db.Exec(ctx, "INSERT INTO pulse_dead_letters (reason, table_name, payload) VALUES ($1, NULLIF($2, ''), $3)",
+			reason, table, payload)
+		return err
+	}
+
+	return nil
+}
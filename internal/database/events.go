@@ -0,0 +1,173 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// ErrPersistenceDisabled is returned by Replay when notifications aren't persisted.
+var ErrPersistenceDisabled = errors.New("notifications are not persisted, set PULSE_EVENTS_RETENTION")
+
+// eventsBatchSize is how many notifications are persisted at once at most.
+const eventsBatchSize = 64
+
+// pruneInterval is how often persisted notifications past retention are deleted.
+const pruneInterval = time.Minute
+
+func (s *service) createEventsTable(ctx context.Context) error {
+	_, err := s.db.Exec(ctx, `CREATE TABLE IF NOT EXISTS pulse_events
+(
+    seq        bigint GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    id         text,
+    table_name text        NOT NULL,
+    operation  text        NOT NULL,
+    payload    jsonb       NOT NULL,
+    created_at timestamptz NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS pulse_events_created_at_idx ON pulse_events (created_at);`)
+
+	return err
+}
+
+// writeEvents persists the notifications of events to be persisted, along
+// with those queued behind them, and sends them all on to ch in order, until
+// ctx is done.
+func (s *service) writeEvents(ctx context.Context, events <-chan DBNotification, ch chan DBNotification) {
+	batch := make([]DBNotification, 0, eventsBatchSize)
+	for {
+		batch = batch[:0]
+		select {
+		case n := <-events:
+			batch = append(batch, n)
+		case <-ctx.Done():
+			return
+		}
+	queued:
+		for len(batch) < eventsBatchSize {
+			select {
+			case n := <-events:
+				batch = append(batch, n)
+			default:
+				break queued
+			}
+		}
+
+		if err := s.persist(ctx, batch); err != nil {
+			slog.Error("Failed to persist notifications", "source", s.source, "count", len(batch), "error", err)
+		}
+
+		for _, n := range batch {
+			select {
+			case ch <- n:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// persist stores the notifications of batch to be persisted in pulse_events,
+// in a single round trip, so they can be replayed later. Each is numbered
+// with its seq.
+func (s *service) persist(ctx context.Context, batch []DBNotification) error {
+	var queued []int
+	b := &pgx.Batch{}
+	for i := range batch {
+		if !batch[i].persist {
+			continue
+		}
+		batch[i].persist = false
+
+		payload, err := json.Marshal(batch[i])
+		if err != nil {
+			return err
+		}
+		b.Queue("INSERT INTO pulse_events (id, table_name, operation, payload) VALUES ($1, $2, $3, $4) RETURNING seq",
+			batch[i].ID, batch[i].Table, batch[i].Operation, payload)
+		queued = append(queued, i)
+	}
+	if len(queued) == 0 {
+		return nil
+	}
+
+	results := s.db.SendBatch(ctx, b)
+	defer results.Close()
+
+	for _, i := range queued {
+		if err := results.QueryRow().Scan(&batch[i].Persisted); err != nil {
+			return err
+		}
+	}
+
+	return results.Close()
+}
+
+// prune deletes the persisted notifications past retention until ctx is cancelled.
+func (s *service) prune(ctx context.Context) {
+	ticker := time.NewTicker(pruneInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			cutoff := time.Now().Add(-s.retention)
+			if _, err := s.db.Exec(ctx, "DELETE FROM pulse_events WHERE created_at < $1", cutoff); err != nil {
+				slog.Error("Failed to prune events", "source", s.source, "error", err)
+			}
+		}
+	}
+}
+
+// Replay returns the persisted notifications emitted since the given time,
+// oldest first. Those persisted before it can't have been emitted since.
+func (s *service) Replay(ctx context.Context, table string, since time.Time) ([]DBNotification, error) {
+	if s.retention == 0 {
+		return nil, ErrPersistenceDisabled
+	}
+
+	schema, name, qualified := strings.Cut(table, ".")
+	if !qualified {
+		schema, name = "", table
+	}
+
+	rows, err := s.replica.Query(ctx, `SELECT seq, payload::text
+FROM pulse_events
+WHERE created_at >= $1
+  AND coalesce((payload ->> 'ts')::timestamptz, created_at) >= $1
+  AND ($2 = '' OR table_name = $2)
+  AND ($3 = '' OR payload ->> 'schema' = $3)
+ORDER BY seq`, since, name, schema)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var notifications []DBNotification
+	for rows.Next() {
+		var seq int64
+		var payload string
+		if err := rows.Scan(&seq, &payload); err != nil {
+			return nil, err
+		}
+
+		var n DBNotification
+		decoder := json.NewDecoder(bytes.NewReader([]byte(payload)))
+		decoder.UseNumber()
+		if err := decoder.Decode(&n); err != nil {
+			return nil, err
+		}
+		n.Persisted = seq
+		notifications = append(notifications, n)
+	}
+
+	return notifications, rows.Err()
+}
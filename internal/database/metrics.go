@@ -0,0 +1,68 @@
+package database
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// connected holds the services whose pools are open, their stats are
+// reported on /metrics.
+var connected = struct {
+	mut      sync.Mutex
+	services map[*service]struct{}
+}{services: make(map[*service]struct{})}
+
+var (
+	poolConnections = prometheus.NewDesc(
+		"pulse_db_pool_connections",
+		"Connections of the database pools, by source and state: acquired, idle, total or max.",
+		[]string{"source", "state"}, nil,
+	)
+	poolEmptyAcquires = prometheus.NewDesc(
+		"pulse_db_pool_empty_acquires_total",
+		"Acquisitions that had to wait for a connection, by source.",
+		[]string{"source"}, nil,
+	)
+)
+
+func init() {
+	prometheus.MustRegister(poolCollector{})
+}
+
+// poolCollector reports the stats of the connected pools on every scrape.
+type poolCollector struct{}
+
+func (poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- poolConnections
+	ch <- poolEmptyAcquires
+}
+
+func (poolCollector) Collect(ch chan<- prometheus.Metric) {
+	connected.mut.Lock()
+	defer connected.mut.Unlock()
+
+	for s := range connected.services {
+		stat := s.db.Stat()
+		ch <- prometheus.MustNewConstMetric(poolConnections, prometheus.GaugeValue, float64(stat.AcquiredConns()), s.source, "acquired")
+		ch <- prometheus.MustNewConstMetric(poolConnections, prometheus.GaugeValue, float64(stat.IdleConns()), s.source, "idle")
+		ch <- prometheus.MustNewConstMetric(poolConnections, prometheus.GaugeValue, float64(stat.TotalConns()), s.source, "total")
+		ch <- prometheus.MustNewConstMetric(poolConnections, prometheus.GaugeValue, float64(stat.MaxConns()), s.source, "max")
+		ch <- prometheus.MustNewConstMetric(poolEmptyAcquires, prometheus.CounterValue, float64(stat.EmptyAcquireCount()), s.source)
+	}
+}
+
+// track reports the pool of s, until untrack.
+func track(s *service) {
+	connected.mut.Lock()
+	defer connected.mut.Unlock()
+
+	connected.services[s] = struct{}{}
+}
+
+func untrack(s *service) {
+	connected.mut.Lock()
+	defer connected.mut.Unlock()
+
+	delete(connected.services, s)
+}
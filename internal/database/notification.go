@@ -0,0 +1,145 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// OperationEventLost is sent in place of a notification that couldn't be
+// decoded, so subscribers know they missed a change and should resync.
+const OperationEventLost = "event_lost"
+
+// OperationResubscribed is sent once Watch listens again after losing its
+// connection, subscribers may have missed changes meanwhile and should resync.
+const OperationResubscribed = "resubscribed"
+
+// OperationTruncate is sent when a table is truncated, every one of its rows
+// is gone. It carries no row.
+const OperationTruncate = "truncate"
+
+// Gap reports whether n tells that notifications may have been missed,
+// rather than being a change of a table.
+func (n DBNotification) Gap() bool {
+	return n.Operation == OperationEventLost || n.Operation == OperationResubscribed
+}
+
+// PatchOperation is a single RFC 6902 JSON Patch operation.
+type PatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value"`
+}
+
+// rawNotification is the payload built by the pulse_watcher trigger.
+type rawNotification struct {
+	DBNotification
+	Checksum string          `json:"checksum"`
+	Data     json.RawMessage `json:"data"`
+	// Oversized payloads left the row out, it didn't fit in a notification.
+	// Key holds its primary key instead
+	Oversized bool              `json:"oversized"`
+	Key       map[string]string `json:"key"`
+}
+
+// Decode turns a pulse_watcher payload into a DBNotification.
+// Payloads that can't be parsed or don't match their checksum are logged and
+// turned into an event_lost notification.
+func Decode(payload string) DBNotification {
+	dbNotification, _, err := decode(payload)
+	if err != nil {
+		return lost(payload, err)
+	}
+
+	return dbNotification
+}
+
+// lost logs why payload couldn't be decoded and returns the event_lost
+// notification sent in its place.
+func lost(payload string, err error) DBNotification {
+	slog.Error("Failed to decode a notification", "payload", payload, "error", err)
+	return DBNotification{Operation: OperationEventLost}
+}
+
+// decode parses payload. If it's oversized, its row was left out and must be
+// fetched by the primary key it returns, which is nil otherwise.
+func decode(payload string) (DBNotification, map[string]string, error) {
+	// Numbers are kept as json.Number, float64 can't hold a bigint
+	var raw rawNotification
+	decoder := json.NewDecoder(bytes.NewReader([]byte(payload)))
+	decoder.UseNumber()
+	if err := decoder.Decode(&raw); err != nil {
+		return DBNotification{}, nil, err
+	}
+
+	// Payloads from triggers synced before checksums existed don't carry one
+	if raw.Checksum != "" {
+		sum := md5.Sum(raw.Data)
+		if checksum := hex.EncodeToString(sum[:]); checksum != raw.Checksum {
+			return DBNotification{}, nil, fmt.Errorf("checksum mismatch: payload %s, computed %s", raw.Checksum, checksum)
+		}
+	}
+
+	dbNotification := raw.DBNotification
+	if len(raw.Data) > 0 {
+		decoder := json.NewDecoder(bytes.NewReader(raw.Data))
+		decoder.UseNumber()
+		if err := decoder.Decode(&dbNotification.Data); err != nil {
+			return DBNotification{}, nil, err
+		}
+	}
+
+	if raw.Oversized && raw.Key == nil {
+		raw.Key = map[string]string{}
+	}
+	return dbNotification, raw.Key, nil
+}
+
+// fetchRow returns the row whose primary key is key, as the column allowlist
+// of n's table leaves it. Deleted rows can't be fetched, their key is
+// returned instead.
+// Rows are read once the notification is received, changes committed
+// since then are included.
+func (s *service) fetchRow(ctx context.Context, n DBNotification, key map[string]string) (map[string]interface{}, error) {
+	if len(key) == 0 {
+		return nil, fmt.Errorf("fetching %s: no primary key", n.Table)
+	}
+
+	if n.Operation == "delete" {
+		row := make(map[string]interface{}, len(key))
+		for column, value := range key {
+			row[column] = value
+		}
+		return row, nil
+	}
+
+	var conditions []string
+	var args []interface{}
+	for column, value := range key {
+		args = append(args, value)
+		conditions = append(conditions, fmt.Sprintf("t.%s = $%d", pgx.Identifier{column}.Sanitize(), len(args)))
+	}
+
+	var raw []byte
+	query := fmt.Sprintf("SELECT to_json(t) FROM %s t WHERE %s", pgx.Identifier{n.Schema, n.Table}.Sanitize(), strings.Join(conditions, " AND "))
+	if err := s.db.QueryRow(ctx, query, args...).Scan(&raw); err != nil {
+		return nil, fmt.Errorf("fetching %s %s: %w", n.Table, n.ID, err)
+	}
+
+	var row map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	if err := decoder.Decode(&row); err != nil {
+		return nil, err
+	}
+
+	s.leaveColumnsOut(watchedTable{schema: n.Schema, name: n.Table}, row)
+	return row, nil
+}
@@ -0,0 +1,159 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// outboxBatch is how many undelivered notifications are read from the
+// outbox at once.
+const outboxBatch = 1000
+
+// syncOutbox creates pulse_notify, which the triggers send their payloads
+// through. With OutboxRetention it first writes them to pulse_outbox, and
+// notifies with their outbox_id, otherwise it only notifies.
+func (s *service) syncOutbox(ctx context.Context, tx pgx.Tx) error {
+	// The channel is a validated identifier, safe to interpolate
+	if s.cfg.OutboxRetention == 0 {
+		_, err := tx.Exec(ctx, fmt.Sprintf(`CREATE OR REPLACE FUNCTION pulse_notify(notification json) RETURNS void AS
+$$
+BEGIN
+    PERFORM pg_notify('%[1]s', notification::text);
+END;
+$$ LANGUAGE plpgsql;`, s.cfg.channel()))
+		return err
+	}
+
+	_, err := tx.Exec(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS pulse_outbox
+(
+    id           bigint GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    payload      json        NOT NULL,
+    created_at   timestamptz NOT NULL DEFAULT now(),
+    delivered_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS pulse_outbox_undelivered_idx ON pulse_outbox (id) WHERE delivered_at IS NULL;
+CREATE INDEX IF NOT EXISTS pulse_outbox_created_at_idx ON pulse_outbox (created_at);
+
+CREATE OR REPLACE FUNCTION pulse_notify(notification json) RETURNS void AS
+$$
+DECLARE
+    outbox_id BIGINT;
+BEGIN
+    INSERT INTO pulse_outbox (payload) VALUES (notification) RETURNING id INTO outbox_id;
+
+    -- Spliced in rather than added through jsonb, which would reformat the
+    -- data its checksum was computed on
+    PERFORM pg_notify('%[1]s', '{"outbox_id":' || outbox_id || ',' || substr(notification::text, 2));
+END;
+$$ LANGUAGE plpgsql;`, s.cfg.channel()))
+	return err
+}
+
+// outboxID returns the outbox_id of payload, zero if it has none.
+func outboxID(payload string) int64 {
+	var ref struct {
+		OutboxID int64 `json:"outbox_id"`
+	}
+	_ = json.Unmarshal([]byte(payload), &ref)
+	return ref.OutboxID
+}
+
+// catchUpOutbox sends to ch the notifications of the outbox no Watch
+// delivered yet, like those written while pulse was down, and marks them
+// delivered. It returns their outbox ids, so the notifications received
+// for them on the channel meanwhile aren't sent twice.
+func (s *service) catchUpOutbox(ctx context.Context, ch chan DBNotification) (map[int64]bool, error) {
+	caughtUp := make(map[int64]bool)
+
+	var after int64
+	for {
+		batch, err := s.undelivered(ctx, after)
+		if err != nil {
+			return nil, err
+		}
+
+		ids := make([]int64, 0, len(batch))
+		for _, undelivered := range batch {
+			n, ok := s.receive(ctx, undelivered.payload)
+			if !ok || !s.emit(ctx, ch, n) {
+				return nil, ctx.Err()
+			}
+			caughtUp[undelivered.id] = true
+			ids = append(ids, undelivered.id)
+			after = undelivered.id
+		}
+
+		if len(ids) > 0 {
+			if _, err := s.db.Exec(ctx, "UPDATE pulse_outbox SET delivered_at = now() WHERE id = ANY($1)", ids); err != nil {
+				return nil, err
+			}
+		}
+		if len(batch) < outboxBatch {
+			return caughtUp, nil
+		}
+	}
+}
+
+// outboxNotification is a notification of the outbox, as the trigger wrote it.
+type outboxNotification struct {
+	id      int64
+	payload string
+}
+
+// undelivered returns up to outboxBatch notifications of the outbox numbered
+// after the given one that weren't delivered yet, oldest first.
+func (s *service) undelivered(ctx context.Context, after int64) ([]outboxNotification, error) {
+	rows, err := s.db.Query(ctx, `SELECT id, payload::text
+FROM pulse_outbox
+WHERE delivered_at IS NULL
+  AND id > $1
+ORDER BY id
+LIMIT $2`, after, outboxBatch)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var notifications []outboxNotification
+	for rows.Next() {
+		var n outboxNotification
+		if err := rows.Scan(&n.id, &n.payload); err != nil {
+			return nil, err
+		}
+		notifications = append(notifications, n)
+	}
+
+	return notifications, rows.Err()
+}
+
+// markDelivered records that the notification of the outbox numbered id was
+// delivered, so it isn't caught up with again.
+func (s *service) markDelivered(ctx context.Context, id int64) {
+	if _, err := s.db.Exec(ctx, "UPDATE pulse_outbox SET delivered_at = now() WHERE id = $1", id); err != nil && ctx.Err() == nil {
+		slog.Error("Failed to mark an outbox notification delivered", "source", s.source, "outbox_id", id, "error", err)
+	}
+}
+
+// pruneOutbox deletes the notifications of the outbox past retention,
+// delivered or not, until ctx is cancelled.
+func (s *service) pruneOutbox(ctx context.Context) {
+	ticker := time.NewTicker(pruneInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			cutoff := time.Now().Add(-s.cfg.OutboxRetention)
+			if _, err := s.db.Exec(ctx, "DELETE FROM pulse_outbox WHERE created_at < $1", cutoff); err != nil {
+				slog.Error("Failed to prune the outbox", "source", s.source, "error", err)
+			}
+		}
+	}
+}
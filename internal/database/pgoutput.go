@@ -0,0 +1,252 @@
+package database
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pglogrepl"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// relation is a table as described by pgoutput before its first change.
+type relation struct {
+	schema  string
+	name    string
+	columns []column
+	// primaryKey lists its primary key columns. pgoutput only describes the
+	// replica identity, which is every column once it's full
+	primaryKey []string
+}
+
+type column struct {
+	name string
+	oid  uint32
+}
+
+// tupleValue is a column of a changed row. Unchanged values are those of
+// TOASTed columns an update left as is, pgoutput doesn't send them.
+type tupleValue struct {
+	null      bool
+	unchanged bool
+	text      string
+}
+
+// pgoutput turns the messages of the pgoutput plugin, protocol version 1,
+// as parsed by pglogrepl, into notifications.
+// Relations are remembered as they're described, changes are buffered until
+// their transaction commits.
+type pgoutput struct {
+	relations map[uint32]relation
+	// columns maps tables to the only columns their notifications carry
+	columns map[string][]string
+	// primaryKey looks up the primary key columns of a table
+	primaryKey func(schema, table string) ([]string, error)
+
+	xid        uint32
+	commitTime time.Time
+	changes    []DBNotification
+}
+
+func newPgoutput(columns map[string][]string, primaryKey func(schema, table string) ([]string, error)) *pgoutput {
+	return &pgoutput{relations: make(map[uint32]relation), columns: columns, primaryKey: primaryKey}
+}
+
+// decode decodes a message. When it's a commit, it returns the
+// notifications of the transaction and true.
+func (p *pgoutput) decode(data []byte) ([]DBNotification, bool, error) {
+	message, err := pglogrepl.Parse(data)
+	if err != nil {
+		return nil, false, err
+	}
+
+	switch m := message.(type) {
+	case *pglogrepl.BeginMessage:
+		p.commitTime, p.xid, p.changes = m.CommitTime, m.Xid, nil
+	case *pglogrepl.CommitMessage:
+		changes := p.changes
+		p.changes = nil
+		return changes, true, nil
+	case *pglogrepl.RelationMessage:
+		rel := relation{schema: m.Namespace, name: m.RelationName}
+		for _, c := range m.Columns {
+			rel.columns = append(rel.columns, column{name: c.Name, oid: c.DataType})
+		}
+
+		if rel.primaryKey, err = p.primaryKey(rel.schema, rel.name); err != nil {
+			return nil, false, fmt.Errorf("primary key of %s.%s: %w", rel.schema, rel.name, err)
+		}
+		p.relations[m.RelationID] = rel
+	case *pglogrepl.InsertMessage:
+		return nil, false, p.changed("insert", m.RelationID, nil, m.Tuple)
+	case *pglogrepl.UpdateMessage:
+		return nil, false, p.changed("update", m.RelationID, m.OldTuple, m.NewTuple)
+	case *pglogrepl.DeleteMessage:
+		return nil, false, p.changed("delete", m.RelationID, m.OldTuple, nil)
+	case *pglogrepl.TruncateMessage:
+		for _, id := range m.RelationIDs {
+			rel, ok := p.relations[id]
+			if !ok {
+				return nil, false, fmt.Errorf("truncate of an undescribed relation")
+			}
+			p.changes = append(p.changes, DBNotification{
+				Operation: OperationTruncate,
+				Table:     rel.name,
+				Schema:    rel.schema,
+				Txid:      int64(p.xid),
+				EmittedAt: p.commitTime,
+				TraceID:   traceID(p.xid, p.commitTime),
+			})
+		}
+	default:
+		// Types, origins and logical messages don't notify
+	}
+
+	return nil, false, nil
+}
+
+// changed buffers the notification of a change to the relation id, if it
+// notifies.
+func (p *pgoutput) changed(operation string, id uint32, oldTuple, newTuple *pglogrepl.TupleData) error {
+	rel, ok := p.relations[id]
+	if !ok {
+		return fmt.Errorf("%s of an undescribed relation", operation)
+	}
+
+	if n, ok := p.change(operation, rel, tupleValues(oldTuple), tupleValues(newTuple)); ok {
+		p.changes = append(p.changes, n)
+	}
+	return nil
+}
+
+// tupleValues returns the values of the columns of t, none if it's nil.
+func tupleValues(t *pglogrepl.TupleData) []tupleValue {
+	if t == nil {
+		return nil
+	}
+
+	values := make([]tupleValue, len(t.Columns))
+	for i, c := range t.Columns {
+		switch c.DataType {
+		case pglogrepl.TupleDataTypeNull:
+			values[i].null = true
+		case pglogrepl.TupleDataTypeToast:
+			values[i].unchanged = true
+		default:
+			values[i].text = string(c.Data)
+		}
+	}
+	return values
+}
+
+// change builds the notification of a change to rel, like the pulse_watcher
+// trigger does. It returns false if the change only touched columns left out.
+func (p *pgoutput) change(operation string, rel relation, oldRow, newRow []tupleValue) (DBNotification, bool) {
+	n := DBNotification{
+		Operation: operation,
+		Table:     rel.name,
+		Schema:    rel.schema,
+		Txid:      int64(p.xid),
+		EmittedAt: p.commitTime,
+		TraceID:   traceID(p.xid, p.commitTime),
+	}
+
+	allowed, restricted := tableSetting(p.columns, watchedTable{schema: rel.schema, name: rel.name})
+	includes := func(name string) bool {
+		return !restricted || contains(allowed, name)
+	}
+
+	row := newRow
+	if operation == "delete" {
+		row = oldRow
+	}
+
+	key := make([]string, len(rel.primaryKey))
+	data := make(map[string]interface{})
+	for i, c := range rel.columns {
+		if i >= len(row) {
+			break
+		}
+
+		value := row[i]
+		// Unchanged values are only known from the old row
+		if value.unchanged && i < len(oldRow) {
+			value = oldRow[i]
+		}
+		if value.unchanged {
+			continue
+		}
+
+		for k, column := range rel.primaryKey {
+			if column == c.name {
+				key[k] = value.text
+			}
+		}
+		if includes(c.name) {
+			data[c.name] = columnValue(c.oid, value)
+		}
+	}
+	n.Data = data
+	if len(key) > 0 {
+		// Like the triggers' pulse_row_id
+		n.ID = strings.Join(key, ",")
+	}
+
+	// The previous values are only sent with REPLICA IDENTITY FULL
+	if operation == "update" && len(oldRow) == len(newRow) {
+		n.Changed = []string{}
+		n.Old = make(map[string]interface{})
+		for i, c := range rel.columns {
+			if i >= len(oldRow) || newRow[i].unchanged || oldRow[i] == newRow[i] || !includes(c.name) {
+				continue
+			}
+			n.Changed = append(n.Changed, c.name)
+			n.Old[c.name] = columnValue(c.oid, oldRow[i])
+		}
+
+		if restricted && len(n.Changed) == 0 {
+			return DBNotification{}, false
+		}
+	}
+
+	return n, true
+}
+
+// columnValue converts the text value of a column of type oid to what
+// to_json would have made of it: numbers and booleans keep their type and
+// JSON is inlined, everything else is a string.
+func columnValue(oid uint32, value tupleValue) interface{} {
+	if value.null {
+		return nil
+	}
+
+	switch oid {
+	case pgtype.BoolOID:
+		return value.text == "t"
+	case pgtype.Int2OID, pgtype.Int4OID, pgtype.Int8OID, pgtype.Float4OID, pgtype.Float8OID, pgtype.NumericOID:
+		// NaN and Infinity aren't JSON numbers
+		if _, err := strconv.ParseFloat(value.text, 64); err == nil && value.text != "NaN" {
+			return json.Number(value.text)
+		}
+	case pgtype.JSONOID, pgtype.JSONBOID:
+		var inlined interface{}
+		decoder := json.NewDecoder(bytes.NewReader([]byte(value.text)))
+		decoder.UseNumber()
+		if err := decoder.Decode(&inlined); err == nil {
+			return inlined
+		}
+	}
+
+	return value.text
+}
+
+// traceID returns the trace shared by the notifications of a transaction.
+func traceID(xid uint32, commitTime time.Time) string {
+	sum := md5.Sum([]byte(fmt.Sprintf("%d%s", xid, commitTime.Format(time.RFC3339Nano))))
+	return hex.EncodeToString(sum[:])
+}
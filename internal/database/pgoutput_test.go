@@ -0,0 +1,216 @@
+package database
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// messageOf builds a pgoutput message out of its fields: bytes, strings
+// (null terminated), uint16, uint32, uint64, raw bytes and nested fields.
+func messageOf(fields ...interface{}) []byte {
+	var data []byte
+	for _, field := range fields {
+		switch f := field.(type) {
+		case byte:
+			data = append(data, f)
+		case string:
+			data = append(append(data, f...), 0)
+		case rawBytes:
+			data = append(data, f...)
+		case uint16:
+			data = binary.BigEndian.AppendUint16(data, f)
+		case uint32:
+			data = binary.BigEndian.AppendUint32(data, f)
+		case uint64:
+			data = binary.BigEndian.AppendUint64(data, f)
+		case []interface{}:
+			data = append(data, messageOf(f...)...)
+		}
+	}
+	return data
+}
+
+// primaryKeyOf returns a lookup of the primary key columns giving columns
+// for every table.
+func primaryKeyOf(columns ...string) func(schema, table string) ([]string, error) {
+	return func(schema, table string) ([]string, error) {
+		return columns, nil
+	}
+}
+
+// rawBytes is appended as is, without a terminating null.
+type rawBytes string
+
+// tuple builds the fields of a tuple of text values, nil for null ones.
+func tuple(values ...interface{}) []interface{} {
+	fields := []interface{}{uint16(len(values))}
+	for _, value := range values {
+		if value == nil {
+			fields = append(fields, byte('n'))
+			continue
+		}
+		v := value.(string)
+		fields = append(fields, byte('t'), uint32(len(v)), rawBytes(v))
+	}
+	return fields
+}
+
+func TestPgoutputDecodesTransactions(t *testing.T) {
+	committed := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+	// Timestamps are in microseconds since 2000-01-01
+	micros := uint64(committed.Sub(time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)).Microseconds())
+
+	p := newPgoutput(nil, primaryKeyOf("id"))
+	steps := [][]byte{
+		messageOf(byte('B'), uint64(100), micros, uint32(42)),
+		messageOf(byte('R'), uint32(1), "public", "orders", byte('f'), uint16(4),
+			byte(1), "id", uint32(pgtype.Int4OID), uint32(0),
+			byte(0), "paid", uint32(pgtype.BoolOID), uint32(0),
+			byte(0), "meta", uint32(pgtype.JSONBOID), uint32(0),
+			byte(0), "note", uint32(pgtype.TextOID), uint32(0)),
+		messageOf(byte('I'), uint32(1), byte('N'), tuple("7", "f", `{"a": 1}`, nil)),
+		messageOf(byte('U'), uint32(1), byte('O'), tuple("7", "f", `{"a": 1}`, nil), byte('N'), tuple("7", "t", `{"a": 1}`, nil)),
+		messageOf(byte('D'), uint32(1), byte('O'), tuple("7", "t", `{"a": 1}`, "bye")),
+	}
+	for _, step := range steps {
+		if notifications, done, err := p.decode(step); err != nil || done || notifications != nil {
+			t.Fatalf("decode() = %v, %v, %v before the commit", notifications, done, err)
+		}
+	}
+
+	notifications, done, err := p.decode(messageOf(byte('C'), byte(0), uint64(100), uint64(120), micros))
+	if err != nil || !done {
+		t.Fatalf("decode() = %v, %v on commit", done, err)
+	}
+	if len(notifications) != 3 {
+		t.Fatalf("received %d notifications, expected 3", len(notifications))
+	}
+
+	insert := notifications[0]
+	row := map[string]interface{}{"id": json.Number("7"), "paid": false, "meta": map[string]interface{}{"a": json.Number("1")}, "note": nil}
+	if insert.Operation != "insert" || insert.Table != "orders" || insert.Schema != "public" || insert.ID != "7" || insert.Txid != 42 {
+		t.Errorf("insert = %+v", insert)
+	}
+	if !insert.EmittedAt.Equal(committed) || len(insert.TraceID) != 32 || !reflect.DeepEqual(insert.Data, row) {
+		t.Errorf("insert = %+v", insert)
+	}
+
+	update := notifications[1]
+	if update.Operation != "update" || !reflect.DeepEqual(update.Changed, []string{"paid"}) || !reflect.DeepEqual(update.Old, map[string]interface{}{"paid": false}) {
+		t.Errorf("update = %+v", update)
+	}
+	if update.TraceID != insert.TraceID {
+		t.Errorf("trace ids %s and %s differ within a transaction", insert.TraceID, update.TraceID)
+	}
+
+	if remove := notifications[2]; remove.Operation != "delete" || remove.Data.(map[string]interface{})["note"] != "bye" {
+		t.Errorf("delete = %+v", remove)
+	}
+}
+
+func TestPgoutputLeavesColumnsOut(t *testing.T) {
+	p := newPgoutput(map[string][]string{"users": {"id", "email"}}, primaryKeyOf("id"))
+	steps := [][]byte{
+		messageOf(byte('B'), uint64(100), uint64(0), uint32(1)),
+		messageOf(byte('R'), uint32(2), "public", "users", byte('f'), uint16(3),
+			byte(1), "id", uint32(pgtype.Int8OID), uint32(0),
+			byte(0), "email", uint32(pgtype.TextOID), uint32(0),
+			byte(0), "password", uint32(pgtype.TextOID), uint32(0)),
+		// Only the password changed, it doesn't notify
+		messageOf(byte('U'), uint32(2), byte('O'), tuple("1", "a@b.c", "old"), byte('N'), tuple("1", "a@b.c", "new")),
+		messageOf(byte('U'), uint32(2), byte('O'), tuple("1", "a@b.c", "old"), byte('N'), tuple("1", "d@e.f", "new")),
+	}
+	for _, step := range steps {
+		if _, _, err := p.decode(step); err != nil {
+			t.Fatalf("decode() error = %v", err)
+		}
+	}
+
+	notifications, _, err := p.decode(messageOf(byte('C'), byte(0), uint64(100), uint64(120), uint64(0)))
+	if err != nil || len(notifications) != 1 {
+		t.Fatalf("decode() = %v, %v, expected a single notification", notifications, err)
+	}
+	if data := notifications[0].Data.(map[string]interface{}); len(data) != 2 || data["email"] != "d@e.f" {
+		t.Errorf("data = %v, expected id and email only", data)
+	}
+}
+
+func TestPgoutputDecodesTruncates(t *testing.T) {
+	p := newPgoutput(nil, primaryKeyOf("id"))
+	steps := [][]byte{
+		messageOf(byte('B'), uint64(100), uint64(0), uint32(7)),
+		messageOf(byte('R'), uint32(1), "public", "orders", byte('f'), uint16(1), byte(1), "id", uint32(pgtype.Int4OID), uint32(0)),
+		messageOf(byte('R'), uint32(2), "billing", "invoices", byte('f'), uint16(1), byte(1), "id", uint32(pgtype.Int4OID), uint32(0)),
+		messageOf(byte('T'), uint32(2), byte(0), uint32(1), uint32(2)),
+	}
+	for _, step := range steps {
+		if _, _, err := p.decode(step); err != nil {
+			t.Fatalf("decode() error = %v", err)
+		}
+	}
+
+	notifications, _, err := p.decode(messageOf(byte('C'), byte(0), uint64(100), uint64(120), uint64(0)))
+	if err != nil || len(notifications) != 2 {
+		t.Fatalf("decode() = %v, %v, expected a truncate per table", notifications, err)
+	}
+	for i, table := range []string{"orders", "invoices"} {
+		if n := notifications[i]; n.Operation != OperationTruncate || n.Table != table || n.Txid != 7 || n.Data != nil {
+			t.Errorf("notification %d = %+v, expected the truncate of %s", i, n, table)
+		}
+	}
+
+	if _, _, err := p.decode(messageOf(byte('T'), uint32(1), byte(0), uint32(9))); err == nil {
+		t.Errorf("decode() of the truncate of an undescribed relation expected an error")
+	}
+}
+
+func TestPgoutputJoinsCompositeKeys(t *testing.T) {
+	p := newPgoutput(nil, primaryKeyOf("tenant_id", "number"))
+	steps := [][]byte{
+		messageOf(byte('B'), uint64(100), uint64(0), uint32(1)),
+		messageOf(byte('R'), uint32(3), "public", "invoices", byte('f'), uint16(3),
+			byte(1), "number", uint32(pgtype.Int4OID), uint32(0),
+			byte(1), "tenant_id", uint32(pgtype.TextOID), uint32(0),
+			byte(1), "total", uint32(pgtype.NumericOID), uint32(0)),
+		messageOf(byte('I'), uint32(3), byte('N'), tuple("12", "acme", "9.99")),
+	}
+	for _, step := range steps {
+		if _, _, err := p.decode(step); err != nil {
+			t.Fatalf("decode() error = %v", err)
+		}
+	}
+
+	notifications, _, err := p.decode(messageOf(byte('C'), byte(0), uint64(100), uint64(120), uint64(0)))
+	if err != nil || len(notifications) != 1 {
+		t.Fatalf("decode() = %v, %v, expected a single notification", notifications, err)
+	}
+	if id := notifications[0].ID; id != "acme,12" {
+		t.Errorf("id = %q, expected the key columns in order", id)
+	}
+}
+
+func TestPgoutputRejectsMalformedMessages(t *testing.T) {
+	relation := messageOf(byte('R'), uint32(1), "public", "t", byte('f'), uint16(1), byte(0), "id", uint32(pgtype.TextOID), uint32(0))
+
+	for name, data := range map[string][]byte{
+		"short begin":          messageOf(byte('B'), uint32(1)),
+		"short commit":         messageOf(byte('C'), byte(0), uint64(100)),
+		"undescribed relation": messageOf(byte('I'), uint32(9), byte('N'), tuple("1")),
+		"undescribed delete":   messageOf(byte('D'), uint32(9), byte('O'), tuple("1")),
+	} {
+		t.Run(name, func(t *testing.T) {
+			p := newPgoutput(nil, primaryKeyOf("id"))
+			if _, _, err := p.decode(relation); err != nil {
+				t.Fatalf("decode() error = %v", err)
+			}
+			if _, _, err := p.decode(data); err == nil {
+				t.Errorf("decode() expected an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+)
+
+// ErrReplayLogDisabled is returned by the replay log methods unless
+// PULSE_REPLAY_LOG_SIZE is set.
+var ErrReplayLogDisabled = errors.New("the replay log is disabled, set PULSE_REPLAY_LOG_SIZE")
+
+// replayLogPruneEvery is how many notifications are recorded between two
+// prunes of the replay log.
+const replayLogPruneEvery = 100
+
+func (s *service) createReplayLogTable(ctx context.Context) error {
+	_, err := s.db.Exec(ctx, `CREATE TABLE IF NOT EXISTS pulse_replay_log
+(
+    seq        bigint PRIMARY KEY,
+    payload    jsonb       NOT NULL,
+    created_at timestamptz NOT NULL DEFAULT now()
+);`)
+
+	return err
+}
+
+// Record appends n, numbered by the server, to pulse_replay_log. Only the
+// last PULSE_REPLAY_LOG_SIZE notifications are kept.
+func (s *service) Record(ctx context.Context, n DBNotification) error {
+	if s.cfg.ReplayLogSize == 0 {
+		return ErrReplayLogDisabled
+	}
+
+	payload, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.db.Exec(ctx, "INSERT INTO pulse_replay_log (seq, payload) VALUES ($1, $2)", n.Seq, payload); err != nil {
+		return err
+	}
+
+	if n.Seq%replayLogPruneEvery == 0 {
+		_, err = s.db.Exec(ctx, "DELETE FROM pulse_replay_log WHERE seq <= $1", n.Seq-int64(s.cfg.ReplayLogSize))
+	}
+	return err
+}
+
+// Recorded returns the notifications of pulse_replay_log numbered after seq,
+// oldest first.
+func (s *service) Recorded(ctx context.Context, after int64) ([]DBNotification, error) {
+	if s.cfg.ReplayLogSize == 0 {
+		return nil, ErrReplayLogDisabled
+	}
+
+	rows, err := s.db.Query(ctx, "SELECT payload::text FROM pulse_replay_log WHERE seq > $1 ORDER BY seq", after)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var notifications []DBNotification
+	for rows.Next() {
+		var payload string
+		if err := rows.Scan(&payload); err != nil {
+			return nil, err
+		}
+
+		var n DBNotification
+		decoder := json.NewDecoder(bytes.NewReader([]byte(payload)))
+		decoder.UseNumber()
+		if err := decoder.Decode(&n); err != nil {
+			return nil, err
+		}
+		notifications = append(notifications, n)
+	}
+
+	return notifications, rows.Err()
+}
+
+// LastRecorded returns the number of the last notification of
+// pulse_replay_log, zero if it's empty.
+func (s *service) LastRecorded(ctx context.Context) (int64, error) {
+	if s.cfg.ReplayLogSize == 0 {
+		return 0, ErrReplayLogDisabled
+	}
+
+	var seq int64
+	err := s.db.QueryRow(ctx, "SELECT COALESCE(max(seq), 0) FROM pulse_replay_log").Scan(&seq)
+	return seq, err
+}
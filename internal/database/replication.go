@@ -0,0 +1,215 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pglogrepl"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+// standbyInterval is how often the progress is reported to the server, it
+// must be shorter than its wal_sender_timeout.
+const standbyInterval = 10 * time.Second
+
+// syncPublication makes the publication of the slot publish the watched
+// tables, and only them.
+// Their replica identity is set to full, so deletes carry the whole row and
+// updates the previous values, like the triggers' notifications.
+func (s *service) syncPublication(ctx context.Context, tx pgx.Tx, watched []watchedTable) error {
+	quoted := make([]string, len(watched))
+	for i, t := range watched {
+		quoted[i] = t.quoted()
+		if _, err := tx.Exec(ctx, fmt.Sprintf("ALTER TABLE %s REPLICA IDENTITY FULL", t.quoted())); err != nil {
+			return fmt.Errorf("replica identity of %s: %w", t.quoted(), err)
+		}
+	}
+
+	var exists bool
+	if err := tx.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM pg_publication WHERE pubname = $1)", s.cfg.slot()).Scan(&exists); err != nil {
+		return err
+	}
+
+	// The slot is a validated identifier, safe to interpolate
+	publication := pgx.Identifier{s.cfg.slot()}.Sanitize()
+	var query string
+	switch {
+	case !exists && len(quoted) == 0:
+		query = fmt.Sprintf("CREATE PUBLICATION %s", publication)
+	case !exists:
+		query = fmt.Sprintf("CREATE PUBLICATION %s FOR TABLE %s", publication, strings.Join(quoted, ", "))
+	case len(quoted) == 0:
+		// SET TABLE needs at least one table
+		query = fmt.Sprintf(`DO $$
+DECLARE
+    t record;
+BEGIN
+    FOR t IN SELECT schemaname, tablename FROM pg_publication_tables WHERE pubname = %s LOOP
+        EXECUTE format('ALTER PUBLICATION %s DROP TABLE %%I.%%I', t.schemaname, t.tablename);
+    END LOOP;
+END;
+$$;`, quoteLiteral(s.cfg.slot()), publication)
+	default:
+		query = fmt.Sprintf("ALTER PUBLICATION %s SET TABLE %s", publication, strings.Join(quoted, ", "))
+	}
+
+	if _, err := tx.Exec(ctx, query); err != nil {
+		return fmt.Errorf("publication %s: %w", publication, err)
+	}
+	return nil
+}
+
+// createSlot creates the logical replication slot unless it exists. It keeps
+// the changes made while pulse isn't running, until they're consumed.
+func (s *service) createSlot(ctx context.Context) error {
+	_, err := s.db.Exec(ctx, `SELECT pg_create_logical_replication_slot($1, 'pgoutput')
+WHERE NOT EXISTS (SELECT 1 FROM pg_replication_slots WHERE slot_name = $1)`, s.cfg.slot())
+	if err != nil {
+		return fmt.Errorf("replication slot %s: %w", s.cfg.slot(), err)
+	}
+	return nil
+}
+
+// replicate streams the changes of the replication slot to ch, as
+// notifications, until the connection fails or ctx is done.
+// listening is closed once streaming started. A transaction is acknowledged
+// once all its notifications were sent, the slot sends the others again
+// after a reconnection.
+// It returns the error that ended the connection, nil if ctx is done.
+func (s *service) replicate(ctx context.Context, ch chan DBNotification, listening chan struct{}) error {
+	conn, err := s.replicationConn(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return fmt.Errorf("unable to connect for replication: %w", err)
+	}
+	defer func() {
+		closeCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		conn.Close(closeCtx)
+	}()
+
+	// The slot is a validated identifier, safe to interpolate
+	err = pglogrepl.StartReplication(ctx, conn, s.cfg.slot(), 0, pglogrepl.StartReplicationOptions{
+		PluginArgs: []string{"proto_version '1'", "publication_names " + quoteLiteral(s.cfg.slot())},
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return fmt.Errorf("unable to start replication: %w", err)
+	}
+	s.listening.Store(true)
+	defer s.listening.Store(false)
+	close(listening)
+
+	decoder := newPgoutput(s.cfg.TableColumns, func(schema, table string) ([]string, error) {
+		return s.primaryKey(ctx, schema, table)
+	})
+	// acknowledged is the position up to which every change was handled
+	var acknowledged pglogrepl.LSN
+	inTransaction := false
+	nextStatus := time.Now().Add(standbyInterval)
+
+	for {
+		if time.Now().After(nextStatus) {
+			status := pglogrepl.StandbyStatusUpdate{WALWritePosition: acknowledged, WALFlushPosition: acknowledged, WALApplyPosition: acknowledged}
+			if err := pglogrepl.SendStandbyStatusUpdate(ctx, conn, status); err != nil {
+				return fmt.Errorf("unable to report progress: %w", err)
+			}
+			nextStatus = time.Now().Add(standbyInterval)
+		}
+
+		receiveCtx, cancel := context.WithDeadline(ctx, nextStatus)
+		msg, err := conn.ReceiveMessage(receiveCtx)
+		cancel()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if pgconn.Timeout(err) {
+				continue
+			}
+			return fmt.Errorf("unable to receive changes: %w", err)
+		}
+
+		var data []byte
+		switch msg := msg.(type) {
+		case *pgproto3.CopyData:
+			data = msg.Data
+		case *pgproto3.ErrorResponse:
+			return pgconn.ErrorResponseToPgError(msg)
+		default:
+			continue
+		}
+
+		if len(data) == 0 {
+			continue
+		}
+		switch data[0] {
+		case pglogrepl.PrimaryKeepaliveMessageByteID:
+			keepalive, err := pglogrepl.ParsePrimaryKeepaliveMessage(data[1:])
+			if err != nil {
+				return fmt.Errorf("invalid keepalive: %w", err)
+			}
+
+			// Everything sent before the keepalive was handled
+			if !inTransaction && keepalive.ServerWALEnd > acknowledged {
+				acknowledged = keepalive.ServerWALEnd
+			}
+			if keepalive.ReplyRequested {
+				nextStatus = time.Now()
+			}
+		case pglogrepl.XLogDataByteID:
+			change, err := pglogrepl.ParseXLogData(data[1:])
+			if err != nil {
+				return fmt.Errorf("invalid change: %w", err)
+			}
+
+			notifications, committed, err := decoder.decode(change.WALData)
+			if err != nil {
+				return fmt.Errorf("unable to decode change: %w", err)
+			}
+			if !committed {
+				inTransaction = true
+				continue
+			}
+
+			for _, n := range notifications {
+				if !s.emit(ctx, ch, n) {
+					return nil
+				}
+			}
+			inTransaction = false
+			if change.ServerWALEnd > acknowledged {
+				acknowledged = change.ServerWALEnd
+			}
+		}
+	}
+}
+
+// replicationConn opens a replication connection to the database, to its
+// listen endpoint if it has one.
+func (s *service) replicationConn(ctx context.Context) (*pgconn.PgConn, error) {
+	connConfig, err := pgconn.ParseConfig(s.cfg.listenConnString())
+	if err != nil {
+		return nil, err
+	}
+	connConfig.RuntimeParams["replication"] = "database"
+	if s.cfg.TLS != nil {
+		connConfig.TLSConfig = s.cfg.TLS
+		connConfig.Fallbacks = nil
+	}
+
+	return pgconn.ConnectConfig(ctx, connConfig)
+}
+
+// quoteLiteral quotes s as an SQL string literal.
+func quoteLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
@@ -0,0 +1,119 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// TxSnapshot tells which transactions a snapshot sees, as
+// txid_current_snapshot() describes it: those before Xmin, and those before
+// Xmax but Xip, which were still in progress.
+type TxSnapshot struct {
+	Xmin int64
+	Xmax int64
+	Xip  []int64
+}
+
+// Sees reports whether the changes of the transaction txid are in the
+// snapshot.
+// The 32 bits ids of CaptureReplication are taken to be the nearest to Xmax
+// of any epoch, like Postgres compares them.
+func (s TxSnapshot) Sees(txid int64) bool {
+	if txid>>32 == 0 && s.Xmax>>32 != 0 {
+		txid |= s.Xmax &^ (1<<32 - 1)
+		if txid-s.Xmax > 1<<31 {
+			txid -= 1 << 32
+		} else if s.Xmax-txid > 1<<31 {
+			txid += 1 << 32
+		}
+	}
+
+	if txid < s.Xmin {
+		return true
+	}
+	if txid >= s.Xmax {
+		return false
+	}
+	for _, running := range s.Xip {
+		if running == txid {
+			return false
+		}
+	}
+	return true
+}
+
+// parseTxSnapshot parses the xmin:xmax:xip,... text of a snapshot.
+func parseTxSnapshot(raw string) (TxSnapshot, error) {
+	parts := strings.Split(raw, ":")
+	if len(parts) != 3 {
+		return TxSnapshot{}, fmt.Errorf("invalid snapshot %q", raw)
+	}
+
+	var s TxSnapshot
+	var err error
+	if s.Xmin, err = strconv.ParseInt(parts[0], 10, 64); err != nil {
+		return TxSnapshot{}, fmt.Errorf("invalid snapshot %q: %w", raw, err)
+	}
+	if s.Xmax, err = strconv.ParseInt(parts[1], 10, 64); err != nil {
+		return TxSnapshot{}, fmt.Errorf("invalid snapshot %q: %w", raw, err)
+	}
+	if parts[2] != "" {
+		for _, xip := range strings.Split(parts[2], ",") {
+			txid, err := strconv.ParseInt(xip, 10, 64)
+			if err != nil {
+				return TxSnapshot{}, fmt.Errorf("invalid snapshot %q: %w", raw, err)
+			}
+			s.Xip = append(s.Xip, txid)
+		}
+	}
+	return s, nil
+}
+
+// ScanTable reads every current row of table, limit at a time, in a single
+// repeatable read transaction, and hands them to page. It returns the
+// snapshot they were read in, telling the changes they include from the
+// later ones.
+// The transaction stays open until the whole table is read, on the replica
+// when there's one.
+func (s *service) ScanTable(ctx context.Context, table string, limit int, page func([]DBNotification) error) (TxSnapshot, error) {
+	t, err := s.resolveTable(ctx, table)
+	if err != nil {
+		return TxSnapshot{}, err
+	}
+
+	tx, err := s.replica.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return TxSnapshot{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	// The first query takes the snapshot every page is then read in
+	var raw string
+	if err := tx.QueryRow(ctx, "SELECT txid_current_snapshot()::text").Scan(&raw); err != nil {
+		return TxSnapshot{}, err
+	}
+	snapshot, err := parseTxSnapshot(raw)
+	if err != nil {
+		return TxSnapshot{}, err
+	}
+
+	after := ""
+	for {
+		rows, err := s.snapshotPage(ctx, tx, t, after, limit)
+		if err != nil {
+			return TxSnapshot{}, err
+		}
+		if err := page(rows); err != nil {
+			return TxSnapshot{}, err
+		}
+
+		if len(rows) < limit {
+			return snapshot, nil
+		}
+		after = rows[len(rows)-1].ID
+	}
+}
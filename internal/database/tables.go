@@ -0,0 +1,511 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// ErrUnknownTable is returned for a table that isn't in the watched schemas,
+// or is excluded.
+var ErrUnknownTable = errors.New("unknown table")
+
+// ErrAmbiguousTable is returned for a table configured without its schema
+// that several watched schemas have.
+var ErrAmbiguousTable = errors.New("table in several schemas, qualify it with its schema")
+
+// watchedTable is a table whose changes notify.
+type watchedTable struct {
+	schema string
+	name   string
+	// primaryKey lists the columns of its primary key in order, it's empty
+	// if it has none
+	primaryKey []string
+}
+
+// quoted returns the schema qualified table, safe to interpolate into queries.
+func (t watchedTable) quoted() string {
+	return pgx.Identifier{t.schema, t.name}.Sanitize()
+}
+
+// primaryKeyJSON returns the primary key columns as a JSON array.
+func (t watchedTable) primaryKeyJSON() string {
+	columns, _ := json.Marshal(t.primaryKey)
+	if t.primaryKey == nil {
+		columns = []byte("[]")
+	}
+	return string(columns)
+}
+
+// primaryKeyArg returns the primary key columns as a JSON array literal, the
+// first argument of the triggers.
+func (t watchedTable) primaryKeyArg() string {
+	return quoteLiteral(t.primaryKeyJSON())
+}
+
+// primaryKeyColumns selects the primary key columns of the table whose oid
+// is the parameter, in order, as a text array.
+const primaryKeyColumns = `SELECT coalesce(array_agg(a.attname::text ORDER BY k.position), '{}')
+FROM pg_index i
+CROSS JOIN unnest(i.indkey) WITH ORDINALITY k(attnum, position)
+JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = k.attnum
+WHERE i.indrelid = %s AND i.indisprimary`
+
+// primaryKey returns the primary key columns of table in schema.
+func (s *service) primaryKey(ctx context.Context, schema, table string) ([]string, error) {
+	var columns []string
+	err := s.db.QueryRow(ctx, fmt.Sprintf(primaryKeyColumns, "$1::regclass"), pgx.Identifier{schema, table}.Sanitize()).Scan(&columns)
+	return columns, err
+}
+
+// ownTables are pulse's own tables, which are never watched. Tables of the
+// application named pulse_* are.
+var ownTables = []string{"pulse_events", "pulse_dead_letters", "pulse_replay_log", "pulse_outbox", "pulse_cluster_relay", "pulse_api_keys"}
+
+// querier is what's needed from a pool or transaction to look tables up.
+type querier interface {
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+}
+
+// tables returns the tables of the watched schemas, pulse's own left out,
+// in the order of the schemas. Excluded tables are returned separately.
+func (s *service) tables(ctx context.Context, q querier) (watched, excluded []watchedTable, err error) {
+	schemas := s.cfg.schemas()
+	rows, err := q.Query(ctx, fmt.Sprintf(`SELECT schemaname::text, tablename::text, (%s)
+FROM pg_tables
+WHERE schemaname = ANY ($1)
+  AND tablename <> ALL ($2)
+ORDER BY array_position($1, schemaname::text), tablename`, fmt.Sprintf(primaryKeyColumns, "format('%I.%I', schemaname, tablename)::regclass")), schemas, ownTables)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var t watchedTable
+		if err := rows.Scan(&t.schema, &t.name, &t.primaryKey); err != nil {
+			return nil, nil, err
+		}
+
+		if s.cfg.excludes(t.schema, t.name) {
+			excluded = append(excluded, t)
+		} else {
+			watched = append(watched, t)
+		}
+	}
+
+	return watched, excluded, rows.Err()
+}
+
+// watchedNamed returns the watched table a setting is keyed by: its schema
+// qualified name, like public.users, or its bare name when a single watched
+// schema has such a table.
+// It returns ErrUnknownTable if there's none, ErrAmbiguousTable if a bare
+// name is in several schemas.
+func watchedNamed(watched []watchedTable, name string) (watchedTable, error) {
+	var matches []watchedTable
+	for _, t := range watched {
+		if t.schema+"."+t.name == name {
+			return t, nil
+		}
+		if t.name == name {
+			matches = append(matches, t)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return watchedTable{}, ErrUnknownTable
+	case 1:
+		return matches[0], nil
+	}
+	return watchedTable{}, ErrAmbiguousTable
+}
+
+// tableSetting returns the setting of t, keyed by its schema qualified name
+// or else its bare one.
+func tableSetting[V any](settings map[string]V, t watchedTable) (V, bool) {
+	if setting, ok := settings[t.schema+"."+t.name]; ok {
+		return setting, true
+	}
+	setting, ok := settings[t.name]
+	return setting, ok
+}
+
+// installedTriggers returns the tables having some of pulse's triggers, by
+// schema qualified name. Those having only the plain row and truncate
+// triggers syncRowTriggers creates are mapped to the argument of the row
+// one, the others to "".
+func installedTriggers(ctx context.Context, tx pgx.Tx) (map[string]string, error) {
+	// 29 is a row trigger fired after inserts, updates and deletes, 32 a
+	// statement trigger fired after truncates
+	rows, err := tx.Query(ctx, `SELECT n.nspname::text, c.relname::text,
+    count(*) = 2 AND bool_and(CASE t.tgname::text
+        WHEN c.relname::text || '_trigger' THEN t.tgtype = 29 AND t.tgqual IS NULL AND t.tgnargs = 1
+        WHEN c.relname::text || '_truncate' THEN t.tgtype = 32 AND t.tgnargs = 0
+        ELSE false END),
+    coalesce((array_agg(t.tgargs) FILTER (WHERE t.tgtype = 29))[1], '')
+FROM pg_trigger t
+JOIN pg_proc p ON p.oid = t.tgfoid
+JOIN pg_class c ON c.oid = t.tgrelid
+JOIN pg_namespace n ON n.oid = c.relnamespace
+WHERE NOT t.tgisinternal
+  AND p.proname IN ('pulse_watcher', 'pulse_bulk_watcher')
+GROUP BY n.nspname, c.relname`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	installed := make(map[string]string)
+	for rows.Next() {
+		var schema, table string
+		var plain bool
+		var args []byte
+		if err := rows.Scan(&schema, &table, &plain, &args); err != nil {
+			return nil, err
+		}
+
+		installed[schema+"."+table] = ""
+		if plain {
+			// Arguments are stored NUL terminated
+			installed[schema+"."+table] = strings.TrimSuffix(string(args), "\x00")
+		}
+	}
+	return installed, rows.Err()
+}
+
+// syncRowTriggers installs the row and truncate triggers on every watched
+// table, dropping their conditional and bulk triggers, which are installed
+// back afterwards where configured. Excluded tables have all of pulse's
+// triggers dropped.
+// Tables already having those two alone, or no trigger when they shouldn't,
+// are left as they are, so they aren't locked.
+// It returns the watched tables.
+func (s *service) syncRowTriggers(ctx context.Context, tx pgx.Tx) ([]watchedTable, error) {
+	watched, excluded, err := s.tables(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	installed, err := installedTriggers(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, t := range append(watched, excluded...) {
+		args, triggered := installed[t.schema+"."+t.name]
+		if s.cfg.excludes(t.schema, t.name) || s.cfg.replication() {
+			if !triggered {
+				continue
+			}
+		} else if args == t.primaryKeyJSON() {
+			continue
+		}
+
+		drop := fmt.Sprintf(`DROP TRIGGER IF EXISTS %[2]s ON %[1]s;
+DROP TRIGGER IF EXISTS %[3]s ON %[1]s;
+DROP TRIGGER IF EXISTS %[4]s ON %[1]s;
+DROP TRIGGER IF EXISTS %[5]s ON %[1]s;`,
+			t.quoted(),
+			pgx.Identifier{t.name + "_update_trigger"}.Sanitize(),
+			pgx.Identifier{t.name + "_bulk_insert"}.Sanitize(),
+			pgx.Identifier{t.name + "_bulk_update"}.Sanitize(),
+			pgx.Identifier{t.name + "_bulk_delete"}.Sanitize(),
+		)
+
+		trigger := pgx.Identifier{t.name + "_trigger"}.Sanitize()
+		truncate := pgx.Identifier{t.name + "_truncate"}.Sanitize()
+		if s.cfg.excludes(t.schema, t.name) || s.cfg.replication() {
+			drop += fmt.Sprintf("\nDROP TRIGGER IF EXISTS %s ON %s;\nDROP TRIGGER IF EXISTS %s ON %[2]s;", trigger, t.quoted(), truncate)
+		} else {
+			drop += fmt.Sprintf(`
+CREATE OR REPLACE TRIGGER %s AFTER INSERT OR UPDATE OR DELETE ON %s
+    FOR EACH ROW EXECUTE FUNCTION %s;
+CREATE OR REPLACE TRIGGER %s AFTER TRUNCATE ON %[2]s
+    FOR EACH STATEMENT EXECUTE FUNCTION pulse_watcher();`, trigger, t.quoted(), watcherCall(t, nil), truncate)
+		}
+
+		if _, err := tx.Exec(ctx, drop); err != nil {
+			return nil, fmt.Errorf("triggers of %s: %w", t.quoted(), err)
+		}
+	}
+
+	return watched, nil
+}
+
+// Unwatched returns the watched tables none of whose triggers call
+// pulse_watcher or pulse_bulk_watcher, or that aren't published with
+// CaptureReplication, schema qualified.
+func (s *service) Unwatched(ctx context.Context) ([]string, error) {
+	watched, _, err := s.tables(ctx, s.db)
+	if err != nil {
+		return nil, err
+	}
+
+	check := `SELECT EXISTS (
+    SELECT 1
+    FROM pg_trigger t
+    JOIN pg_proc p ON p.oid = t.tgfoid
+    WHERE t.tgrelid = $1::regclass
+      AND NOT t.tgisinternal
+      AND p.proname IN ('pulse_watcher', 'pulse_bulk_watcher')
+)`
+	args := []interface{}{nil}
+	if s.cfg.replication() {
+		check = `SELECT EXISTS (
+    SELECT 1
+    FROM pg_publication_rel r
+    JOIN pg_publication p ON p.oid = r.prpubid
+    WHERE r.prrelid = $1::regclass
+      AND p.pubname = $2
+)`
+		args = append(args, s.cfg.slot())
+	}
+
+	var unwatched []string
+	for _, t := range watched {
+		var notifies bool
+		args[0] = t.quoted()
+		if err := s.db.QueryRow(ctx, check, args...).Scan(&notifies); err != nil {
+			return nil, err
+		}
+		if !notifies {
+			unwatched = append(unwatched, t.schema+"."+t.name)
+		}
+	}
+	return unwatched, nil
+}
+
+// OperationSchema is sent for every table Watch found and synced after it
+// was created, its changes notify from then on.
+const OperationSchema = "schema"
+
+// reconcile syncs the tables every SyncInterval, or as soon as a ddl event
+// tells of a new one, if some were created since the last sync, sending an
+// OperationSchema notification for each to ch, until ctx is done.
+func (s *service) reconcile(ctx context.Context, ch chan DBNotification) {
+	ticker := time.NewTicker(s.cfg.SyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-s.reconcileNow:
+		}
+
+		created, err := s.Unwatched(ctx)
+		if err != nil {
+			slog.Error("Failed to look for new tables", "source", s.source, "error", err)
+			continue
+		}
+		if len(created) == 0 {
+			continue
+		}
+
+		if err := s.SyncTables(ctx); err != nil {
+			slog.Error("Failed to sync new tables", "source", s.source, "tables", created, "error", err)
+			continue
+		}
+		slog.Info("Synced new tables", "source", s.source, "tables", created)
+
+		for _, table := range created {
+			schema, name, _ := strings.Cut(table, ".")
+			select {
+			case ch <- DBNotification{Operation: OperationSchema, Table: name, Schema: schema, Source: s.source, EmittedAt: time.Now()}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// RemoveTriggers drops, in a transaction, the triggers calling pulse_watcher
+// or pulse_bulk_watcher from the tables named, in any schema, and the
+// functions and event triggers once no table is named.
+func (s *service) RemoveTriggers(ctx context.Context, tables ...string) ([]string, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx, `SELECT n.nspname::text, c.relname::text, t.tgname::text
+FROM pg_trigger t
+JOIN pg_proc p ON p.oid = t.tgfoid
+JOIN pg_class c ON c.oid = t.tgrelid
+JOIN pg_namespace n ON n.oid = c.relnamespace
+WHERE NOT t.tgisinternal
+  AND p.proname IN ('pulse_watcher', 'pulse_bulk_watcher')
+ORDER BY n.nspname, c.relname, t.tgname`)
+	if err != nil {
+		return nil, err
+	}
+
+	var drops []string
+	var removed []string
+	for rows.Next() {
+		var schema, table, trigger string
+		if err := rows.Scan(&schema, &table, &trigger); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if len(tables) > 0 && !slices.Contains(tables, table) && !slices.Contains(tables, schema+"."+table) {
+			continue
+		}
+
+		drops = append(drops, fmt.Sprintf("DROP TRIGGER %s ON %s;", pgx.Identifier{trigger}.Sanitize(), pgx.Identifier{schema, table}.Sanitize()))
+		if name := schema + "." + table; len(removed) == 0 || removed[len(removed)-1] != name {
+			removed = append(removed, name)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(tables) == 0 {
+		drops = append(drops, `DROP FUNCTION IF EXISTS pulse_watcher();
+DROP FUNCTION IF EXISTS pulse_bulk_watcher();
+DROP FUNCTION IF EXISTS pulse_row_id(jsonb, jsonb);
+DROP FUNCTION IF EXISTS pulse_notify(json);
+DROP EVENT TRIGGER IF EXISTS pulse_ddl_end;
+DROP EVENT TRIGGER IF EXISTS pulse_ddl_drop;
+DROP FUNCTION IF EXISTS pulse_ddl_watcher();
+DROP FUNCTION IF EXISTS pulse_ddl_notify(text, text, text);`)
+	}
+	if len(drops) > 0 {
+		if _, err := tx.Exec(ctx, strings.Join(drops, "\n")); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+
+	if len(tables) == 0 {
+		s.synced.Store(false)
+	}
+	return removed, nil
+}
+
+// resolveTable resolves a table named by a client, as is or schema
+// qualified, into the watched table, whose quoted name can safely be
+// interpolated into a query, like SELECT * FROM <table>.
+// Tables of the first watched schema having one by that name win.
+// It returns ErrUnknownTable unless the table is watched.
+func (s *service) resolveTable(ctx context.Context, table string) (watchedTable, error) {
+	schemas := s.cfg.schemas()
+	if schema, name, qualified := strings.Cut(table, "."); qualified {
+		if !slices.Contains(schemas, schema) {
+			return watchedTable{}, ErrUnknownTable
+		}
+		schemas, table = []string{schema}, name
+	}
+
+	rows, err := s.db.Query(ctx, `SELECT schemaname::text
+FROM pg_tables
+WHERE schemaname = ANY ($1)
+  AND tablename = $2
+ORDER BY array_position($1, schemaname::text)`, schemas, table)
+	if err != nil {
+		return watchedTable{}, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var schema string
+		if err := rows.Scan(&schema); err != nil {
+			return watchedTable{}, err
+		}
+
+		if !contains(ownTables, table) && !s.cfg.excludes(schema, table) {
+			return watchedTable{schema: schema, name: table}, nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return watchedTable{}, err
+	}
+
+	return watchedTable{}, ErrUnknownTable
+}
+
+// OperationSnapshot is the operation of the rows read by Snapshot, as opposed
+// to changes.
+const OperationSnapshot = "snapshot"
+
+// Snapshot returns up to limit rows of table as snapshot notifications,
+// ordered by id and starting after the row whose id is after, if set.
+// It returns ErrUnknownTable unless the table exists in a watched schema.
+func (s *service) Snapshot(ctx context.Context, table, after string, limit int) ([]DBNotification, error) {
+	t, err := s.resolveTable(ctx, table)
+	if err != nil {
+		return nil, err
+	}
+	return s.snapshotPage(ctx, s.replica, t, after, limit)
+}
+
+// rowQuerier is what's needed from a pool or transaction to read rows.
+type rowQuerier interface {
+	querier
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+}
+
+// snapshotPage returns up to limit rows of t read by q, ordered by id and
+// starting after the given one. Like notifications, rows only have the
+// columns of t's allowlist, if it has one.
+func (s *service) snapshotPage(ctx context.Context, q rowQuerier, t watchedTable, after string, limit int) ([]DBNotification, error) {
+	quoted := t.quoted()
+
+	query := fmt.Sprintf("SELECT t.id::text, to_json(t)::text FROM %s t ORDER BY t.id LIMIT $1", quoted)
+	args := []interface{}{limit}
+	if after != "" {
+		// The cursor is compared as the id's own type, numbers don't sort as text
+		var idType string
+		err := q.QueryRow(ctx, "SELECT format_type(atttypid, atttypmod) FROM pg_attribute WHERE attrelid = $1::regclass AND attname = 'id' AND NOT attisdropped", quoted).Scan(&idType)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, fmt.Errorf("table %s has no id column", t.name)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		query = fmt.Sprintf("SELECT t.id::text, to_json(t)::text FROM %s t WHERE t.id > $2::text::%s ORDER BY t.id LIMIT $1", quoted, idType)
+		args = append(args, after)
+	}
+
+	rows, err := q.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var notifications []DBNotification
+	for rows.Next() {
+		var id, data string
+		if err := rows.Scan(&id, &data); err != nil {
+			return nil, err
+		}
+
+		var row map[string]interface{}
+		decoder := json.NewDecoder(strings.NewReader(data))
+		decoder.UseNumber()
+		if err := decoder.Decode(&row); err != nil {
+			return nil, err
+		}
+		s.leaveColumnsOut(t, row)
+
+		notifications = append(notifications, DBNotification{Operation: OperationSnapshot, Table: t.name, Schema: t.schema, ID: id, Data: row, Source: s.source})
+	}
+
+	return notifications, rows.Err()
+}
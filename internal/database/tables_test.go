@@ -0,0 +1,64 @@
+package database
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestWatchedNamedPrefersQualifiedNames(t *testing.T) {
+	watched := []watchedTable{
+		{schema: "public", name: "users"},
+		{schema: "audit", name: "users"},
+		{schema: "audit", name: "events"},
+	}
+
+	for _, tc := range []struct {
+		name     string
+		expected watchedTable
+		err      error
+	}{
+		{name: "audit.users", expected: watched[1]},
+		{name: "public.users", expected: watched[0]},
+		{name: "events", expected: watched[2]},
+		{name: "audit.events", expected: watched[2]},
+		{name: "users", err: ErrAmbiguousTable},
+		{name: "public.events", err: ErrUnknownTable},
+		{name: "orders", err: ErrUnknownTable},
+	} {
+		table, err := watchedNamed(watched, tc.name)
+		if !errors.Is(err, tc.err) || table.schema != tc.expected.schema || table.name != tc.expected.name {
+			t.Errorf("watchedNamed(%q) = %+v, %v, expected %+v, %v", tc.name, table, err, tc.expected, tc.err)
+		}
+	}
+}
+
+func TestColumnsOfQualifiedTables(t *testing.T) {
+	s := &service{cfg: Config{TableColumns: map[string][]string{
+		"audit.users": {"id"},
+		"users":       {"id", "email"},
+	}}}
+
+	// The qualified allowlist wins over the bare one
+	if allowed, _ := s.allowedColumns(watchedTable{schema: "audit", name: "users"}); len(allowed) != 1 {
+		t.Errorf("allowed columns of audit.users = %v, expected id", allowed)
+	}
+	if allowed, _ := s.allowedColumns(watchedTable{schema: "public", name: "users"}); len(allowed) != 2 {
+		t.Errorf("allowed columns of public.users = %v, expected id and email", allowed)
+	}
+
+	for _, tc := range []struct {
+		table, column string
+		expected      bool
+	}{
+		{"public.users", "email", true},
+		{"audit.users", "email", false},
+		// users is both tables, audit's leaves email out
+		{"users", "email", false},
+		{"users", "id", true},
+		{"orders", "total", true},
+	} {
+		if allowed := s.ColumnAllowed(tc.table, tc.column); allowed != tc.expected {
+			t.Errorf("ColumnAllowed(%q, %q) = %v, expected %v", tc.table, tc.column, allowed, tc.expected)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// ErrVisibilityDisabled is returned by Visible unless PULSE_VISIBILITY_CHECK
+// is set.
+var ErrVisibilityDisabled = errors.New("rows aren't checked, set PULSE_VISIBILITY_CHECK")
+
+// visibilityQuery returns the query running the visibility check, with the
+// claims, the row, its table and operation as parameters.
+func (s *service) visibilityQuery() string {
+	return `SELECT coalesce((` + s.cfg.VisibilityCheck + `), false)
+FROM (SELECT $1::jsonb AS claims, $2::jsonb AS data, $3::text AS table_schema, $4::text AS table_name, $5::text AS operation) AS pulse_row`
+}
+
+// prepareVisibilityCheck parses the visibility check, so mistakes are
+// reported by SyncTables rather than by the first row checked.
+func (s *service) prepareVisibilityCheck(ctx context.Context) error {
+	conn, err := s.db.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	if _, err := conn.Conn().Prepare(ctx, "", s.visibilityQuery()); err != nil {
+		return fmt.Errorf("invalid PULSE_VISIBILITY_CHECK: %w", err)
+	}
+	return nil
+}
+
+// Visible runs the visibility check of n once per claims, a JSON object each,
+// and reports which may see its row.
+// The checks run in a read only transaction, as Config.VisibilityRole when
+// it's set, with the claims in the request.jwt.claims setting too, where row
+// level security policies written for PostgREST read them.
+func (s *service) Visible(ctx context.Context, n DBNotification, claims []string) ([]bool, error) {
+	if s.cfg.VisibilityCheck == "" {
+		return nil, ErrVisibilityDisabled
+	}
+
+	// Bulk notifications carry no row, checks get NULL
+	var data []byte
+	if n.Data != nil {
+		var err error
+		if data, err = json.Marshal(n.Data); err != nil {
+			return nil, err
+		}
+	}
+
+	tx, err := s.db.BeginTx(ctx, pgx.TxOptions{AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	batch := &pgx.Batch{}
+	if s.cfg.VisibilityRole != "" {
+		batch.Queue("SET LOCAL ROLE " + pgx.Identifier{s.cfg.VisibilityRole}.Sanitize())
+	}
+	for _, c := range claims {
+		batch.Queue("SELECT set_config('request.jwt.claims', $1, true)", c)
+		batch.Queue(s.visibilityQuery(), c, data, n.Schema, n.Table, n.Operation)
+	}
+
+	results := tx.SendBatch(ctx, batch)
+	if s.cfg.VisibilityRole != "" {
+		if _, err := results.Exec(); err != nil {
+			results.Close()
+			return nil, err
+		}
+	}
+
+	visible := make([]bool, len(claims))
+	for i := range claims {
+		if _, err := results.Exec(); err != nil {
+			results.Close()
+			return nil, err
+		}
+		if err := results.QueryRow().Scan(&visible[i]); err != nil {
+			results.Close()
+			return nil, err
+		}
+	}
+	return visible, results.Close()
+}
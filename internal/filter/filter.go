@@ -0,0 +1,464 @@
+// Package filter compiles subscription filter expressions into predicates
+// evaluated against the row of a notification.
+//
+// The grammar is a small, safe subset of SQL's WHERE clause:
+//
+//	expr       = and { "OR" and }
+//	and        = unary { "AND" unary }
+//	unary      = "NOT" unary | "(" expr ")" | comparison
+//	comparison = column op literal
+//	           | column [ "NOT" ] "IN" "(" literal { "," literal } ")"
+//	           | column "IS" [ "NOT" ] "NULL"
+//	op         = "=" | "!=" | "<>" | "<" | "<=" | ">" | ">="
+//	literal    = number | 'string' | TRUE | FALSE | NULL | ":" param
+//
+// Columns are top-level keys of the row, keywords are case insensitive.
+// Parameters are bound to values by ParseWith, never spliced into the text.
+// Expressions are only ever evaluated in Go, never sent to the database.
+//
+// ParseWhere compiles the PostgREST-style conditions of ?where= into the same
+// kind of Predicate.
+package filter
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Predicate reports whether a row matches the compiled expression.
+type Predicate func(row map[string]interface{}) bool
+
+// Parse compiles expr into a Predicate.
+// It returns an error if expr is outside of the grammar.
+func Parse(expr string) (Predicate, error) {
+	return ParseWith(expr, nil)
+}
+
+// ParseWith compiles expr into a Predicate, binding its :param literals to
+// the values of params: strings, numbers (float64 or json.Number) and bools.
+// It returns an error if expr is outside of the grammar or uses a parameter
+// missing from params or of another type.
+func ParseWith(expr string, params map[string]interface{}) (Predicate, error) {
+	tokens, err := lex(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens, params: params}
+	predicate, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if tok := p.peek(); tok.kind != tokenEOF {
+		return nil, fmt.Errorf("unexpected %q at position %d", tok.text, tok.pos)
+	}
+
+	return predicate, nil
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenNumber
+	tokenString
+	tokenOperator
+	tokenLParen
+	tokenRParen
+	tokenComma
+	tokenParam
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func lex(expr string) ([]token, error) {
+	var tokens []token
+
+	for i := 0; i < len(expr); {
+		r := rune(expr[i])
+
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, token{kind: tokenLParen, text: "(", pos: i})
+			i++
+		case r == ')':
+			tokens = append(tokens, token{kind: tokenRParen, text: ")", pos: i})
+			i++
+		case r == ',':
+			tokens = append(tokens, token{kind: tokenComma, text: ",", pos: i})
+			i++
+		case strings.ContainsRune("=!<>", r):
+			start := i
+			i++
+			if i < len(expr) && (expr[i] == '=' || (r == '<' && expr[i] == '>')) {
+				i++
+			}
+
+			op := expr[start:i]
+			if op == "!" {
+				return nil, fmt.Errorf("unexpected %q at position %d", op, start)
+			}
+			tokens = append(tokens, token{kind: tokenOperator, text: op, pos: start})
+		case r == '\'':
+			start := i
+			var value strings.Builder
+			for i++; ; i++ {
+				if i >= len(expr) {
+					return nil, fmt.Errorf("unterminated string at position %d", start)
+				}
+
+				// Quotes are escaped by doubling them, like in SQL
+				if expr[i] == '\'' {
+					if i+1 < len(expr) && expr[i+1] == '\'' {
+						value.WriteByte('\'')
+						i++
+						continue
+					}
+					i++
+					break
+				}
+				value.WriteByte(expr[i])
+			}
+			tokens = append(tokens, token{kind: tokenString, text: value.String(), pos: start})
+		case r == ':':
+			start := i
+			for i++; i < len(expr) && (expr[i] == '_' || unicode.IsLetter(rune(expr[i])) || unicode.IsDigit(rune(expr[i]))); i++ {
+			}
+			if i == start+1 {
+				return nil, fmt.Errorf("expected parameter name at position %d", i)
+			}
+			tokens = append(tokens, token{kind: tokenParam, text: expr[start+1 : i], pos: start})
+		case r == '-' || r == '.' || unicode.IsDigit(r):
+			start := i
+			for i++; i < len(expr) && (expr[i] == '.' || unicode.IsDigit(rune(expr[i])) || expr[i] == 'e' || expr[i] == 'E'); i++ {
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: expr[start:i], pos: start})
+		case r == '_' || unicode.IsLetter(r):
+			start := i
+			for i++; i < len(expr) && (expr[i] == '_' || unicode.IsLetter(rune(expr[i])) || unicode.IsDigit(rune(expr[i]))); i++ {
+			}
+			tokens = append(tokens, token{kind: tokenIdent, text: expr[start:i], pos: start})
+		default:
+			return nil, fmt.Errorf("unexpected %q at position %d", r, i)
+		}
+	}
+
+	return append(tokens, token{kind: tokenEOF, pos: len(expr)}), nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+	params map[string]interface{}
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokenEOF {
+		p.pos++
+	}
+	return tok
+}
+
+// keyword consumes the next token if it's the given keyword.
+func (p *parser) keyword(keyword string) bool {
+	if tok := p.peek(); tok.kind == tokenIdent && strings.EqualFold(tok.text, keyword) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(kind tokenKind, what string) error {
+	if tok := p.next(); tok.kind != kind {
+		return fmt.Errorf("expected %s at position %d", what, tok.pos)
+	}
+	return nil
+}
+
+func (p *parser) parseOr() (Predicate, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.keyword("OR") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+
+		l := left
+		left = func(row map[string]interface{}) bool { return l(row) || right(row) }
+	}
+
+	return left, nil
+}
+
+func (p *parser) parseAnd() (Predicate, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.keyword("AND") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		l := left
+		left = func(row map[string]interface{}) bool { return l(row) && right(row) }
+	}
+
+	return left, nil
+}
+
+func (p *parser) parseUnary() (Predicate, error) {
+	if p.keyword("NOT") {
+		inner, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(row map[string]interface{}) bool { return !inner(row) }, nil
+	}
+
+	if p.peek().kind == tokenLParen {
+		p.next()
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(tokenRParen, "\")\""); err != nil {
+			return nil, err
+		}
+		return inner, nil
+	}
+
+	return p.parseComparison()
+}
+
+func (p *parser) parseComparison() (Predicate, error) {
+	column := p.next()
+	if column.kind != tokenIdent || isKeyword(column.text) {
+		return nil, fmt.Errorf("expected column at position %d", column.pos)
+	}
+
+	if p.keyword("IS") {
+		negate := p.keyword("NOT")
+		if !p.keyword("NULL") {
+			return nil, fmt.Errorf("expected NULL at position %d", p.peek().pos)
+		}
+
+		return func(row map[string]interface{}) bool {
+			return (row[column.text] == nil) != negate
+		}, nil
+	}
+
+	negate := p.keyword("NOT")
+	if p.keyword("IN") {
+		values, err := p.parseList()
+		if err != nil {
+			return nil, err
+		}
+
+		return func(row map[string]interface{}) bool {
+			for _, value := range values {
+				if cmp, ok := compare(row[column.text], value); ok && cmp == 0 {
+					return !negate
+				}
+			}
+			return negate
+		}, nil
+	}
+	if negate {
+		return nil, fmt.Errorf("expected IN at position %d", p.peek().pos)
+	}
+
+	op := p.next()
+	if op.kind != tokenOperator {
+		return nil, fmt.Errorf("expected operator at position %d", op.pos)
+	}
+
+	value, err := p.parseLiteral()
+	if err != nil {
+		return nil, err
+	}
+
+	return func(row map[string]interface{}) bool {
+		cmp, ok := compare(row[column.text], value)
+		if !ok {
+			return false
+		}
+
+		switch op.text {
+		case "=":
+			return cmp == 0
+		case "!=", "<>":
+			return cmp != 0
+		case "<":
+			return cmp < 0
+		case "<=":
+			return cmp <= 0
+		case ">":
+			return cmp > 0
+		default:
+			return cmp >= 0
+		}
+	}, nil
+}
+
+func (p *parser) parseList() ([]interface{}, error) {
+	if err := p.expect(tokenLParen, "\"(\""); err != nil {
+		return nil, err
+	}
+
+	var values []interface{}
+	for {
+		value, err := p.parseLiteral()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+
+		if p.peek().kind != tokenComma {
+			break
+		}
+		p.next()
+	}
+
+	if err := p.expect(tokenRParen, "\")\""); err != nil {
+		return nil, err
+	}
+
+	return values, nil
+}
+
+func (p *parser) parseLiteral() (interface{}, error) {
+	tok := p.next()
+
+	switch {
+	case tok.kind == tokenString:
+		return tok.text, nil
+	case tok.kind == tokenNumber:
+		if _, err := strconv.ParseFloat(tok.text, 64); err != nil {
+			return nil, fmt.Errorf("invalid number %q at position %d", tok.text, tok.pos)
+		}
+		return json.Number(tok.text), nil
+	case tok.kind == tokenIdent && strings.EqualFold(tok.text, "TRUE"):
+		return true, nil
+	case tok.kind == tokenIdent && strings.EqualFold(tok.text, "FALSE"):
+		return false, nil
+	case tok.kind == tokenIdent && strings.EqualFold(tok.text, "NULL"):
+		return nil, nil
+	case tok.kind == tokenParam:
+		value, ok := p.params[tok.text]
+		if !ok {
+			return nil, fmt.Errorf("unknown parameter %q at position %d", tok.text, tok.pos)
+		}
+
+		switch v := value.(type) {
+		case string, bool:
+			return v, nil
+		case json.Number, float64:
+			n, _ := number(v)
+			return n, nil
+		}
+		return nil, fmt.Errorf("parameter %q at position %d must be a string, number or boolean", tok.text, tok.pos)
+	}
+
+	return nil, fmt.Errorf("expected value at position %d", tok.pos)
+}
+
+func isKeyword(ident string) bool {
+	switch strings.ToUpper(ident) {
+	case "AND", "OR", "NOT", "IN", "IS", "NULL", "TRUE", "FALSE":
+		return true
+	}
+	return false
+}
+
+// compare orders a column value against a literal.
+// It returns false when the two can't be compared, e.g. a string and a number
+// or anything against NULL, so such comparisons never match, like in SQL.
+func compare(column, literal interface{}) (int, bool) {
+	switch l := literal.(type) {
+	case json.Number:
+		c, ok := number(column)
+		if !ok {
+			return 0, false
+		}
+		return compareNumbers(c, l), true
+	case string:
+		c, ok := column.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(c, l), true
+	case bool:
+		c, ok := column.(bool)
+		if !ok || c != l {
+			return 1, ok
+		}
+		return 0, true
+	}
+
+	return 0, false
+}
+
+// number converts a decoded column value into a json.Number.
+func number(value interface{}) (json.Number, bool) {
+	switch v := value.(type) {
+	case json.Number:
+		return v, true
+	case float64:
+		return json.Number(strconv.FormatFloat(v, 'f', -1, 64)), true
+	case int:
+		return json.Number(strconv.Itoa(v)), true
+	case int64:
+		return json.Number(strconv.FormatInt(v, 10)), true
+	}
+
+	return "", false
+}
+
+// compareNumbers compares a and b exactly when both are integers, so bigint
+// columns past 2^53 still compare correctly, and as floats otherwise.
+func compareNumbers(a, b json.Number) int {
+	if x, err := a.Int64(); err == nil {
+		if y, err := b.Int64(); err == nil {
+			switch {
+			case x < y:
+				return -1
+			case x > y:
+				return 1
+			}
+			return 0
+		}
+	}
+
+	x, _ := a.Float64()
+	y, _ := b.Float64()
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
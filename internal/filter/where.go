@@ -0,0 +1,292 @@
+package filter
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// ParseWhere compiles PostgREST-style conditions into a Predicate matching
+// the rows meeting all of them. Conditions are separated by commas:
+//
+//	where     = condition { "," condition }
+//	condition = column "=" [ "not." ] operator "." value
+//	operator  = "eq" | "neq" | "gt" | "gte" | "lt" | "lte" | "like" | "ilike"
+//	          | "in" | "is"
+//
+// Values are text, compared as the column's type: status=eq.shipped,
+// total=gt.100 or paid=eq.true. They are double quoted to hold commas or
+// parentheses, with \" and \\ escapes. in takes a list, status=in.(a,b), is
+// takes null, true or false, and like and ilike patterns match any run of
+// characters with *.
+// It returns an error if any condition is outside of the grammar.
+func ParseWhere(where string) (Predicate, error) {
+	conditions, err := splitList(where)
+	if err != nil {
+		return nil, err
+	}
+
+	var predicates []Predicate
+	for _, condition := range conditions {
+		predicate, err := parseCondition(condition)
+		if err != nil {
+			return nil, fmt.Errorf("condition %q: %w", condition, err)
+		}
+		predicates = append(predicates, predicate)
+	}
+	if len(predicates) == 0 {
+		return nil, fmt.Errorf("expected a condition")
+	}
+
+	return func(row map[string]interface{}) bool {
+		for _, predicate := range predicates {
+			if !predicate(row) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+func parseCondition(condition string) (Predicate, error) {
+	column, rest, ok := strings.Cut(condition, "=")
+	if !ok || !validColumn(column) {
+		return nil, fmt.Errorf("expected column=operator.value")
+	}
+
+	negate := strings.HasPrefix(rest, "not.")
+	rest = strings.TrimPrefix(rest, "not.")
+
+	op, value, ok := strings.Cut(rest, ".")
+	if !ok {
+		return nil, fmt.Errorf("expected operator.value")
+	}
+
+	predicate, err := parseOperator(column, op, value)
+	if err != nil {
+		return nil, err
+	}
+	if negate {
+		return func(row map[string]interface{}) bool { return !predicate(row) }, nil
+	}
+	return predicate, nil
+}
+
+func parseOperator(column, op, value string) (Predicate, error) {
+	switch op {
+	case "eq", "neq", "gt", "gte", "lt", "lte":
+		text, err := unquote(value)
+		if err != nil {
+			return nil, err
+		}
+
+		return func(row map[string]interface{}) bool {
+			cmp, ok := compareText(row[column], text)
+			if !ok {
+				return false
+			}
+
+			switch op {
+			case "eq":
+				return cmp == 0
+			case "neq":
+				return cmp != 0
+			case "gt":
+				return cmp > 0
+			case "gte":
+				return cmp >= 0
+			case "lt":
+				return cmp < 0
+			default:
+				return cmp <= 0
+			}
+		}, nil
+	case "like", "ilike":
+		pattern, err := unquote(value)
+		if err != nil {
+			return nil, err
+		}
+		if op == "ilike" {
+			pattern = strings.ToLower(pattern)
+		}
+
+		return func(row map[string]interface{}) bool {
+			s, ok := row[column].(string)
+			if !ok {
+				return false
+			}
+			if op == "ilike" {
+				s = strings.ToLower(s)
+			}
+			return like(pattern, s)
+		}, nil
+	case "in":
+		if !strings.HasPrefix(value, "(") || !strings.HasSuffix(value, ")") {
+			return nil, fmt.Errorf("expected a list like in.(a,b)")
+		}
+		values, err := splitList(value[1 : len(value)-1])
+		if err != nil {
+			return nil, err
+		}
+		if len(values) == 0 {
+			return nil, fmt.Errorf("expected a value in the list")
+		}
+		for i := range values {
+			if values[i], err = unquote(values[i]); err != nil {
+				return nil, err
+			}
+		}
+
+		return func(row map[string]interface{}) bool {
+			for _, text := range values {
+				if cmp, ok := compareText(row[column], text); ok && cmp == 0 {
+					return true
+				}
+			}
+			return false
+		}, nil
+	case "is":
+		switch value {
+		case "null":
+			return func(row map[string]interface{}) bool { return row[column] == nil }, nil
+		case "true", "false":
+			want := value == "true"
+			return func(row map[string]interface{}) bool {
+				b, ok := row[column].(bool)
+				return ok && b == want
+			}, nil
+		}
+		return nil, fmt.Errorf("is expects null, true or false")
+	}
+
+	return nil, fmt.Errorf("unknown operator %q", op)
+}
+
+// compareText orders a column value against text read as the column's type.
+// It returns false when the text isn't of that type or the column is NULL,
+// so such comparisons never match.
+func compareText(column interface{}, text string) (int, bool) {
+	switch column.(type) {
+	case string:
+		return compare(column, text)
+	case bool:
+		b, err := strconv.ParseBool(text)
+		if err != nil {
+			return 0, false
+		}
+		return compare(column, b)
+	}
+
+	if _, err := strconv.ParseFloat(text, 64); err != nil {
+		return 0, false
+	}
+	return compare(column, json.Number(text))
+}
+
+// like reports whether s matches pattern, where * matches any run of
+// characters.
+func like(pattern, s string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return s == pattern
+	}
+
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+
+	last := parts[len(parts)-1]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(s, part)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(part):]
+	}
+	return strings.HasSuffix(s, last)
+}
+
+// splitList splits s on the commas outside of double quotes and
+// parentheses, ignoring empty items.
+func splitList(s string) ([]string, error) {
+	var items []string
+	depth, quoted, start := 0, false, 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quoted && c == '\\':
+			i++
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+		case c == '(':
+			depth++
+		case c == ')':
+			if depth--; depth < 0 {
+				return nil, fmt.Errorf("unexpected \")\" at position %d", i)
+			}
+		case c == ',' && depth == 0:
+			if item := strings.TrimSpace(s[start:i]); item != "" {
+				items = append(items, item)
+			}
+			start = i + 1
+		}
+	}
+	if quoted {
+		return nil, fmt.Errorf("unterminated quote")
+	}
+	if depth > 0 {
+		return nil, fmt.Errorf("unterminated \"(\"")
+	}
+
+	if item := strings.TrimSpace(s[start:]); item != "" {
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// unquote returns value, without its double quotes and escapes if it's
+// quoted.
+func unquote(value string) (string, error) {
+	if !strings.HasPrefix(value, "\"") {
+		if strings.ContainsAny(value, "\"(),") {
+			return "", fmt.Errorf("values holding quotes, commas or parentheses must be double quoted")
+		}
+		return value, nil
+	}
+
+	if len(value) < 2 || !strings.HasSuffix(value, "\"") {
+		return "", fmt.Errorf("unterminated quote")
+	}
+
+	var unquoted strings.Builder
+	for i := 1; i < len(value)-1; i++ {
+		c := value[i]
+		if c == '\\' {
+			if i++; i == len(value)-1 {
+				return "", fmt.Errorf("unterminated quote")
+			}
+			c = value[i]
+		} else if c == '"' {
+			return "", fmt.Errorf("unexpected quote")
+		}
+		unquoted.WriteByte(c)
+	}
+	return unquoted.String(), nil
+}
+
+// validColumn reports whether column is a top-level key of the row that
+// conditions can name.
+func validColumn(column string) bool {
+	if column == "" {
+		return false
+	}
+	for i, r := range column {
+		if !(r == '_' || unicode.IsLetter(r) || (i > 0 && unicode.IsDigit(r))) {
+			return false
+		}
+	}
+	return true
+}
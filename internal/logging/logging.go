@@ -0,0 +1,48 @@
+// Package logging builds the structured logger of pulse, configured by
+// LOG_LEVEL and LOG_FORMAT.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Formats of the log lines, picked with LOG_FORMAT
+const (
+	// FormatText writes key=value lines, it's the default
+	FormatText = "text"
+	// FormatJSON writes one JSON object per line
+	FormatJSON = "json"
+)
+
+// FromEnv returns the logger writing to stderr at LOG_LEVEL (debug, info,
+// the default, warn or error) in LOG_FORMAT.
+// It returns an error if either is invalid.
+func FromEnv() (*slog.Logger, error) {
+	return New(os.Stderr, os.Getenv("LOG_LEVEL"), os.Getenv("LOG_FORMAT"))
+}
+
+// New returns the logger writing to w the lines of level and above, in
+// format. Empty values pick the defaults.
+// It returns an error if either is invalid.
+func New(w io.Writer, level, format string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if level != "" {
+		if err := lvl.UnmarshalText([]byte(level)); err != nil {
+			return nil, fmt.Errorf("invalid LOG_LEVEL %q, must be debug, info, warn or error", level)
+		}
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl}
+	switch strings.ToLower(format) {
+	case "", FormatText:
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case FormatJSON:
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("invalid LOG_FORMAT %q, must be %s or %s", format, FormatText, FormatJSON)
+	}
+}
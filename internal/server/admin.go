@@ -0,0 +1,238 @@
+package server
+
+import (
+	"cmp"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"nhooyr.io/websocket"
+)
+
+// reasonAdmin is why the clients disconnected through the admin API are
+// closed.
+const reasonAdmin = "disconnected_by_admin"
+
+// rateWindow is how far back the event rates of the tables are averaged.
+const rateWindow = time.Minute
+
+// registerAdmin adds the /admin routes to e, behind token.
+func (s *Server) registerAdmin(e *echo.Echo, token string) {
+	admin := e.Group("/admin", middleware.KeyAuth(func(key string, c echo.Context) (bool, error) {
+		return subtle.ConstantTimeCompare([]byte(key), []byte(token)) == 1, nil
+	}))
+
+	admin.GET("/clients", s.adminClientsHandler)
+	admin.DELETE("/clients/:id", s.adminDisconnectHandler)
+	admin.GET("/tables", s.adminTablesHandler)
+	admin.GET("/databases", s.adminDatabasesHandler)
+	admin.POST("/sync", s.adminSyncHandler)
+}
+
+// adminClient describes a connected client and its subscription. Each
+// subscription of a /ws connection is a client of its own.
+type adminClient struct {
+	ID          uint64    `json:"id"`
+	RequestID   string    `json:"request_id,omitempty"`
+	ClientID    string    `json:"client_id,omitempty"`
+	Tables      []string  `json:"tables"`
+	IDs         []string  `json:"ids,omitempty"`
+	Operations  []string  `json:"operations,omitempty"`
+	Source      string    `json:"source,omitempty"`
+	Protocol    string    `json:"protocol"`
+	Encoding    string    `json:"encoding,omitempty"`
+	Queued      int       `json:"queued"`
+	QueueSize   int       `json:"queue_size"`
+	ConnectedAt time.Time `json:"connected_at"`
+}
+
+// adminClientsHandler lists the connected clients, oldest first.
+func (s *Server) adminClientsHandler(c echo.Context) error {
+	clients := []adminClient{}
+	s.clients.each(func(cli *client) {
+		clients = append(clients, adminClient{
+			ID:          cli.id,
+			RequestID:   cli.requestID,
+			ClientID:    cli.clientID,
+			Tables:      append([]string{}, cli.sub.tables...),
+			IDs:         cli.sub.ids,
+			Operations:  cli.sub.operations,
+			Source:      cli.sub.source,
+			Protocol:    cli.version,
+			Encoding:    cli.encoding,
+			Queued:      len(cli.send),
+			QueueSize:   cap(cli.send),
+			ConnectedAt: cli.connectedAt,
+		})
+	})
+
+	slices.SortFunc(clients, func(a, b adminClient) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+
+	return c.JSON(http.StatusOK, map[string][]adminClient{"clients": clients})
+}
+
+// adminDisconnectHandler closes the client of the given id right away, with
+// the disconnected_by_admin reason. What's queued for it is dropped.
+func (s *Server) adminDisconnectHandler(c echo.Context) error {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "id must be the id of a client")
+	}
+
+	cli, ok := s.clients.find(id)
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("no client with id %d", id))
+	}
+
+	requestLogger(c).Info("Disconnecting a client", "id", id, "client_request_id", cli.requestID)
+	cli.kick()
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// adminTable is the event rate of a table.
+type adminTable struct {
+	Table string `json:"table"`
+	// Total counts the notifications since the server started
+	Total int64 `json:"total"`
+	// PerSecond averages them over the last rateWindow
+	PerSecond float64 `json:"per_second"`
+}
+
+// adminTablesHandler lists the tables notifications went through with their
+// event rates, by name.
+func (s *Server) adminTablesHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, map[string][]adminTable{"tables": s.rates.snapshot(time.Now())})
+}
+
+// adminDatabase is the state of a database: its health, whether it's
+// watched, and the tables of its watched schemas that don't notify.
+type adminDatabase struct {
+	Source    string            `json:"source"`
+	Health    map[string]string `json:"health"`
+	Ready     bool              `json:"ready"`
+	Unwatched []string          `json:"unwatched"`
+	// Error tells why the unwatched tables couldn't be listed, if they
+	// couldn't
+	Error string `json:"error,omitempty"`
+}
+
+// adminDatabasesHandler reports the state of every database, in the order
+// they're configured. Unlike /health it answers 200 while one is down.
+func (s *Server) adminDatabasesHandler(c echo.Context) error {
+	databases := []adminDatabase{}
+	for _, db := range s.dbs {
+		health, _ := db.Health(c.Request().Context())
+		state := adminDatabase{Source: db.Source(), Health: health, Ready: db.Ready(), Unwatched: []string{}}
+
+		unwatched, err := db.Unwatched(c.Request().Context())
+		if err != nil {
+			requestLogger(c).Warn("Failed to list the unwatched tables", "source", db.Source(), "error", err)
+			state.Error = "could not list the unwatched tables"
+		} else if unwatched != nil {
+			state.Unwatched = unwatched
+		}
+		databases = append(databases, state)
+	}
+
+	return c.JSON(http.StatusOK, map[string][]adminDatabase{"databases": databases})
+}
+
+// adminSyncHandler syncs the triggers of every database again, e.g. after
+// tables were created.
+func (s *Server) adminSyncHandler(c echo.Context) error {
+	synced := []string{}
+	for _, db := range s.dbs {
+		if err := db.SyncTables(c.Request().Context()); err != nil {
+			requestLogger(c).Error("Failed to sync the tables", "source", db.Source(), "error", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("could not sync the tables of %s", db.Source()))
+		}
+		synced = append(synced, db.Source())
+	}
+
+	return c.JSON(http.StatusOK, map[string][]string{"synced": synced})
+}
+
+// kick makes the client's handler disconnect right away, dropping what's
+// queued. Unlike close it can be called from outside the Hub, any number of
+// times.
+func (c *client) kick() {
+	c.kickOnce.Do(func() { close(c.kicked) })
+}
+
+// kickedCode is the close code of the clients disconnected with kick.
+const kickedCode = websocket.StatusPolicyViolation
+
+// eventRates counts the notifications the Hub goes through by table, in
+// buckets of a second over the rateWindow.
+type eventRates struct {
+	mut    sync.Mutex
+	tables map[string]*tableRate
+}
+
+type tableRate struct {
+	total int64
+	// counts holds the notifications of each second of seconds, indexed by
+	// the Unix second modulo the window
+	counts  [int(rateWindow / time.Second)]int64
+	seconds [int(rateWindow / time.Second)]int64
+}
+
+func newEventRates() *eventRates {
+	return &eventRates{tables: make(map[string]*tableRate)}
+}
+
+// add counts a notification of table at now. Those of no table, like gaps,
+// aren't counted.
+func (r *eventRates) add(table string, now time.Time) {
+	if table == "" {
+		return
+	}
+
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	rate, ok := r.tables[table]
+	if !ok {
+		rate = &tableRate{}
+		r.tables[table] = rate
+	}
+
+	second := now.Unix()
+	i := second % int64(len(rate.counts))
+	if rate.seconds[i] != second {
+		rate.seconds[i], rate.counts[i] = second, 0
+	}
+	rate.counts[i]++
+	rate.total++
+}
+
+// snapshot returns the rate of every table as of now, by name.
+func (r *eventRates) snapshot(now time.Time) []adminTable {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	tables := make([]adminTable, 0, len(r.tables))
+	for table, rate := range r.tables {
+		var recent int64
+		for i, second := range rate.seconds {
+			if now.Unix()-second < int64(len(rate.seconds)) {
+				recent += rate.counts[i]
+			}
+		}
+		tables = append(tables, adminTable{Table: table, Total: rate.total, PerSecond: float64(recent) / rateWindow.Seconds()})
+	}
+
+	slices.SortFunc(tables, func(a, b adminTable) int {
+		return cmp.Compare(a.Table, b.Table)
+	})
+	return tables
+}
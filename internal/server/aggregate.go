@@ -0,0 +1,225 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+
+	"pulse/internal/database"
+)
+
+// defaultAggregateInterval is how often aggregating clients are sent the
+// value when it changed.
+const defaultAggregateInterval = time.Second
+
+// snapshotPage is how many rows are read at a time while seeding aggregates.
+const snapshotPage = 1000
+
+// aggregateInterval returns the push interval set by PULSE_AGGREGATE_INTERVAL.
+func aggregateInterval() time.Duration {
+	interval, err := time.ParseDuration(os.Getenv("PULSE_AGGREGATE_INTERVAL"))
+	if err != nil || interval <= 0 {
+		return defaultAggregateInterval
+	}
+
+	return interval
+}
+
+// aggregation is the function picked with ?aggregate=, count or sum(column).
+type aggregation struct {
+	function string
+	// column is summed, it's empty for count
+	column string
+}
+
+// parseAggregation parses count or sum(column).
+func parseAggregation(expr string) (*aggregation, error) {
+	expr = strings.TrimSpace(expr)
+	if expr == "count" {
+		return &aggregation{function: "count"}, nil
+	}
+
+	if column, ok := strings.CutPrefix(expr, "sum("); ok && strings.HasSuffix(column, ")") {
+		if column = strings.TrimSpace(strings.TrimSuffix(column, ")")); column != "" {
+			return &aggregation{function: "sum", column: column}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("aggregate must be count or sum(column)")
+}
+
+func (a aggregation) String() string {
+	if a.function == "sum" {
+		return "sum(" + a.column + ")"
+	}
+	return a.function
+}
+
+// aggregateMessage carries the current value of an aggregating subscription.
+// The value is exact, sums of bigint or numeric columns don't round.
+type aggregateMessage struct {
+	Operation string      `json:"operation"`
+	Table     string      `json:"table"`
+	Function  string      `json:"function"`
+	Value     json.Number `json:"value"`
+}
+
+// aggregator maintains the value of an aggregating subscription over the
+// rows matching it. It's only used by its client's handler.
+type aggregator struct {
+	sub   Subscription
+	value *big.Rat
+	// dirty is set when value changed since it was last sent
+	dirty bool
+	// seeded are the snapshots the value was seeded in, by source
+	seeded map[string]database.TxSnapshot
+}
+
+func newAggregator(sub Subscription) *aggregator {
+	return &aggregator{sub: sub, value: new(big.Rat)}
+}
+
+// seed computes the value over the current rows of the subscribed table,
+// read in a single snapshot per database. The changes queued meanwhile are
+// applied unless the snapshot already includes them, see apply.
+func (a *aggregator) seed(ctx context.Context, dbs []database.Service) error {
+	value := new(big.Rat)
+	seeded := make(map[string]database.TxSnapshot)
+	for _, db := range dbs {
+		if a.sub.source != "" && a.sub.source != db.Source() {
+			continue
+		}
+
+		snapshot, err := db.ScanTable(ctx, a.sub.table(), snapshotPage, func(rows []database.DBNotification) error {
+			for _, row := range rows {
+				if data, ok := row.Data.(map[string]interface{}); ok && allows(a.sub.ids, row.ID) && a.matches(data) {
+					value.Add(value, a.contribution(data))
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		seeded[db.Source()] = snapshot
+	}
+
+	a.value = value
+	a.seeded = seeded
+	a.dirty = true
+	return nil
+}
+
+// seen reports whether the value was seeded in a snapshot including msg.
+// Notifications outside of transactions, like published ones, never are.
+func (a *aggregator) seen(msg database.DBNotification) bool {
+	snapshot, ok := a.seeded[msg.Source]
+	return ok && msg.Txid != 0 && snapshot.Sees(msg.Txid)
+}
+
+// apply updates the value with msg, which went through the subscription.
+// Changes the seeded value includes already are skipped.
+// It returns false when msg can't be applied and the value must be seeded
+// again, like for gaps, bulk notifications or truncates.
+func (a *aggregator) apply(msg database.DBNotification) bool {
+	if a.seen(msg) {
+		return true
+	}
+	if msg.Gap() || msg.Bulk || msg.Operation == database.OperationTruncate {
+		return false
+	}
+
+	row, ok := msg.Data.(map[string]interface{})
+	if !ok {
+		return msg.Operation != "insert" && msg.Operation != "update" && msg.Operation != "delete"
+	}
+
+	value := new(big.Rat).Set(a.value)
+	switch msg.Operation {
+	case "insert":
+		if a.matches(row) {
+			value.Add(value, a.contribution(row))
+		}
+	case "delete":
+		if a.matches(row) {
+			value.Sub(value, a.contribution(row))
+		}
+	case "update":
+		// Updates from before old values were tracked can't be undone
+		if msg.Old == nil {
+			return false
+		}
+
+		// The update may move the row in or out of the filter
+		if before := previousRow(row, msg.Old); a.matches(before) {
+			value.Sub(value, a.contribution(before))
+		}
+		if a.matches(row) {
+			value.Add(value, a.contribution(row))
+		}
+	}
+
+	if value.Cmp(a.value) != 0 {
+		a.value = value
+		a.dirty = true
+	}
+	return true
+}
+
+// matches reports whether row passes the subscription's filter.
+func (a *aggregator) matches(row map[string]interface{}) bool {
+	return a.sub.filter == nil || a.sub.filter(row)
+}
+
+// contribution is what row adds to the value, non-numeric sums add nothing.
+// Numbers are read exactly, as the decimals Postgres formats them as.
+func (a *aggregator) contribution(row map[string]interface{}) *big.Rat {
+	if a.sub.aggregate.function == "count" {
+		return big.NewRat(1, 1)
+	}
+
+	switch value := row[a.sub.aggregate.column].(type) {
+	case json.Number:
+		if r, ok := new(big.Rat).SetString(value.String()); ok {
+			return r
+		}
+	case float64:
+		if r := new(big.Rat).SetFloat64(value); r != nil {
+			return r
+		}
+	}
+	return new(big.Rat)
+}
+
+// decimal formats r, a sum of decimals, with as many decimal places as it
+// takes to be exact.
+func decimal(r *big.Rat) string {
+	if r.IsInt() {
+		return r.Num().String()
+	}
+
+	// The denominator of a sum of decimals divides a power of ten, floats
+	// are sums of powers of two
+	places := 0
+	for p, rem := big.NewInt(1), new(big.Int); places < 1100; places++ {
+		if rem.Mod(p, r.Denom()).Sign() == 0 {
+			break
+		}
+		p.Mul(p, big.NewInt(10))
+	}
+	return r.FloatString(places)
+}
+
+// message returns the current value as sent to the client.
+func (a *aggregator) message() aggregateMessage {
+	return aggregateMessage{
+		Operation: "aggregate",
+		Table:     a.sub.table(),
+		Function:  a.sub.aggregate.String(),
+		Value:     json.Number(decimal(a.value)),
+	}
+}
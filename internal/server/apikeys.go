@@ -0,0 +1,163 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+
+	"pulse/internal/database"
+	"pulse/internal/filter"
+)
+
+// apiKeyHeader carries the API key of a subscriber, ?apikey= does too.
+const apiKeyHeader = "X-API-Key"
+
+// grantKey is where the grant of a subscriber authenticated by an API key is
+// kept in its request's echo.Context. It wins over the policies.
+const grantKey = "pulse.grant"
+
+// apiKeyNameKey is where the name of that key is kept.
+const apiKeyNameKey = "pulse.api_key"
+
+// APIKey grants the subscribers presenting Key every row of Tables. It's a
+// simpler alternative to JWTs for server to server subscribers.
+type APIKey struct {
+	// Name identifies the key in the logs
+	Name string `json:"name"`
+	Key  string `json:"key"`
+	// Tables are the tables granted, or anyTable for every table
+	Tables []string `json:"tables"`
+}
+
+// loadAPIKeys returns the API keys set by PULSE_API_KEYS, a JSON array like
+// [{"name": "billing", "key": "...", "tables": ["orders", "invoices"]}].
+// It returns an error if the variable isn't such an array, or a key is
+// unnamed, empty or given twice.
+func loadAPIKeys() ([]APIKey, error) {
+	raw := os.Getenv("PULSE_API_KEYS")
+	if raw == "" {
+		return nil, nil
+	}
+
+	var keys []APIKey
+	if err := json.Unmarshal([]byte(raw), &keys); err != nil {
+		return nil, fmt.Errorf("invalid PULSE_API_KEYS: %w", err)
+	}
+
+	seen := make(map[string]bool)
+	for i, key := range keys {
+		if key.Name == "" || key.Key == "" {
+			return nil, fmt.Errorf("invalid PULSE_API_KEYS: key %d must have a name and a key", i)
+		}
+		if seen[key.Key] {
+			return nil, fmt.Errorf("invalid PULSE_API_KEYS: key %q is given twice", key.Name)
+		}
+		seen[key.Key] = true
+
+		for _, table := range key.Tables {
+			if !validGrant(table) {
+				return nil, fmt.Errorf("invalid PULSE_API_KEYS: key %q: invalid table %q", key.Name, table)
+			}
+		}
+	}
+
+	return keys, nil
+}
+
+// apiKeyGrant returns the grant of every row of tables. Invalid tables, which
+// pulse_api_keys may hold, are left out.
+func apiKeyGrant(tables []string) *grant {
+	g := &grant{tables: make(map[string]filter.Predicate)}
+	for _, table := range tables {
+		if validGrant(table) {
+			g.tables[table] = nil
+		}
+	}
+	return g
+}
+
+// authenticate returns the middleware authenticating subscribers with an API
+// key, once PULSE_API_KEYS or PULSE_API_KEYS_TABLE is set, or with a JWT,
+// once PULSE_JWT_SECRET is. It's nil when neither is.
+// Subscribers presenting a key are granted its tables, the others need a
+// token when JWTs are enabled.
+func (s *Server) authenticate() echo.MiddlewareFunc {
+	tokenAuth := jwtAuth()
+	if len(s.apiKeys) == 0 && !s.apiKeysTable {
+		return tokenAuth
+	}
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		withToken := next
+		if tokenAuth != nil {
+			withToken = tokenAuth(next)
+		}
+
+		return func(c echo.Context) error {
+			key := c.Request().Header.Get(apiKeyHeader)
+			if key == "" {
+				key = c.QueryParam("apikey")
+			}
+			if key == "" {
+				if tokenAuth != nil {
+					return withToken(c)
+				}
+				return unauthorized(c, "missing API key")
+			}
+
+			name, tables, err := s.lookupAPIKey(c, key)
+			if errors.Is(err, database.ErrUnknownAPIKey) {
+				return unauthorized(c, "invalid API key")
+			}
+			if err != nil {
+				slog.Error("Failed to look up an API key", "error", err)
+				return echo.NewHTTPError(http.StatusServiceUnavailable, "unable to check the API key")
+			}
+
+			c.Set(grantKey, apiKeyGrant(tables))
+			c.Set(apiKeyNameKey, name)
+			c.Set(claimsKey, jwt.MapClaims{"api_key": name})
+			return next(c)
+		}
+	}
+}
+
+// lookupAPIKey returns the name and tables of key, looked up in
+// PULSE_API_KEYS and then in the pulse_api_keys table of every database.
+// It returns database.ErrUnknownAPIKey if none has it, or the error of a
+// database that couldn't be asked.
+func (s *Server) lookupAPIKey(c echo.Context, key string) (string, []string, error) {
+	// Comparing the digests takes as long whatever the keys' lengths
+	digest := sha256.Sum256([]byte(key))
+	for _, apiKey := range s.apiKeys {
+		want := sha256.Sum256([]byte(apiKey.Key))
+		if subtle.ConstantTimeCompare(digest[:], want[:]) == 1 {
+			return apiKey.Name, apiKey.Tables, nil
+		}
+	}
+
+	err := database.ErrUnknownAPIKey
+	if !s.apiKeysTable {
+		return "", nil, err
+	}
+
+	for _, db := range s.dbs {
+		apiKey, lookupErr := db.LookupAPIKey(c.Request().Context(), key)
+		switch {
+		case lookupErr == nil:
+			return apiKey.Name, apiKey.Tables, nil
+		case errors.Is(lookupErr, database.ErrUnknownAPIKey), errors.Is(lookupErr, database.ErrAPIKeysDisabled):
+		default:
+			err = lookupErr
+		}
+	}
+	return "", nil, err
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+)
+
+// claimsKey is where the verified claims of a subscriber are kept in its
+// request's echo.Context.
+const claimsKey = "pulse.claims"
+
+// jwtAuth returns the middleware authenticating subscribers with a JWT
+// signed with PULSE_JWT_SECRET, or nil when it's unset.
+// The token is read from the Authorization header or, since browsers can't
+// set headers on websockets, from ?access_token=. Tokens must be signed with
+// HMAC, have an expiry that hasn't passed and, when PULSE_JWT_ISSUER is set,
+// be issued by it.
+func jwtAuth() echo.MiddlewareFunc {
+	secret := os.Getenv("PULSE_JWT_SECRET")
+	if secret == "" {
+		return nil
+	}
+
+	parser := jwt.NewParser(jwtOptions(os.Getenv("PULSE_JWT_ISSUER"))...)
+	keyFunc := func(*jwt.Token) (interface{}, error) {
+		return []byte(secret), nil
+	}
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			raw := c.QueryParam("access_token")
+			if bearer, ok := strings.CutPrefix(c.Request().Header.Get(echo.HeaderAuthorization), "Bearer "); ok {
+				raw = bearer
+			}
+			if raw == "" {
+				return unauthorized(c, "missing token")
+			}
+
+			claims := jwt.MapClaims{}
+			if _, err := parser.ParseWithClaims(raw, claims, keyFunc); err != nil {
+				if errors.Is(err, jwt.ErrTokenInvalidIssuer) {
+					return unauthorized(c, "invalid token issuer")
+				}
+				return unauthorized(c, "invalid token")
+			}
+
+			c.Set(claimsKey, claims)
+			return next(c)
+		}
+	}
+}
+
+// jwtOptions are the checks of the tokens, besides their signature.
+func jwtOptions(issuer string) []jwt.ParserOption {
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{"HS256", "HS384", "HS512"}),
+		jwt.WithExpirationRequired(),
+	}
+	if issuer != "" {
+		options = append(options, jwt.WithIssuer(issuer))
+	}
+	return options
+}
+
+func unauthorized(c echo.Context, message string) error {
+	c.Response().Header().Set(echo.HeaderWWWAuthenticate, "Bearer")
+	return echo.NewHTTPError(http.StatusUnauthorized, message)
+}
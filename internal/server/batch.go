@@ -0,0 +1,139 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+// batchTransaction delivers the changes of a transaction together, picked
+// with ?batch=transaction.
+const batchTransaction = "transaction"
+
+const (
+	// transactionWait is how long the changes of a transaction wait for the
+	// next one before they're delivered. Postgres sends them all at commit,
+	// but tables take turns being fanned out
+	transactionWait = 50 * time.Millisecond
+	// maxTransactionBatch caps the changes delivered together, larger
+	// transactions are delivered in several batches
+	maxTransactionBatch = 1000
+)
+
+// Operations of the transactionMessages around a batch
+const (
+	operationBegin  = "begin"
+	operationCommit = "commit"
+)
+
+// transactionMessage precedes the changes of a batch, telling how many
+// follow, and ends them.
+type transactionMessage struct {
+	Operation string `json:"operation"`
+	Txid      int64  `json:"txid"`
+	Source    string `json:"source"`
+	Count     int    `json:"count,omitempty"`
+}
+
+// transactionBatch holds the changes of a transaction waiting to be
+// delivered.
+type transactionBatch struct {
+	txid    int64
+	source  string
+	changes []queued
+	// last is when its last change was queued
+	last time.Time
+}
+
+// batcher groups the notifications queued for a client by transaction, in
+// the order their transactions were first seen.
+type batcher struct {
+	pending []*transactionBatch
+}
+
+// add queues out with the changes of its transaction and returns the
+// batches ready to be delivered: the transaction's once it's full.
+func (b *batcher) add(out queued, now time.Time) []*transactionBatch {
+	var batch *transactionBatch
+	for _, pending := range b.pending {
+		if pending.txid == out.msg.Txid && pending.source == out.msg.Source {
+			batch = pending
+		}
+	}
+	if batch == nil {
+		batch = &transactionBatch{txid: out.msg.Txid, source: out.msg.Source}
+		b.pending = append(b.pending, batch)
+	}
+
+	batch.changes = append(batch.changes, out)
+	batch.last = now
+	if len(batch.changes) < maxTransactionBatch {
+		return nil
+	}
+
+	for i, pending := range b.pending {
+		if pending == batch {
+			b.pending = append(b.pending[:i], b.pending[i+1:]...)
+			break
+		}
+	}
+	return []*transactionBatch{batch}
+}
+
+// due returns the batches whose transaction got no change for
+// transactionWait, stopping at the first one still waiting so transactions
+// are delivered in order. The zero time returns them all.
+func (b *batcher) due(now time.Time) []*transactionBatch {
+	n := 0
+	for n < len(b.pending) && (now.IsZero() || now.Sub(b.pending[n].last) >= transactionWait) {
+		n++
+	}
+
+	due := b.pending[:n:n]
+	b.pending = b.pending[n:]
+	return due
+}
+
+// deliverBatches writes the changes of every batch to cli, each between a
+// begin and a commit message.
+// It returns false if the connection was closed as a result.
+func (s *Server) deliverBatches(cli *client, batches []*transactionBatch) bool {
+	for _, batch := range batches {
+		begin := transactionMessage{Operation: operationBegin, Txid: batch.txid, Source: batch.source, Count: len(batch.changes)}
+		if !writeMessage(cli, begin) {
+			return false
+		}
+
+		for _, out := range batch.changes {
+			if !s.deliver(cli, out.msg, out.shared) {
+				return false
+			}
+			observeLatency(out.msg)
+		}
+
+		commit := transactionMessage{Operation: operationCommit, Txid: batch.txid, Source: batch.source}
+		if !writeMessage(cli, commit) {
+			return false
+		}
+	}
+	return true
+}
+
+// writeMessage writes msg to cli as JSON.
+// It returns false if the connection was closed as a result.
+func writeMessage(cli *client, msg interface{}) bool {
+	jsonData, _ := json.Marshal(msg)
+
+	ctx, cancel := context.WithTimeout(cli.ctx, cli.writeTimeout)
+	defer cancel()
+
+	if err := cli.conn.Write(ctx, websocket.MessageText, jsonData); err != nil {
+		logWriteError(err)
+
+		disconnect(cli.conn, websocket.StatusGoingAway, reasonWriteFailed)
+		return false
+	}
+	return true
+}
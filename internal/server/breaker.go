@@ -0,0 +1,90 @@
+package server
+
+import (
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// breaker is a circuit breaker over websocket writes.
+// When too many of the recent writes failed it opens and the Hub stops
+// delivering until cooldown has passed, then it lets notifications through
+// again to probe whether the clients recovered.
+type breaker struct {
+	mut sync.Mutex
+
+	// threshold is the failure rate, between 0 and 1, that opens the breaker
+	threshold float64
+	// minWrites is the number of writes in window needed to evaluate the rate
+	minWrites int
+	window    time.Duration
+	cooldown  time.Duration
+
+	windowStart time.Time
+	writes      int
+	failures    int
+	openUntil   time.Time
+}
+
+// newBreaker creates a breaker configured by PULSE_BREAKER_THRESHOLD and
+// PULSE_BREAKER_COOLDOWN, defaulting to 0.5 and 5s.
+func newBreaker() *breaker {
+	b := &breaker{
+		threshold: 0.5,
+		minWrites: 10,
+		window:    time.Second,
+		cooldown:  5 * time.Second,
+	}
+
+	if threshold, err := strconv.ParseFloat(os.Getenv("PULSE_BREAKER_THRESHOLD"), 64); err == nil {
+		b.threshold = threshold
+	}
+
+	if cooldown, err := time.ParseDuration(os.Getenv("PULSE_BREAKER_COOLDOWN")); err == nil {
+		b.cooldown = cooldown
+	}
+
+	return b
+}
+
+// allow reports whether notifications should be delivered right now.
+func (b *breaker) allow() bool {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+
+	return !time.Now().Before(b.openUntil)
+}
+
+// record accounts for the result of a single write, opening the breaker if
+// the failure rate in the current window crosses the threshold.
+func (b *breaker) record(failed bool) {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+
+	now := time.Now()
+	if now.Sub(b.windowStart) > b.window {
+		b.windowStart = now
+		b.writes = 0
+		b.failures = 0
+	}
+
+	b.writes++
+	if failed {
+		b.failures++
+	}
+
+	if now.Before(b.openUntil) || b.writes < b.minWrites {
+		return
+	}
+
+	if rate := float64(b.failures) / float64(b.writes); rate > b.threshold {
+		slog.Warn("Circuit breaker open, pausing broadcast", "failures", b.failures, "writes", b.writes, "cooldown", b.cooldown)
+
+		b.openUntil = now.Add(b.cooldown)
+		b.windowStart = b.openUntil
+		b.writes = 0
+		b.failures = 0
+	}
+}
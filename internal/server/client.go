@@ -0,0 +1,199 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"nhooyr.io/websocket"
+
+	"pulse/internal/database"
+)
+
+// Strategies for a client whose send queue is full, picked with ?overflow=
+const (
+	// overflowDisconnect evicts the client, it's the default
+	overflowDisconnect = "disconnect"
+	// overflowDropOldest discards the oldest queued notification
+	overflowDropOldest = "drop_oldest"
+	// overflowDropNewest discards the notification being queued
+	overflowDropNewest = "drop_newest"
+)
+
+// defaultQueueSize is the number of notifications a client can fall behind
+// by before its overflow strategy kicks in.
+const defaultQueueSize = 64
+
+// defaultWriteTimeout bounds how long a single write to a client can take.
+const defaultWriteTimeout = 10 * time.Second
+
+type client struct {
+	conn conn
+
+	sub      Subscription
+	clientID string
+	// identity is who the client is, its saved subscription is theirs only
+	identity string
+	// shard is the part of the registry holding the client once registered
+	shard *registryShard
+	// id identifies the client in the admin API, it's assigned along with
+	// connectedAt when it's registered
+	id          uint64
+	connectedAt time.Time
+	// requestID is the X-Request-ID of the request that opened the connection
+	requestID string
+	version   string
+	envelope  string
+	// encoding is the binary encoding of the notifications, empty for JSON
+	encoding string
+	overflow string
+	// session encrypts the data sent with ?encrypt=true, nil otherwise
+	session *session
+	// aggregator replaces the notifications with ?aggregate=, nil otherwise
+	aggregator *aggregator
+	// batcher groups the notifications by transaction with
+	// ?batch=transaction, nil otherwise
+	batcher *batcher
+	// limiter caps the updates delivered with ?max_rate=, nil otherwise
+	limiter *rateLimiter
+	// debouncer coalesces the updates of each row with ?coalesce=, nil
+	// otherwise
+	debouncer *debouncer
+	// heartbeat is how often a heartbeat message is sent with ?heartbeat=,
+	// zero for never
+	heartbeat time.Duration
+	// grant is what the client's claims allow it to receive, nil allows all
+	grant *grant
+	// claims are the client's claims as a JSON object, the visibility
+	// checks run with them
+	claims string
+	// since is when the replay of persisted notifications starts, if set
+	since time.Time
+	// replayed is the last persisted notification replayed of each source,
+	// the live ones up to it were delivered already
+	replayed map[string]int64
+	// snapshot is sent before the live notifications, nil if not asked for
+	snapshot *snapshotRequest
+	// resume delivers the notifications numbered after after first, the
+	// live ones up to it were delivered already
+	resume bool
+	after  int64
+
+	// send queues the notifications for the client's handler to write.
+	// Only the Hub sends to it, it's closed to make the handler disconnect.
+	send chan queued
+	// closeCode and closeReason are set right before send is closed
+	closeCode   websocket.StatusCode
+	closeReason string
+	// kicked is closed to make the handler disconnect right away, see kick
+	kicked   chan struct{}
+	kickOnce sync.Once
+
+	// ctx bounds the writes to the client, cancel aborts a stuck one
+	ctx          context.Context
+	cancel       context.CancelFunc
+	writeTimeout time.Duration
+}
+
+// logger returns the logger of the lines about c, telling which client and
+// request they're about.
+func (c *client) logger() *slog.Logger {
+	logger := slog.Default()
+	if c.requestID != "" {
+		logger = logger.With("request_id", c.requestID)
+	}
+	if c.clientID != "" {
+		logger = logger.With("client_id", c.clientID)
+	}
+	return logger
+}
+
+// queued is a notification in a client's send queue.
+type queued struct {
+	msg database.DBNotification
+	// shared caches the encodings of msg for the other clients it was
+	// queued to as is, nil if the client's subscription reshaped it
+	shared *encodings
+}
+
+// defaultPingInterval is how often idle websockets are pinged.
+const defaultPingInterval = 5 * time.Second
+
+// queueSize returns the send queue size set by PULSE_CLIENT_QUEUE_SIZE.
+func queueSize() int {
+	size, err := strconv.Atoi(os.Getenv("PULSE_CLIENT_QUEUE_SIZE"))
+	if err != nil || size < 1 {
+		return defaultQueueSize
+	}
+
+	return size
+}
+
+// writeTimeout returns the write timeout set by PULSE_WRITE_TIMEOUT.
+func writeTimeout() time.Duration {
+	timeout, err := time.ParseDuration(os.Getenv("PULSE_WRITE_TIMEOUT"))
+	if err != nil || timeout <= 0 {
+		return defaultWriteTimeout
+	}
+
+	return timeout
+}
+
+// pingInterval returns the websocket ping interval set by PULSE_PING_INTERVAL.
+func pingInterval() time.Duration {
+	interval, err := time.ParseDuration(os.Getenv("PULSE_PING_INTERVAL"))
+	if err != nil || interval <= 0 {
+		return defaultPingInterval
+	}
+
+	return interval
+}
+
+// enqueue queues msg, applying the overflow strategy if the queue is full.
+// It returns false when the client should be evicted instead.
+func (c *client) enqueue(msg queued) bool {
+	select {
+	case c.send <- msg:
+		return true
+	default:
+	}
+
+	switch c.overflow {
+	case overflowDropNewest:
+		droppedNotifications.WithLabelValues(dropQueueFull).Inc()
+		return true
+	case overflowDropOldest:
+		droppedNotifications.WithLabelValues(dropQueueFull).Inc()
+		select {
+		case <-c.send:
+		default:
+		}
+
+		select {
+		case c.send <- msg:
+		default:
+		}
+		return true
+	}
+
+	return false
+}
+
+// ping pings the client and waits for the pong, for at most its write timeout.
+func (c *client) ping() error {
+	ctx, cancel := context.WithTimeout(c.ctx, c.writeTimeout)
+	defer cancel()
+
+	return c.conn.Ping(ctx)
+}
+
+// close makes the client's handler disconnect with code and reason once it
+// has written what's already queued.
+func (c *client) close(code websocket.StatusCode, reason string) {
+	c.closeCode = code
+	c.closeReason = reason
+	close(c.send)
+}
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+
+	"pulse/internal/database"
+)
+
+// rowKey identifies the row a notification is about.
+type rowKey struct {
+	source string
+	schema string
+	table  string
+	id     string
+}
+
+func keyOf(msg database.DBNotification) rowKey {
+	return rowKey{source: msg.Source, schema: msg.Schema, table: msg.Table, id: msg.ID}
+}
+
+// coalescable reports whether msg can be merged with the other updates of
+// its row: bulk notifications and rows without an id can't.
+func coalescable(msg database.DBNotification) bool {
+	return msg.Operation == "update" && !msg.Bulk && msg.ID != ""
+}
+
+// pendingUpdate is the latest state of a row waiting to be delivered.
+type pendingUpdate struct {
+	out queued
+	// since is when the first of the updates merged into it was queued
+	since time.Time
+}
+
+// coalescer holds the updates of a client waiting to be delivered, merging
+// those of the same row, in the order their rows were first held.
+type coalescer struct {
+	pending []*pendingUpdate
+	rows    map[rowKey]*pendingUpdate
+}
+
+func newCoalescer() *coalescer {
+	return &coalescer{rows: map[rowKey]*pendingUpdate{}}
+}
+
+// hold keeps the update out until it's taken, merged into the one of its
+// row already held if any.
+func (c *coalescer) hold(out queued, now time.Time) {
+	key := keyOf(out.msg)
+	if held, ok := c.rows[key]; ok {
+		held.out = queued{msg: mergeUpdates(held.out.msg, out.msg)}
+		return
+	}
+
+	held := &pendingUpdate{out: out, since: now}
+	c.pending = append(c.pending, held)
+	c.rows[key] = held
+}
+
+// take returns the update held for the row of msg, if any, so it's
+// delivered before msg.
+func (c *coalescer) take(msg database.DBNotification) (queued, bool) {
+	key := keyOf(msg)
+	held, ok := c.rows[key]
+	if !ok {
+		return queued{}, false
+	}
+
+	delete(c.rows, key)
+	for i, pending := range c.pending {
+		if pending == held {
+			c.pending = append(c.pending[:i], c.pending[i+1:]...)
+			break
+		}
+	}
+	return held.out, true
+}
+
+// next returns the update held the longest, if any, and when it was first
+// held.
+func (c *coalescer) next() (*pendingUpdate, bool) {
+	if len(c.pending) == 0 {
+		return nil, false
+	}
+	return c.pending[0], true
+}
+
+// pop takes the update held the longest.
+func (c *coalescer) pop() queued {
+	held := c.pending[0]
+	c.pending = c.pending[1:]
+	delete(c.rows, keyOf(held.out.msg))
+	return held.out
+}
+
+// mergeUpdates returns the update of a row standing for prev followed by
+// next: next's row, the columns changed by either with their values from
+// before prev, and a patch replacing them all.
+func mergeUpdates(prev, next database.DBNotification) database.DBNotification {
+	merged := next
+
+	if prev.Changed != nil && next.Changed != nil {
+		merged.Changed = append([]string{}, prev.Changed...)
+		for _, column := range next.Changed {
+			if !contains(merged.Changed, column) {
+				merged.Changed = append(merged.Changed, column)
+			}
+		}
+	} else {
+		// Either can't tell which columns changed
+		merged.Changed = nil
+	}
+
+	if prev.Old != nil && next.Old != nil {
+		merged.Old = make(map[string]interface{}, len(prev.Old)+len(next.Old))
+		for column, value := range next.Old {
+			merged.Old[column] = value
+		}
+		for column, value := range prev.Old {
+			merged.Old[column] = value
+		}
+	} else {
+		merged.Old = nil
+	}
+
+	if prev.Patch != nil && next.Patch != nil {
+		merged.Patch = append([]database.PatchOperation{}, prev.Patch...)
+		for _, op := range next.Patch {
+			replaced := false
+			for i := range merged.Patch {
+				if merged.Patch[i].Path == op.Path {
+					merged.Patch[i] = op
+					replaced = true
+				}
+			}
+			if !replaced {
+				merged.Patch = append(merged.Patch, op)
+			}
+		}
+	} else {
+		// The row is sent whole
+		merged.Patch = nil
+	}
+
+	return merged
+}
+
+// maxCoalesceWindow bounds ?coalesce=, so updates aren't held indefinitely.
+const maxCoalesceWindow = time.Minute
+
+// debouncer holds the updates of a client for the ?coalesce= window, then
+// delivers the latest of each row.
+type debouncer struct {
+	window time.Duration
+	held   *coalescer
+}
+
+// parseCoalesce returns the debouncer asked for by ?coalesce=, nil if none is.
+// It returns an error if the window is invalid.
+func parseCoalesce(query url.Values) (*debouncer, error) {
+	coalesce := query.Get("coalesce")
+	if coalesce == "" {
+		return nil, nil
+	}
+
+	window, err := time.ParseDuration(coalesce)
+	if err != nil || window <= 0 || window > maxCoalesceWindow {
+		return nil, fmt.Errorf("coalesce must be a duration up to %s", maxCoalesceWindow)
+	}
+
+	return &debouncer{window: window, held: newCoalescer()}, nil
+}
+
+// tick is how often the held updates are looked at.
+func (d *debouncer) tick() time.Duration {
+	return max(d.window/4, minRateTick)
+}
+
+// admit returns the notifications to deliver now that out was queued, in
+// order: the held updates whose window is over, then out unless it's held.
+// Other operations are delivered right after the update held for their row,
+// or all of them for notifications about no row, like gaps.
+func (d *debouncer) admit(out queued, now time.Time) []queued {
+	ready := d.due(now)
+
+	if coalescable(out.msg) {
+		d.held.hold(out, now)
+		return ready
+	}
+
+	if out.msg.ID == "" {
+		for {
+			if _, ok := d.held.next(); !ok {
+				break
+			}
+			ready = append(ready, d.held.pop())
+		}
+	} else if held, ok := d.held.take(out.msg); ok {
+		ready = append(ready, held)
+	}
+	return append(ready, out)
+}
+
+// due returns the held updates whose window is over, the longest held first.
+func (d *debouncer) due(now time.Time) []queued {
+	var ready []queued
+	for {
+		held, ok := d.held.next()
+		if !ok || now.Sub(held.since) < d.window {
+			break
+		}
+		ready = append(ready, d.held.pop())
+	}
+	return ready
+}
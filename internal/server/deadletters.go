@@ -0,0 +1,103 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"pulse/internal/database"
+)
+
+// deadLetterQueueSize is how many dead letters wait to be stored before the
+// next ones are dropped.
+const deadLetterQueueSize = 1024
+
+var droppedDeadLetters = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "pulse_dead_letters_dropped_total",
+	Help: "Dead letters dropped because too many were waiting to be stored, by reason.",
+}, []string{"reason"})
+
+// deadLetter is a notification that couldn't be delivered for reason, to be
+// stored by the dead letter sink of db.
+type deadLetter struct {
+	db     database.Service
+	reason string
+	msg    database.DBNotification
+}
+
+// deadLetterQueue stores dead letters in the background, one at a time, so
+// a slow sink holds up neither the Hub nor the clients.
+type deadLetterQueue struct {
+	mut    sync.Mutex
+	closed bool
+	queue  chan deadLetter
+	done   chan struct{}
+
+	// ctx is cancelled once Shutdown gives up on the dead letters left
+	ctx  context.Context
+	stop context.CancelFunc
+}
+
+func newDeadLetterQueue(size int) *deadLetterQueue {
+	ctx, stop := context.WithCancel(context.Background())
+	q := &deadLetterQueue{
+		queue: make(chan deadLetter, size),
+		done:  make(chan struct{}),
+		ctx:   ctx,
+		stop:  stop,
+	}
+	go q.run()
+	return q
+}
+
+func (q *deadLetterQueue) run() {
+	defer close(q.done)
+
+	for dl := range q.queue {
+		if q.ctx.Err() != nil {
+			droppedDeadLetters.WithLabelValues(dl.reason).Inc()
+			continue
+		}
+		if err := dl.db.DeadLetter(q.ctx, dl.reason, dl.msg); err != nil {
+			slog.Error("Failed to dead-letter a notification", "operation", dl.msg.Operation, "table", dl.msg.Table, "error", err)
+		}
+	}
+}
+
+// push queues dl without waiting. If the queue is full or closed, dl is
+// dropped and counted instead, and push returns false.
+func (q *deadLetterQueue) push(dl deadLetter) bool {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+
+	if !q.closed {
+		select {
+		case q.queue <- dl:
+			return true
+		default:
+		}
+	}
+	droppedDeadLetters.WithLabelValues(dl.reason).Inc()
+	return false
+}
+
+// close stores the dead letters already queued, until ctx expires, after
+// which those left are dropped.
+func (q *deadLetterQueue) close(ctx context.Context) {
+	q.mut.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.queue)
+	}
+	q.mut.Unlock()
+
+	select {
+	case <-q.done:
+	case <-ctx.Done():
+		q.stop()
+		<-q.done
+	}
+}
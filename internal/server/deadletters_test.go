@@ -0,0 +1,88 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"pulse/internal/database"
+)
+
+// blockedSink is a database whose dead letter sink hangs until released.
+type blockedSink struct {
+	database.Service
+	release chan struct{}
+	stored  chan string
+}
+
+func (b *blockedSink) DeadLetter(ctx context.Context, reason string, n database.DBNotification) error {
+	select {
+	case <-b.release:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	b.stored <- n.ID
+	return nil
+}
+
+func TestDeadLetterQueueDropsInsteadOfWaiting(t *testing.T) {
+	db := &blockedSink{release: make(chan struct{}), stored: make(chan string, 10)}
+	q := newDeadLetterQueue(1)
+
+	// A hanging sink fills the queue, after which push drops without waiting
+	done := make(chan int)
+	go func() {
+		queued := 0
+		for i := 0; i < 10; i++ {
+			if q.push(deadLetter{db: db, reason: reasonBreakerOpen, msg: database.DBNotification{ID: "1"}}) {
+				queued++
+			}
+		}
+		done <- queued
+	}()
+
+	var queued int
+	select {
+	case queued = <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("push waited for the dead letter sink")
+	}
+	if queued > 2 {
+		t.Errorf("%d dead letters queued, expected at most 2 with a queue of 1", queued)
+	}
+
+	// Close stores what was queued
+	close(db.release)
+	q.close(context.Background())
+	if len(db.stored) != queued {
+		t.Errorf("%d dead letters stored, expected the %d queued", len(db.stored), queued)
+	}
+	if q.push(deadLetter{db: db, reason: reasonBreakerOpen}) {
+		t.Errorf("push queued a dead letter after close")
+	}
+}
+
+func TestDeadLetterQueueCloseGivesUpWithItsContext(t *testing.T) {
+	db := &blockedSink{release: make(chan struct{}), stored: make(chan string, 10)}
+	q := newDeadLetterQueue(4)
+	for i := 0; i < 4; i++ {
+		q.push(deadLetter{db: db, reason: reasonBreakerOpen})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	closed := make(chan struct{})
+	go func() {
+		q.close(ctx)
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatalf("close waited for the dead letter sink past its context")
+	}
+	if len(db.stored) != 0 {
+		t.Errorf("%d dead letters stored by a hanging sink", len(db.stored))
+	}
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"sync"
+
+	"pulse/internal/database"
+)
+
+// dedupSize is how many recent row changes a client remembers with ?dedup=true
+const dedupSize = 1024
+
+// dedupKey identifies a single row change.
+type dedupKey struct {
+	table     string
+	id        string
+	operation string
+	txid      int64
+}
+
+// dedup drops notifications already seen among the last dedupSize ones.
+// Several changes to the same row within a transaction share a key, so only
+// the first of them gets through.
+type dedup struct {
+	mut   sync.Mutex
+	seen  map[dedupKey]bool
+	order []dedupKey
+	next  int
+}
+
+func newDedup() *dedup {
+	return &dedup{
+		seen:  make(map[dedupKey]bool, dedupSize),
+		order: make([]dedupKey, 0, dedupSize),
+	}
+}
+
+// clone returns a copy of d, remembering the same changes. It's nil if d is.
+func (d *dedup) clone() *dedup {
+	if d == nil {
+		return nil
+	}
+
+	d.mut.Lock()
+	defer d.mut.Unlock()
+
+	c := &dedup{
+		seen:  make(map[dedupKey]bool, dedupSize),
+		order: append(make([]dedupKey, 0, dedupSize), d.order...),
+		next:  d.next,
+	}
+	for key := range d.seen {
+		c.seen[key] = true
+	}
+	return c
+}
+
+// duplicate reports whether msg was already seen, remembering it otherwise.
+// Notifications without a transaction, like published events, are never
+// duplicates.
+func (d *dedup) duplicate(msg database.DBNotification) bool {
+	if msg.Txid == 0 {
+		return false
+	}
+
+	key := dedupKey{table: msg.Table, id: msg.ID, operation: msg.Operation, txid: msg.Txid}
+
+	d.mut.Lock()
+	defer d.mut.Unlock()
+
+	if d.seen[key] {
+		return true
+	}
+
+	// Forget the oldest key once full
+	if len(d.order) < dedupSize {
+		d.order = append(d.order, key)
+	} else {
+		delete(d.seen, d.order[d.next])
+		d.order[d.next] = key
+		d.next = (d.next + 1) % dedupSize
+	}
+	d.seen[key] = true
+
+	return false
+}
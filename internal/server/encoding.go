@@ -0,0 +1,133 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strconv"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"pulse/internal/database"
+	"pulse/proto/pulsev2"
+)
+
+// Encodings of the notifications, picked with ?encoding=. The binary ones are
+// sent in binary messages, control messages stay JSON text messages.
+const (
+	encodingJSON = "json"
+	// encodingMsgpack is MessagePack, in the shape of the JSON encoding
+	encodingMsgpack = "msgpack"
+	// encodingProtobuf is the Notification message of proto/pulse.proto
+	encodingProtobuf = "protobuf"
+)
+
+func init() {
+	// JSON numbers stay integers when they are
+	msgpack.Register(json.Number(""), func(e *msgpack.Encoder, v reflect.Value) error {
+		n := json.Number(v.String())
+		if i, err := n.Int64(); err == nil {
+			return e.EncodeInt(i)
+		}
+		if u, err := strconv.ParseUint(string(n), 10, 64); err == nil {
+			return e.EncodeUint(u)
+		}
+		f, err := n.Float64()
+		if err != nil {
+			return err
+		}
+		return e.EncodeFloat64(f)
+	}, nil)
+}
+
+// encodeMsgpack converts the JSON encoding of a notification into
+// MessagePack. Integers stay integers, object keys are sorted.
+func encodeMsgpack(jsonData []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(jsonData))
+	decoder.UseNumber()
+
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	b.Grow(len(jsonData))
+	encoder := msgpack.NewEncoder(&b)
+	encoder.SetSortMapKeys(true)
+	if err := encoder.Encode(value); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// protoMarshal sorts the keys of Structs, so a notification always
+// encodes the same.
+var protoMarshal = proto.MarshalOptions{Deterministic: true}
+
+// encodeProtobuf marshals msg as a Notification message. pulse.v1 only has
+// the operation, table, id, seq, ts and data, and data is left out of
+// patches like in JSON.
+func encodeProtobuf(msg database.DBNotification, version string) ([]byte, error) {
+	data, err := protoValue(msg.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	n := &pulsev2.Notification{Operation: msg.Operation, Table: msg.Table, Id: msg.ID, Seq: msg.Seq, Data: data}
+	if !msg.EmittedAt.IsZero() {
+		n.Ts = timestamppb.New(msg.EmittedAt)
+	}
+	if version == protocolV1 {
+		return protoMarshal.Marshal(n)
+	}
+
+	n.Schema = msg.Schema
+	n.Txid = msg.Txid
+	n.Source = msg.Source
+	n.Changed = msg.Changed
+	if msg.Patch != nil {
+		n.Data = nil
+	}
+	if msg.Old != nil {
+		old, err := protoValue(msg.Old)
+		if err != nil {
+			return nil, err
+		}
+		n.Old = old.GetStructValue()
+	}
+	for _, op := range msg.Patch {
+		value, err := protoValue(op.Value)
+		if err != nil {
+			return nil, err
+		}
+		n.Patch = append(n.Patch, &pulsev2.PatchOperation{Op: op.Op, Path: op.Path, Value: value})
+	}
+	n.Bulk = msg.Bulk
+	n.Count = msg.Count
+	n.Ids = msg.IDs
+	n.TraceId = msg.TraceID
+
+	return protoMarshal.Marshal(n)
+}
+
+// protoValue converts value to a google.protobuf.Value. Numbers are doubles,
+// values other than those JSON decodes to go through JSON first.
+func protoValue(value interface{}) (*structpb.Value, error) {
+	if v, err := structpb.NewValue(value); err == nil {
+		return v, nil
+	}
+
+	jsonData, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var decoded interface{}
+	if err := json.Unmarshal(jsonData, &decoded); err != nil {
+		return nil, err
+	}
+	return structpb.NewValue(decoded)
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+
+	"pulse/internal/database"
+	"pulse/proto/pulsev2"
+)
+
+// decodeMsgpack decodes b, its numbers as json.Numbers like the JSON
+// decoder with UseNumber.
+func decodeMsgpack(t *testing.T, b []byte) interface{} {
+	t.Helper()
+
+	decoder := msgpack.NewDecoder(bytes.NewReader(b))
+	decoder.UseLooseInterfaceDecoding(true)
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		t.Fatalf("MessagePack decode error = %v", err)
+	}
+	if _, err := decoder.PeekCode(); err != io.EOF {
+		t.Errorf("bytes left after the notification")
+	}
+
+	var numbers func(value interface{}) interface{}
+	numbers = func(value interface{}) interface{} {
+		switch v := value.(type) {
+		case int64:
+			return json.Number(strconv.FormatInt(v, 10))
+		case uint64:
+			return json.Number(strconv.FormatUint(v, 10))
+		case float64:
+			return json.Number(strconv.FormatFloat(v, 'f', -1, 64))
+		case []interface{}:
+			for i, item := range v {
+				v[i] = numbers(item)
+			}
+		case map[string]interface{}:
+			for key, item := range v {
+				v[key] = numbers(item)
+			}
+		}
+		return value
+	}
+	return numbers(value)
+}
+
+func TestEncodeMsgpack(t *testing.T) {
+	wide := map[string]interface{}{}
+	var list []interface{}
+	for i := 0; i < 20; i++ {
+		wide[fmt.Sprint("column_", i)] = float64(i)
+		list = append(list, strings.Repeat("x", i*20))
+	}
+
+	msg := database.DBNotification{
+		Operation: "update",
+		Table:     "orders",
+		ID:        "1",
+		Txid:      -1,
+		Source:    "fake",
+		EmittedAt: time.Unix(1700000000, 0).UTC(),
+		Data: map[string]interface{}{
+			"small":    float64(-20),
+			"negative": float64(-200),
+			"big":      json.Number("9007199254740993"),
+			"huge":     json.Number("18446744073709551615"),
+			"ratio":    1.5,
+			"paid":     true,
+			"coupon":   nil,
+			"long":     strings.Repeat("y", 70000),
+			"list":     list,
+			"wide":     wide,
+		},
+	}
+
+	jsonData, err := encode(msg, protocolV2, "", "")
+	if err != nil {
+		t.Fatalf("encode error = %v", err)
+	}
+	data, err := encode(msg, protocolV2, "", encodingMsgpack)
+	if err != nil {
+		t.Fatalf("encode error = %v", err)
+	}
+	if len(data) >= len(jsonData) {
+		t.Errorf("MessagePack is %d bytes, expected less than the %d of JSON", len(data), len(jsonData))
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(jsonData))
+	decoder.UseNumber()
+	var expected interface{}
+	decoder.Decode(&expected)
+
+	// Object keys are sorted
+	if !bytes.Contains(data, []byte("\xa6coupon\xc0\xa4huge\xcf\xff\xff\xff\xff\xff\xff\xff\xff\xa4list")) {
+		t.Errorf("MessagePack = % x, expected the keys of data sorted and huge an unsigned integer", data)
+	}
+
+	actual := decodeMsgpack(t, data)
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("MessagePack decodes to %v, expected %v", actual, expected)
+	}
+}
+
+func TestEncodeProtobuf(t *testing.T) {
+	msg := database.DBNotification{Operation: "insert", Table: "t", ID: "1", Source: "fake", Data: map[string]interface{}{"a": true}}
+
+	data, err := encode(msg, protocolV1, "", encodingProtobuf)
+	if err != nil {
+		t.Fatalf("encode error = %v", err)
+	}
+
+	// operation, table, id, then data as a Struct of a: true
+	expected := []byte{0x0a, 6, 'i', 'n', 's', 'e', 'r', 't', 0x12, 1, 't', 0x22, 1, '1', 0x52, 11, 0x2a, 9, 0x0a, 7, 0x0a, 1, 'a', 0x12, 2, 0x20, 1}
+	if !bytes.Equal(data, expected) {
+		t.Errorf("pulse.v1 encoding = % x, expected % x", data, expected)
+	}
+
+	// pulse.v1 carries seq and ts too
+	msg.Seq, msg.EmittedAt = 3, time.Unix(1700000000, 0).UTC()
+	data, err = encode(msg, protocolV1, "", encodingProtobuf)
+	if err != nil {
+		t.Fatalf("encode error = %v", err)
+	}
+	decoded := &pulsev2.Notification{}
+	if err := proto.Unmarshal(data, decoded); err != nil {
+		t.Fatalf("Unmarshal error = %v", err)
+	}
+	if decoded.GetSeq() != 3 || !decoded.GetTs().AsTime().Equal(msg.EmittedAt) || decoded.GetSource() != "" {
+		t.Errorf("pulse.v1 notification = %v, expected seq 3 and ts, without source", decoded)
+	}
+	msg.Seq = 0
+
+	// Patches leave data out, the timestamp and source are there
+	msg.EmittedAt = time.Unix(1700000000, 5).UTC()
+	msg.Patch = []database.PatchOperation{{Op: "replace", Path: "/a", Value: json.Number("2")}}
+	data, err = encode(msg, protocolV2, "", encodingProtobuf)
+	if err != nil {
+		t.Fatalf("encode error = %v", err)
+	}
+
+	fields := map[uint64][]byte{}
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		data = data[n:]
+		if tag&7 != 2 {
+			t.Fatalf("field %d has wire type %d, expected only strings and messages", tag>>3, tag&7)
+		}
+		size, n := binary.Uvarint(data)
+		fields[tag>>3], data = data[n:n+int(size)], data[n+int(size):]
+	}
+
+	if _, ok := fields[10]; ok {
+		t.Errorf("data is set along the patch")
+	}
+	if string(fields[7]) != "fake" {
+		t.Errorf("source = %q, expected fake", fields[7])
+	}
+	if ts := []byte{0x08, 0x80, 0xe2, 0xcf, 0xaa, 0x06, 0x10, 5}; !bytes.Equal(fields[9], ts) {
+		t.Errorf("ts = % x, expected % x", fields[9], ts)
+	}
+	patch := []byte{0x0a, 7, 'r', 'e', 'p', 'l', 'a', 'c', 'e', 0x12, 2, '/', 'a', 0x1a, 9, 0x11, 0, 0, 0, 0, 0, 0, 0, 0x40}
+	if !bytes.Equal(fields[12], patch) {
+		t.Errorf("patch = % x, expected % x", fields[12], patch)
+	}
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+
+	"pulse/internal/database"
+)
+
+// encryptionInfo binds the derived keys to their use in pulse.
+const encryptionInfo = "pulse encrypt"
+
+// keyMessage is the first message sent to encrypted subscribers, it carries
+// the server's half of the key exchange.
+type keyMessage struct {
+	Operation string `json:"operation"`
+	Key       string `json:"key"`
+}
+
+// session encrypts the data of the notifications sent to a single client.
+// The key is agreed with X25519 between the client's key, sent with ?key=,
+// and an ephemeral one generated for the connection, then derived with
+// HKDF-SHA256 into an AES-256-GCM key. It's never stored nor reused.
+type session struct {
+	aead cipher.AEAD
+	// publicKey is the server's ephemeral public key
+	publicKey []byte
+}
+
+// newSession agrees on a session key with the base64url encoded X25519
+// public key of the client.
+// It returns an error if the key is invalid.
+func newSession(clientKey string) (*session, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(clientKey)
+	if err != nil {
+		return nil, fmt.Errorf("key must be base64url encoded")
+	}
+	peer, err := ecdh.X25519().NewPublicKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("key must be an X25519 public key")
+	}
+
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := private.ECDH(peer)
+	if err != nil {
+		return nil, fmt.Errorf("key must be an X25519 public key")
+	}
+
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, nil, []byte(encryptionInfo)), key); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &session{aead: aead, publicKey: private.PublicKey().Bytes()}, nil
+}
+
+// keyMessage returns the message handing the server's public key to the client.
+func (s *session) keyMessage() keyMessage {
+	return keyMessage{Operation: "key", Key: base64.RawURLEncoding.EncodeToString(s.publicKey)}
+}
+
+// seal replaces the data of msg with its JSON encoding encrypted, as the
+// base64 encoded nonce followed by the ciphertext.
+// The previous values of updates are dropped, they'd be sent in the clear.
+func (s *session) seal(msg database.DBNotification) (database.DBNotification, error) {
+	msg.Old = nil
+	if msg.Data == nil {
+		return msg, nil
+	}
+
+	plaintext, err := json.Marshal(msg.Data)
+	if err != nil {
+		return msg, err
+	}
+
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return msg, err
+	}
+
+	msg.Data = base64.StdEncoding.EncodeToString(s.aead.Seal(nonce, nonce, plaintext, nil))
+	return msg, nil
+}
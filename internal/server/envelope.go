@@ -0,0 +1,93 @@
+package server
+
+import (
+	"encoding/json"
+	"time"
+
+	"pulse/internal/database"
+)
+
+// envelopeDebezium reshapes notifications like Debezium's change events, so
+// existing CDC tooling can consume them. It's picked with ?envelope=debezium.
+const envelopeDebezium = "debezium"
+
+// debeziumOperations maps row operations to Debezium's op codes, other
+// operations are sent as they are.
+var debeziumOperations = map[string]string{
+	"insert": "c",
+	"update": "u",
+	"delete": "d",
+	// Debezium's snapshot reads
+	database.OperationSnapshot: "r",
+}
+
+// debeziumEnvelope is a DBNotification in Debezium's change event shape.
+type debeziumEnvelope struct {
+	Op     string            `json:"op"`
+	Table  string            `json:"table"`
+	Key    map[string]string `json:"key"`
+	Before interface{}       `json:"before"`
+	After  interface{}       `json:"after"`
+	Source debeziumSource    `json:"source"`
+	TsMs   int64             `json:"ts_ms"`
+}
+
+type debeziumSource struct {
+	Name  string `json:"name"`
+	Table string `json:"table"`
+	TxID  int64  `json:"txId"`
+	TsMs  int64  `json:"ts_ms"`
+}
+
+// encodeDebezium marshals msg as a Debezium change event.
+// The row before an update is rebuilt from the current one and the previous
+// values of the changed columns.
+func encodeDebezium(msg database.DBNotification) ([]byte, error) {
+	envelope := debeziumEnvelope{
+		Op:    msg.Operation,
+		Table: msg.Table,
+		Key:   map[string]string{"id": msg.ID},
+		Source: debeziumSource{
+			Name:  msg.Source,
+			Table: msg.Table,
+			TxID:  msg.Txid,
+		},
+		// Like Debezium, when the event was processed, the change's is in source
+		TsMs: time.Now().UnixMilli(),
+	}
+	if op, ok := debeziumOperations[msg.Operation]; ok {
+		envelope.Op = op
+	}
+	if !msg.EmittedAt.IsZero() {
+		envelope.Source.TsMs = msg.EmittedAt.UnixMilli()
+	}
+
+	switch msg.Operation {
+	case "delete":
+		envelope.Before = msg.Data
+	case "update":
+		envelope.After = msg.Data
+		if row, ok := msg.Data.(map[string]interface{}); ok && msg.Old != nil {
+			envelope.Before = previousRow(row, msg.Old)
+		}
+	default:
+		envelope.After = msg.Data
+	}
+
+	return json.Marshal(envelope)
+}
+
+// previousRow rebuilds the row before an update out of the current one and
+// the previous values of the changed columns.
+func previousRow(row, old map[string]interface{}) map[string]interface{} {
+	before := make(map[string]interface{}, len(row))
+	for column, value := range row {
+		before[column] = value
+	}
+	for column, value := range old {
+		if _, ok := row[column]; ok {
+			before[column] = value
+		}
+	}
+	return before
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"pulse/internal/database"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Bounds of the notifications returned by a /events request
+const (
+	defaultEventsLimit = 100
+	maxEventsLimit     = 1000
+)
+
+// eventsResponse is the body of /events: the notifications after since,
+// oldest first, and the since of the next poll.
+type eventsResponse struct {
+	Events []database.DBNotification `json:"events"`
+	Next   string                    `json:"next"`
+}
+
+// eventsHandler returns the notifications missed since ?since=, for
+// consumers polling over HTTP rather than holding a connection open. A seq
+// returns those numbered after it, from the replay buffer and log, preceded
+// by an event_lost notification if some are no longer kept. An RFC 3339
+// timestamp returns those persisted and emitted since then, which needs
+// PULSE_EVENTS_RETENTION. ?table= or ?tables= and the other subscription
+// parameters, like ?filter=, pick the notifications.
+func (s *Server) eventsHandler(c echo.Context) error {
+	query := c.QueryParams()
+	table := query.Get("table")
+	sub, err := NewSubscription(table, "", query)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if err := s.checkFirehose(sub); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if sub.aggregate != nil || sub.diff {
+		return echo.NewHTTPError(http.StatusBadRequest, "aggregate and diff aren't supported by /events")
+	}
+
+	limit := defaultEventsLimit
+	if param := query.Get("limit"); param != "" {
+		if limit, err = strconv.Atoi(param); err != nil || limit < 1 || limit > maxEventsLimit {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxEventsLimit))
+		}
+	}
+
+	who := s.subscriberOf(c)
+	cli := &client{sub: sub, grant: who.grant, claims: who.claims}
+	if err := cli.authorize(); err != nil {
+		return echo.NewHTTPError(http.StatusForbidden, err.Error())
+	}
+
+	since := query.Get("since")
+	if since == "" {
+		since = "0"
+	}
+	if seq, err := strconv.ParseInt(since, 10, 64); err == nil && seq >= 0 {
+		return s.eventsAfter(c, cli, seq, limit)
+	}
+
+	t, err := time.Parse(time.RFC3339, since)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "since must be the seq of a notification or an RFC 3339 timestamp")
+	}
+	return s.eventsSince(c, cli, t, limit)
+}
+
+// eventsAfter answers with up to limit notifications of cli numbered after
+// seq. The next poll continues after the last one looked at, even if it
+// wasn't cli's.
+func (s *Server) eventsAfter(c echo.Context, cli *client, seq int64, limit int) error {
+	notifications, complete, err := s.ring.since(c.Request().Context(), seq)
+	if err != nil {
+		requestLogger(c).Error("Failed to read the missed events", "after", seq, "error", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "could not read the events")
+	}
+
+	resp := eventsResponse{Events: []database.DBNotification{}, Next: strconv.FormatInt(seq, 10)}
+	if !complete {
+		resp.Events = append(resp.Events, database.DBNotification{Operation: database.OperationEventLost, EmittedAt: time.Now()})
+	}
+
+	for _, msg := range notifications {
+		if len(resp.Events) == limit {
+			break
+		}
+
+		resp.Next = strconv.FormatInt(msg.Seq, 10)
+		if !s.allows(c.Request().Context(), cli, msg) {
+			continue
+		}
+		if n, ok := cli.sub.Accept(msg); ok {
+			resp.Events = append(resp.Events, n)
+		}
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+// eventsSince answers with up to limit notifications of cli persisted by
+// every database and emitted since t, oldest first. The next poll continues right after
+// the time of the last one.
+func (s *Server) eventsSince(c echo.Context, cli *client, t time.Time, limit int) error {
+	var notifications []database.DBNotification
+	for _, db := range s.dbs {
+		persisted, err := db.Replay(c.Request().Context(), cli.sub.table(), t)
+		if errors.Is(err, database.ErrPersistenceDisabled) {
+			return echo.NewHTTPError(http.StatusNotImplemented, err.Error())
+		}
+		if err != nil {
+			requestLogger(c).Error("Failed to replay", "source", db.Source(), "table", cli.sub.table(), "error", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "could not read the events")
+		}
+
+		for _, msg := range persisted {
+			msg.Source = db.Source()
+			if !s.allows(c.Request().Context(), cli, msg) {
+				continue
+			}
+			if n, ok := cli.sub.Accept(msg); ok {
+				notifications = append(notifications, n)
+			}
+		}
+	}
+
+	// Each database's are in order already
+	slices.SortStableFunc(notifications, func(a, b database.DBNotification) int {
+		return a.EmittedAt.Compare(b.EmittedAt)
+	})
+	if len(notifications) > limit {
+		notifications = notifications[:limit]
+	}
+
+	resp := eventsResponse{Events: []database.DBNotification{}, Next: t.Format(time.RFC3339Nano)}
+	if len(notifications) > 0 {
+		resp.Events = notifications
+		// Postgres keeps microseconds
+		resp.Next = notifications[len(notifications)-1].EmittedAt.Add(time.Microsecond).Format(time.RFC3339Nano)
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,324 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/tap"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	"nhooyr.io/websocket"
+
+	"pulse/proto/pulsev2"
+)
+
+// grpcSubscribePath is the method of the Pulse service of proto/pulse.proto.
+const grpcSubscribePath = "/pulse.v2.Pulse/Subscribe"
+
+// GRPCServer returns a gRPC server of the Pulse service, created with opts,
+// which can't set InTapHandle. Subscribe streams the notifications of a
+// subscription as Message messages, notifications in their protobuf
+// encoding and control messages as Structs.
+// Subscribing requires a token in the authorization metadata once
+// PULSE_JWT_SECRET is set, or an API key in the x-api-key metadata once
+// there are some.
+func (s *Server) GRPCServer(opts ...grpc.ServerOption) *grpc.Server {
+	service := &grpcService{s: s, e: echo.New()}
+	service.middlewares = append(service.middlewares, middleware.RequestID())
+	if s.limits.enabled() {
+		service.middlewares = append(service.middlewares, s.limitConnections)
+	}
+	if auth := s.authenticate(); auth != nil {
+		service.middlewares = append(service.middlewares, auth)
+	}
+
+	srv := grpc.NewServer(append(opts, grpc.InTapHandle(abortableStream))...)
+	pulsev2.RegisterPulseServer(srv, service)
+
+	return srv
+}
+
+// abortStreamKey holds the cancel function of the context of a stream.
+// gRPC only gives up on a Send blocked by a client that doesn't read once
+// the stream's context is done, the handler couldn't end it otherwise.
+type abortStreamKey struct{}
+
+// abortableStream makes the context of every stream cancellable by its
+// handler.
+func abortableStream(ctx context.Context, _ *tap.Info) (context.Context, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	return context.WithValue(ctx, abortStreamKey{}, cancel), nil
+}
+
+// grpcService serves the Pulse service. Subscriptions go through the
+// middlewares of the websocket routes, as requests carrying the metadata as
+// their headers.
+type grpcService struct {
+	pulsev2.UnimplementedPulseServer
+
+	s           *Server
+	e           *echo.Echo
+	middlewares []echo.MiddlewareFunc
+}
+
+func (g *grpcService) Subscribe(req *pulsev2.SubscribeRequest, stream pulsev2.Pulse_SubscribeServer) error {
+	ctx := stream.Context()
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, grpcSubscribePath, nil)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for key, values := range md {
+		if !strings.HasPrefix(key, ":") {
+			r.Header[http.CanonicalHeaderKey(key)] = values
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		r.RemoteAddr = p.Addr.String()
+	}
+
+	w := &grpcHeaders{header: http.Header{}}
+	handler := func(c echo.Context) error {
+		return g.s.grpcSubscribe(c, req, stream)
+	}
+	for i := len(g.middlewares) - 1; i >= 0; i-- {
+		handler = g.middlewares[i](handler)
+	}
+
+	return grpcError(handler(g.e.NewContext(r, w)), w.header, stream)
+}
+
+// grpcHeaders collects the headers the middlewares set, like Retry-After,
+// they're sent as trailers.
+type grpcHeaders struct {
+	header http.Header
+}
+
+func (h *grpcHeaders) Header() http.Header         { return h.header }
+func (h *grpcHeaders) Write(p []byte) (int, error) { return len(p), nil }
+func (h *grpcHeaders) WriteHeader(int)             {}
+
+// grpcError converts the HTTP error of a subscription refused before its
+// stream started to a gRPC status, the headers set along go in the trailers.
+// Statuses are returned as they are.
+func grpcError(err error, header http.Header, stream grpc.ServerStream) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+
+	code, message := http.StatusInternalServerError, err.Error()
+	var httpErr *echo.HTTPError
+	if errors.As(err, &httpErr) {
+		code, message = httpErr.Code, fmt.Sprint(httpErr.Message)
+	}
+
+	trailer := metadata.MD{}
+	for key, values := range header {
+		trailer.Append(key, values...)
+	}
+	stream.SetTrailer(trailer)
+
+	return status.Error(grpcCode(code), message)
+}
+
+// grpcCode maps the status of an HTTP error to a gRPC code.
+func grpcCode(code int) codes.Code {
+	switch code {
+	case http.StatusBadRequest:
+		return codes.InvalidArgument
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusServiceUnavailable:
+		return codes.Unavailable
+	case http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	}
+	return codes.Internal
+}
+
+// grpcSubscribe streams the notifications of the subscription of req, in
+// the pulse.v2 shape, until either side ends the stream.
+func (s *Server) grpcSubscribe(c echo.Context, req *pulsev2.SubscribeRequest, stream pulsev2.Pulse_SubscribeServer) error {
+	query := url.Values{}
+	for key, value := range req.Params {
+		query.Set(key, value)
+	}
+
+	// Notifications are always Notification messages
+	if query.Has("encoding") || query.Has("envelope") {
+		return echo.NewHTTPError(http.StatusBadRequest, "encoding and envelope aren't supported over gRPC")
+	}
+
+	sub, err := NewSubscription(req.Table, req.Id, query)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if err := s.checkFirehose(sub); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	cli, err := s.clientFor(sub, query, s.subscriberOf(c))
+	if errors.Is(err, errForbidden) {
+		return echo.NewHTTPError(http.StatusForbidden, err.Error())
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	cli.requestID = c.Response().Header().Get(echo.HeaderXRequestID)
+
+	// The headers go right away, like the websocket handshake
+	if err := stream.SendHeader(nil); err != nil {
+		cli.logger().Warn("Failed to open the gRPC stream", "error", err)
+		return status.Error(codes.Unavailable, "could not open stream")
+	}
+
+	conn := newGRPCConn(stream)
+	defer conn.finish()
+
+	cli.version = protocolV2
+	cli.encoding = encodingProtobuf
+	cli.conn = conn
+
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+	stop := context.AfterFunc(conn.ctx, cancel)
+	defer stop()
+
+	s.serve(cli, ctx)
+
+	return conn.status()
+}
+
+// grpcConn is the response stream of Subscribe. Binary messages are the
+// protobuf encoding of notifications, text ones are JSON control messages,
+// converted to Structs.
+// The stream ends with the status of its close, the control message sent
+// before closing carries the reason too.
+type grpcConn struct {
+	mut     sync.Mutex
+	stream  pulsev2.Pulse_SubscribeServer
+	abort   context.CancelFunc
+	code    codes.Code
+	message string
+
+	// ctx is cancelled once the stream is closed, ending the handler
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// newGRPCConn wraps stream, whose context abortableStream made cancellable.
+func newGRPCConn(stream pulsev2.Pulse_SubscribeServer) *grpcConn {
+	c := &grpcConn{stream: stream, abort: func() {}}
+	if abort, ok := stream.Context().Value(abortStreamKey{}).(context.CancelFunc); ok {
+		c.abort = abort
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+
+	return c
+}
+
+// Write sends p as a Message, a notification if it's binary and else a
+// control message. The stream is aborted if ctx is done before it's sent.
+func (c *grpcConn) Write(ctx context.Context, typ websocket.MessageType, p []byte) error {
+	message := &pulsev2.Message{}
+	if typ == websocket.MessageText {
+		control := &structpb.Struct{}
+		if err := protojson.Unmarshal(p, control); err != nil {
+			return err
+		}
+		message.Kind = &pulsev2.Message_Control{Control: control}
+	} else {
+		notification := &pulsev2.Notification{}
+		if err := proto.Unmarshal(p, notification); err != nil {
+			return err
+		}
+		message.Kind = &pulsev2.Message_Notification{Notification: notification}
+	}
+
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	if c.ctx.Err() != nil {
+		return errStreamClosed
+	}
+
+	stop := context.AfterFunc(ctx, c.abort)
+	defer stop()
+	return c.stream.Send(message)
+}
+
+// Ping does nothing, HTTP/2 keeps the connection alive on its own and a
+// peer gone away fails the next write.
+func (c *grpcConn) Ping(context.Context) error {
+	return nil
+}
+
+// Close ends the stream with the status matching code, once the handler
+// returns.
+func (c *grpcConn) Close(code websocket.StatusCode, reason string) error {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	if c.ctx.Err() == nil {
+		c.code, c.message = grpcStatus(code), reason
+	}
+	c.cancel()
+	return nil
+}
+
+// CloseNow aborts the stream, and a write in progress.
+func (c *grpcConn) CloseNow() error {
+	c.cancel()
+	c.abort()
+	return nil
+}
+
+// finish closes the stream once the write in progress, if any, is done.
+// It can't be written to after its handler returned.
+func (c *grpcConn) finish() {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	c.cancel()
+}
+
+// status returns the status the stream ends with, nil for OK.
+func (c *grpcConn) status() error {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	if c.code == codes.OK {
+		return nil
+	}
+	return status.Error(c.code, c.message)
+}
+
+// grpcStatus maps the close code of a client to a gRPC status.
+func grpcStatus(code websocket.StatusCode) codes.Code {
+	switch code {
+	case websocket.StatusNormalClosure:
+		return codes.OK
+	case websocket.StatusGoingAway:
+		return codes.Unavailable
+	case websocket.StatusPolicyViolation:
+		return codes.ResourceExhausted
+	case websocket.StatusInternalError:
+		return codes.Internal
+	}
+	return codes.Unknown
+}
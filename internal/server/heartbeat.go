@@ -0,0 +1,65 @@
+package server
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+)
+
+// operationHeartbeat is the operation of the heartbeat messages.
+const operationHeartbeat = "heartbeat"
+
+// Bounds of the ?heartbeat= interval, unless set by PULSE_MIN_HEARTBEAT and
+// PULSE_MAX_HEARTBEAT
+const (
+	defaultMinHeartbeat = time.Second
+	defaultMaxHeartbeat = 5 * time.Minute
+)
+
+// heartbeatMessage is sent every ?heartbeat= interval, so clients can tell
+// the stream is alive while no change happens.
+type heartbeatMessage struct {
+	Operation string    `json:"operation"`
+	Ts        time.Time `json:"ts"`
+}
+
+// heartbeatBounds returns the bounds of the heartbeat interval set by
+// PULSE_MIN_HEARTBEAT and PULSE_MAX_HEARTBEAT.
+func heartbeatBounds() (time.Duration, time.Duration) {
+	minimum, err := time.ParseDuration(os.Getenv("PULSE_MIN_HEARTBEAT"))
+	if err != nil || minimum <= 0 {
+		minimum = defaultMinHeartbeat
+	}
+
+	maximum, err := time.ParseDuration(os.Getenv("PULSE_MAX_HEARTBEAT"))
+	if err != nil || maximum < minimum {
+		maximum = max(defaultMaxHeartbeat, minimum)
+	}
+
+	return minimum, maximum
+}
+
+// parseHeartbeat returns the heartbeat interval asked for by ?heartbeat=,
+// zero if none is.
+// It returns an error if it's invalid or out of the bounds.
+func parseHeartbeat(query url.Values) (time.Duration, error) {
+	heartbeat := query.Get("heartbeat")
+	if heartbeat == "" {
+		return 0, nil
+	}
+
+	minimum, maximum := heartbeatBounds()
+	interval, err := time.ParseDuration(heartbeat)
+	if err != nil || interval < minimum || interval > maximum {
+		return 0, fmt.Errorf("heartbeat must be a duration between %s and %s", minimum, maximum)
+	}
+
+	return interval, nil
+}
+
+// sendHeartbeat writes a heartbeat message to cli.
+// It returns false if the connection was closed as a result.
+func sendHeartbeat(cli *client) bool {
+	return writeMessage(cli, heartbeatMessage{Operation: operationHeartbeat, Ts: time.Now()})
+}
@@ -0,0 +1,231 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// limitedRetryAfter is how long clients turned away because the server is
+// full are told to wait.
+const limitedRetryAfter = time.Second
+
+// Why connections are turned away
+const (
+	rejectMaxConnections      = "max_connections"
+	rejectMaxConnectionsPerIP = "max_connections_per_ip"
+	rejectRateLimited         = "rate_limited"
+)
+
+// rejectStatus is the status answered to the connections turned away, by
+// reason.
+var rejectStatus = map[string]int{
+	rejectMaxConnections:      http.StatusServiceUnavailable,
+	rejectMaxConnectionsPerIP: http.StatusTooManyRequests,
+	rejectRateLimited:         http.StatusTooManyRequests,
+}
+
+// connectionLimits bounds the subscriptions open at once, in total and per
+// client IP, and how fast an IP can open them, so a misbehaving client can't
+// exhaust the file descriptors. Zero disables a limit.
+type connectionLimits struct {
+	mu sync.Mutex
+
+	maxTotal int
+	maxPerIP int
+	// rate is how many connections an IP can open per second, burst at once
+	rate  float64
+	burst float64
+
+	total   int
+	perIP   map[string]int
+	buckets map[string]*tokenBucket
+}
+
+// tokenBucket holds the connections an IP may still open right away, as of
+// last.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// ConnectionLimits bounds the subscriptions open at once and how fast they
+// can be opened. Zero disables a limit.
+type ConnectionLimits struct {
+	// MaxConnections caps the subscriptions open at once
+	MaxConnections int
+	// MaxConnectionsPerIP caps those of a single client IP
+	MaxConnectionsPerIP int
+	// Rate is how many connections an IP can open per second
+	Rate float64
+	// Burst is how many an IP can open at once, the rate rounded up if zero
+	Burst int
+}
+
+// limitsFromEnv returns the limits set by PULSE_MAX_CONNECTIONS,
+// PULSE_MAX_CONNECTIONS_PER_IP, PULSE_CONNECTION_RATE and
+// PULSE_CONNECTION_BURST, unset ones are disabled.
+// It returns an error if any is invalid.
+func limitsFromEnv() (ConnectionLimits, error) {
+	var (
+		limits ConnectionLimits
+		err    error
+	)
+
+	if value := os.Getenv("PULSE_MAX_CONNECTIONS"); value != "" {
+		if limits.MaxConnections, err = strconv.Atoi(value); err != nil {
+			return ConnectionLimits{}, fmt.Errorf("PULSE_MAX_CONNECTIONS must be a number")
+		}
+	}
+
+	if value := os.Getenv("PULSE_MAX_CONNECTIONS_PER_IP"); value != "" {
+		if limits.MaxConnectionsPerIP, err = strconv.Atoi(value); err != nil {
+			return ConnectionLimits{}, fmt.Errorf("PULSE_MAX_CONNECTIONS_PER_IP must be a number")
+		}
+	}
+
+	if value := os.Getenv("PULSE_CONNECTION_RATE"); value != "" {
+		if limits.Rate, err = strconv.ParseFloat(value, 64); err != nil {
+			return ConnectionLimits{}, fmt.Errorf("PULSE_CONNECTION_RATE must be a number of connections per second")
+		}
+	}
+
+	if value := os.Getenv("PULSE_CONNECTION_BURST"); value != "" {
+		if limits.Burst, err = strconv.Atoi(value); err != nil {
+			return ConnectionLimits{}, fmt.Errorf("PULSE_CONNECTION_BURST must be a number")
+		}
+	}
+
+	if err := limits.validate(); err != nil {
+		return ConnectionLimits{}, err
+	}
+	return limits, nil
+}
+
+// validate checks the limits are positive, or zero, and consistent.
+func (cfg ConnectionLimits) validate() error {
+	if cfg.MaxConnections < 0 || cfg.MaxConnectionsPerIP < 0 {
+		return fmt.Errorf("the maximum connections can't be negative")
+	}
+	if cfg.Rate < 0 || math.IsNaN(cfg.Rate) || math.IsInf(cfg.Rate, 0) {
+		return fmt.Errorf("the connection rate must be a positive number")
+	}
+	if cfg.Burst < 0 {
+		return fmt.Errorf("the connection burst can't be negative")
+	}
+	if cfg.Burst > 0 && cfg.Rate == 0 {
+		return fmt.Errorf("the connection burst needs a connection rate")
+	}
+	return nil
+}
+
+// newConnectionLimits creates the limits of cfg, the burst defaulting to the
+// rate rounded up.
+func newConnectionLimits(cfg ConnectionLimits) *connectionLimits {
+	l := &connectionLimits{
+		maxTotal: cfg.MaxConnections,
+		maxPerIP: cfg.MaxConnectionsPerIP,
+		rate:     cfg.Rate,
+		perIP:    map[string]int{},
+		buckets:  map[string]*tokenBucket{},
+	}
+
+	if l.rate > 0 {
+		l.burst = math.Ceil(l.rate)
+		if cfg.Burst > 0 {
+			l.burst = float64(cfg.Burst)
+		}
+	}
+
+	return l
+}
+
+// acquire takes a connection slot for ip.
+// It returns an empty reason once taken, to be released after the connection
+// closed, otherwise why it's turned away and how long to wait before
+// retrying.
+func (l *connectionLimits) acquire(ip string, now time.Time) (string, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.rate > 0 {
+		bucket, ok := l.buckets[ip]
+		if !ok {
+			bucket = &tokenBucket{tokens: l.burst, last: now}
+			l.buckets[ip] = bucket
+		}
+
+		bucket.tokens = min(l.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate)
+		bucket.last = now
+		if bucket.tokens < 1 {
+			wait := time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+			return rejectRateLimited, wait
+		}
+		bucket.tokens--
+	}
+
+	if l.maxTotal > 0 && l.total >= l.maxTotal {
+		return rejectMaxConnections, limitedRetryAfter
+	}
+	if l.maxPerIP > 0 && l.perIP[ip] >= l.maxPerIP {
+		return rejectMaxConnectionsPerIP, limitedRetryAfter
+	}
+
+	l.total++
+	l.perIP[ip]++
+	return "", 0
+}
+
+// release gives back the slot of a connection of ip once it closed, and
+// forgets the buckets that filled up again.
+func (l *connectionLimits) release(ip string, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.total--
+	if l.perIP[ip]--; l.perIP[ip] <= 0 {
+		delete(l.perIP, ip)
+	}
+
+	for ip, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, ip)
+		}
+	}
+}
+
+// enabled reports whether any limit is set, none are on a zero Server.
+func (l *connectionLimits) enabled() bool {
+	return l != nil && (l.maxTotal > 0 || l.maxPerIP > 0 || l.rate > 0)
+}
+
+// clientIP is the IP the limits count connections by. X-Forwarded-For is
+// only trusted from proxies on loopback and private networks, so clients
+// can't spoof it to get around them.
+var clientIP = echo.ExtractIPFromXFFHeader()
+
+// limitConnections turns away the subscriptions over the server's
+// connection limits with a 503 or 429 and a Retry-After header. The slot is
+// held until the handler returns, once the subscription closed.
+func (s *Server) limitConnections(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ip := clientIP(c.Request())
+		reason, wait := s.limits.acquire(ip, time.Now())
+		if reason != "" {
+			rejectedConnections.WithLabelValues(reason).Inc()
+
+			seconds := int(math.Ceil(wait.Seconds()))
+			c.Response().Header().Set("Retry-After", strconv.Itoa(max(seconds, 1)))
+			return echo.NewHTTPError(rejectStatus[reason], "too many connections")
+		}
+		defer s.limits.release(ip, time.Now())
+
+		return next(c)
+	}
+}
@@ -0,0 +1,317 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strconv"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+	"nhooyr.io/websocket"
+)
+
+// maxMuxSubscriptions is how many subscriptions a single /ws connection can
+// hold at once.
+const maxMuxSubscriptions = 100
+
+// Actions of the messages clients send on /ws
+const (
+	actionSubscribe   = "subscribe"
+	actionUnsubscribe = "unsubscribe"
+)
+
+// muxRequest is a message sent by a client on /ws.
+// Subscribing takes the route parameters as table and id, and the query
+// parameters of /ws/:table as params. The subscription id is picked by the
+// server unless the client sets one.
+type muxRequest struct {
+	Action       string            `json:"action"`
+	Subscription string            `json:"subscription"`
+	Table        string            `json:"table"`
+	ID           string            `json:"id"`
+	Params       map[string]string `json:"params"`
+}
+
+// muxReply answers a muxRequest: operation is "subscribed", "unsubscribed"
+// or "error", with the reason.
+type muxReply struct {
+	Operation    string `json:"operation"`
+	Subscription string `json:"subscription,omitempty"`
+	Reason       string `json:"reason,omitempty"`
+}
+
+// muxMessage wraps what a subscription sends, its notifications and control
+// messages, with the subscription's id.
+type muxMessage struct {
+	Subscription string          `json:"subscription"`
+	Message      json.RawMessage `json:"message"`
+}
+
+// mux is a websocket carrying several subscriptions. Each of them is served
+// as its own client, writing through a muxConn.
+type mux struct {
+	socket  *websocket.Conn
+	version string
+	// subscriber opened the socket, its subscriptions are granted what
+	// it is
+	subscriber subscriber
+	// requestID is the X-Request-ID of the request that opened the socket
+	requestID string
+
+	mut           sync.Mutex
+	subscriptions map[string]*muxConn
+	// next numbers the subscriptions whose id the server picks
+	next int
+	// closeCode and closeReason are set once the socket is closing, it's
+	// closed when the last subscription ends
+	closeCode   websocket.StatusCode
+	closeReason string
+	// served waits for the subscriptions' handlers
+	served sync.WaitGroup
+}
+
+// muxConn is the conn of a subscription of a mux. Its messages are wrapped in
+// a muxMessage and closing it only ends the subscription.
+type muxConn struct {
+	mux *mux
+	id  string
+	// cancel ends the subscription's handler, done is closed once it returned
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func (c *muxConn) Write(ctx context.Context, typ websocket.MessageType, p []byte) error {
+	jsonData, err := json.Marshal(muxMessage{Subscription: c.id, Message: p})
+	if err != nil {
+		return err
+	}
+
+	return c.mux.socket.Write(ctx, typ, jsonData)
+}
+
+func (c *muxConn) Ping(ctx context.Context) error {
+	return c.mux.socket.Ping(ctx)
+}
+
+// Close ends the subscription. When the server is going away, on shutdown or
+// after a failed write, the whole socket is closed with code once no
+// subscription is left.
+func (c *muxConn) Close(code websocket.StatusCode, reason string) error {
+	c.cancel()
+	if code == websocket.StatusGoingAway {
+		c.mux.close(code, reason)
+	}
+	return nil
+}
+
+func (c *muxConn) CloseNow() error {
+	return c.mux.socket.CloseNow()
+}
+
+// muxHandler serves /ws, a websocket on which the client subscribes and
+// unsubscribes with muxRequest messages, until either side closes it.
+// The notifications of every subscription are wrapped in a muxMessage.
+func (s *Server) muxHandler(c echo.Context) error {
+	w := c.Response().Writer
+	r := c.Request()
+
+	socket, err := websocket.Accept(w, r, s.acceptOptions())
+	if err != nil {
+		// Accept already answered, e.g. 403 to other origins
+		requestLogger(c).Warn("Failed to open the websocket", "error", err)
+		return nil
+	}
+	defer socket.Close(websocket.StatusGoingAway, "server closing websocket")
+
+	s.handlers.Add(1)
+	defer s.handlers.Done()
+
+	m := &mux{
+		socket:        socket,
+		version:       socket.Subprotocol(),
+		requestID:     c.Response().Header().Get(echo.HeaderXRequestID),
+		subscriptions: make(map[string]*muxConn),
+	}
+	if m.version == "" {
+		m.version = protocolV1
+	}
+	m.subscriber = s.subscriberOf(c)
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer func() {
+		cancel()
+		m.served.Wait()
+	}()
+
+	s.clients.registerMux(m)
+	defer s.clients.unregisterMux(m)
+
+	for {
+		_, data, err := socket.Read(ctx)
+		if err != nil {
+			return nil
+		}
+
+		var req muxRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			m.reply(ctx, muxReply{Operation: "error", Reason: "messages must be JSON requests"})
+			continue
+		}
+
+		switch req.Action {
+		case actionSubscribe:
+			s.muxSubscribe(ctx, m, req)
+		case actionUnsubscribe:
+			m.reply(ctx, m.unsubscribe(req.Subscription))
+		default:
+			m.reply(ctx, muxReply{Operation: "error", Subscription: req.Subscription, Reason: fmt.Sprintf("action must be %s or %s", actionSubscribe, actionUnsubscribe)})
+		}
+	}
+}
+
+// muxSubscribe starts serving the subscription described by req on m, until
+// ctx is done or it's unsubscribed. The reply is written before anything the
+// subscription sends.
+func (s *Server) muxSubscribe(ctx context.Context, m *mux, req muxRequest) {
+	reply, serve := s.muxAdd(ctx, m, req)
+	m.reply(ctx, reply)
+	if serve != nil {
+		go serve()
+	}
+}
+
+// muxAdd adds the subscription described by req to m. It returns the reply
+// and, if it was added, the function serving it.
+func (s *Server) muxAdd(ctx context.Context, m *mux, req muxRequest) (muxReply, func()) {
+	refuse := func(reason string) (muxReply, func()) {
+		return muxReply{Operation: "error", Subscription: req.Subscription, Reason: reason}, nil
+	}
+
+	if len(req.Subscription) > 128 {
+		return refuse("subscription must have at most 128 characters")
+	}
+
+	query := make(url.Values)
+	for name, value := range req.Params {
+		query.Set(name, value)
+	}
+
+	sub, err := NewSubscription(req.Table, req.ID, query)
+	if err != nil {
+		return refuse(err.Error())
+	}
+	if err := s.checkFirehose(sub); err != nil {
+		return refuse(err.Error())
+	}
+
+	cli, err := s.clientFor(sub, query, m.subscriber)
+	if err != nil {
+		return refuse(err.Error())
+	}
+	// Messages are wrapped in JSON
+	if cli.encoding != "" {
+		return refuse("encoding isn't supported on /ws")
+	}
+	cli.version = m.version
+	cli.requestID = m.requestID
+
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	switch {
+	case m.closeReason != "":
+		return refuse(m.closeReason)
+	case len(m.subscriptions) >= maxMuxSubscriptions:
+		return refuse(fmt.Sprintf("at most %d subscriptions per connection", maxMuxSubscriptions))
+	case req.Subscription == "":
+		for req.Subscription == "" || m.subscriptions[req.Subscription] != nil {
+			m.next++
+			req.Subscription = strconv.Itoa(m.next)
+		}
+	case m.subscriptions[req.Subscription] != nil:
+		return refuse(fmt.Sprintf("subscription %q already exists", req.Subscription))
+	}
+
+	subCtx, cancel := context.WithCancel(ctx)
+	conn := &muxConn{mux: m, id: req.Subscription, cancel: cancel, done: make(chan struct{})}
+	m.subscriptions[conn.id] = conn
+	cli.conn = conn
+
+	m.served.Add(1)
+	serve := func() {
+		defer m.served.Done()
+		defer m.remove(conn)
+
+		s.serve(cli, subCtx)
+	}
+
+	return muxReply{Operation: "subscribed", Subscription: conn.id}, serve
+}
+
+// unsubscribe ends the subscription id, once its handler returned nothing
+// more is written for it.
+func (m *mux) unsubscribe(id string) muxReply {
+	m.mut.Lock()
+	conn := m.subscriptions[id]
+	m.mut.Unlock()
+
+	if conn == nil {
+		return muxReply{Operation: "error", Subscription: id, Reason: fmt.Sprintf("no subscription %q", id)}
+	}
+
+	conn.cancel()
+	<-conn.done
+
+	return muxReply{Operation: "unsubscribed", Subscription: id}
+}
+
+// remove forgets the subscription of conn once its handler returned, closing
+// the socket if it was the last one of a closing mux.
+func (m *mux) remove(conn *muxConn) {
+	conn.cancel()
+
+	m.mut.Lock()
+	delete(m.subscriptions, conn.id)
+	closing := m.closeReason != "" && len(m.subscriptions) == 0
+	code, reason := m.closeCode, m.closeReason
+	m.mut.Unlock()
+
+	close(conn.done)
+	if closing {
+		disconnect(m.socket, code, reason)
+	}
+}
+
+// close closes the socket with code and reason once every subscription
+// ended, right away if there are none. No subscription can be added anymore.
+// It doesn't block, Shutdown calls it holding the clients lock.
+func (m *mux) close(code websocket.StatusCode, reason string) {
+	m.mut.Lock()
+	if m.closeReason != "" {
+		m.mut.Unlock()
+		return
+	}
+	m.closeCode, m.closeReason = code, reason
+	closing := len(m.subscriptions) == 0
+	m.mut.Unlock()
+
+	if closing {
+		go disconnect(m.socket, code, reason)
+	}
+}
+
+// reply writes msg to the socket, for at most the write timeout.
+func (m *mux) reply(ctx context.Context, msg muxReply) {
+	jsonData, _ := json.Marshal(msg)
+
+	ctx, cancel := context.WithTimeout(ctx, writeTimeout())
+	defer cancel()
+
+	if err := m.socket.Write(ctx, websocket.MessageText, jsonData); err != nil && !errors.Is(err, context.Canceled) {
+		slog.Warn("Failed to reply on the socket", "request_id", m.requestID, "error", err)
+	}
+}
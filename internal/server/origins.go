@@ -0,0 +1,88 @@
+package server
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// anyOrigin allows every origin in ALLOWED_ORIGINS.
+const anyOrigin = "*"
+
+// originsFromEnv returns the origins set by ALLOWED_ORIGINS, a comma
+// separated list of origins like https://app.example.com, where * matches
+// any part of the host, e.g. https://*.example.com, or * alone for any
+// origin. It returns nil when it's unset.
+// It returns an error if any of them isn't an origin.
+func originsFromEnv() ([]string, error) {
+	var origins []string
+	for _, origin := range strings.Split(os.Getenv("ALLOWED_ORIGINS"), ",") {
+		if origin = strings.TrimSpace(origin); origin == "" {
+			continue
+		}
+		if !validOrigin(origin) {
+			return nil, fmt.Errorf("ALLOWED_ORIGINS must be origins like https://app.example.com, %q isn't", origin)
+		}
+		origins = append(origins, strings.ToLower(origin))
+	}
+	return origins, nil
+}
+
+// validOrigin reports whether origin is anyOrigin or a scheme and a host,
+// with an optional port and nothing else.
+func validOrigin(origin string) bool {
+	if origin == anyOrigin {
+		return true
+	}
+
+	u, err := url.Parse(strings.ReplaceAll(origin, "*", "x"))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return false
+	}
+	return u.Path == "" && u.RawQuery == "" && u.Fragment == "" && u.User == nil
+}
+
+// originAllowed reports whether origin matches any of origins.
+func originAllowed(origins []string, origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, pattern := range origins {
+		if pattern == anyOrigin {
+			return true
+		}
+		if matched, _ := path.Match(pattern, origin); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// originHosts returns the hosts of origins, which websocket.AcceptOptions
+// matches the Origin header of the handshakes against. The page's own host
+// is always allowed.
+func originHosts(origins []string) []string {
+	hosts := make([]string, 0, len(origins))
+	for _, origin := range origins {
+		if _, host, ok := strings.Cut(origin, "://"); ok {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// cors returns the middleware answering the preflight requests of origins
+// and letting them read the responses.
+func cors(origins []string) echo.MiddlewareFunc {
+	return middleware.CORSWithConfig(middleware.CORSConfig{
+		AllowOriginFunc: func(origin string) (bool, error) {
+			return originAllowed(origins, origin), nil
+		},
+		AllowHeaders:  []string{echo.HeaderAuthorization, echo.HeaderContentType, echo.HeaderXRequestID, "traceparent"},
+		ExposeHeaders: []string{echo.HeaderXRequestID, echo.HeaderRetryAfter},
+		MaxAge:        3600,
+	})
+}
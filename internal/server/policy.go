@@ -0,0 +1,235 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"pulse/internal/database"
+	"pulse/internal/filter"
+)
+
+// errForbidden is returned by newClient when the subscriber's claims don't
+// grant what it subscribed to.
+var errForbidden = errors.New("forbidden")
+
+// anyTable is the key of a policy's tables granting every table not listed.
+const anyTable = "*"
+
+// Policy grants the subscribers whose claims match When access to Tables.
+type Policy struct {
+	// When maps claims to the value they must have. Claims holding a list
+	// match when it contains the value. An empty When matches everyone
+	When map[string]interface{} `json:"when"`
+	// Tables maps the tables granted, or anyTable, to the row predicate the
+	// rows must match, in the ?filter= syntax with the claims as :params.
+	// An empty predicate grants every row
+	Tables map[string]string `json:"tables"`
+}
+
+// loadPolicies returns the policies set by PULSE_POLICIES, a JSON array of
+// policies tried in order, e.g.
+// [{"when": {"role": "admin"}, "tables": {"*": ""}},
+// {"tables": {"orders": "tenant_id = :tenant_id"}}].
+// It returns an error if the variable isn't such an array.
+func loadPolicies() ([]Policy, error) {
+	raw := os.Getenv("PULSE_POLICIES")
+	if raw == "" {
+		return nil, nil
+	}
+
+	var policies []Policy
+	if err := json.Unmarshal([]byte(raw), &policies); err != nil {
+		return nil, fmt.Errorf("invalid PULSE_POLICIES: %w", err)
+	}
+
+	for i, p := range policies {
+		for claim, value := range p.When {
+			switch value.(type) {
+			case string, float64, bool:
+			default:
+				return nil, fmt.Errorf("invalid PULSE_POLICIES: policy %d: claim %q must be a string, number or boolean", i, claim)
+			}
+		}
+
+		for table := range p.Tables {
+			if !validGrant(table) {
+				return nil, fmt.Errorf("invalid PULSE_POLICIES: policy %d: invalid table %q", i, table)
+			}
+		}
+	}
+
+	return policies, nil
+}
+
+// matches reports whether claims meet every condition of the policy.
+func (p Policy) matches(claims jwt.MapClaims) bool {
+	for claim, want := range p.When {
+		switch value := claims[claim].(type) {
+		case []interface{}:
+			found := false
+			for _, item := range value {
+				found = found || item == want
+			}
+			if !found {
+				return false
+			}
+		default:
+			if value != want {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// grant is what a subscriber may receive: the tables of the first policy its
+// claims matched and their row predicates. A nil grant allows everything,
+// it's what subscribers get without PULSE_POLICIES.
+type grant struct {
+	// tables maps the granted tables, or anyTable, to their row predicate,
+	// nil when every row is granted
+	tables map[string]filter.Predicate
+}
+
+// grantFor compiles the grant of the first policy matching claims, which are
+// nil for unauthenticated subscribers.
+// A subscriber matching no policy is granted nothing. Predicates referencing
+// a claim the subscriber doesn't have leave their table out.
+func grantFor(policies []Policy, claims jwt.MapClaims) *grant {
+	if policies == nil {
+		return nil
+	}
+
+	g := &grant{tables: make(map[string]filter.Predicate)}
+	for _, p := range policies {
+		if !p.matches(claims) {
+			continue
+		}
+
+		for table, expr := range p.Tables {
+			if expr == "" {
+				g.tables[table] = nil
+				continue
+			}
+
+			if predicate, err := filter.ParseWith(expr, claims); err == nil {
+				g.tables[table] = predicate
+			}
+		}
+		break
+	}
+
+	return g
+}
+
+// validGrant reports whether table can be granted: anyTable, a table or a
+// schema qualified one, like billing.invoices.
+func validGrant(table string) bool {
+	if schema, name, qualified := strings.Cut(table, "."); qualified {
+		return validTable(schema) && validTable(name)
+	}
+	return table == anyTable || validTable(table)
+}
+
+// table returns the row predicate of table in schema and whether it's
+// granted at all. Tables are granted by their schema qualified name, which
+// wins, or their bare name in every schema, like subscriptions match them.
+// A table subscribed to without its schema has none.
+func (g *grant) table(schema, table string) (filter.Predicate, bool) {
+	if schema != "" {
+		if predicate, ok := g.tables[schema+"."+table]; ok {
+			return predicate, true
+		}
+	}
+	if predicate, ok := g.tables[table]; ok {
+		return predicate, true
+	}
+
+	predicate, ok := g.tables[anyTable]
+	return predicate, ok
+}
+
+// allowsTable reports whether any row of table, schema qualified or not, may
+// be received.
+func (g *grant) allowsTable(table string) bool {
+	if g == nil {
+		return true
+	}
+
+	_, ok := g.table(splitTable(table))
+	return ok
+}
+
+// restricted reports whether only some rows of table, schema qualified or
+// not, may be received.
+func (g *grant) restricted(table string) bool {
+	if g == nil {
+		return false
+	}
+
+	predicate, _ := g.table(splitTable(table))
+	return predicate != nil
+}
+
+// splitTable returns the schema of table, empty if it isn't qualified, and
+// its name.
+func splitTable(table string) (string, string) {
+	if schema, name, qualified := strings.Cut(table, "."); qualified {
+		return schema, name
+	}
+	return "", table
+}
+
+// allows reports whether n may be received.
+// Bulk notifications of tables restricted to some rows are denied, their
+// rows can't be checked, truncates and gaps aren't.
+func (g *grant) allows(n database.DBNotification) bool {
+	if g == nil || (n.Gap() && n.Table == "") {
+		return true
+	}
+
+	predicate, ok := g.table(n.Schema, n.Table)
+	if !ok {
+		return false
+	}
+	// Truncates carry no row, and remove the granted ones too
+	if predicate == nil || n.Operation == database.OperationTruncate || n.Gap() {
+		return true
+	}
+
+	row, isRow := n.Data.(map[string]interface{})
+	return isRow && !n.Bulk && predicate(row)
+}
+
+// authorize checks the subscription of cli against its grant.
+// It returns an error wrapping errForbidden if it subscribed to a table it
+// isn't granted, or aggregates one it's only granted some rows of.
+func (cli *client) authorize() error {
+	if cli.grant == nil {
+		return nil
+	}
+
+	if len(cli.grant.tables) == 0 {
+		return fmt.Errorf("%w: no table granted", errForbidden)
+	}
+
+	// Patterns can match tables outside of the grant, their notifications
+	// are checked one by one
+	for _, table := range cli.sub.tables {
+		if !strings.ContainsAny(table, "*?") && !cli.grant.allowsTable(table) {
+			return fmt.Errorf("%w: table %q isn't granted", errForbidden, table)
+		}
+	}
+
+	// The aggregate would be seeded from rows outside of the grant
+	if cli.aggregator != nil && cli.grant.restricted(cli.sub.table()) {
+		return fmt.Errorf("%w: aggregate needs every row of %q granted", errForbidden, cli.sub.table())
+	}
+
+	return nil
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+
+	"pulse/internal/database"
+)
+
+// pool is a fixed set of workers the Hub fans notifications out with, so
+// filtering and queueing for many clients is spread over the CPUs without
+// spawning goroutines per notification. Each worker has its own queue, the
+// shards of the clientRegistry are each fanned out to by the same worker.
+type pool struct {
+	work []chan func()
+}
+
+// newPool starts the number of workers set by PULSE_BROADCAST_WORKERS,
+// defaulting to GOMAXPROCS.
+func newPool() *pool {
+	size, err := strconv.Atoi(os.Getenv("PULSE_BROADCAST_WORKERS"))
+	if err != nil || size < 1 {
+		size = runtime.GOMAXPROCS(0)
+	}
+
+	p := &pool{work: make([]chan func(), size)}
+	for i := range p.work {
+		work := make(chan func())
+		p.work[i] = work
+		go func() {
+			for w := range work {
+				w()
+			}
+		}()
+	}
+
+	return p
+}
+
+// size returns the number of workers.
+func (p *pool) size() int {
+	return len(p.work)
+}
+
+// eviction is a client the Hub must disconnect, and why.
+type eviction struct {
+	cli    *client
+	reason string
+}
+
+// fanout queues msg to every client of r accepting it, and visible to, each
+// shard on its worker, and waits until done. The clients receiving it as is
+// share its encodings.
+// It returns the clients that must be evicted, and how many clients were
+// considered.
+func (p *pool) fanout(msg database.DBNotification, r *clientRegistry, visible visibility) (evicted []eviction, considered int) {
+	var (
+		wg  sync.WaitGroup
+		mut sync.Mutex
+	)
+	shared := newEncodings()
+
+	for i, shard := range r.shards {
+		wg.Add(1)
+		p.work[i%len(p.work)] <- func() {
+			defer wg.Done()
+
+			var shardEvicted []eviction
+			n := shard.candidates(msg, func(cli *client) {
+				if reason := fanoutOne(cli, msg, shared, visible); reason != "" {
+					shardEvicted = append(shardEvicted, eviction{cli: cli, reason: reason})
+				}
+			})
+
+			mut.Lock()
+			evicted = append(evicted, shardEvicted...)
+			considered += n
+			mut.Unlock()
+		}
+	}
+	wg.Wait()
+
+	return evicted, considered
+}
+
+// fanoutOne queues msg to cli if it's granted it, it's visible to it and it
+// accepts it, with the encodings shared unless its subscription reshapes msg.
+// It returns why cli must be evicted, if it must: its queue overflowed or it
+// panicked, e.g. in its filter, which must not take the whole server down.
+func fanoutOne(cli *client, msg database.DBNotification, shared *encodings, visible visibility) (reason string) {
+	defer func() {
+		if r := recover(); r != nil {
+			cli.logger().Error("Panic fanning out a notification", "operation", msg.Operation, "table", msg.Table, "panic", r)
+			reason = reasonInternal
+		}
+	}()
+
+	if !cli.grant.allows(msg) || !visible.allows(cli) {
+		return ""
+	}
+	n, ok := cli.sub.Accept(msg)
+	if !ok {
+		return ""
+	}
+	if cli.sub.reshapes() {
+		shared = nil
+	}
+	if !cli.enqueue(queued{msg: n, shared: shared}) {
+		return reasonSlowClient
+	}
+	return ""
+}
+
+// stop ends the workers, fanout can't be called afterwards.
+func (p *pool) stop() {
+	for _, work := range p.work {
+		close(work)
+	}
+}
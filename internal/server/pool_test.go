@@ -0,0 +1,301 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"pulse/internal/database"
+)
+
+// benchmarkClients creates n clients subscribed to every notification, whose
+// queues never overflow.
+func benchmarkClients(n int) []*client {
+	clients := make([]*client, n)
+	for i := range clients {
+		clients[i] = &client{
+			conn:     &nopConn{id: i},
+			sub:      Subscription{sample: 1},
+			overflow: overflowDropNewest,
+			send:     make(chan queued, 1),
+		}
+	}
+	return clients
+}
+
+// registryOf registers clients in a registry of the given number of shards.
+func registryOf(shards int, clients []*client) *clientRegistry {
+	r := newClientRegistry(shards)
+	for _, cli := range clients {
+		r.register(cli)
+	}
+	return r
+}
+
+// BenchmarkFanout compares the sharded pool against a goroutine per client
+// and notification, with 10k clients.
+func BenchmarkFanout(b *testing.B) {
+	msg := database.DBNotification{Operation: "insert", Table: "orders", ID: "1"}
+	clients := benchmarkClients(10000)
+
+	b.Run("goroutine per client", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			var wg sync.WaitGroup
+			for _, cli := range clients {
+				wg.Add(1)
+				go func(cli *client) {
+					defer wg.Done()
+					if n, ok := cli.sub.Accept(msg); ok {
+						cli.enqueue(queued{msg: n})
+					}
+				}(cli)
+			}
+			wg.Wait()
+		}
+	})
+
+	for _, workers := range []int{1, 8} {
+		b.Run(fmt.Sprintf("pool of %d", workers), func(b *testing.B) {
+			b.Setenv("PULSE_BROADCAST_WORKERS", fmt.Sprint(workers))
+			p := newPool()
+			defer p.stop()
+			r := registryOf(p.size(), clients)
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				p.fanout(msg, r, nil)
+			}
+		})
+	}
+}
+
+// BenchmarkFanoutByTable broadcasts to one of 100 tables, with 100 of 10k
+// clients subscribed to each: scanning every client against going through
+// the shards' table index.
+func BenchmarkFanoutByTable(b *testing.B) {
+	msg := database.DBNotification{Operation: "insert", Table: "table_0", ID: "1"}
+	clients := benchmarkClients(10000)
+	for i, cli := range clients {
+		cli.sub.tables = []string{fmt.Sprintf("table_%d", i%100)}
+	}
+
+	b.Run("scan every client", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			shared := newEncodings()
+			for _, cli := range clients {
+				fanoutOne(cli, msg, shared, nil)
+			}
+		}
+	})
+
+	for _, workers := range []int{1, 8} {
+		b.Run(fmt.Sprintf("%d shards", workers), func(b *testing.B) {
+			b.Setenv("PULSE_BROADCAST_WORKERS", fmt.Sprint(workers))
+			p := newPool()
+			defer p.stop()
+			r := registryOf(p.size(), clients)
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				p.fanout(msg, r, nil)
+			}
+		})
+	}
+}
+
+// BenchmarkFanoutByRow updates one row, with each of 10k clients subscribed
+// to its own row of the table.
+func BenchmarkFanoutByRow(b *testing.B) {
+	msg := database.DBNotification{Operation: "update", Table: "orders", ID: "0"}
+	clients := benchmarkClients(10000)
+	for i, cli := range clients {
+		cli.sub.tables, cli.sub.ids = []string{"orders"}, []string{fmt.Sprint(i)}
+	}
+
+	b.Run("scan every client", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			shared := newEncodings()
+			for _, cli := range clients {
+				fanoutOne(cli, msg, shared, nil)
+			}
+		}
+	})
+
+	b.Run("row index", func(b *testing.B) {
+		p := newPool()
+		defer p.stop()
+		r := registryOf(p.size(), clients)
+		b.ResetTimer()
+
+		for i := 0; i < b.N; i++ {
+			p.fanout(msg, r, nil)
+		}
+	})
+}
+
+func TestFanoutRecoversPanics(t *testing.T) {
+	clients := benchmarkClients(3)
+	clients[1].sub.filter = func(row map[string]interface{}) bool { panic("broken filter") }
+
+	p := newPool()
+	defer p.stop()
+
+	msg := database.DBNotification{Operation: "insert", Table: "orders", Data: map[string]interface{}{}}
+	evicted, considered := p.fanout(msg, registryOf(p.size(), clients), nil)
+
+	if len(evicted) != 1 || evicted[0].cli != clients[1] || evicted[0].reason != reasonInternal {
+		t.Errorf("evicted = %v, expected the panicking client", evicted)
+	}
+	if considered != len(clients) {
+		t.Errorf("considered %d clients, expected %d", considered, len(clients))
+	}
+	for _, i := range []int{0, 2} {
+		if len(clients[i].send) != 1 {
+			t.Errorf("client %d queued %d notifications, expected 1", i, len(clients[i].send))
+		}
+	}
+}
+
+func TestFanoutOnlyConsidersSubscribedTables(t *testing.T) {
+	t.Setenv("PULSE_BROADCAST_WORKERS", "4")
+	clients := benchmarkClients(12)
+	for i, cli := range clients[:10] {
+		cli.sub.tables = []string{[]string{"orders", "users"}[i%2]}
+	}
+	// Multi-table and firehose subscriptions
+	clients[10].sub.tables = []string{"orders", "users"}
+
+	p := newPool()
+	defer p.stop()
+	r := registryOf(p.size(), clients)
+
+	_, considered := p.fanout(database.DBNotification{Operation: "insert", Table: "orders", ID: "1"}, r, nil)
+	if considered != 7 {
+		t.Errorf("considered %d clients, expected the 5 of orders and the 2 of every table", considered)
+	}
+	for i, cli := range clients {
+		if queued, expected := len(cli.send) == 1, i%2 == 0 || i >= 10; queued != expected {
+			t.Errorf("client %d queued = %v, expected %v", i, queued, expected)
+		}
+	}
+
+	// Gaps reach every client
+	if _, considered := p.fanout(database.DBNotification{Operation: database.OperationEventLost}, r, nil); considered != len(clients) {
+		t.Errorf("considered %d clients for a gap, expected all %d", considered, len(clients))
+	}
+
+	for _, cli := range clients {
+		r.unregister(cli)
+	}
+	if _, considered := p.fanout(database.DBNotification{Operation: "insert", Table: "orders", ID: "2"}, r, nil); considered != 0 {
+		t.Errorf("considered %d clients once they're unregistered, expected none", considered)
+	}
+}
+
+func TestFanoutOnlyConsidersSubscribedRows(t *testing.T) {
+	clients := benchmarkClients(3)
+	clients[0].sub.tables, clients[0].sub.ids = []string{"orders"}, []string{"1"}
+	clients[1].sub.tables, clients[1].sub.ids = []string{"orders"}, []string{"2", "3"}
+	clients[2].sub.tables = []string{"orders"}
+
+	p := newPool()
+	defer p.stop()
+	r := registryOf(p.size(), clients)
+
+	if _, considered := p.fanout(database.DBNotification{Operation: "update", Table: "orders", ID: "3"}, r, nil); considered != 2 {
+		t.Errorf("considered %d clients, expected the one of row 3 and the one of the table", considered)
+	}
+	if len(clients[0].send) != 0 || len(clients[1].send) != 1 || len(clients[2].send) != 1 {
+		t.Errorf("queued %d, %d and %d notifications, expected 0, 1 and 1", len(clients[0].send), len(clients[1].send), len(clients[2].send))
+	}
+
+	// Bulk notifications can be about any row
+	if _, considered := p.fanout(database.DBNotification{Operation: "update", Table: "orders", Bulk: true, Count: 10}, r, nil); considered != 3 {
+		t.Errorf("considered %d clients for a bulk notification, expected all 3", considered)
+	}
+
+	r.unregister(clients[1])
+	if _, considered := p.fanout(database.DBNotification{Operation: "update", Table: "orders", ID: "3"}, r, nil); considered != 1 {
+		t.Errorf("considered %d clients once row 3's is unregistered, expected 1", considered)
+	}
+}
+
+func TestFanoutMatchesPatterns(t *testing.T) {
+	clients := benchmarkClients(3)
+	clients[0].sub.tables = []string{"orders_*", "orders_1?", "users"}
+	clients[1].sub.tables = []string{"tenant_*.orders_*"}
+	clients[2].sub.tables = []string{"users_*"}
+
+	p := newPool()
+	defer p.stop()
+	r := registryOf(p.size(), clients)
+
+	if _, considered := p.fanout(database.DBNotification{Operation: "insert", Table: "orders_12", Schema: "tenant_12", ID: "1"}, r, nil); considered != 2 {
+		t.Errorf("considered %d clients, expected the two whose patterns match", considered)
+	}
+	if len(clients[0].send) != 1 || len(clients[1].send) != 1 || len(clients[2].send) != 0 {
+		t.Errorf("queued %d, %d and %d notifications, expected 1, 1 and 0", len(clients[0].send), len(clients[1].send), len(clients[2].send))
+	}
+
+	// Tables listed along patterns match exactly
+	if _, considered := p.fanout(database.DBNotification{Operation: "insert", Table: "users", ID: "1"}, r, nil); considered != 1 {
+		t.Errorf("considered %d clients for users, expected 1", considered)
+	}
+
+	r.unregister(clients[0])
+	if _, considered := p.fanout(database.DBNotification{Operation: "insert", Table: "orders_12", Schema: "public", ID: "1"}, r, nil); considered != 0 {
+		t.Errorf("considered %d clients once the first one is unregistered, expected none", considered)
+	}
+}
+
+func TestFanoutSharesEncodings(t *testing.T) {
+	clients := benchmarkClients(3)
+	clients[2].sub.fields = [][]string{{"id"}}
+
+	p := newPool()
+	defer p.stop()
+
+	msg := database.DBNotification{Operation: "insert", Table: "orders", ID: "1", Data: map[string]interface{}{"id": 1, "total": 10}}
+	p.fanout(msg, registryOf(p.size(), clients), nil)
+
+	first, second, projected := <-clients[0].send, <-clients[1].send, <-clients[2].send
+	if first.shared == nil || first.shared != second.shared {
+		t.Fatalf("clients receiving the notification as is don't share its encodings")
+	}
+	if projected.shared != nil {
+		t.Errorf("the client projecting fields shares the encodings of the whole row")
+	}
+
+	a, _ := first.shared.encode(first.msg, protocolV2, "", encodingJSON)
+	b, _ := second.shared.encode(second.msg, protocolV2, "", encodingJSON)
+	if &a[0] != &b[0] {
+		t.Errorf("the notification was encoded once per client")
+	}
+	if v1, _ := first.shared.encode(first.msg, protocolV1, "", encodingJSON); string(v1) == string(a) {
+		t.Errorf("pulse.v1 got the pulse.v2 encoding %s", v1)
+	}
+}
+
+// BenchmarkBroadcastEncoding compares encoding a notification for each of
+// 10k clients against sharing its encoding.
+func BenchmarkBroadcastEncoding(b *testing.B) {
+	msg := database.DBNotification{Operation: "update", Table: "orders", ID: "1", Data: map[string]interface{}{"id": 1, "total": 10, "status": "paid"}}
+	const clients = 10000
+
+	b.Run("per client", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for j := 0; j < clients; j++ {
+				encode(msg, protocolV2, "", encodingJSON)
+			}
+		}
+	})
+
+	b.Run("shared", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			shared := newEncodings()
+			for j := 0; j < clients; j++ {
+				shared.encode(msg, protocolV2, "", encodingJSON)
+			}
+		}
+	})
+}
@@ -0,0 +1,202 @@
+// pulse.js is the browser client of pulse, served by the server on /pulse.js.
+//
+//   <script src="https://pulse.example.com/pulse.js"></script>
+//   <script>
+//     const sub = Pulse.subscribe("orders", { filter: "amount > 100" }, (n) => console.log(n));
+//     // later: sub.close();
+//   </script>
+//
+// Subscriptions reconnect on their own, resuming after the seq of the last
+// notification received. Heartbeats detect connections that silently died.
+(function (root, factory) {
+  if (typeof module === "object" && module.exports) {
+    module.exports = factory(root);
+  } else {
+    root.Pulse = factory(root);
+  }
+})(typeof self !== "undefined" ? self : this, function (root) {
+  "use strict";
+
+  // The wire contract spoken, every field of the notifications is sent
+  var protocol = "pulse.v2";
+
+  // Options of subscribe sent as query parameters, arrays are joined by commas
+  var params = {
+    ids: "ids",
+    operations: "operations",
+    columns: "columns",
+    fields: "fields",
+    filter: "filter",
+    where: "where",
+    source: "source",
+    tables: "tables",
+    sample: "sample",
+    dedup: "dedup",
+    diff: "diff",
+    overflow: "overflow",
+    batch: "batch",
+    maxRate: "max_rate",
+    rateMode: "rate_mode",
+    coalesce: "coalesce",
+    clientId: "client_id",
+  };
+
+  // The server the script was loaded from, the default base URL
+  var script = root.document && root.document.currentScript;
+  var defaultURL = script ? new URL(script.src).origin : "";
+
+  // Subscription is a websocket to pulse, reconnected until it's closed.
+  function Subscription(baseURL, table, options, onNotification) {
+    this.baseURL = baseURL;
+    this.table = table;
+    this.options = options;
+    this.onNotification = onNotification;
+
+    // seq is the seq of the last notification, the next connection resumes
+    // after it
+    this.seq = options.since || 0;
+    this.closed = false;
+    this.socket = null;
+    this.watchdog = null;
+    this.retry = null;
+
+    this.connect();
+  }
+
+  Subscription.prototype.url = function () {
+    var url = new URL(this.table ? "/ws/" + encodeURIComponent(this.table) : "/ws/all", this.baseURL);
+    url.protocol = url.protocol === "https:" ? "wss:" : "ws:";
+
+    var options = this.options;
+    Object.keys(params).forEach(function (name) {
+      var value = options[name];
+      if (value === undefined || value === null) return;
+      url.searchParams.set(params[name], Array.isArray(value) ? value.join(",") : String(value));
+    });
+    if (options.heartbeat) url.searchParams.set("heartbeat", options.heartbeat + "ms");
+    if (options.accessToken) url.searchParams.set("access_token", options.accessToken);
+    if (this.seq > 0 && options.resume !== false) url.searchParams.set("since", String(this.seq));
+
+    return url.toString();
+  };
+
+  Subscription.prototype.connect = function () {
+    var self = this;
+    var socket = new WebSocket(this.url(), protocol);
+    // A draining server says when another instance should take over
+    var delay = this.options.reconnectDelay || 1000;
+
+    this.socket = socket;
+    socket.onopen = function () {
+      self.alive();
+      if (self.options.onOpen) self.options.onOpen();
+    };
+    socket.onmessage = function (event) {
+      self.alive();
+
+      var msg;
+      try {
+        msg = JSON.parse(event.data);
+      } catch (err) {
+        return;
+      }
+
+      // Control messages are the only ones without a table
+      if (!msg.table) {
+        switch (msg.operation) {
+          case "heartbeat":
+            return;
+          case "draining":
+            delay = msg.retry_after_ms || delay;
+            return;
+          case "close":
+            self.close();
+            return;
+          case "error":
+            if (self.options.onError) self.options.onError(new Error("server closed the connection: " + msg.reason));
+            return;
+        }
+      }
+
+      if (msg.seq > 0) self.seq = msg.seq;
+      self.onNotification(msg);
+    };
+    socket.onclose = function () {
+      clearTimeout(self.watchdog);
+      if (self.socket !== socket || self.closed) return;
+
+      if (self.options.onClose) self.options.onClose();
+      self.retry = setTimeout(function () {
+        self.connect();
+      }, delay);
+    };
+  };
+
+  // alive restarts the watchdog: without a message for two heartbeats the
+  // connection is taken for dead and reopened.
+  Subscription.prototype.alive = function () {
+    var self = this;
+    if (!this.options.heartbeat) return;
+
+    clearTimeout(this.watchdog);
+    this.watchdog = setTimeout(function () {
+      self.socket.close();
+    }, 2 * this.options.heartbeat);
+  };
+
+  // close ends the subscription for good.
+  Subscription.prototype.close = function () {
+    this.closed = true;
+    clearTimeout(this.watchdog);
+    clearTimeout(this.retry);
+    if (this.socket) this.socket.close(1000);
+  };
+
+  // Client subscribes to the pulse server at url, the one pulse.js was
+  // loaded from by default. Its options apply to every subscription.
+  function Client(url, options) {
+    this.url = url || defaultURL;
+    this.options = options || {};
+  }
+
+  // subscribe calls onNotification with the notifications of table matching
+  // options, every table's if it's empty. It returns the Subscription, to
+  // close.
+  //
+  // options are the subscription parameters of the server in camel case,
+  // e.g. ids, operations, filter or maxRate, along with:
+  //   accessToken     the JWT of the subscriber, if the server needs one
+  //   heartbeat       the interval in ms the server sends heartbeats at
+  //   resume          false to not replay what's missed while reconnecting
+  //   since           the seq to resume after on the first connection
+  //   reconnectDelay  the wait in ms before reconnecting, 1000 by default
+  //   onOpen, onClose, onError  called as the connection opens, drops or is
+  //                   closed by the server
+  Client.prototype.subscribe = function (table, options, onNotification) {
+    if (typeof options === "function") {
+      onNotification = options;
+      options = {};
+    }
+
+    var merged = {};
+    Object.keys(this.options).forEach(function (name) {
+      merged[name] = this.options[name];
+    }, this);
+    Object.keys(options || {}).forEach(function (name) {
+      merged[name] = options[name];
+    });
+
+    return new Subscription(this.url, table, merged, onNotification);
+  };
+
+  return {
+    Client: Client,
+    connect: function (url, options) {
+      return new Client(url, options);
+    },
+    // subscribe subscribes to the server pulse.js was loaded from
+    subscribe: function (table, options, onNotification) {
+      return new Client().subscribe(table, options, onNotification);
+    },
+  };
+});
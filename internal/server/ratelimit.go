@@ -0,0 +1,150 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// What happens to the updates over a client's ?max_rate=, picked with
+// ?rate_mode=
+const (
+	// rateModeCoalesce holds them, delivering the latest of each row as the
+	// rate allows
+	rateModeCoalesce = "coalesce"
+	// rateModeDrop drops them
+	rateModeDrop = "drop"
+)
+
+// dropRateLimited is why the updates over a client's rate are dropped.
+const dropRateLimited = "rate_limited"
+
+// minRateTick bounds how often the held updates are looked at.
+const minRateTick = 10 * time.Millisecond
+
+// rateLimiter caps the updates delivered to a client per second. Other
+// operations always go through, right after the update held for their row.
+type rateLimiter struct {
+	rate float64
+	mode string
+
+	// tokens are the updates that can be delivered right away as of last,
+	// up to the rate rounded up
+	tokens float64
+	burst  float64
+	last   time.Time
+
+	held *coalescer
+}
+
+// parseRateLimit returns the limiter asked for by ?max_rate= and
+// ?rate_mode=, nil if none is.
+// It returns an error if either is invalid.
+func parseRateLimit(query url.Values) (*rateLimiter, error) {
+	maxRate, mode := query.Get("max_rate"), query.Get("rate_mode")
+	if maxRate == "" {
+		if mode != "" {
+			return nil, fmt.Errorf("rate_mode needs max_rate")
+		}
+		return nil, nil
+	}
+
+	rate, err := strconv.ParseFloat(maxRate, 64)
+	if err != nil || rate <= 0 || math.IsInf(rate, 0) {
+		return nil, fmt.Errorf("max_rate must be a positive number of updates per second")
+	}
+
+	switch mode {
+	case "":
+		mode = rateModeCoalesce
+	case rateModeCoalesce, rateModeDrop:
+	default:
+		return nil, fmt.Errorf("rate_mode must be %s or %s", rateModeCoalesce, rateModeDrop)
+	}
+
+	burst := math.Ceil(rate)
+	return &rateLimiter{rate: rate, mode: mode, tokens: burst, burst: burst, held: newCoalescer()}, nil
+}
+
+// tick is how often the held updates are delivered.
+func (l *rateLimiter) tick() time.Duration {
+	return max(time.Duration(float64(time.Second)/l.rate), minRateTick)
+}
+
+// refill adds the tokens earned since the last call.
+func (l *rateLimiter) refill(now time.Time) {
+	if !l.last.IsZero() {
+		l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	}
+	l.last = now
+}
+
+// admit returns the notifications to deliver now that out was queued, in
+// order: the held updates the rate allows, then out unless it's held or
+// dropped.
+func (l *rateLimiter) admit(out queued, now time.Time) []queued {
+	ready := l.release(now)
+
+	if !coalescable(out.msg) {
+		if held, ok := l.held.take(out.msg); ok {
+			ready = append(ready, held)
+		}
+		return append(ready, out)
+	}
+
+	// Updates of a row already held wait with it
+	if _, waiting := l.held.rows[keyOf(out.msg)]; !waiting && l.tokens >= 1 {
+		l.tokens--
+		return append(ready, out)
+	}
+
+	if l.mode == rateModeDrop {
+		droppedNotifications.WithLabelValues(dropRateLimited).Inc()
+		return ready
+	}
+
+	l.held.hold(out, now)
+	return ready
+}
+
+// release returns the held updates the rate allows, the longest held
+// first.
+func (l *rateLimiter) release(now time.Time) []queued {
+	l.refill(now)
+
+	var ready []queued
+	for l.tokens >= 1 {
+		if _, ok := l.held.next(); !ok {
+			break
+		}
+		l.tokens--
+		ready = append(ready, l.held.pop())
+	}
+	return ready
+}
+
+// flush returns every held update, the longest held first, whatever the
+// rate. They'd be lost otherwise once the client is closed.
+func (l *rateLimiter) flush() []queued {
+	var ready []queued
+	for {
+		if _, ok := l.held.next(); !ok {
+			return ready
+		}
+		ready = append(ready, l.held.pop())
+	}
+}
+
+// deliverReady writes the notifications released by a limiter to cli.
+// It returns false if the connection was closed as a result.
+func (s *Server) deliverReady(cli *client, ready []queued) bool {
+	for _, out := range ready {
+		if !s.deliver(cli, out.msg, out.shared) {
+			return false
+		}
+		observeLatency(out.msg)
+	}
+	return true
+}
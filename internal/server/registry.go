@@ -0,0 +1,293 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"pulse/internal/database"
+)
+
+// clientRegistry holds the connected clients and the /ws connections
+// multiplexing them. The handlers register and unregister concurrently with
+// the Hub and Shutdown ranging over them.
+// Clients are spread over shards, each fanned out to by its own worker of
+// the pool and indexed by the tables and rows subscribed to, so a
+// notification only goes through the clients that may accept it. Clients
+// subscribed to patterns are indexed by them, a notification goes through
+// those of the patterns matching its table.
+type clientRegistry struct {
+	shards []*registryShard
+	// next picks the shard of the next client, round-robin
+	next atomic.Uint64
+	// ids numbers the clients registered
+	ids atomic.Uint64
+
+	mut   sync.RWMutex
+	muxes map[*mux]struct{}
+}
+
+// registryShard is a part of the clients, see clientRegistry.
+type registryShard struct {
+	mut     sync.RWMutex
+	clients map[conn]*client
+	// index holds the clients by the tables they subscribed to, or by their
+	// rows if they subscribed to ids. Those of every table are under
+	// allTables
+	index map[indexKey]map[*client]struct{}
+	// rowsOf holds the clients indexed by rows by their table, for bulk
+	// notifications which can be about any row
+	rowsOf map[string]map[*client]struct{}
+	// patterns holds the clients subscribed to any pattern by each of their
+	// tables, patterns or not, they're never in index too
+	patterns map[string]map[*client]struct{}
+}
+
+// indexKey is a table, or one of its rows if id is set.
+type indexKey struct {
+	table, id string
+}
+
+// allTables indexes the clients of every table in a registryShard. Table
+// names can't be empty.
+const allTables = ""
+
+// newClientRegistry returns a registry of the given number of shards, at
+// least one.
+func newClientRegistry(shards int) *clientRegistry {
+	r := &clientRegistry{
+		shards: make([]*registryShard, max(shards, 1)),
+		muxes:  make(map[*mux]struct{}),
+	}
+	for i := range r.shards {
+		r.shards[i] = &registryShard{
+			clients:  make(map[conn]*client),
+			index:    make(map[indexKey]map[*client]struct{}),
+			rowsOf:   make(map[string]map[*client]struct{}),
+			patterns: make(map[string]map[*client]struct{}),
+		}
+	}
+	return r
+}
+
+// register adds cli, counted as connected to its table.
+func (r *clientRegistry) register(cli *client) {
+	shard := r.shards[(r.next.Add(1)-1)%uint64(len(r.shards))]
+
+	shard.mut.Lock()
+	defer shard.mut.Unlock()
+
+	cli.shard = shard
+	cli.id, cli.connectedAt = r.ids.Add(1), time.Now()
+	shard.clients[cli.conn] = cli
+	if cli.sub.hasPatterns() {
+		for _, pattern := range cli.sub.tables {
+			if shard.patterns[pattern] == nil {
+				shard.patterns[pattern] = make(map[*client]struct{})
+			}
+			shard.patterns[pattern][cli] = struct{}{}
+		}
+		connectedClients.WithLabelValues(cli.sub.table()).Inc()
+		return
+	}
+
+	for _, key := range indexKeys(cli) {
+		if shard.index[key] == nil {
+			shard.index[key] = make(map[*client]struct{})
+		}
+		shard.index[key][cli] = struct{}{}
+
+		if key.id != "" {
+			if shard.rowsOf[key.table] == nil {
+				shard.rowsOf[key.table] = make(map[*client]struct{})
+			}
+			shard.rowsOf[key.table][cli] = struct{}{}
+		}
+	}
+	connectedClients.WithLabelValues(cli.sub.table()).Inc()
+}
+
+// unregister forgets cli, it may be called again once it's evicted.
+func (r *clientRegistry) unregister(cli *client) {
+	shard := cli.shard
+	if shard == nil {
+		return
+	}
+
+	shard.mut.Lock()
+	defer shard.mut.Unlock()
+
+	if _, ok := shard.clients[cli.conn]; !ok {
+		return
+	}
+
+	delete(shard.clients, cli.conn)
+	if cli.sub.hasPatterns() {
+		for _, pattern := range cli.sub.tables {
+			delete(shard.patterns[pattern], cli)
+			if len(shard.patterns[pattern]) == 0 {
+				delete(shard.patterns, pattern)
+			}
+		}
+		connectedClients.WithLabelValues(cli.sub.table()).Dec()
+		return
+	}
+
+	for _, key := range indexKeys(cli) {
+		delete(shard.index[key], cli)
+		if len(shard.index[key]) == 0 {
+			delete(shard.index, key)
+		}
+
+		delete(shard.rowsOf[key.table], cli)
+		if len(shard.rowsOf[key.table]) == 0 {
+			delete(shard.rowsOf, key.table)
+		}
+	}
+	connectedClients.WithLabelValues(cli.sub.table()).Dec()
+}
+
+// indexKeys returns the keys cli is indexed by: its tables, or each of their
+// rows it subscribed to, allTables if it didn't pick any table.
+func indexKeys(cli *client) []indexKey {
+	if len(cli.sub.tables) == 0 {
+		return []indexKey{{table: allTables}}
+	}
+
+	var keys []indexKey
+	for _, table := range cli.sub.tables {
+		if len(cli.sub.ids) == 0 {
+			keys = append(keys, indexKey{table: table})
+			continue
+		}
+		for _, id := range cli.sub.ids {
+			keys = append(keys, indexKey{table: table, id: id})
+		}
+	}
+	return keys
+}
+
+func (r *clientRegistry) registerMux(m *mux) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	r.muxes[m] = struct{}{}
+}
+
+func (r *clientRegistry) unregisterMux(m *mux) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	delete(r.muxes, m)
+}
+
+// each calls f for every client with its shard locked, f must not register
+// or unregister.
+func (r *clientRegistry) each(f func(cli *client)) {
+	for _, shard := range r.shards {
+		shard.mut.RLock()
+		for _, cli := range shard.clients {
+			f(cli)
+		}
+		shard.mut.RUnlock()
+	}
+}
+
+// claimsOf returns the distinct claims of the clients msg may be fanned out
+// to, those whose grant allows it.
+func (r *clientRegistry) claimsOf(msg database.DBNotification) []string {
+	seen := make(map[string]bool)
+	var claims []string
+	for _, shard := range r.shards {
+		shard.candidates(msg, func(cli *client) {
+			if !seen[cli.claims] && cli.grant.allows(msg) {
+				seen[cli.claims] = true
+				claims = append(claims, cli.claims)
+			}
+		})
+	}
+	return claims
+}
+
+// find returns the client of the given id, if it's registered.
+func (r *clientRegistry) find(id uint64) (*client, bool) {
+	for _, shard := range r.shards {
+		shard.mut.RLock()
+		for _, cli := range shard.clients {
+			if cli.id == id {
+				shard.mut.RUnlock()
+				return cli, true
+			}
+		}
+		shard.mut.RUnlock()
+	}
+	return nil, false
+}
+
+// eachMux is each for the /ws connections.
+func (r *clientRegistry) eachMux(f func(m *mux)) {
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+
+	for m := range r.muxes {
+		f(m)
+	}
+}
+
+// candidates calls f for every client of the shard that may accept msg, with
+// the shard locked: those of its table, its row, every table and the patterns
+// matching its table, or all of them for gaps of no table. Bulk, truncate and
+// gap notifications of a table go to the clients of any row of their table.
+// It returns how many there were.
+func (s *registryShard) candidates(msg database.DBNotification, f func(cli *client)) int {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+
+	if msg.Gap() && msg.Table == "" {
+		for _, cli := range s.clients {
+			f(cli)
+		}
+		return len(s.clients)
+	}
+
+	var matched []map[*client]struct{}
+	sets := []map[*client]struct{}{s.index[indexKey{table: allTables}]}
+	if msg.Table != allTables {
+		sets = append(sets, s.index[indexKey{table: msg.Table}])
+		switch {
+		case msg.Bulk, msg.Operation == database.OperationTruncate, msg.Gap():
+			sets = append(sets, s.rowsOf[msg.Table])
+		case msg.ID != "":
+			sets = append(sets, s.index[indexKey{table: msg.Table, id: msg.ID}])
+		}
+
+		for pattern, set := range s.patterns {
+			if matchesTable(pattern, msg) {
+				matched = append(matched, set)
+			}
+		}
+	}
+	// Clients matching through several of their patterns are called once
+	if len(matched) == 1 {
+		sets, matched = append(sets, matched[0]), nil
+	}
+
+	n := 0
+	for _, set := range sets {
+		for cli := range set {
+			f(cli)
+		}
+		n += len(set)
+	}
+
+	seen := make(map[*client]struct{}, len(matched))
+	for _, set := range matched {
+		for cli := range set {
+			if _, ok := seen[cli]; !ok {
+				seen[cli] = struct{}{}
+				f(cli)
+			}
+		}
+	}
+	return n + len(seen)
+}
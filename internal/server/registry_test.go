@@ -0,0 +1,74 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"nhooyr.io/websocket"
+
+	"pulse/internal/database"
+)
+
+// nopConn is a conn discarding everything, telling clients apart.
+type nopConn struct{ id int }
+
+func (*nopConn) Write(ctx context.Context, typ websocket.MessageType, p []byte) error { return nil }
+func (*nopConn) Ping(ctx context.Context) error                                       { return nil }
+func (*nopConn) Close(code websocket.StatusCode, reason string) error                 { return nil }
+func (*nopConn) CloseNow() error                                                      { return nil }
+
+func TestRegistryConcurrentAccess(t *testing.T) {
+	r := newClientRegistry(4)
+
+	const handlers = 50
+	var wg sync.WaitGroup
+	for i := 0; i < handlers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			cli := &client{conn: &nopConn{id: i}}
+			for j := 0; j < 100; j++ {
+				r.register(cli)
+				r.unregister(cli)
+			}
+			r.register(cli)
+		}()
+	}
+
+	// Like the Hub fanning out meanwhile
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		for i := 0; i < 100; i++ {
+			r.shards[i%len(r.shards)].candidates(database.DBNotification{Table: "orders"}, func(cli *client) {})
+			r.each(func(cli *client) {})
+		}
+	}()
+
+	wg.Wait()
+	<-done
+
+	if clients := registered(r); len(clients) != handlers {
+		t.Fatalf("registered %d clients, expected %d", len(clients), handlers)
+	}
+
+	// Unregistering twice, e.g. once evicted and when its handler returns
+	cli := registered(r)[0]
+	r.unregister(cli)
+	r.unregister(cli)
+	if clients := registered(r); len(clients) != handlers-1 {
+		t.Errorf("registered %d clients, expected %d", len(clients), handlers-1)
+	}
+}
+
+// registered returns the clients of r.
+func registered(r *clientRegistry) []*client {
+	var clients []*client
+	r.each(func(cli *client) {
+		clients = append(clients, cli)
+	})
+	return clients
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"pulse/internal/database"
+)
+
+// defaultReplayBuffer is how many notifications are kept in memory for the
+// clients resuming with ?since=.
+const defaultReplayBuffer = 1000
+
+// recordTimeout bounds recording a notification in the replay log.
+const recordTimeout = 5 * time.Second
+
+// replayBuffer returns the buffer size set by PULSE_REPLAY_BUFFER, zero only
+// keeps the notifications in the replay log.
+func replayBuffer() int {
+	size, err := strconv.Atoi(os.Getenv("PULSE_REPLAY_BUFFER"))
+	if err != nil || size < 0 {
+		return defaultReplayBuffer
+	}
+
+	return size
+}
+
+// ring numbers the notifications the Hub fans out and keeps the last ones,
+// so clients reconnecting with ?since= get those they missed.
+// When the first database has a replay log, every notification is recorded
+// there too: resuming then reaches further back than the buffer, and
+// survives restarts.
+type ring struct {
+	mut sync.RWMutex
+	// events holds the last notifications, once full the oldest is at next
+	events []database.DBNotification
+	next   int
+	// last is the number of the newest notification
+	last int64
+
+	// log is the database holding the replay log, nil if there's none
+	log database.Service
+}
+
+// newRing creates a ring buffering size notifications, recorded in the
+// replay log of the first of dbs if it has one. Numbering carries on from
+// the last notification recorded.
+func newRing(size int, dbs []database.Service) *ring {
+	r := &ring{events: make([]database.DBNotification, 0, size)}
+	if len(dbs) == 0 {
+		return r
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), recordTimeout)
+	defer cancel()
+
+	last, err := dbs[0].LastRecorded(ctx)
+	switch {
+	case err == nil:
+		r.log, r.last = dbs[0], last
+	case !errors.Is(err, database.ErrReplayLogDisabled):
+		slog.Error("Failed to read the replay log, only buffering", "source", dbs[0].Source(), "error", err)
+	}
+
+	return r
+}
+
+// append numbers msg and keeps it. It returns msg with its number.
+func (r *ring) append(msg database.DBNotification) database.DBNotification {
+	r.mut.Lock()
+	r.last++
+	msg.Seq = r.last
+	switch {
+	case cap(r.events) == 0:
+	case len(r.events) < cap(r.events):
+		r.events = append(r.events, msg)
+	default:
+		r.events[r.next] = msg
+		r.next = (r.next + 1) % len(r.events)
+	}
+	r.mut.Unlock()
+
+	if r.log != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), recordTimeout)
+		defer cancel()
+
+		if err := r.log.Record(ctx, msg); err != nil {
+			slog.Error("Failed to record a notification", "operation", msg.Operation, "table", msg.Table, "error", err)
+		}
+	}
+
+	return msg
+}
+
+// since returns the notifications numbered after seq, oldest first, and
+// whether none of them is missing: those older than the buffer and the
+// replay log are lost, and so are all of them if seq is newer than the last
+// one, e.g. handed out before a restart.
+func (r *ring) since(ctx context.Context, seq int64) ([]database.DBNotification, bool, error) {
+	buffered, complete := r.buffered(seq)
+	if complete || r.log == nil {
+		return buffered, complete, nil
+	}
+
+	recorded, err := r.log.Recorded(ctx, seq)
+	if err != nil {
+		return nil, false, err
+	}
+	complete = len(recorded) > 0 && recorded[0].Seq == seq+1
+
+	// The newest may not be recorded yet
+	for _, msg := range buffered {
+		if len(recorded) == 0 || msg.Seq > recorded[len(recorded)-1].Seq {
+			recorded = append(recorded, msg)
+		}
+	}
+
+	return recorded, complete, nil
+}
+
+// buffered returns the buffered notifications numbered after seq, and
+// whether the buffer holds all of them.
+func (r *ring) buffered(seq int64) ([]database.DBNotification, bool) {
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+
+	if seq > r.last {
+		return nil, false
+	}
+
+	missed := r.last - seq
+	complete := missed <= int64(len(r.events))
+	if !complete {
+		missed = int64(len(r.events))
+	}
+
+	notifications := make([]database.DBNotification, 0, missed)
+	for i := len(r.events) - int(missed); i < len(r.events); i++ {
+		notifications = append(notifications, r.events[(r.next+i)%len(r.events)])
+	}
+
+	return notifications, complete
+}
@@ -1,34 +1,386 @@
 package server
 
 import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
 	"net/http"
+	"net/url"
+	"os"
+	"strconv"
 
 	"fmt"
-	"log"
+	"log/slog"
 	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
 
 	"nhooyr.io/websocket"
+
+	"pulse/internal/database"
+	"pulse/internal/tracing"
 )
 
 func (s *Server) RegisterRoutes() http.Handler {
 	e := echo.New()
-	e.Use(middleware.Logger())
+	e.Use(middleware.RequestID())
+	e.Use(middleware.RequestLoggerWithConfig(requestLoggerConfig))
 	e.Use(middleware.Recover())
+	if len(s.origins) > 0 {
+		e.Use(cors(s.origins))
+	}
 
 	e.GET("/", s.HelloWorldHandler)
 
 	e.GET("/health", s.healthHandler)
+	e.GET("/livez", s.livezHandler)
+	e.GET("/readyz", s.readyzHandler)
+	e.GET("/metrics", echo.WrapHandler(promhttp.Handler()))
+	e.GET("/pulse.js", pulseJSHandler)
+
+	// Subscribing requires a token once PULSE_JWT_SECRET is set, or an API
+	// key once there are some
+	var subscribe []echo.MiddlewareFunc
+	if s.limits.enabled() {
+		subscribe = append(subscribe, s.limitConnections)
+	}
+	if auth := s.authenticate(); auth != nil {
+		subscribe = append(subscribe, auth)
+	}
+
+	e.GET("/ws", s.muxHandler, subscribe...)
+	e.GET("/ws/all", s.firehose(s.wsHandler), subscribe...)
+	e.GET("/sse/all", s.firehose(s.sseHandler), subscribe...)
+
+	// Publishing is disabled unless a token is configured
+	if token := os.Getenv("PULSE_PUBLISH_TOKEN"); token != "" {
+		e.POST("/publish", s.publishHandler, middleware.KeyAuth(func(key string, c echo.Context) (bool, error) {
+			return subtle.ConstantTimeCompare([]byte(key), []byte(token)) == 1, nil
+		}))
+	}
+
+	e.GET("/events", s.eventsHandler, subscribe...)
+
+	// So is the admin API, along with the dashboard calling it
+	if token := os.Getenv("PULSE_ADMIN_TOKEN"); token != "" {
+		s.registerAdmin(e, token)
+		registerUI(e)
+	}
+
+	// Named databases have routes of their own, e.g. /ws/eu/orders, which
+	// win over the ids of tables named like them
+	for _, db := range s.dbs {
+		if source := db.Source(); database.ValidName(source) {
+			scoped := append([]echo.MiddlewareFunc{scopedTo(source)}, subscribe...)
+			e.GET("/ws/"+source+"/:table", s.wsHandler, scoped...)
+			e.GET("/ws/"+source+"/:table/:id", s.wsHandler, scoped...)
+			e.GET("/sse/"+source+"/:table", s.sseHandler, scoped...)
+			e.GET("/sse/"+source+"/:table/:id", s.sseHandler, scoped...)
+		}
+	}
+
+	e.GET("/ws/:table", s.wsHandler, subscribe...)
+	e.GET("/ws/:table/:id", s.wsHandler, subscribe...)
 
-	e.GET("/ws/all", s.allWsHandler)
-	e.GET("/ws/:table", s.singleTableWsHandler)
-	e.GET("/ws/:table/:id", s.singleRowWsHandler)
+	e.GET("/sse/:table", s.sseHandler, subscribe...)
+	e.GET("/sse/:table/:id", s.sseHandler, subscribe...)
 
 	return e
 }
 
+// scopedTo restricts the subscriptions of a route to the database whose
+// source is source, as ?source= does.
+func scopedTo(source string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			r := c.Request()
+			query := r.URL.Query()
+			query.Set("source", source)
+			r.URL.RawQuery = query.Encode()
+			return next(c)
+		}
+	}
+}
+
+// requestLoggerConfig logs every request once it's served, with its
+// X-Request-ID. Websockets and event streams are logged when they close.
+var requestLoggerConfig = middleware.RequestLoggerConfig{
+	LogRequestID: true,
+	LogMethod:    true,
+	LogURIPath:   true,
+	LogStatus:    true,
+	LogLatency:   true,
+	LogRemoteIP:  true,
+	LogError:     true,
+	HandleError:  true,
+	LogValuesFunc: func(c echo.Context, v middleware.RequestLoggerValues) error {
+		attrs := []any{
+			"request_id", v.RequestID,
+			"method", v.Method,
+			"path", v.URIPath,
+			"status", v.Status,
+			"latency", v.Latency,
+			"remote_ip", v.RemoteIP,
+		}
+		if table := c.Param("table"); table != "" {
+			attrs = append(attrs, "table", table)
+		}
+		if name, ok := c.Get(apiKeyNameKey).(string); ok {
+			attrs = append(attrs, "api_key", name)
+		}
+
+		if v.Error != nil {
+			slog.Warn("Request failed", append(attrs, "error", v.Error)...)
+		} else {
+			slog.Info("Request served", attrs...)
+		}
+		return nil
+	},
+}
+
+// requestLogger returns the logger of the lines about the request of c,
+// telling which one it is.
+func requestLogger(c echo.Context) *slog.Logger {
+	return slog.With("request_id", c.Response().Header().Get(echo.HeaderXRequestID))
+}
+
+// firehose guards the /all route of handler. Unless the firehose is enabled
+// it only restores saved subscriptions.
+// It's registered explicitly either way, so /:table doesn't pick it up as
+// table "all".
+func (s *Server) firehose(handler echo.HandlerFunc) echo.HandlerFunc {
+	if s.firehoseEnabled() {
+		return handler
+	}
+
+	return func(c echo.Context) error {
+		if c.QueryParam("client_id") != "" {
+			return handler(c)
+		}
+		return echo.ErrNotFound
+	}
+}
+
+// firehoseEnabled reports whether /ws/all should be exposed, as configured
+// or, if it wasn't, as set by PULSE_ENABLE_FIREHOSE.
+func (s *Server) firehoseEnabled() bool {
+	if s.firehoseOption != nil {
+		return *s.firehoseOption
+	}
+
+	enabled, ok := firehoseFromEnv()
+	return enabled || !ok
+}
+
+// errFirehoseDisabled refuses the subscriptions to every table while the
+// firehose is disabled.
+var errFirehoseDisabled = errors.New("the firehose is disabled, a table is required")
+
+// checkFirehose returns errFirehoseDisabled if sub gets the notifications of
+// every table, without a table or through a pattern like *, while the
+// firehose is disabled. Every transport checks its subscriptions with it.
+func (s *Server) checkFirehose(sub Subscription) error {
+	if sub.matchesEveryTable() && !s.firehoseEnabled() {
+		return errFirehoseDisabled
+	}
+	return nil
+}
+
+// firehoseFromEnv returns whether PULSE_ENABLE_FIREHOSE enables /ws/all, and
+// whether it's set to a valid boolean at all.
+func firehoseFromEnv() (enabled, ok bool) {
+	enabled, err := strconv.ParseBool(os.Getenv("PULSE_ENABLE_FIREHOSE"))
+	return enabled, err == nil
+}
+
+// newClient builds the client for a websocket request out of its path and
+// query parameters.
+// With ?client_id= and no other subscription parameters on /ws/all, the
+// subscription the same subscriber saved for that id is restored, and
+// authorized again like a new one.
+// It returns an error if any of the parameters is invalid.
+func (s *Server) newClient(c echo.Context) (*client, error) {
+	clientID := c.QueryParam("client_id")
+	if len(clientID) > 128 {
+		return nil, fmt.Errorf("client_id must have at most 128 characters")
+	}
+
+	table, id, query := c.Param("table"), c.Param("id"), c.QueryParams()
+	who := s.subscriberOf(c)
+
+	var sub Subscription
+	restored := false
+	if clientID != "" && table == "" && !hasSubscriptionParams(query) {
+		sub, restored = s.subscriptions.load(who.identity, clientID)
+	}
+
+	if !restored {
+		if table == "" && !s.firehoseEnabled() {
+			return nil, fmt.Errorf("no subscription saved for client_id %q", clientID)
+		}
+
+		var err error
+		if sub, err = NewSubscription(table, id, query); err != nil {
+			return nil, err
+		}
+		if err := s.checkFirehose(sub); err != nil {
+			return nil, err
+		}
+	}
+
+	cli, err := s.clientFor(sub, query, who)
+	if err != nil {
+		return nil, err
+	}
+	cli.clientID = clientID
+	cli.identity = who.identity
+	cli.requestID = c.Response().Header().Get(echo.HeaderXRequestID)
+
+	return cli, nil
+}
+
+// clientFor builds the client of sub, configured by the query parameters and
+// granted what who is.
+// It returns an error if any of the parameters is invalid, or errForbidden if
+// sub isn't granted.
+func (s *Server) clientFor(sub Subscription, query url.Values, who subscriber) (*client, error) {
+	cli := &client{
+		sub:      sub,
+		overflow: overflowDisconnect,
+		send:     make(chan queued, queueSize()),
+		kicked:   make(chan struct{}),
+
+		writeTimeout: writeTimeout(),
+	}
+
+	if since := query.Get("since_time"); since != "" {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			return nil, fmt.Errorf("since_time must be an RFC 3339 timestamp")
+		}
+		cli.since = t
+	}
+
+	if since := query.Get("since"); since != "" {
+		seq, err := strconv.ParseInt(since, 10, 64)
+		if err != nil || seq < 0 {
+			return nil, fmt.Errorf("since must be the seq of a notification")
+		}
+		if sub.aggregate != nil {
+			return nil, fmt.Errorf("since can't be combined with aggregate")
+		}
+		cli.resume, cli.after = true, seq
+	}
+
+	var err error
+	if cli.snapshot, err = parseSnapshot(sub, query); err != nil {
+		return nil, err
+	}
+	if cli.snapshot != nil && (cli.resume || !cli.since.IsZero()) {
+		return nil, fmt.Errorf("snapshot can't be combined with since or since_time")
+	}
+
+	switch overflow := query.Get("overflow"); overflow {
+	case "":
+	case overflowDisconnect, overflowDropOldest, overflowDropNewest:
+		cli.overflow = overflow
+	default:
+		return nil, fmt.Errorf("overflow must be one of %s, %s or %s", overflowDisconnect, overflowDropOldest, overflowDropNewest)
+	}
+
+	switch envelope := query.Get("envelope"); envelope {
+	case "", envelopeDebezium:
+		cli.envelope = envelope
+	default:
+		return nil, fmt.Errorf("envelope must be %s", envelopeDebezium)
+	}
+
+	switch encoding := query.Get("encoding"); encoding {
+	case "", encodingJSON:
+	case encodingMsgpack, encodingProtobuf:
+		if encoding == encodingProtobuf && cli.envelope != "" {
+			return nil, fmt.Errorf("encoding %s can't be combined with envelope", encodingProtobuf)
+		}
+		cli.encoding = encoding
+	default:
+		return nil, fmt.Errorf("encoding must be one of %s, %s or %s", encodingJSON, encodingMsgpack, encodingProtobuf)
+	}
+
+	if encrypt := query.Get("encrypt"); encrypt != "" {
+		enabled, err := strconv.ParseBool(encrypt)
+		if err != nil {
+			return nil, fmt.Errorf("encrypt must be a boolean")
+		}
+
+		if enabled {
+			// Patches and envelopes would carry the row in the clear
+			if sub.diff || cli.envelope != "" {
+				return nil, fmt.Errorf("encrypt can't be combined with diff or envelope")
+			}
+			if cli.session, err = newSession(query.Get("key")); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if sub.aggregate != nil {
+		if cli.envelope != "" || cli.session != nil || cli.encoding != "" {
+			return nil, fmt.Errorf("aggregate can't be combined with envelope, encoding or encrypt")
+		}
+		// The rows are read without the columns their allowlist leaves out
+		if column := sub.aggregate.column; column != "" {
+			for _, db := range s.dbs {
+				if (sub.source == "" || sub.source == db.Source()) && !db.ColumnAllowed(sub.table(), column) {
+					return nil, fmt.Errorf("column %s of %s can't be aggregated, it's left out of the notifications", column, sub.table())
+				}
+			}
+		}
+		cli.aggregator = newAggregator(sub)
+	}
+
+	switch batch := query.Get("batch"); batch {
+	case "":
+	case batchTransaction:
+		if sub.aggregate != nil || cli.envelope != "" {
+			return nil, fmt.Errorf("batch can't be combined with aggregate or envelope")
+		}
+		cli.batcher = &batcher{}
+	default:
+		return nil, fmt.Errorf("batch must be %s", batchTransaction)
+	}
+
+	if cli.limiter, err = parseRateLimit(query); err != nil {
+		return nil, err
+	}
+	if cli.limiter != nil && (sub.aggregate != nil || cli.batcher != nil) {
+		return nil, fmt.Errorf("max_rate can't be combined with aggregate or batch")
+	}
+
+	if cli.debouncer, err = parseCoalesce(query); err != nil {
+		return nil, err
+	}
+	if cli.debouncer != nil && (sub.aggregate != nil || cli.batcher != nil || cli.limiter != nil) {
+		return nil, fmt.Errorf("coalesce can't be combined with aggregate, batch or max_rate")
+	}
+
+	heartbeat, err := parseHeartbeat(query)
+	if err != nil {
+		return nil, err
+	}
+	cli.heartbeat = heartbeat
+
+	cli.grant, cli.claims = who.grant, who.claims
+	if err := cli.authorize(); err != nil {
+		return nil, err
+	}
+
+	return cli, nil
+}
+
 func (s *Server) HelloWorldHandler(c echo.Context) error {
 	resp := map[string]string{
 		"message": "Hello World",
@@ -37,19 +389,60 @@ func (s *Server) HelloWorldHandler(c echo.Context) error {
 	return c.JSON(http.StatusOK, resp)
 }
 
+// healthHandler reports the stats of every database, with a 503 if any of
+// them is down. The server keeps running meanwhile, Watch reconnects once
+// it's back.
 func (s *Server) healthHandler(c echo.Context) error {
-	return c.JSON(http.StatusOK, s.db.Health())
+	status := http.StatusOK
+	resp := make(map[string]map[string]string)
+	for _, db := range s.dbs {
+		stats, err := db.Health(c.Request().Context())
+		if err != nil {
+			requestLogger(c).Warn("Database down", "source", db.Source(), "error", err)
+			status = http.StatusServiceUnavailable
+		}
+		resp[db.Source()] = stats
+	}
+
+	if len(s.dbs) == 1 {
+		return c.JSON(status, resp[s.dbs[0].Source()])
+	}
+	return c.JSON(status, resp)
+}
+
+// livezHandler reports the process is up, it never touches the databases.
+func (s *Server) livezHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, map[string]string{"status": "up"})
+}
+
+// readyzHandler reports whether every database has its triggers synced and
+// is being watched, i.e. whether the server can deliver notifications.
+func (s *Server) readyzHandler(c echo.Context) error {
+	resp := make(map[string]string)
+	ready := true
+	for _, db := range s.dbs {
+		if db.Ready() {
+			resp[db.Source()] = "ready"
+		} else {
+			resp[db.Source()] = "not ready"
+			ready = false
+		}
+	}
+
+	if !ready {
+		return c.JSON(http.StatusServiceUnavailable, resp)
+	}
+	return c.JSON(http.StatusOK, resp)
 }
 
 func (s *Server) websocketHandler(c echo.Context) error {
 	w := c.Response().Writer
 	r := c.Request()
-	socket, err := websocket.Accept(w, r, nil)
+	socket, err := websocket.Accept(w, r, s.acceptOptions())
 
 	if err != nil {
-		log.Printf("could not open websocket: %v", err)
-		_, _ = w.Write([]byte("could not open websocket"))
-		w.WriteHeader(http.StatusInternalServerError)
+		// Accept already answered, e.g. 403 to other origins
+		requestLogger(c).Warn("Failed to open the websocket", "error", err)
 		return nil
 	}
 
@@ -69,113 +462,342 @@ func (s *Server) websocketHandler(c echo.Context) error {
 	return nil
 }
 
-func (s *Server) allWsHandler(c echo.Context) error {
-	w := c.Response().Writer
-	r := c.Request()
+// reservedOperations can't be published, they're emitted by pulse itself
+var reservedOperations = map[string]bool{
+	"insert":                       true,
+	"update":                       true,
+	"delete":                       true,
+	database.OperationEventLost:    true,
+	database.OperationResubscribed: true,
+	database.OperationSchema:       true,
+	database.OperationDDL:          true,
+	database.OperationTruncate:     true,
+}
 
-	socket, err := websocket.Accept(w, r, nil)
-	if err != nil {
-		log.Printf("could not open websocket: %v", err)
-		_, _ = w.Write([]byte("could not open websocket"))
-		w.WriteHeader(http.StatusInternalServerError)
-		return nil
+// publishHandler pushes a custom event into the stream.
+// The body is a DBNotification with a custom operation, it goes through the
+// same filtering as database changes.
+func (s *Server) publishHandler(c echo.Context) error {
+	var msg database.DBNotification
+	if err := json.NewDecoder(c.Request().Body).Decode(&msg); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "body must be a JSON notification")
 	}
-	defer socket.Close(websocket.StatusGoingAway, "server closing websocket")
 
-	s.clients[socket] = &client{}
+	if !validTable(msg.Table) {
+		return echo.NewHTTPError(http.StatusBadRequest, "table must be a valid table name")
+	}
 
-	ctx := r.Context()
-	socketCtx := socket.CloseRead(ctx)
+	if msg.Operation == "" || len(msg.Operation) > 64 {
+		return echo.NewHTTPError(http.StatusBadRequest, "operation must have between 1 and 64 characters")
+	}
 
-	ticker := time.NewTicker(5 * time.Second)
-	defer ticker.Stop()
+	if reservedOperations[msg.Operation] {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("operation %q is reserved", msg.Operation))
+	}
 
-_for:
-	for {
-		select {
-		case <-socketCtx.Done():
-			break _for
-		case <-ticker.C:
-			if err := socket.Ping(socketCtx); err != nil {
-				log.Println("Failed to ping socket", err)
-				break _for
-			}
+	msg.Source = publishSource
+	msg.Txid = 0
+	msg.EmittedAt = time.Now()
+
+	// Continues the publisher's trace, if it sent one
+	var parent tracing.SpanContext
+	if traceparent := c.Request().Header.Get("traceparent"); traceparent != "" {
+		parent, _ = tracing.ParseTraceparent(traceparent)
+	}
+	span := tracing.Start(parent, "pulse.publish",
+		attribute.String("pulse.table", msg.Table),
+		attribute.String("pulse.operation", msg.Operation))
+	defer span.End()
+	if sc := span.SpanContext(); sc.IsValid() {
+		parent = sc
+	}
+	if parent.IsValid() {
+		msg.Span = parent
+		msg.TraceID = parent.TraceID().String()
+	}
+
+	// The clients of the other replicas get it through the first database
+	if len(s.dbs) > 0 {
+		if err := s.dbs[0].Relay(c.Request().Context(), msg); err != nil && !errors.Is(err, database.ErrClusterDisabled) {
+			tracing.SetError(span, err)
+			requestLogger(c).Error("Failed to relay the published event", "table", msg.Table, "error", err)
+			return echo.NewHTTPError(http.StatusServiceUnavailable, "could not relay the event to the other replicas")
 		}
 	}
 
-	return nil
+	// Shutdown closes broadcast once no publish is sending to it
+	s.publishing.RLock()
+	defer s.publishing.RUnlock()
+
+	select {
+	case <-s.closing:
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "the server is shutting down")
+	default:
+	}
+
+	select {
+	case s.broadcast <- msg:
+	case <-s.closing:
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "the server is shutting down")
+	case <-c.Request().Context().Done():
+		return c.Request().Context().Err()
+	}
+
+	return c.NoContent(http.StatusAccepted)
 }
 
-func (s *Server) singleTableWsHandler(c echo.Context) error {
+// wsHandler subscribes a websocket to the notifications matching the route
+// and query parameters until either side closes it.
+// It's shared by /ws/all, /ws/:table and /ws/:table/:id.
+func (s *Server) wsHandler(c echo.Context) error {
+	cli, err := s.newClient(c)
+	if errors.Is(err, errForbidden) {
+		return echo.NewHTTPError(http.StatusForbidden, err.Error())
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
 	w := c.Response().Writer
 	r := c.Request()
 
-	socket, err := websocket.Accept(w, r, nil)
+	socket, err := websocket.Accept(w, r, s.acceptOptions())
 	if err != nil {
-		log.Printf("could not open websocket: %v", err)
-		_, _ = w.Write([]byte("could not open websocket"))
-		w.WriteHeader(http.StatusInternalServerError)
+		// Accept already answered, e.g. 403 to other origins
+		requestLogger(c).Warn("Failed to open the websocket", "error", err)
 		return nil
 	}
 	defer socket.Close(websocket.StatusGoingAway, "server closing websocket")
 
-	s.clients[socket] = &client{table: c.Param("table")}
+	cli.version = socket.Subprotocol()
+	if cli.version == "" {
+		cli.version = protocolV1
+	}
 
-	ctx := r.Context()
-	socketCtx := socket.CloseRead(ctx)
+	cli.conn = socket
+	s.serve(cli, socket.CloseRead(r.Context()))
 
-	ticker := time.NewTicker(5 * time.Second)
-	defer ticker.Stop()
+	return nil
+}
 
-_for:
-	for {
-		select {
-		case <-socketCtx.Done():
-			break _for
-		case <-ticker.C:
-			if err := socket.Ping(socketCtx); err != nil {
-				log.Println("Failed to ping socket", err)
-				break _for
-			}
-		}
+// sseHandler streams the notifications matching the route and query
+// parameters as server-sent events, in the pulse.v2 shape, until either side
+// closes the stream.
+// It's shared by /sse/all, /sse/:table and /sse/:table/:id.
+func (s *Server) sseHandler(c echo.Context) error {
+	cli, err := s.newClient(c)
+	if errors.Is(err, errForbidden) {
+		return echo.NewHTTPError(http.StatusForbidden, err.Error())
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if cli.encoding != "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "encoding isn't supported by server-sent events")
+	}
+
+	stream, err := newSSEConn(c.Response())
+	if err != nil {
+		cli.logger().Warn("Failed to open the event stream", "error", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "could not open event stream")
 	}
+	defer stream.finish()
+
+	cli.version = protocolV2
+	cli.conn = stream
+
+	ctx, cancel := context.WithCancel(c.Request().Context())
+	defer cancel()
+	stop := context.AfterFunc(stream.ctx, cancel)
+	defer stop()
+
+	s.serve(cli, ctx)
 
 	return nil
 }
 
-func (s *Server) singleRowWsHandler(c echo.Context) error {
-	w := c.Response().Writer
-	r := c.Request()
+// serve registers cli and writes it the notifications the Hub queues until
+// ctx is done or the connection is closed.
+func (s *Server) serve(cli *client, ctx context.Context) {
+	cli.ctx, cli.cancel = context.WithCancel(ctx)
+	defer cli.cancel()
 
-	socket, err := websocket.Accept(w, r, nil)
-	if err != nil {
-		log.Printf("could not open websocket: %v", err)
-		_, _ = w.Write([]byte("could not open websocket"))
-		w.WriteHeader(http.StatusInternalServerError)
-		return nil
+	s.handlers.Add(1)
+	defer s.handlers.Done()
+
+	s.clients.register(cli)
+	defer s.clients.unregister(cli)
+
+	// Released on disconnect, so it expires a ttl after the client left
+	if cli.clientID != "" {
+		s.subscriptions.save(cli.identity, cli.clientID, cli)
+		defer s.subscriptions.release(cli.identity, cli.clientID, cli)
 	}
-	defer socket.Close(websocket.StatusGoingAway, "server closing websocket")
 
-	s.clients[socket] = &client{table: c.Param("table"), id: c.Param("id")}
+	// The key goes first, nothing can be decrypted without it
+	if cli.session != nil {
+		jsonData, _ := json.Marshal(cli.session.keyMessage())
+		if err := cli.conn.Write(cli.ctx, websocket.MessageText, jsonData); err != nil {
+			return
+		}
+	}
 
-	ctx := r.Context()
-	socketCtx := socket.CloseRead(ctx)
+	// Live notifications queue up while the table is aggregated or
+	// snapshotted, or the persisted ones are replayed
+	var flush <-chan time.Time
+	if cli.aggregator != nil {
+		if !s.seed(cli) {
+			return
+		}
+
+		flushTicker := time.NewTicker(aggregateInterval())
+		defer flushTicker.Stop()
+		flush = flushTicker.C
+	} else if cli.snapshot != nil {
+		if !s.snapshot(cli) {
+			return
+		}
+	} else if cli.resume {
+		if !s.resume(cli) {
+			return
+		}
+	} else if !cli.since.IsZero() && !s.replay(cli) {
+		return
+	}
 
-	ticker := time.NewTicker(5 * time.Second)
+	// Transactions are delivered once they got no change for a while
+	var batches <-chan time.Time
+	if cli.batcher != nil {
+		batchTicker := time.NewTicker(transactionWait / 2)
+		defer batchTicker.Stop()
+		batches = batchTicker.C
+	}
+
+	// Updates over the rate, or within the coalesce window, are held until
+	// they can be delivered
+	var limited <-chan time.Time
+	if cli.limiter != nil {
+		limitTicker := time.NewTicker(cli.limiter.tick())
+		defer limitTicker.Stop()
+		limited = limitTicker.C
+	} else if cli.debouncer != nil {
+		limitTicker := time.NewTicker(cli.debouncer.tick())
+		defer limitTicker.Stop()
+		limited = limitTicker.C
+	}
+
+	var heartbeats <-chan time.Time
+	if cli.heartbeat > 0 {
+		heartbeatTicker := time.NewTicker(cli.heartbeat)
+		defer heartbeatTicker.Stop()
+		heartbeats = heartbeatTicker.C
+	}
+
+	ticker := time.NewTicker(pingInterval())
 	defer ticker.Stop()
 
-_for:
 	for {
 		select {
-		case <-socketCtx.Done():
-			break _for
+		case <-ctx.Done():
+			return
+		case <-cli.kicked:
+			disconnect(cli.conn, kickedCode, reasonAdmin)
+			return
+		case out, ok := <-cli.send:
+			if !ok {
+				// The held updates and buffered transactions are delivered
+				// before the close, like the rest of the queue
+				if cli.limiter != nil && !s.deliverReady(cli, cli.limiter.flush()) {
+					return
+				}
+				// Far enough in the future for every window to have passed
+				if cli.debouncer != nil && !s.deliverReady(cli, cli.debouncer.due(time.Now().Add(maxCoalesceWindow))) {
+					return
+				}
+				if cli.batcher != nil && !s.deliverBatches(cli, cli.batcher.due(time.Time{})) {
+					return
+				}
+				disconnect(cli.conn, cli.closeCode, cli.closeReason)
+				return
+			}
+			msg := out.msg
+
+			// Queued while resuming, it was delivered already
+			if cli.resume && msg.Seq <= cli.after {
+				continue
+			}
+			// Persisted before it was replayed, it was delivered already
+			if msg.Persisted != 0 && msg.Persisted <= cli.replayed[msg.Source] {
+				continue
+			}
+
+			if cli.aggregator != nil {
+				if !cli.aggregator.apply(msg) {
+					cli.logger().Debug("Seeding the aggregate again", "table", cli.sub.table(), "operation", msg.Operation, "gap", msg.Gap())
+					if !s.seed(cli) {
+						return
+					}
+				}
+				continue
+			}
+
+			if cli.limiter != nil {
+				if !s.deliverReady(cli, cli.limiter.admit(out, time.Now())) {
+					return
+				}
+				continue
+			}
+			if cli.debouncer != nil {
+				if !s.deliverReady(cli, cli.debouncer.admit(out, time.Now())) {
+					return
+				}
+				continue
+			}
+
+			// Notifications outside of transactions, like published ones and
+			// gaps, come after those queued before them
+			if cli.batcher != nil && msg.Txid != 0 {
+				if !s.deliverBatches(cli, cli.batcher.add(out, time.Now())) {
+					return
+				}
+				continue
+			}
+			if cli.batcher != nil && !s.deliverBatches(cli, cli.batcher.due(time.Time{})) {
+				return
+			}
+
+			if !s.deliver(cli, msg, out.shared) {
+				return
+			}
+			observeLatency(msg)
+		case <-flush:
+			if cli.aggregator.dirty && !s.sendAggregate(cli) {
+				return
+			}
+		case <-batches:
+			if !s.deliverBatches(cli, cli.batcher.due(time.Now())) {
+				return
+			}
+		case <-limited:
+			var ready []queued
+			if cli.limiter != nil {
+				ready = cli.limiter.release(time.Now())
+			} else {
+				ready = cli.debouncer.due(time.Now())
+			}
+			if !s.deliverReady(cli, ready) {
+				return
+			}
+		case <-heartbeats:
+			if !sendHeartbeat(cli) {
+				return
+			}
 		case <-ticker.C:
-			if err := socket.Ping(socketCtx); err != nil {
-				log.Println("Failed to ping socket", err)
-				break _for
+			// A peer that stopped answering is dropped like one that stopped reading
+			if err := cli.ping(); err != nil {
+				cli.logger().Info("Failed to ping the socket", "error", err)
+				return
 			}
 		}
 	}
-
-	return nil
 }
@@ -0,0 +1,226 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"pulse/internal/database"
+)
+
+// defaultTableQueueSize is how many notifications of a single table can wait
+// for the Hub before the table queue policy applies.
+const defaultTableQueueSize = 256
+
+// What happens to the notifications of a table whose queue is full, picked
+// with PULSE_TABLE_QUEUE_POLICY
+const (
+	// tableQueueBlock stops reading new notifications until the table's
+	// queue has room again, nothing is lost
+	tableQueueBlock = "block"
+	// tableQueueDropOldest drops the table's oldest notification, which is
+	// dead-lettered, and tells the table's subscribers with event_lost
+	tableQueueDropOldest = "drop_oldest"
+)
+
+// dropTableQueueFull is why the notifications of a table whose queue
+// overflowed are dropped.
+const dropTableQueueFull = "table_queue_full"
+
+// scheduler queues notifications per table and hands them to the Hub round
+// robin across tables, so a table churning far faster than the others can't
+// delay their notifications behind its own.
+// The order of the notifications within a table is preserved: a table's
+// next notification isn't popped until its last one is done. A table
+// queuing more than its share either holds the intake back until it's
+// drained or drops its oldest notifications, depending on the policy.
+type scheduler struct {
+	mut  sync.Mutex
+	cond *sync.Cond
+
+	queues map[string][]database.DBNotification
+	// active are the tables with queued notifications, in round robin order
+	active []string
+	next   int
+	// busy are the tables whose last notification popped isn't done yet
+	busy map[string]bool
+	// lost are the tables that dropped notifications since they were last
+	// popped, with the gap to hand out before their next notification
+	lost   map[string]database.DBNotification
+	size   int
+	policy string
+	closed bool
+}
+
+// tableQueueFromEnv returns the queue size and policy set by
+// PULSE_TABLE_QUEUE_SIZE and PULSE_TABLE_QUEUE_POLICY, zero and empty when
+// they're unset.
+// It returns an error if either is invalid.
+func tableQueueFromEnv() (int, string, error) {
+	var size int
+	if value := os.Getenv("PULSE_TABLE_QUEUE_SIZE"); value != "" {
+		var err error
+		if size, err = strconv.Atoi(value); err != nil || size < 1 {
+			return 0, "", fmt.Errorf("PULSE_TABLE_QUEUE_SIZE must be a positive number")
+		}
+	}
+
+	policy := os.Getenv("PULSE_TABLE_QUEUE_POLICY")
+	if err := validTableQueuePolicy(policy); err != nil {
+		return 0, "", err
+	}
+
+	return size, policy, nil
+}
+
+// validTableQueuePolicy returns an error unless policy is a table queue
+// policy or empty, for the default.
+func validTableQueuePolicy(policy string) error {
+	switch policy {
+	case "", tableQueueBlock, tableQueueDropOldest:
+		return nil
+	}
+	return fmt.Errorf("table queue policy must be %s or %s", tableQueueBlock, tableQueueDropOldest)
+}
+
+// newScheduler creates a scheduler whose tables queue up to size
+// notifications, defaulting to 256, and apply policy once full, blocking by
+// default.
+func newScheduler(size int, policy string) *scheduler {
+	if size < 1 {
+		size = defaultTableQueueSize
+	}
+	if policy == "" {
+		policy = tableQueueBlock
+	}
+
+	s := &scheduler{
+		queues: make(map[string][]database.DBNotification),
+		lost:   make(map[string]database.DBNotification),
+		busy:   make(map[string]bool),
+		size:   size,
+		policy: policy,
+	}
+	s.cond = sync.NewCond(&s.mut)
+
+	return s
+}
+
+// push queues msg. When its table's queue is full it waits for room with the
+// block policy, or drops the table's oldest notification and returns it, with
+// true, with drop_oldest.
+func (s *scheduler) push(msg database.DBNotification) (database.DBNotification, bool) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	if s.policy == tableQueueBlock {
+		for len(s.queues[msg.Table]) >= s.size && !s.closed {
+			s.cond.Wait()
+		}
+	}
+
+	var dropped database.DBNotification
+	queue := s.queues[msg.Table]
+	full := len(queue) >= s.size
+	if full {
+		dropped = queue[0]
+		queue[0] = database.DBNotification{}
+		queue = queue[1:]
+
+		// Notifications of several sources may have been dropped, the gap
+		// then goes to the subscribers of any of them
+		gap, ok := s.lost[msg.Table]
+		if !ok {
+			gap = database.DBNotification{Operation: database.OperationEventLost, Table: dropped.Table, Schema: dropped.Schema, Source: dropped.Source}
+		} else if gap.Source != dropped.Source {
+			gap.Source = ""
+		}
+		s.lost[msg.Table] = gap
+	}
+
+	if len(queue) == 0 && !full {
+		s.active = append(s.active, msg.Table)
+	}
+	s.queues[msg.Table] = append(queue, msg)
+	s.cond.Broadcast()
+
+	return dropped, full
+}
+
+// pop returns the next notification, taking turns across the tables that
+// aren't busy. A table that dropped notifications since its last turn gets
+// an event_lost notification for the table first.
+// The table is busy until done is called for it. pop waits for a
+// notification of a table that isn't busy and returns false once the
+// scheduler is closed and drained.
+func (s *scheduler) pop() (database.DBNotification, bool) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	i := s.ready()
+	for i < 0 {
+		if s.closed && len(s.active) == 0 {
+			return database.DBNotification{}, false
+		}
+		s.cond.Wait()
+		i = s.ready()
+	}
+	table := s.active[i]
+	s.busy[table] = true
+	s.next = i
+
+	// The table keeps its turn, its notifications follow the gap
+	if gap, ok := s.lost[table]; ok {
+		delete(s.lost, table)
+		gap.EmittedAt = time.Now()
+		return gap, true
+	}
+
+	queue := s.queues[table]
+	msg := queue[0]
+	queue[0] = database.DBNotification{}
+
+	if len(queue) == 1 {
+		delete(s.queues, table)
+		s.active = append(s.active[:i], s.active[i+1:]...)
+	} else {
+		s.queues[table] = queue[1:]
+		s.next++
+	}
+	s.cond.Broadcast()
+
+	return msg, true
+}
+
+// ready returns the index in active of the next table whose turn it is and
+// isn't busy, -1 if there's none.
+func (s *scheduler) ready() int {
+	for n := 0; n < len(s.active); n++ {
+		i := (s.next + n) % len(s.active)
+		if !s.busy[s.active[i]] {
+			return i
+		}
+	}
+	return -1
+}
+
+// done tells the notification last popped of table was fanned out, its next
+// one can be popped.
+func (s *scheduler) done(table string) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	delete(s.busy, table)
+	s.cond.Broadcast()
+}
+
+// close makes pop return false once the queued notifications are drained.
+func (s *scheduler) close() {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	s.closed = true
+	s.cond.Broadcast()
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"pulse/internal/database"
+)
+
+func TestSchedulerTakesTurnsAcrossTables(t *testing.T) {
+	s := newScheduler(1000, "")
+
+	for i := 0; i < 1000; i++ {
+		s.push(database.DBNotification{Table: "audit_log"})
+	}
+	s.push(database.DBNotification{Table: "orders"})
+
+	// The rare table is served within one turn of the hot one
+	for i := 0; i < 2; i++ {
+		msg, _ := s.pop()
+		if msg.Table == "orders" {
+			return
+		}
+		s.done(msg.Table)
+	}
+	t.Errorf("orders wasn't served within a turn of audit_log")
+}
+
+func TestSchedulerBlocksFullTableQueues(t *testing.T) {
+	s := newScheduler(2, tableQueueBlock)
+
+	s.push(database.DBNotification{Table: "audit_log", ID: "1"})
+	s.push(database.DBNotification{Table: "audit_log", ID: "2"})
+
+	pushed := make(chan struct{})
+	go func() {
+		s.push(database.DBNotification{Table: "audit_log", ID: "3"})
+		close(pushed)
+	}()
+
+	select {
+	case <-pushed:
+		t.Fatalf("push to a full table queue didn't wait")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	var ids []string
+	for i := 0; i < 3; i++ {
+		msg, _ := s.pop()
+		ids = append(ids, msg.ID)
+		s.done(msg.Table)
+		if i == 0 {
+			<-pushed
+		}
+	}
+
+	if len(ids) != 3 || ids[0] != "1" || ids[1] != "2" || ids[2] != "3" {
+		t.Errorf("audit_log popped %v, expected [1 2 3] in order", ids)
+	}
+}
+
+func TestSchedulerDropsOldestOfFullTableQueues(t *testing.T) {
+	s := newScheduler(2, tableQueueDropOldest)
+
+	s.push(database.DBNotification{Table: "audit_log", ID: "1", Source: "main"})
+	s.push(database.DBNotification{Table: "audit_log", ID: "2", Source: "main"})
+
+	dropped, full := s.push(database.DBNotification{Table: "audit_log", ID: "3", Source: "main"})
+	if !full || dropped.ID != "1" {
+		t.Errorf("push to a full table queue = %v, %v, expected 1 dropped", dropped, full)
+	}
+
+	// Other tables aren't held back by a full one
+	if _, full := s.push(database.DBNotification{Table: "orders"}); full {
+		t.Errorf("push to orders dropped a notification")
+	}
+
+	var popped []database.DBNotification
+	for i := 0; i < 4; i++ {
+		msg, _ := s.pop()
+		if msg.Table == "audit_log" {
+			popped = append(popped, msg)
+		}
+		s.done(msg.Table)
+	}
+
+	// The gap precedes what's left of the table
+	if len(popped) != 3 || popped[0].Operation != database.OperationEventLost || popped[0].Source != "main" || popped[1].ID != "2" || popped[2].ID != "3" {
+		t.Errorf("audit_log popped %v, expected event_lost, 2 and 3", popped)
+	}
+
+	s.close()
+	if _, ok := s.pop(); ok {
+		t.Errorf("pop succeeded on a closed and drained scheduler")
+	}
+}
+
+func TestSchedulerSkipsBusyTables(t *testing.T) {
+	s := newScheduler(0, "")
+
+	s.push(database.DBNotification{Table: "audit_log", ID: "1"})
+	s.push(database.DBNotification{Table: "audit_log", ID: "2"})
+	s.push(database.DBNotification{Table: "orders", ID: "1"})
+
+	if msg, _ := s.pop(); msg.Table != "audit_log" || msg.ID != "1" {
+		t.Fatalf("popped %v, expected audit_log 1", msg)
+	}
+
+	// audit_log 2 waits for audit_log 1 to be done, orders doesn't
+	if msg, _ := s.pop(); msg.Table != "orders" {
+		t.Fatalf("popped %v while audit_log is busy, expected orders", msg)
+	}
+	s.done("orders")
+
+	popped := make(chan database.DBNotification)
+	go func() {
+		msg, _ := s.pop()
+		popped <- msg
+	}()
+
+	select {
+	case msg := <-popped:
+		t.Fatalf("popped %v while audit_log is busy", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	s.done("audit_log")
+	if msg := <-popped; msg.Table != "audit_log" || msg.ID != "2" {
+		t.Errorf("popped %v once audit_log was done, expected audit_log 2", msg)
+	}
+}
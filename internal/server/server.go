@@ -2,110 +2,1209 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"slices"
 	"strconv"
 	"sync"
 	"time"
 
 	_ "github.com/joho/godotenv/autoload"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
 	"nhooyr.io/websocket"
 
+	"pulse/internal/config"
 	"pulse/internal/database"
+	"pulse/internal/sinks"
+	"pulse/internal/tracing"
 )
 
-type client struct {
-	isClosing bool
-	mut       sync.Mutex
-	table     string
-	id        string
+// Wire contract versions, negotiated through the websocket subprotocol.
+// Clients that don't ask for one get pulse.v1.
+const (
+	// protocolV1 is the original flat shape: operation, table, id and data,
+	// along with seq and ts
+	protocolV1 = "pulse.v1"
+	// protocolV2 is the full DBNotification
+	protocolV2 = "pulse.v2"
+)
+
+// Websocket compression modes, picked with PULSE_WS_COMPRESSION
+const (
+	// compressionContextTakeover keeps a sliding window per connection, it
+	// compresses best but holds more memory
+	compressionContextTakeover = "context_takeover"
+	// compressionNoContextTakeover compresses every message on its own
+	compressionNoContextTakeover = "no_context_takeover"
+)
+
+// acceptOptions returns the options websockets are accepted with.
+// permessage-deflate is negotiated with the clients supporting it when
+// PULSE_WS_COMPRESSION is set, it's off by default since it costs CPU.
+// Messages smaller than PULSE_WS_COMPRESSION_THRESHOLD bytes aren't
+// compressed, the default depends on the mode.
+// Handshakes from other origins than the server's are refused unless they're
+// allowed by ALLOWED_ORIGINS.
+func (s *Server) acceptOptions() *websocket.AcceptOptions {
+	opts := &websocket.AcceptOptions{
+		Subprotocols:    []string{protocolV2, protocolV1},
+		CompressionMode: websocket.CompressionDisabled,
+	}
+
+	switch os.Getenv("PULSE_WS_COMPRESSION") {
+	case compressionContextTakeover:
+		opts.CompressionMode = websocket.CompressionContextTakeover
+	case compressionNoContextTakeover:
+		opts.CompressionMode = websocket.CompressionNoContextTakeover
+	}
+
+	if threshold, err := strconv.Atoi(os.Getenv("PULSE_WS_COMPRESSION_THRESHOLD")); err == nil && threshold > 0 {
+		opts.CompressionThreshold = threshold
+	}
+
+	if slices.Contains(s.origins, anyOrigin) {
+		opts.InsecureSkipVerify = true
+	} else {
+		opts.OriginPatterns = originHosts(s.origins)
+	}
+
+	return opts
+}
+
+// legacyNotification is the pulse.v1 shape of a DBNotification.
+type legacyNotification struct {
+	Operation string      `json:"operation"`
+	Table     string      `json:"table"`
+	ID        string      `json:"id"`
+	Seq       int64       `json:"seq,omitempty"`
+	EmittedAt time.Time   `json:"ts"`
+	Data      interface{} `json:"data"`
+}
+
+// patchNotification is a DBNotification sent as a patch, without its data.
+type patchNotification struct {
+	database.DBNotification
+	// Data shadows the embedded one, so it's omitted
+	Data interface{} `json:"data,omitempty"`
+}
+
+// encode marshals msg in the given encoding, in the shape of the given
+// envelope, if any, or of the given protocol version otherwise.
+// pulse.v1 has no patches, the whole row is always sent.
+func encode(msg database.DBNotification, version, envelope, encoding string) ([]byte, error) {
+	switch encoding {
+	case encodingProtobuf:
+		return encodeProtobuf(msg, version)
+	case encodingMsgpack:
+		jsonData, err := encode(msg, version, envelope, encodingJSON)
+		if err != nil {
+			return nil, err
+		}
+		return encodeMsgpack(jsonData)
+	}
+
+	if envelope == envelopeDebezium {
+		return encodeDebezium(msg)
+	}
+
+	if version == protocolV1 {
+		return json.Marshal(legacyNotification{
+			Operation: msg.Operation,
+			Table:     msg.Table,
+			ID:        msg.ID,
+			Seq:       msg.Seq,
+			EmittedAt: msg.EmittedAt,
+			Data:      msg.Data,
+		})
+	}
+
+	if msg.Patch != nil {
+		return json.Marshal(patchNotification{DBNotification: msg})
+	}
+
+	return json.Marshal(msg)
+}
+
+// encodings caches the encodings of a notification by protocol version,
+// envelope and encoding. A broadcast shares it between the clients receiving the
+// notification as is, so it's marshaled once per shape rather than once per
+// client.
+type encodings struct {
+	mut   sync.Mutex
+	cache map[encodingKey][]byte
+}
+
+type encodingKey struct {
+	version, envelope, encoding string
+}
+
+func newEncodings() *encodings {
+	return &encodings{cache: make(map[encodingKey][]byte)}
+}
+
+// encode returns msg encoded like encode does, the first time only. A nil
+// cache encodes it every time.
+// msg must be the notification the cache was shared for.
+func (e *encodings) encode(msg database.DBNotification, version, envelope, encoding string) ([]byte, error) {
+	if e == nil {
+		return encode(msg, version, envelope, encoding)
+	}
+
+	e.mut.Lock()
+	defer e.mut.Unlock()
+
+	key := encodingKey{version: version, envelope: envelope, encoding: encoding}
+	if data, ok := e.cache[key]; ok {
+		return data, nil
+	}
+
+	data, err := encode(msg, version, envelope, encoding)
+	if err == nil {
+		e.cache[key] = data
+	}
+	return data, err
+}
+
+// Reasons sent to clients in the control message preceding a forced close.
+const (
+	reasonWriteFailed = "write_failed"
+	reasonRowDeleted  = "row_deleted"
+	reasonShutdown    = "server_shutdown"
+	reasonSlowClient  = "slow_client"
+	reasonReplay      = "replay_failed"
+	reasonInternal    = "internal_error"
+	reasonSnapshot    = "snapshot_failed"
+)
+
+// reasonBreakerOpen is why the notifications dropped by the breaker are
+// dead-lettered.
+const reasonBreakerOpen = "breaker_open"
+
+// publishSource is the source of the events sent to /publish.
+const publishSource = "publish"
+
+// latencyBuckets are the histogram buckets in seconds, from 1ms to 10s.
+var latencyBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// deliveryLatency is the time from a change in the database to its delivery.
+var deliveryLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+	Name:    "pulse_notification_latency_seconds",
+	Help:    "Time from the database change to the delivery of its notification.",
+	Buckets: latencyBuckets,
+})
+
+// observeLatency records how long msg took to be delivered since it was emitted.
+// Replayed notifications aren't observed, they'd only measure their age.
+func observeLatency(msg database.DBNotification) {
+	if msg.EmittedAt.IsZero() {
+		return
+	}
+
+	deliveryLatency.Observe(time.Since(msg.EmittedAt).Seconds())
+}
+
+// writeErrors logs the failed writes to clients, which tend to come in
+// bursts, like when a deploy disconnects every client.
+var writeErrors = newThrottle("Failed to write to a client", time.Second)
+
+// dropQueueFull is why the notifications that didn't fit a client's send
+// queue are dropped, whether it was evicted or its overflow strategy dropped
+// one.
+const dropQueueFull = "queue_full"
+
+var (
+	receivedNotifications = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pulse_notifications_received_total",
+		Help: "Notifications received by the Hub, by table.",
+	}, []string{"table"})
+	droppedNotifications = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pulse_notifications_dropped_total",
+		Help: "Notifications that didn't reach a client or any of them, by reason: breaker_open, queue_full, rate_limited, table_queue_full, visibility_failed or write_failed.",
+	}, []string{"reason"})
+	evictedClients = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pulse_clients_evicted_total",
+		Help: "Clients disconnected by the hub, by reason: slow_client when their send queue overflowed or internal_error.",
+	}, []string{"reason"})
+	connectedClients = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pulse_connected_clients",
+		Help: "Clients connected, by the table they're subscribed to, empty for the firehose and several tables.",
+	}, []string{"table"})
+	fanoutDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "pulse_fanout_duration_seconds",
+		Help:    "Time to filter a notification and queue it for the matching clients.",
+		Buckets: latencyBuckets,
+	})
+	rejectedConnections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pulse_connections_rejected_total",
+		Help: "Subscriptions turned away by the connection limits, by reason: max_connections, max_connections_per_ip or rate_limited.",
+	}, []string{"reason"})
+	clientWriteErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "pulse_client_write_errors_total",
+		Help: "Writes to websocket and event stream clients that failed.",
+	})
+)
+
+// logWriteError counts and logs a failed write to a client.
+func logWriteError(err error) {
+	clientWriteErrors.Inc()
+	writeErrors.log(err)
+}
+
+// controlMessage is sent to clients for out-of-band events, so they can tell
+// them apart from DBNotification payloads.
+type controlMessage struct {
+	Operation string `json:"operation"`
+	Reason    string `json:"reason"`
+}
+
+// drainingMessage is sent to every client when the server starts shutting
+// down, so they can reconnect to another instance after RetryAfterMs.
+type drainingMessage struct {
+	Operation    string `json:"operation"`
+	RetryAfterMs int64  `json:"retry_after_ms"`
+}
+
+// defaultRetryAfter is how long draining clients are told to wait before
+// reconnecting.
+const defaultRetryAfter = time.Second
+
+// retryAfter returns the reconnect delay set by PULSE_DRAIN_RETRY_AFTER.
+func retryAfter() time.Duration {
+	delay, err := time.ParseDuration(os.Getenv("PULSE_DRAIN_RETRY_AFTER"))
+	if err != nil || delay < 0 {
+		return defaultRetryAfter
+	}
+
+	return delay
 }
 
 type Server struct {
 	port int
+	http *http.Server
+	// grpc serves the gRPC service, nil unless a port is configured for it
+	grpc     *grpc.Server
+	grpcAddr string
+
+	dbs         []database.Service
+	cancelWatch context.CancelFunc
+	watchers    sync.WaitGroup
 
-	db database.Service
+	clients  *clientRegistry
+	handlers sync.WaitGroup
 
-	clients   map[*websocket.Conn]*client
 	broadcast chan database.DBNotification
+	// closing is closed once Shutdown starts, publishing is held by the
+	// publishes sending to broadcast so it isn't closed under them
+	closing    chan struct{}
+	publishing sync.RWMutex
+	hubDone    chan struct{}
+	breaker    *breaker
+	pool       *pool
+	scheduler  *scheduler
+	limits     *connectionLimits
+	// rates counts the notifications of each table for the admin API
+	rates *eventRates
+	// ring numbers the notifications and keeps them for ?since=
+	ring *ring
+
+	subscriptions *subscriptionStore
+	// policies grant the subscribers tables and rows from their claims
+	policies []Policy
+	// apiKeys authenticate subscribers, along with those of pulse_api_keys
+	// when apiKeysTable is set
+	apiKeys      []APIKey
+	apiKeysTable bool
+	// visibilityChecks runs the visibility checks of the databases before
+	// delivering their rows
+	visibilityChecks bool
+	// outputs receive every notification fanned out, e.g. webhooks
+	outputs []sinks.Sink
+	// deadLetters stores the notifications that couldn't be delivered
+	deadLetters *deadLetterQueue
+	// firehoseOption exposes /ws/all, nil leaves it to PULSE_ENABLE_FIREHOSE
+	firehoseOption *bool
+	// origins are the other origins browsers may call the server from
+	origins []string
 }
 
-func NewServer() *http.Server {
-	port, _ := strconv.Atoi(os.Getenv("PORT"))
+// Config describes the server built by NewServerWithConfig.
+// ConfigFromEnv fills it from the environment, programs embedding pulse can
+// build it themselves. The settings of the routes and of individual clients,
+// like PULSE_JWT_SECRET or PULSE_CLIENT_QUEUE_SIZE, are still read from the
+// environment.
+type Config struct {
+	// Port is the port the HTTP server listens on
+	Port int
+	// GRPCPort is the port the gRPC service listens on, zero disables it
+	GRPCPort int
+	// Databases are watched and fanned into the same stream
+	Databases []database.Config
+	// IdleTimeout bounds idle keep-alive connections, one minute if zero
+	IdleTimeout time.Duration
+	// Tracing receives the spans of the notifications, nil disables tracing
+	Tracing tracing.Exporter
+	// Policies grant the subscribers tables and rows from their JWT claims,
+	// nil grants everything
+	Policies []Policy
+	// APIKeys authenticate subscribers, granting them their tables instead
+	// of what the policies do. The keys of the pulse_api_keys table of the
+	// databases whose config sets APIKeysTable do too
+	APIKeys []APIKey
+	// Sinks receive every notification fanned out, e.g. webhooks. They're
+	// closed on Shutdown
+	Sinks []sinks.Sink
+	// Firehose exposes /ws/all and /sse/all, nil leaves it to
+	// PULSE_ENABLE_FIREHOSE
+	Firehose *bool
+	// TLS terminates TLS on the HTTP and gRPC servers, nil serves plain
+	// HTTP
+	TLS *TLSConfig
+	// AllowedOrigins are the origins browsers may call the server from,
+	// besides its own, like https://app.example.com. * matches any part of
+	// the host, and * alone any origin
+	AllowedOrigins []string
+	// Limits bound the subscriptions open at once and how fast each IP can
+	// open them, unlimited if zero
+	Limits ConnectionLimits
+	// TableQueueSize is how many notifications of a single table wait their
+	// turn to be fanned out, 256 if zero
+	TableQueueSize int
+	// TableQueuePolicy applies to the notifications of a table whose queue
+	// is full: block holds the others back until it has room, drop_oldest
+	// drops its oldest one. Block if empty
+	TableQueuePolicy string
+}
 
-	// ch := make(chan database.DBNotification)
+// ConfigFromEnv returns the configuration set by PORT, PULSE_GRPC_PORT, DATABASE_URLS or the
+// DB_* variables, PULSE_IDLE_TIMEOUT, the OTEL_* variables, PULSE_POLICIES, PULSE_API_KEYS,
+// the sinks' variables like PULSE_WEBHOOKS, the TLS_* variables, the connection limits like
+// PULSE_MAX_CONNECTIONS, the PULSE_TABLE_QUEUE_* variables and the routes of the config file set
+// by PULSE_CONFIG.
+// It returns an error if any of them is invalid.
+func ConfigFromEnv() (Config, error) {
+	cfg := Config{IdleTimeout: idleTimeout()}
+	cfg.Port, _ = strconv.Atoi(os.Getenv("PORT"))
 
-	NewServer := &Server{
-		port: port,
+	var err error
+	if port := os.Getenv("PULSE_GRPC_PORT"); port != "" {
+		if cfg.GRPCPort, err = strconv.Atoi(port); err != nil || cfg.GRPCPort <= 0 {
+			return Config{}, fmt.Errorf("PULSE_GRPC_PORT must be a port number")
+		}
+	}
 
-		db: database.New(),
+	if cfg.Databases, err = database.ConfigsFromEnv(); err != nil {
+		return Config{}, err
+	}
 
-		clients:   make(map[*websocket.Conn]*client),
-		broadcast: make(chan database.DBNotification),
+	if cfg.Tracing, err = tracing.FromEnv(); err != nil {
+		return Config{}, fmt.Errorf("failed to set up tracing: %w", err)
 	}
 
-	if err := NewServer.db.SyncTables(); err != nil {
-		log.Fatalf("Failed to sync tables, can't continue %s\n", err.Error())
+	if cfg.Policies, err = loadPolicies(); err != nil {
+		return Config{}, err
 	}
 
-	go NewServer.db.Watch(NewServer.broadcast)
-	go NewServer.Hub()
+	if cfg.APIKeys, err = loadAPIKeys(); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.Sinks, err = sinks.FromEnv(); err != nil {
+		return Config{}, fmt.Errorf("failed to set up the sinks: %w", err)
+	}
+
+	if cfg.AllowedOrigins, err = originsFromEnv(); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.Limits, err = limitsFromEnv(); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.TableQueueSize, cfg.TableQueuePolicy, err = tableQueueFromEnv(); err != nil {
+		return Config{}, err
+	}
+
+	if cfg.TLS = tlsFromEnv(); cfg.TLS != nil {
+		if err := cfg.TLS.validate(); err != nil {
+			return Config{}, err
+		}
+	}
+
+	// The variable wins over the file
+	file, err := config.FromEnv()
+	if err != nil {
+		return Config{}, err
+	}
+	if _, set := firehoseFromEnv(); !set {
+		cfg.Firehose = file.Routes.Firehose
+	}
+
+	return cfg, nil
+}
+
+// NewServer builds the server configured by the environment.
+// It returns an error if the configuration is invalid or a database can't be
+// set up.
+func NewServer() (*Server, error) {
+	cfg, err := ConfigFromEnv()
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	return NewServerWithConfig(cfg)
+}
+
+// NewServerWithConfig connects to the databases of cfg, syncs their triggers
+// and builds the server, which starts watching them.
+// Failures are returned rather than killing the app, so pulse can be
+// embedded in other programs.
+// It returns an error if a database can't be reached or synced, any database
+// connected so far is closed, if the TLS certificate can't be loaded, or if
+// the connection limits or the table queue policy are invalid.
+func NewServerWithConfig(cfg Config) (*Server, error) {
+	if err := cfg.Limits.validate(); err != nil {
+		return nil, err
+	}
+	if err := validTableQueuePolicy(cfg.TableQueuePolicy); err != nil {
+		return nil, err
+	}
+
+	var tlsConfig *tls.Config
+	if cfg.TLS != nil {
+		var err error
+		if tlsConfig, err = cfg.TLS.build(); err != nil {
+			return nil, fmt.Errorf("invalid TLS configuration: %w", err)
+		}
+	}
+
+	var dbs []database.Service
+	closeAll := func() {
+		for _, db := range dbs {
+			db.Close()
+		}
+	}
+
+	for _, dbConfig := range cfg.Databases {
+		db, err := connectWithRetry(func() (database.Service, error) { return database.NewWithConfig(dbConfig) })
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		dbs = append(dbs, db)
+
+		if err := db.SyncTables(context.Background()); err != nil {
+			closeAll()
+			return nil, fmt.Errorf("failed to sync tables on %s: %w", db.Source(), err)
+		}
+	}
+
+	tracing.SetExporter(cfg.Tracing)
+
+	NewServer := start(dbs, cfg.Policies, cfg.Sinks, newScheduler(cfg.TableQueueSize, cfg.TableQueuePolicy))
+	NewServer.port = cfg.Port
+	NewServer.firehoseOption = cfg.Firehose
+	NewServer.origins = cfg.AllowedOrigins
+	NewServer.apiKeys = cfg.APIKeys
+	NewServer.limits = newConnectionLimits(cfg.Limits)
+	for _, dbConfig := range cfg.Databases {
+		NewServer.apiKeysTable = NewServer.apiKeysTable || dbConfig.APIKeysTable
+		NewServer.visibilityChecks = NewServer.visibilityChecks || dbConfig.VisibilityCheck != ""
+	}
+
+	idle := cfg.IdleTimeout
+	if idle <= 0 {
+		idle = time.Minute
+	}
 
 	// Declare Server config
-	server := &http.Server{
+	// The timeouts only apply to plain HTTP requests: net/http clears the
+	// deadlines of hijacked connections, websockets are kept alive by pings.
+	// Event streams clear them too and set their own on every write
+	NewServer.http = &http.Server{
 		Addr:         fmt.Sprintf(":%d", NewServer.port),
 		Handler:      NewServer.RegisterRoutes(),
-		IdleTimeout:  time.Minute,
+		IdleTimeout:  idle,
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 30 * time.Second,
+		TLSConfig:    tlsConfig,
+	}
+
+	if cfg.GRPCPort != 0 {
+		opts := []grpc.ServerOption{grpc.KeepaliveParams(keepalive.ServerParameters{MaxConnectionIdle: idle})}
+		if tlsConfig != nil {
+			opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+		}
+		NewServer.grpc = NewServer.GRPCServer(opts...)
+		NewServer.grpcAddr = fmt.Sprintf(":%d", cfg.GRPCPort)
+	}
+
+	return NewServer, nil
+}
+
+// connectAttempts is how many times connectWithRetry tries to connect.
+const connectAttempts = 5
+
+// connectWithRetry calls connect until it succeeds, backing off exponentially
+// from a second between attempts. The databases may still be starting, e.g.
+// when deployed alongside the server.
+// It returns the last error once connectAttempts failed.
+func connectWithRetry(connect func() (database.Service, error)) (database.Service, error) {
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		db, err := connect()
+		if err == nil {
+			return db, nil
+		}
+
+		if attempt == connectAttempts {
+			return nil, fmt.Errorf("unable to connect to the database after %d attempts: %w", attempt, err)
+		}
+
+		slog.Warn("Unable to connect to the database, retrying", "backoff", backoff, "error", err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// idleTimeout returns the keep-alive timeout set by PULSE_IDLE_TIMEOUT.
+func idleTimeout() time.Duration {
+	timeout, err := time.ParseDuration(os.Getenv("PULSE_IDLE_TIMEOUT"))
+	if err != nil || timeout <= 0 {
+		return time.Minute
+	}
+
+	return timeout
+}
+
+// New creates a Server on top of dbs and starts watching them for changes.
+// Notifications from every database are fanned into the same stream.
+// Triggers are expected to be synced already.
+// Policies are read from PULSE_POLICIES, API keys from PULSE_API_KEYS and
+// PULSE_API_KEYS_TABLE, sinks from their variables, the allowed origins
+// from ALLOWED_ORIGINS, the connection limits from their variables, like
+// PULSE_MAX_CONNECTIONS, and the table queues from PULSE_TABLE_QUEUE_SIZE
+// and PULSE_TABLE_QUEUE_POLICY. The visibility checks run once
+// PULSE_VISIBILITY_CHECK is set.
+// It returns an error if any is invalid.
+func New(dbs ...database.Service) (*Server, error) {
+	policies, err := loadPolicies()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load policies: %w", err)
+	}
+
+	apiKeys, err := loadAPIKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	var apiKeysTable bool
+	if table := os.Getenv("PULSE_API_KEYS_TABLE"); table != "" {
+		if apiKeysTable, err = strconv.ParseBool(table); err != nil {
+			return nil, fmt.Errorf("invalid PULSE_API_KEYS_TABLE: %w", err)
+		}
+	}
+
+	origins, err := originsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	limits, err := limitsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	size, policy, err := tableQueueFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	outputs, err := sinks.FromEnv()
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up the sinks: %w", err)
+	}
+
+	s := start(dbs, policies, outputs, newScheduler(size, policy))
+	s.origins = origins
+	s.limits = newConnectionLimits(limits)
+	s.apiKeys, s.apiKeysTable = apiKeys, apiKeysTable
+	s.visibilityChecks = os.Getenv("PULSE_VISIBILITY_CHECK") != ""
+	return s, nil
+}
+
+// start creates a Server on top of dbs, granting subscribers access through
+// policies, sending every notification to outputs and taking turns across
+// tables with scheduler, and starts watching the databases.
+func start(dbs []database.Service, policies []Policy, outputs []sinks.Sink, scheduler *scheduler) *Server {
+	ctx, cancel := context.WithCancel(context.Background())
+	// A shard of clients per worker
+	workers := newPool()
+
+	s := &Server{
+		dbs:         dbs,
+		cancelWatch: cancel,
+
+		clients:   newClientRegistry(workers.size()),
+		broadcast: make(chan database.DBNotification, 256),
+		closing:   make(chan struct{}),
+		hubDone:   make(chan struct{}),
+		breaker:   newBreaker(),
+		pool:      workers,
+		scheduler: scheduler,
+		ring:      newRing(replayBuffer(), dbs),
+		rates:     newEventRates(),
+
+		subscriptions: newSubscriptionStore(),
+		policies:      policies,
+		outputs:       outputs,
+		deadLetters:   newDeadLetterQueue(deadLetterQueueSize),
 	}
 
-	return server
+	for _, db := range s.dbs {
+		s.watchers.Add(1)
+		go func(db database.Service) {
+			defer s.watchers.Done()
+			if err := db.Watch(ctx, s.broadcast); err != nil {
+				slog.Error("Stopped watching", "source", db.Source(), "error", err)
+			}
+		}(db)
+	}
+	go s.Hub()
+
+	return s
+}
+
+// ListenAndServe starts the HTTP server built by NewServer, and the gRPC one
+// if it has a port, over TLS if it's configured.
+// It returns the error of the first one to stop.
+func (s *Server) ListenAndServe() error {
+	if s.grpc == nil {
+		return listenAndServe(s.http)
+	}
+
+	errs := make(chan error, 2)
+	go func() { errs <- s.serveGRPC() }()
+	go func() { errs <- listenAndServe(s.http) }()
+	return <-errs
+}
+
+// listenAndServe serves srv over TLS if it has a TLS configuration, which
+// provides the certificates.
+func listenAndServe(srv *http.Server) error {
+	if srv.TLSConfig != nil {
+		return srv.ListenAndServeTLS("", "")
+	}
+	return srv.ListenAndServe()
+}
+
+// serveGRPC serves the gRPC server on its port. Like the HTTP server's, it
+// returns http.ErrServerClosed once it's stopped.
+func (s *Server) serveGRPC() error {
+	lis, err := net.Listen("tcp", s.grpcAddr)
+	if err != nil {
+		return err
+	}
+	if err := s.grpc.Serve(lis); err != nil {
+		return err
+	}
+	return http.ErrServerClosed
+}
+
+// stopGRPC stops the gRPC server once its streams are done, or right away
+// once ctx expires, returning ctx's error.
+func (s *Server) stopGRPC(ctx context.Context) error {
+	stopped := make(chan struct{})
+	go func() {
+		s.grpc.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		s.grpc.Stop()
+		return ctx.Err()
+	}
+}
+
+// Shutdown stops the server gracefully.
+// It tells the connected clients it's draining, stops accepting connections
+// and watching the databases, delivers the notifications already queued to
+// the clients and only then closes their sockets, and finally the databases.
+// If ctx expires before the queues are drained, the sockets are closed
+// anyway and ctx's error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.drain(ctx)
+
+	// Event streams aren't hijacked, http.Shutdown waits for them to end
+	// below, it stops accepting connections right away though
+	httpDone := make(chan error, 1)
+	if s.http != nil {
+		go func() {
+			err := s.http.Shutdown(ctx)
+			if s.grpc != nil {
+				err = errors.Join(err, s.stopGRPC(ctx))
+			}
+			httpDone <- err
+		}()
+	} else {
+		httpDone <- nil
+	}
+
+	// Publishes are turned away from now on, the pending ones give up
+	close(s.closing)
+	s.cancelWatch()
+	s.watchers.Wait()
+	s.publishing.Lock()
+	close(s.broadcast)
+	s.publishing.Unlock()
+
+	select {
+	case <-s.hubDone:
+		// The Hub no longer sends, the handlers write what's left and close
+		s.clients.each(func(cli *client) {
+			cli.close(websocket.StatusGoingAway, reasonShutdown)
+		})
+		// Once their subscriptions are closed
+		s.clients.eachMux(func(m *mux) {
+			m.close(websocket.StatusGoingAway, reasonShutdown)
+		})
+	case <-ctx.Done():
+	}
+
+	handlersDone := make(chan struct{})
+	go func() {
+		s.handlers.Wait()
+		close(handlersDone)
+	}()
+
+	select {
+	case <-handlersDone:
+	case <-ctx.Done():
+		s.clients.each(func(cli *client) {
+			cli.conn.CloseNow()
+		})
+		s.clients.eachMux(func(m *mux) {
+			m.socket.CloseNow()
+		})
+
+		s.closeSinks(ctx)
+		s.deadLetters.close(ctx)
+		s.closeDatabases()
+		return ctx.Err()
+	}
+
+	s.closeSinks(ctx)
+	s.deadLetters.close(ctx)
+	// Replays are done with the pools once the handlers are
+	s.closeDatabases()
+	return <-httpDone
+}
+
+// closeSinks delivers what the sinks have pending, until ctx expires, and
+// closes them. The spans ended so far are exported last.
+func (s *Server) closeSinks(ctx context.Context) {
+	for _, sink := range s.outputs {
+		if err := sink.Close(ctx); err != nil {
+			slog.Error("Failed to close a sink", "error", err)
+		}
+	}
+
+	if err := tracing.Flush(ctx); err != nil {
+		slog.Error("Failed to export the spans", "error", err)
+	}
+}
+
+// closeDatabases closes the connection pools of every database.
+func (s *Server) closeDatabases() {
+	for _, db := range s.dbs {
+		if err := db.Close(); err != nil {
+			slog.Error("Failed to close the database", "source", db.Source(), "error", err)
+		}
+	}
+}
+
+// drain sends the draining control message to every connected client, each
+// write bounded by the client's write timeout.
+func (s *Server) drain(ctx context.Context) {
+	jsonData, _ := json.Marshal(drainingMessage{Operation: "draining", RetryAfterMs: retryAfter().Milliseconds()})
+
+	var writes sync.WaitGroup
+	s.clients.each(func(cli *client) {
+		writes.Add(1)
+		go func() {
+			defer writes.Done()
+
+			ctx, cancel := context.WithTimeout(ctx, cli.writeTimeout)
+			defer cancel()
+			cli.conn.Write(ctx, websocket.MessageText, jsonData)
+		}()
+	})
+
+	writes.Wait()
 }
 
+// maxVisibilityChecks bounds the notifications whose visibility is being
+// checked at once.
+const maxVisibilityChecks = 64
+
+// checked is a notification whose visibility was checked, to be fanned out.
+type checked struct {
+	msg     database.DBNotification
+	visible visibility
+	span    trace.Span
+}
+
+// Hub fans every notification out to the send queues of the matching clients.
+// Tables take turns, see scheduler. The visibility checks run off the Hub,
+// up to maxVisibilityChecks at once, so a slow database only holds back the
+// tables being checked: the other tables are fanned out meanwhile.
+// It returns once broadcast is closed and every notification was fanned out.
 func (s *Server) Hub() {
+	defer close(s.hubDone)
+	defer s.pool.stop()
+
+	go func() {
+		for msg := range s.broadcast {
+			if dropped, full := s.scheduler.push(msg); full {
+				droppedNotifications.WithLabelValues(dropTableQueueFull).Inc()
+				s.deadLetter(dropTableQueueFull, dropped)
+			}
+		}
+		s.scheduler.close()
+	}()
+
+	popped := make(chan database.DBNotification)
+	go func() {
+		defer close(popped)
+		for {
+			msg, ok := s.scheduler.pop()
+			if !ok {
+				return
+			}
+			popped <- msg
+		}
+	}()
+
+	results := make(chan checked)
+	checking := 0
 	for {
+		// No new notification is taken while too many are being checked
+		next := popped
+		if checking >= maxVisibilityChecks {
+			next = nil
+		}
+
 		select {
-		case msg := <-s.broadcast:
-			for connection, cli := range s.clients {
-				go func(conn *websocket.Conn, c *client) {
-					c.mut.Lock()
-					defer c.mut.Unlock()
-
-					if c.isClosing {
-						return
-					}
-
-					if c.table != "" && c.table != msg.Table {
-						return
-					}
-
-					if c.id != "" && c.id != msg.ID {
-						return
-					}
-
-					jsonData, _ := json.Marshal(msg)
-
-					if err := conn.Write(context.Background(), websocket.MessageText, jsonData); err != nil {
-						c.isClosing = true
-
-						log.Println("write error:", err)
-
-						conn.Write(context.Background(), websocket.MessageText, []byte("closing"))
-						conn.Close(websocket.StatusGoingAway, "")
-						delete(s.clients, conn)
-					}
-
-					if c.table == msg.Table && c.id == msg.ID && msg.Operation == "delete" {
-						conn.Write(context.Background(), websocket.MessageText, []byte("row was deleted, nothing to see now"))
-						conn.Close(websocket.StatusGoingAway, "")
-						delete(s.clients, conn)
-					}
-				}(connection, cli)
+		case msg, ok := <-next:
+			if !ok {
+				popped = nil
+				if checking == 0 {
+					return
+				}
+				continue
+			}
+
+			msg, span, ok := s.prepare(msg)
+			if !ok {
+				s.scheduler.done(msg.Table)
+				continue
+			}
+
+			if !s.visibilityChecks || !checksVisibility(msg) {
+				s.fanout(msg, nil, span)
+				continue
+			}
+
+			// Checked once for every subscriber with the same claims, the
+			// table isn't popped again until it's done
+			checking++
+			claims := s.clients.claimsOf(msg)
+			go func() {
+				results <- checked{msg: msg, visible: s.visibilityOf(context.Background(), msg, claims), span: span}
+			}()
+		case c := <-results:
+			checking--
+			s.fanout(c.msg, c.visible, c.span)
+			if popped == nil && checking == 0 {
+				return
 			}
 		}
 	}
 }
+
+// prepare counts msg, numbers it, starts its span and hands it to the
+// outputs.
+// It returns false if it's dropped by the breaker instead.
+func (s *Server) prepare(msg database.DBNotification) (database.DBNotification, trace.Span, bool) {
+	receivedNotifications.WithLabelValues(msg.Table).Inc()
+	s.rates.add(msg.Table, time.Now())
+
+	if !s.breaker.allow() {
+		droppedNotifications.WithLabelValues(reasonBreakerOpen).Inc()
+		s.deadLetter(reasonBreakerOpen, msg)
+		return msg, nil, false
+	}
+
+	msg = s.ring.append(msg)
+
+	span := tracing.Start(msg.TraceParent(), "pulse.fanout",
+		attribute.String("pulse.table", msg.Table),
+		attribute.String("pulse.operation", msg.Operation))
+	msg.Span = span.SpanContext()
+
+	for _, sink := range s.outputs {
+		sink.Send(msg)
+	}
+
+	return msg, span, true
+}
+
+// fanout queues msg to the clients it's visible to, evicting those that
+// can't take it, and lets the scheduler pop the next notification of its
+// table.
+// It must be called from the Hub, which alone closes the send queues.
+func (s *Server) fanout(msg database.DBNotification, visible visibility, span trace.Span) {
+	defer s.scheduler.done(msg.Table)
+
+	start := time.Now()
+	evicted, considered := s.pool.fanout(msg, s.clients, visible)
+	fanoutDuration.Observe(time.Since(start).Seconds())
+
+	span.SetAttributes(attribute.Int("pulse.clients", considered), attribute.Int("pulse.evicted", len(evicted)))
+	span.End()
+
+	for _, e := range evicted {
+		s.clients.unregister(e.cli)
+		evictedClients.WithLabelValues(e.reason).Inc()
+
+		if e.reason == reasonInternal {
+			e.cli.close(websocket.StatusInternalError, reasonInternal)
+			continue
+		}
+
+		droppedNotifications.WithLabelValues(dropQueueFull).Inc()
+		e.cli.logger().Warn("Evicting slow client, its send queue is full", "table", e.cli.sub.table(), "queue_size", cap(e.cli.send))
+		e.cli.close(websocket.StatusPolicyViolation, reasonSlowClient)
+		// It's stuck writing, the close message won't make it anyway
+		e.cli.cancel()
+	}
+}
+
+// replay delivers the notifications persisted since cli.since. Those
+// queued live meanwhile are skipped up to the last one replayed.
+// It returns false if the connection was closed as a result.
+func (s *Server) replay(cli *client) bool {
+	for _, db := range s.dbs {
+		notifications, err := db.Replay(cli.ctx, cli.sub.table(), cli.since)
+		if err != nil {
+			cli.logger().Error("Failed to replay", "source", db.Source(), "table", cli.sub.table(), "error", err)
+
+			disconnect(cli.conn, websocket.StatusInternalError, reasonReplay)
+			return false
+		}
+
+		for _, msg := range notifications {
+			msg.Source = db.Source()
+			if msg.Persisted > cli.replayed[msg.Source] {
+				if cli.replayed == nil {
+					cli.replayed = make(map[string]int64)
+				}
+				cli.replayed[msg.Source] = msg.Persisted
+			}
+			if !s.allows(cli.ctx, cli, msg) {
+				continue
+			}
+			if n, ok := cli.sub.Accept(msg); ok && !s.deliver(cli, n, nil) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// resume delivers the notifications numbered after cli.after. If some of
+// them are no longer kept, the persisted notifications are replayed from
+// cli.since instead when it's set, otherwise an event_lost notification
+// precedes those still kept.
+// It returns false if the connection was closed as a result.
+func (s *Server) resume(cli *client) bool {
+	notifications, complete, err := s.ring.since(cli.ctx, cli.after)
+	if err != nil {
+		cli.logger().Error("Failed to resume", "after", cli.after, "error", err)
+
+		disconnect(cli.conn, websocket.StatusInternalError, reasonReplay)
+		return false
+	}
+
+	if !complete {
+		// cli.after may not even be known, e.g. from before a restart
+		cli.after = 0
+		if !cli.since.IsZero() {
+			return s.replay(cli)
+		}
+		if !s.deliver(cli, database.DBNotification{Operation: database.OperationEventLost, EmittedAt: time.Now()}, nil) {
+			return false
+		}
+	}
+
+	for _, msg := range notifications {
+		cli.after = msg.Seq
+		if !s.allows(cli.ctx, cli, msg) {
+			continue
+		}
+		if n, ok := cli.sub.Accept(msg); ok && !s.deliver(cli, n, nil) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// seed computes the aggregate of cli over the current rows and sends it.
+// It returns false if the connection was closed as a result.
+func (s *Server) seed(cli *client) bool {
+	if err := cli.aggregator.seed(cli.ctx, s.dbs); err != nil {
+		cli.logger().Error("Failed to aggregate", "table", cli.sub.table(), "error", err)
+
+		disconnect(cli.conn, websocket.StatusInternalError, reasonSnapshot)
+		return false
+	}
+
+	return s.sendAggregate(cli)
+}
+
+// sendAggregate writes the current aggregate of cli.
+// It returns false if the connection was closed as a result.
+func (s *Server) sendAggregate(cli *client) bool {
+	jsonData, _ := json.Marshal(cli.aggregator.message())
+
+	ctx, cancel := context.WithTimeout(cli.ctx, cli.writeTimeout)
+	defer cancel()
+
+	if err := cli.conn.Write(ctx, websocket.MessageText, jsonData); err != nil {
+		logWriteError(err)
+
+		disconnect(cli.conn, websocket.StatusGoingAway, reasonWriteFailed)
+		return false
+	}
+
+	cli.aggregator.dirty = false
+	return true
+}
+
+// deliver writes msg to cli.
+// It returns false if the connection was closed as a result, which includes
+// panicking while encoding msg.
+func (s *Server) deliver(cli *client, msg database.DBNotification, shared *encodings) (ok bool) {
+	span := tracing.Start(msg.TraceParent(), "pulse.deliver",
+		attribute.String("pulse.table", msg.Table),
+		attribute.String("pulse.operation", msg.Operation),
+		attribute.String("pulse.protocol", cli.version))
+	defer span.End()
+
+	defer func() {
+		if r := recover(); r != nil {
+			tracing.SetError(span, fmt.Errorf("panic: %v", r))
+			cli.logger().Error("Panic delivering a notification", "operation", msg.Operation, "table", msg.Table, "panic", r)
+
+			disconnect(cli.conn, websocket.StatusInternalError, reasonInternal)
+			ok = false
+		}
+	}()
+
+	accepted := msg
+	if cli.session != nil {
+		// Sealed for this client alone
+		shared = nil
+
+		var err error
+		if msg, err = cli.session.seal(msg); err != nil {
+			cli.logger().Error("Failed to encrypt a notification", "operation", msg.Operation, "table", msg.Table, "error", err)
+
+			disconnect(cli.conn, websocket.StatusInternalError, reasonInternal)
+			return false
+		}
+	}
+
+	data, _ := shared.encode(msg, cli.version, cli.envelope, cli.encoding)
+	typ := websocket.MessageText
+	if cli.encoding != "" {
+		typ = websocket.MessageBinary
+	}
+
+	ctx, cancel := context.WithTimeout(cli.ctx, cli.writeTimeout)
+	defer cancel()
+
+	err := cli.conn.Write(ctx, typ, data)
+	s.breaker.record(err != nil)
+
+	if err != nil {
+		tracing.SetError(span, err)
+		logWriteError(err)
+		droppedNotifications.WithLabelValues(reasonWriteFailed).Inc()
+		s.deadLetter(reasonWriteFailed, accepted)
+
+		disconnect(cli.conn, websocket.StatusGoingAway, reasonWriteFailed)
+		return false
+	}
+
+	if msg.Operation == "delete" && cli.sub.watchesRow(msg) {
+		disconnect(cli.conn, websocket.StatusNormalClosure, reasonRowDeleted)
+		return false
+	}
+
+	return true
+}
+
+// deadLetter hands msg, which couldn't be delivered for reason, to the dead
+// letter sink of the database it came from. Published ones go to the first.
+// It's stored in the background, or dropped if too many are waiting.
+func (s *Server) deadLetter(reason string, msg database.DBNotification) {
+	if len(s.dbs) == 0 {
+		return
+	}
+
+	db := s.dbs[0]
+	for _, d := range s.dbs {
+		if d.Source() == msg.Source {
+			db = d
+		}
+	}
+
+	s.deadLetters.push(deadLetter{db: db, reason: reason, msg: msg})
+}
+
+// disconnect sends a control message describing why the connection is being
+// closed and then closes it with code.
+// Normal closures use the "close" operation, everything else is an "error".
+// The message is given up on after the write timeout, a client that stopped
+// reading doesn't hold the connection open.
+func disconnect(conn conn, code websocket.StatusCode, reason string) {
+	operation := "error"
+	if code == websocket.StatusNormalClosure {
+		operation = "close"
+	}
+
+	jsonData, _ := json.Marshal(controlMessage{Operation: operation, Reason: reason})
+
+	ctx, cancel := context.WithTimeout(context.Background(), writeTimeout())
+	defer cancel()
+
+	conn.Write(ctx, websocket.MessageText, jsonData)
+	conn.Close(code, reason)
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+
+	"nhooyr.io/websocket"
+)
+
+// snapshotComplete is the operation of the message ending a snapshot.
+const snapshotComplete = "snapshot_complete"
+
+// snapshotRequest is what a client connecting with ?snapshot=true asked for:
+// at most limit rows, zero for all, with ids after the given one.
+type snapshotRequest struct {
+	limit int
+	after string
+}
+
+// snapshotMessage tells the client the snapshot is over and the live
+// notifications follow. Cursor is set when the limit cut it short, the next
+// rows come after it.
+type snapshotMessage struct {
+	Operation string `json:"operation"`
+	Table     string `json:"table"`
+	Count     int    `json:"count"`
+	Cursor    string `json:"cursor,omitempty"`
+}
+
+// parseSnapshot returns the snapshot asked for by the ?snapshot=,
+// ?snapshot_limit= and ?snapshot_after= parameters of sub, nil if none is.
+// It returns an error if any of them is invalid.
+func parseSnapshot(sub Subscription, query url.Values) (*snapshotRequest, error) {
+	enabled := false
+	if snapshot := query.Get("snapshot"); snapshot != "" {
+		var err error
+		if enabled, err = strconv.ParseBool(snapshot); err != nil {
+			return nil, fmt.Errorf("snapshot must be a boolean")
+		}
+	}
+	if !enabled {
+		return nil, nil
+	}
+
+	if sub.table() == "" {
+		return nil, fmt.Errorf("snapshot needs a single table")
+	}
+	if sub.aggregate != nil {
+		return nil, fmt.Errorf("snapshot can't be combined with aggregate")
+	}
+
+	req := &snapshotRequest{after: query.Get("snapshot_after")}
+	if limit := query.Get("snapshot_limit"); limit != "" {
+		var err error
+		if req.limit, err = strconv.Atoi(limit); err != nil || req.limit < 1 {
+			return nil, fmt.Errorf("snapshot_limit must be a positive number")
+		}
+	}
+
+	return req, nil
+}
+
+// snapshot sends cli the current rows of its table as snapshot
+// notifications, paging through each database by id, and then a
+// snapshotMessage.
+// Changes made meanwhile queue up and are delivered after it, a row may be
+// sent both ways.
+// It returns false if the connection was closed as a result.
+func (s *Server) snapshot(cli *client) bool {
+	msg := snapshotMessage{Operation: snapshotComplete, Table: cli.sub.table()}
+
+	for _, db := range s.dbs {
+		if cli.sub.source != "" && cli.sub.source != db.Source() {
+			continue
+		}
+
+		after := cli.snapshot.after
+		for msg.Cursor == "" {
+			rows, err := db.Snapshot(cli.ctx, cli.sub.table(), after, snapshotPage)
+			if err != nil {
+				cli.logger().Error("Failed to snapshot", "table", cli.sub.table(), "error", err)
+
+				disconnect(cli.conn, websocket.StatusInternalError, reasonSnapshot)
+				return false
+			}
+
+			for _, row := range rows {
+				if !s.allows(cli.ctx, cli, row) {
+					continue
+				}
+				n, ok := cli.sub.Accept(row)
+				if !ok {
+					continue
+				}
+
+				if !s.deliver(cli, n, nil) {
+					return false
+				}
+				msg.Count++
+
+				if msg.Count == cli.snapshot.limit {
+					msg.Cursor = row.ID
+					break
+				}
+			}
+
+			if len(rows) < snapshotPage {
+				break
+			}
+			after = rows[len(rows)-1].ID
+		}
+	}
+
+	jsonData, _ := json.Marshal(msg)
+
+	ctx, cancel := context.WithTimeout(cli.ctx, cli.writeTimeout)
+	defer cancel()
+
+	if err := cli.conn.Write(ctx, websocket.MessageText, jsonData); err != nil {
+		logWriteError(err)
+
+		disconnect(cli.conn, websocket.StatusGoingAway, reasonWriteFailed)
+		return false
+	}
+
+	return true
+}
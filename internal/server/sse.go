@@ -0,0 +1,116 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+// conn is how a client is written to. *websocket.Conn implements it, and so
+// does sseConn for server-sent events.
+type conn interface {
+	Write(ctx context.Context, typ websocket.MessageType, p []byte) error
+	Ping(ctx context.Context) error
+	Close(code websocket.StatusCode, reason string) error
+	CloseNow() error
+}
+
+// errStreamClosed is returned when writing to a closed event stream.
+var errStreamClosed = errors.New("event stream closed")
+
+// sseConn is a text/event-stream response, every message is sent as the
+// data of an event.
+// The stream has no close frame: the control message sent before closing
+// carries the reason, and the response then ends.
+type sseConn struct {
+	mut        sync.Mutex
+	w          http.ResponseWriter
+	controller *http.ResponseController
+
+	// ctx is cancelled once the stream is closed, ending the response
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// newSSEConn starts the event stream on w.
+func newSSEConn(w http.ResponseWriter) (*sseConn, error) {
+	c := &sseConn{w: w, controller: http.NewResponseController(w)}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+
+	// Unlike hijacked websockets, streams are subject to the server's
+	// timeouts, every write sets its own deadline instead
+	if err := c.controller.SetReadDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return nil, err
+	}
+	if err := c.controller.SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return nil, err
+	}
+
+	header := w.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	// Keeps nginx from buffering the stream
+	header.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	return c, c.controller.Flush()
+}
+
+// Write sends p, a single line of JSON, as an event.
+func (c *sseConn) Write(ctx context.Context, _ websocket.MessageType, p []byte) error {
+	event := make([]byte, 0, len(p)+8)
+	event = append(event, "data: "...)
+	event = append(event, p...)
+	return c.write(ctx, append(event, "\n\n"...))
+}
+
+// Ping sends a comment, which keeps proxies from timing the stream out.
+// Unlike websocket pings, it isn't answered.
+func (c *sseConn) Ping(ctx context.Context) error {
+	return c.write(ctx, []byte(": ping\n\n"))
+}
+
+func (c *sseConn) write(ctx context.Context, event []byte) error {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	if c.ctx.Err() != nil {
+		return errStreamClosed
+	}
+
+	deadline, _ := ctx.Deadline()
+	if err := c.controller.SetWriteDeadline(deadline); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+
+	if _, err := c.w.Write(event); err != nil {
+		return err
+	}
+	return c.controller.Flush()
+}
+
+// Close ends the stream, code and reason were already sent in the control
+// message preceding it.
+func (c *sseConn) Close(websocket.StatusCode, string) error {
+	return c.CloseNow()
+}
+
+// CloseNow ends the stream, aborting a write in progress.
+func (c *sseConn) CloseNow() error {
+	c.cancel()
+	c.controller.SetWriteDeadline(time.Now())
+	return nil
+}
+
+// finish closes the stream once the write in progress, if any, is done.
+// The response can't be written to after its handler returned.
+func (c *sseConn) finish() {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	c.cancel()
+}
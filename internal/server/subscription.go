@@ -0,0 +1,467 @@
+package server
+
+import (
+	"fmt"
+	"math/rand"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"pulse/internal/database"
+	"pulse/internal/filter"
+)
+
+// Subscription describes which notifications a client receives and what they
+// carry. It's parsed once at connect and never changes afterwards.
+type Subscription struct {
+	// tables, ids, operations and sources are allow lists, empty allows all.
+	// Tables may be patterns, see validPattern
+	tables     []string
+	ids        []string
+	operations []string
+	source     string
+	// columns drops updates that don't change any of them
+	columns []string
+	// fields projects data down to the given keys, each a path reaching into
+	// JSON objects
+	fields [][]string
+	filter filter.Predicate
+	sample float64
+	dedup  *dedup
+	// diff delivers updates as a JSON Patch of their changed columns
+	diff bool
+	// aggregate delivers a running aggregate of the rows instead of changes
+	aggregate *aggregation
+}
+
+// subscriptionParams are the query parameters making up a Subscription.
+var subscriptionParams = []string{"tables", "ids", "operations", "ops", "source", "columns", "fields", "select", "filter", "where", "sample", "dedup", "diff", "aggregate"}
+
+// hasSubscriptionParams reports whether query sets any subscription parameter.
+func hasSubscriptionParams(query url.Values) bool {
+	for _, param := range subscriptionParams {
+		if query.Has(param) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewSubscription builds the subscription for the table and id of the route
+// and its query parameters.
+// It returns an error if any of the parameters is invalid.
+func NewSubscription(table, id string, query url.Values) (Subscription, error) {
+	sub := Subscription{
+		tables:     list(query.Get("tables")),
+		ids:        list(query.Get("ids")),
+		operations: list(query.Get("operations")),
+		source:     query.Get("source"),
+		columns:    list(query.Get("columns")),
+		sample:     1,
+	}
+
+	// ops is short for operations
+	if query.Has("ops") {
+		if query.Has("operations") {
+			return Subscription{}, fmt.Errorf("ops and operations can't be combined")
+		}
+		sub.operations = list(query.Get("ops"))
+	}
+
+	// select is the PostgREST name of fields
+	fields := list(query.Get("fields"))
+	if query.Has("select") {
+		if query.Has("fields") {
+			return Subscription{}, fmt.Errorf("select and fields can't be combined")
+		}
+		fields = list(query.Get("select"))
+	}
+	for _, field := range fields {
+		if strings.HasPrefix(field, ".") || strings.HasSuffix(field, ".") || strings.Contains(field, "..") {
+			return Subscription{}, fmt.Errorf("invalid field %q", field)
+		}
+		// Fields within a selected one are already part of it
+		if !containsParent(fields, field) {
+			sub.fields = append(sub.fields, strings.Split(field, "."))
+		}
+	}
+
+	for _, t := range append([]string{table}, sub.tables...) {
+		if t != "" && !validPattern(t) {
+			return Subscription{}, fmt.Errorf("invalid table %q", t)
+		}
+	}
+
+	// The route narrows the query parameters down, it can't widen them
+	if table != "" {
+		if len(sub.tables) > 0 && !contains(sub.tables, table) {
+			return Subscription{}, fmt.Errorf("tables must include %q", table)
+		}
+		sub.tables = []string{table}
+	}
+	if id != "" {
+		if len(sub.ids) > 0 && !contains(sub.ids, id) {
+			return Subscription{}, fmt.Errorf("ids must include %q", id)
+		}
+		sub.ids = []string{id}
+	}
+
+	if sample := query.Get("sample"); sample != "" {
+		rate, err := strconv.ParseFloat(sample, 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return Subscription{}, fmt.Errorf("sample must be a number between 0 and 1")
+		}
+		sub.sample = rate
+	}
+
+	if expr := query.Get("filter"); expr != "" {
+		predicate, err := filter.Parse(expr)
+		if err != nil {
+			return Subscription{}, fmt.Errorf("invalid filter: %w", err)
+		}
+		sub.filter = predicate
+	}
+
+	// Every where parameter narrows the filter down
+	if where := query["where"]; len(where) > 0 {
+		predicate, err := filter.ParseWhere(strings.Join(where, ","))
+		if err != nil {
+			return Subscription{}, fmt.Errorf("invalid where: %w", err)
+		}
+		if expr := sub.filter; expr != nil {
+			sub.filter = func(row map[string]interface{}) bool { return expr(row) && predicate(row) }
+		} else {
+			sub.filter = predicate
+		}
+	}
+
+	if dedup := query.Get("dedup"); dedup != "" {
+		enabled, err := strconv.ParseBool(dedup)
+		if err != nil {
+			return Subscription{}, fmt.Errorf("dedup must be a boolean")
+		}
+		if enabled {
+			sub.dedup = newDedup()
+		}
+	}
+
+	if diff := query.Get("diff"); diff != "" {
+		enabled, err := strconv.ParseBool(diff)
+		if err != nil {
+			return Subscription{}, fmt.Errorf("diff must be a boolean")
+		}
+		sub.diff = enabled
+	}
+
+	if expr := query.Get("aggregate"); expr != "" {
+		aggregate, err := parseAggregation(expr)
+		if err != nil {
+			return Subscription{}, err
+		}
+		if sub.table() == "" {
+			return Subscription{}, fmt.Errorf("aggregate needs a single table")
+		}
+		// They'd make the aggregate miss rows
+		if sub.diff || len(sub.fields) > 0 || len(sub.columns) > 0 || sub.sample < 1 {
+			return Subscription{}, fmt.Errorf("aggregate can't be combined with diff, fields, columns or sample")
+		}
+		sub.aggregate = aggregate
+	}
+
+	return sub, nil
+}
+
+// Accept reports whether n matches the subscription and returns it with its
+// data projected to the subscribed fields.
+// n itself is never modified, it's shared by every subscriber.
+func (sub Subscription) Accept(n database.DBNotification) (database.DBNotification, bool) {
+	// Gaps of no table go to every subscriber, those of a table to its own
+	if n.Gap() {
+		return n, (sub.source == "" || sub.source == n.Source) && (n.Table == "" || sub.watchesTable(n))
+	}
+
+	// Snapshot rows aren't changes, ?operations= doesn't apply to them
+	if !sub.watchesTable(n) || (n.Operation != database.OperationSnapshot && !allows(sub.operations, n.Operation)) {
+		return n, false
+	}
+
+	if sub.source != "" && sub.source != n.Source {
+		return n, false
+	}
+
+	// Truncates remove every row, whatever the subscribed ids and filter
+	if n.Operation == database.OperationTruncate {
+		return n, sub.dedup == nil || !sub.dedup.duplicate(n)
+	}
+
+	// Bulk notifications carry no row to filter on, they go through unless
+	// none of the rows can be one of the subscribed ids
+	if n.Bulk {
+		truncated := n.Count > int64(len(n.IDs))
+		if len(sub.ids) > 0 && !truncated && !overlaps(sub.ids, n.IDs) {
+			return n, false
+		}
+		return n, sub.dedup == nil || !sub.dedup.duplicate(n)
+	}
+
+	if !allows(sub.ids, n.ID) {
+		return n, false
+	}
+
+	// Updates without the changed columns, like replayed ones from before
+	// they were tracked, can't be told apart so they go through
+	if len(sub.columns) > 0 && n.Operation == "update" && n.Changed != nil && !overlaps(sub.columns, n.Changed) {
+		return n, false
+	}
+
+	// Aggregates filter the rows before and after updates themselves, rows
+	// leaving the filter must be taken out
+	row, isRow := n.Data.(map[string]interface{})
+	if sub.filter != nil && sub.aggregate == nil && (!isRow || !sub.filter(row)) {
+		return n, false
+	}
+
+	// Deletes and snapshot rows are never sampled out, clients would keep
+	// stale rows or miss some
+	if sub.sample < 1 && n.Operation != "delete" && n.Operation != database.OperationSnapshot && rand.Float64() >= sub.sample {
+		return n, false
+	}
+
+	if sub.dedup != nil && sub.dedup.duplicate(n) {
+		return n, false
+	}
+
+	projected := row
+	if len(sub.fields) > 0 && isRow {
+		projected = project(row, sub.fields)
+		n.Data = projected
+	}
+
+	// Updates from before old values were tracked are sent whole
+	if sub.diff && n.Operation == "update" && n.Old != nil && isRow {
+		n.Patch = sub.patch(n, projected)
+	}
+
+	return n, true
+}
+
+// reshapes reports whether Accept changes the notifications it accepts,
+// projecting their fields or adding patches to updates.
+func (sub Subscription) reshapes() bool {
+	return sub.diff || len(sub.fields) > 0
+}
+
+// patch describes the changed columns of the update n, whose new values are
+// the projected row, as RFC 6902 replace operations. Columns projected out
+// are left out.
+func (sub Subscription) patch(n database.DBNotification, row map[string]interface{}) []database.PatchOperation {
+	patch := []database.PatchOperation{}
+	for _, column := range n.Changed {
+		if _, ok := row[column]; len(sub.fields) > 0 && !ok {
+			continue
+		}
+
+		patch = append(patch, database.PatchOperation{
+			Op:    "replace",
+			Path:  "/" + pointerEscaper.Replace(column),
+			Value: row[column],
+		})
+	}
+	return patch
+}
+
+// project returns the fields of row, following paths into its JSON objects,
+// e.g. customer.name. Missing fields are left out. No field may be within
+// another, the objects along the paths are copied as they're filled in.
+func project(row map[string]interface{}, fields [][]string) map[string]interface{} {
+	projected := make(map[string]interface{}, len(fields))
+	for _, path := range fields {
+		value, ok := lookup(row, path)
+		if !ok {
+			continue
+		}
+
+		object := projected
+		for _, key := range path[:len(path)-1] {
+			next, ok := object[key].(map[string]interface{})
+			if !ok {
+				next = make(map[string]interface{})
+				object[key] = next
+			}
+			object = next
+		}
+		object[path[len(path)-1]] = value
+	}
+	return projected
+}
+
+// lookup returns the value at path in row and whether it's there.
+func lookup(row map[string]interface{}, path []string) (interface{}, bool) {
+	var value interface{} = row
+	for _, key := range path {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = object[key]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// containsParent reports whether fields holds a field field is within, like
+// customer for customer.name.
+func containsParent(fields []string, field string) bool {
+	for _, parent := range fields {
+		if strings.HasPrefix(field, parent+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// pointerEscaper escapes a column into an RFC 6901 JSON Pointer token.
+var pointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
+
+// watchesRow reports whether the subscription is bound to the single row n
+// is about.
+func (sub Subscription) watchesRow(n database.DBNotification) bool {
+	return len(sub.tables) == 1 && len(sub.ids) == 1 && sub.tables[0] == n.Table && sub.ids[0] == n.ID
+}
+
+// watchesTable reports whether n is about one of the subscribed tables, or
+// one matching their patterns.
+func (sub Subscription) watchesTable(n database.DBNotification) bool {
+	if len(sub.tables) == 0 {
+		return true
+	}
+	for _, table := range sub.tables {
+		if matchesTable(table, n) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasPatterns reports whether any of the subscribed tables is a pattern.
+func (sub Subscription) hasPatterns() bool {
+	for _, table := range sub.tables {
+		if isPattern(table) {
+			return true
+		}
+	}
+	return false
+}
+
+// table returns the only table subscribed to, if there's a single one and
+// it isn't a pattern. It's schema qualified if subscribed to as such.
+func (sub Subscription) table() string {
+	if len(sub.tables) == 1 && !strings.ContainsAny(sub.tables[0], "*?") {
+		return sub.tables[0]
+	}
+	return ""
+}
+
+// validTable reports whether name can be a table, i.e. an unquoted Postgres
+// identifier of at most 63 bytes. Names are checked before they reach any
+// query, those needing quotes can't be subscribed to.
+func validTable(name string) bool {
+	if name == "" || len(name) > 63 {
+		return false
+	}
+
+	for i, r := range name {
+		if !(r == '_' || unicode.IsLetter(r) || (i > 0 && (r == '$' || unicode.IsDigit(r)))) {
+			return false
+		}
+	}
+	return true
+}
+
+// validPattern reports whether pattern is a table or a glob over the table
+// names, where * matches any run of characters and ? a single one, like
+// orders_*. Patterns qualified by a schema, like events.*, match the schema
+// of the notifications too.
+func validPattern(pattern string) bool {
+	wildcards := strings.NewReplacer("*", "_", "?", "_")
+	if schema, table, qualified := strings.Cut(pattern, "."); qualified {
+		return validTable(wildcards.Replace(schema)) && validTable(wildcards.Replace(table))
+	}
+	return validTable(wildcards.Replace(pattern))
+}
+
+// matchesEveryTable reports whether sub gets the notifications of every
+// table: it has none, or a pattern whose table is only wildcards, like * or
+// public.*.
+func (sub Subscription) matchesEveryTable() bool {
+	if len(sub.tables) == 0 {
+		return true
+	}
+
+	for _, table := range sub.tables {
+		if i := strings.LastIndex(table, "."); i >= 0 {
+			table = table[i+1:]
+		}
+		if strings.Contains(table, "*") && strings.Trim(table, "*?") == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// isPattern reports whether table is a pattern rather than a single table.
+func isPattern(table string) bool {
+	return strings.ContainsAny(table, "*?.")
+}
+
+// matchesTable reports whether n is about table, or a table matching it if
+// it's a pattern.
+func matchesTable(table string, n database.DBNotification) bool {
+	if !isPattern(table) {
+		return table == n.Table
+	}
+
+	name := n.Table
+	if strings.Contains(table, ".") {
+		name = n.Schema + "." + n.Table
+	}
+	matched, _ := path.Match(table, name)
+	return matched
+}
+
+// list splits a comma separated query parameter, ignoring empty items.
+func list(param string) []string {
+	var items []string
+	for _, item := range strings.Split(param, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func contains(items []string, item string) bool {
+	for _, i := range items {
+		if i == item {
+			return true
+		}
+	}
+	return false
+}
+
+// allows reports whether item is in the allow list, an empty one allows all.
+func allows(allowed []string, item string) bool {
+	return len(allowed) == 0 || contains(allowed, item)
+}
+
+func overlaps(a, b []string) bool {
+	for _, item := range a {
+		if contains(b, item) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// defaultSubscriptionTTL is how long a client's subscription is remembered
+// after it disconnects.
+const defaultSubscriptionTTL = time.Hour
+
+// subscriptionStore remembers the subscriptions of the clients connecting
+// with ?client_id=, so they can reconnect without sending them again.
+// They're saved per identity, a client_id only restores the subscriptions of
+// the subscriber who saved them.
+type subscriptionStore struct {
+	mut  sync.Mutex
+	subs map[string]storedSubscription
+	ttl  time.Duration
+}
+
+type storedSubscription struct {
+	sub     Subscription
+	expires time.Time
+	// owner is the connected client that saved it, it doesn't expire meanwhile
+	owner *client
+}
+
+// newSubscriptionStore creates a store whose entries expire after
+// PULSE_SUBSCRIPTION_TTL, defaulting to an hour.
+func newSubscriptionStore() *subscriptionStore {
+	ttl, err := time.ParseDuration(os.Getenv("PULSE_SUBSCRIPTION_TTL"))
+	if err != nil || ttl <= 0 {
+		ttl = defaultSubscriptionTTL
+	}
+
+	return &subscriptionStore{
+		subs: make(map[string]storedSubscription),
+		ttl:  ttl,
+	}
+}
+
+// subscriptionKey returns the key of the subscription of the subscriber with
+// identity saved for the client id.
+func subscriptionKey(identity, id string) string {
+	return identity + "\x00" + id
+}
+
+// save remembers the subscription of cli for its identity and id, replacing
+// any previous one, until the ttl passes. Expired entries are dropped along
+// the way.
+func (s *subscriptionStore) save(identity, id string, cli *client) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	now := time.Now()
+	for key, stored := range s.subs {
+		if stored.owner == nil && now.After(stored.expires) {
+			delete(s.subs, key)
+		}
+	}
+
+	s.subs[subscriptionKey(identity, id)] = storedSubscription{sub: cli.sub, expires: now.Add(s.ttl), owner: cli}
+}
+
+// release starts the ttl of the subscription saved by cli over, as it just
+// disconnected. It's a no-op if another client saved one for id since.
+func (s *subscriptionStore) release(identity, id string, cli *client) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	key := subscriptionKey(identity, id)
+	if stored, ok := s.subs[key]; ok && stored.owner == cli {
+		stored.expires = time.Now().Add(s.ttl)
+		stored.owner = nil
+		s.subs[key] = stored
+	}
+}
+
+// load returns the subscription saved by the subscriber with identity for
+// id, if it didn't expire. Its dedup state is a copy, the client that saved
+// it may still be connected.
+func (s *subscriptionStore) load(identity, id string) (Subscription, bool) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	stored, ok := s.subs[subscriptionKey(identity, id)]
+	if !ok || (stored.owner == nil && time.Now().After(stored.expires)) {
+		return Subscription{}, false
+	}
+
+	sub := stored.sub
+	sub.dedup = sub.dedup.clone()
+	return sub, true
+}
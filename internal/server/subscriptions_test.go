@@ -0,0 +1,30 @@
+package server
+
+import (
+	"testing"
+
+	"pulse/internal/database"
+)
+
+func TestLoadCopiesDedup(t *testing.T) {
+	s := newSubscriptionStore()
+	live := &client{sub: Subscription{dedup: newDedup()}}
+	s.save("sub:alice", "abc", live)
+
+	if _, ok := s.load("sub:bob", "abc"); ok {
+		t.Fatalf("load() returned alice's subscription to bob")
+	}
+	restored, ok := s.load("sub:alice", "abc")
+	if !ok {
+		t.Fatalf("load() found no subscription")
+	}
+
+	// The live client and the restored one each see the change once
+	change := database.DBNotification{Table: "orders", ID: "1", Operation: "update", Txid: 42}
+	if live.sub.dedup.duplicate(change) {
+		t.Errorf("the live client dropped the first change")
+	}
+	if restored.dedup.duplicate(change) {
+		t.Errorf("the restored client dropped a change only the live one saw")
+	}
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// throttle logs a repetitive error at most once per interval. The errors in
+// between are counted and summed up in a single line once it's over, e.g.
+// when many clients disconnect at once.
+type throttle struct {
+	mut sync.Mutex
+
+	// logger writes the lines, the default logger at the time if nil
+	logger   *slog.Logger
+	msg      string
+	interval time.Duration
+
+	logged     time.Time
+	suppressed int
+	lastErr    error
+	flushing   bool
+}
+
+func newThrottle(msg string, interval time.Duration) *throttle {
+	return &throttle{
+		msg:      msg,
+		interval: interval,
+	}
+}
+
+// log logs err right away unless another one was logged within the interval.
+func (t *throttle) log(err error) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	if since := time.Since(t.logged); since >= t.interval && !t.flushing {
+		t.logged = time.Now()
+		t.output().Warn(t.msg, "error", err)
+		return
+	}
+
+	t.suppressed++
+	t.lastErr = err
+	if !t.flushing {
+		t.flushing = true
+		time.AfterFunc(t.interval-time.Since(t.logged), t.flush)
+	}
+}
+
+// output returns the logger the lines are written to.
+func (t *throttle) output() *slog.Logger {
+	if t.logger == nil {
+		return slog.Default()
+	}
+	return t.logger
+}
+
+// flush sums up the errors suppressed since the last line.
+func (t *throttle) flush() {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	t.output().Warn(t.msg, "suppressed", t.suppressed, "interval", t.interval, "error", t.lastErr)
+	t.logged = time.Now()
+	t.suppressed = 0
+	t.lastErr = nil
+	t.flushing = false
+}
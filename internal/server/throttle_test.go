@@ -0,0 +1,51 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestThrottleBoundsLogLines(t *testing.T) {
+	var out bytes.Buffer
+	var outMut sync.Mutex
+
+	th := newThrottle("write error", 100*time.Millisecond)
+	th.logger = slog.New(slog.NewTextHandler(writerFunc(func(p []byte) (int, error) {
+		outMut.Lock()
+		defer outMut.Unlock()
+		return out.Write(p)
+	}), nil))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 1000; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			th.log(errors.New("connection reset by peer"))
+		}()
+	}
+	wg.Wait()
+	time.Sleep(200 * time.Millisecond)
+
+	outMut.Lock()
+	defer outMut.Unlock()
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("logged %d lines, expected 2:\n%s", len(lines), out.String())
+	}
+	if !strings.Contains(lines[1], "suppressed=999") {
+		t.Errorf("summary = %q, expected it to count the 999 suppressed errors", lines[1])
+	}
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
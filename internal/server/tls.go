@@ -0,0 +1,187 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// defaultCertCache is where the certificates of autocert are kept, unless
+// set by TLS_AUTOCERT_CACHE.
+const defaultCertCache = "certs"
+
+// certCheckInterval is how often the certificate files are checked for
+// changes, at most.
+const certCheckInterval = 10 * time.Second
+
+// TLSConfig terminates TLS on the servers, so clients connect with https://
+// and wss:// without a proxy in front. The certificate is either loaded from
+// files, reloaded once they change, or obtained from Let's Encrypt for the
+// domains.
+type TLSConfig struct {
+	// CertFile and KeyFile hold the PEM encoded certificate, followed by its
+	// intermediates, and its key
+	CertFile string
+	KeyFile  string
+	// Domains are those Let's Encrypt issues certificates for, through the
+	// TLS-ALPN-01 challenge, which needs the server reachable on port 443.
+	// They can't be combined with CertFile and KeyFile
+	Domains []string
+	// CacheDir keeps the certificates issued across restarts, "certs" if
+	// empty
+	CacheDir string
+	// Email is given to Let's Encrypt to warn about expiring certificates
+	Email string
+}
+
+// tlsFromEnv returns the TLS configuration set by TLS_CERT and TLS_KEY, or
+// TLS_AUTOCERT_DOMAINS, TLS_AUTOCERT_CACHE and TLS_AUTOCERT_EMAIL, nil if
+// none is.
+func tlsFromEnv() *TLSConfig {
+	cfg := &TLSConfig{
+		CertFile: os.Getenv("TLS_CERT"),
+		KeyFile:  os.Getenv("TLS_KEY"),
+		CacheDir: os.Getenv("TLS_AUTOCERT_CACHE"),
+		Email:    os.Getenv("TLS_AUTOCERT_EMAIL"),
+	}
+	for _, domain := range strings.Split(os.Getenv("TLS_AUTOCERT_DOMAINS"), ",") {
+		if domain = strings.TrimSpace(domain); domain != "" {
+			cfg.Domains = append(cfg.Domains, domain)
+		}
+	}
+
+	if cfg.CertFile == "" && cfg.KeyFile == "" && len(cfg.Domains) == 0 {
+		return nil
+	}
+	return cfg
+}
+
+// validate checks the configuration is complete and consistent.
+func (cfg *TLSConfig) validate() error {
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		return fmt.Errorf("TLS cert and key must be set together")
+	}
+	if cfg.CertFile != "" && len(cfg.Domains) > 0 {
+		return fmt.Errorf("TLS cert files can't be combined with autocert domains")
+	}
+	if cfg.CertFile == "" && len(cfg.Domains) == 0 {
+		return fmt.Errorf("TLS needs a cert and key or autocert domains")
+	}
+	return nil
+}
+
+// build returns the tls.Config of the servers.
+// It returns an error if the configuration is invalid or the certificate
+// files can't be loaded.
+func (cfg *TLSConfig) build() (*tls.Config, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	if len(cfg.Domains) > 0 {
+		cacheDir := cfg.CacheDir
+		if cacheDir == "" {
+			cacheDir = defaultCertCache
+		}
+
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(cfg.Domains...),
+			Cache:      autocert.DirCache(cacheDir),
+			Email:      cfg.Email,
+		}
+		return manager.TLSConfig(), nil
+	}
+
+	reloader, err := newCertReloader(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.getCertificate,
+	}, nil
+}
+
+// certReloader serves the certificate of a pair of files, loading it again
+// once they're modified, e.g. renewed by certbot or cert-manager.
+type certReloader struct {
+	certFile, keyFile string
+
+	mut  sync.Mutex
+	cert *tls.Certificate
+	// modTime is the latest modification of the files as of the last load
+	modTime time.Time
+	checked time.Time
+}
+
+// newCertReloader loads the certificate of certFile and keyFile.
+// It returns an error if they can't be loaded.
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.load(time.Now()); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// load loads the certificate of the files as of now.
+func (r *certReloader) load(now time.Time) error {
+	modTime, err := r.lastModified()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("unable to load the TLS certificate: %w", err)
+	}
+
+	r.cert, r.modTime, r.checked = &cert, modTime, now
+	return nil
+}
+
+// lastModified returns the latest modification time of the files.
+func (r *certReloader) lastModified() (time.Time, error) {
+	var latest time.Time
+	for _, file := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("unable to load the TLS certificate: %w", err)
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// getCertificate returns the certificate, loaded again if the files changed
+// since. A certificate that fails to load keeps the previous one in use.
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	now := time.Now()
+	if now.Sub(r.checked) < certCheckInterval {
+		return r.cert, nil
+	}
+	r.checked = now
+
+	// Renewals write one file and then the other, a pair that doesn't
+	// match yet is retried on the next check
+	if modTime, err := r.lastModified(); err == nil && modTime.After(r.modTime) {
+		if err := r.load(now); err != nil {
+			slog.Warn("Failed to reload the TLS certificate, keeping the previous one", "error", err)
+		} else {
+			slog.Info("Reloaded the TLS certificate", "cert", r.certFile)
+		}
+	}
+	return r.cert, nil
+}
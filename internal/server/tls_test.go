@@ -0,0 +1,166 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert writes a self-signed certificate for localhost named name to
+// dir, returning its files and the certificate.
+func writeCert(t *testing.T, dir, name string, modTime time.Time) (certFile, keyFile string, cert *x509.Certificate) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate() error = %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey() error = %v", err)
+	}
+
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("write cert error = %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatalf("write key error = %v", err)
+	}
+	for _, file := range []string{certFile, keyFile} {
+		os.Chtimes(file, modTime, modTime)
+	}
+
+	cert, _ = x509.ParseCertificate(der)
+	return certFile, keyFile, cert
+}
+
+// commonName returns the common name of the leaf of cert.
+func commonName(t *testing.T, cert *tls.Certificate) string {
+	t.Helper()
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("ParseCertificate() error = %v", err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestTLSServesTheCertFiles(t *testing.T) {
+	certFile, keyFile, cert := writeCert(t, t.TempDir(), "pulse", time.Now())
+
+	tlsConfig, err := (&TLSConfig{CertFile: certFile, KeyFile: keyFile}).build()
+	if err != nil {
+		t.Fatalf("build() error = %v", err)
+	}
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})}
+	go srv.Serve(listener)
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+
+	resp, err := client.Get("https://" + listener.Addr().String())
+	if err != nil {
+		t.Fatalf("GET error = %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("status = %d, expected %d", resp.StatusCode, http.StatusNoContent)
+	}
+}
+
+func TestCertReloaderPicksUpRenewals(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, _ := writeCert(t, dir, "first", time.Now().Add(-time.Minute))
+
+	r, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("newCertReloader() error = %v", err)
+	}
+	first, _ := r.getCertificate(nil)
+	if name := commonName(t, first); name != "first" {
+		t.Fatalf("certificate = %s, expected first", name)
+	}
+
+	writeCert(t, dir, "renewed", time.Now())
+
+	// Not checked again until certCheckInterval passed
+	if cert, _ := r.getCertificate(nil); cert != first {
+		t.Errorf("certificate reloaded before certCheckInterval")
+	}
+
+	r.checked = time.Now().Add(-certCheckInterval)
+	if cert, _ := r.getCertificate(nil); commonName(t, cert) != "renewed" {
+		t.Errorf("certificate = %s, expected renewed", commonName(t, cert))
+	}
+
+	// A broken renewal keeps the previous certificate
+	os.WriteFile(certFile, []byte("not a certificate"), 0o600)
+	os.Chtimes(certFile, time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+	r.checked = time.Now().Add(-certCheckInterval)
+	if cert, err := r.getCertificate(nil); err != nil || commonName(t, cert) != "renewed" {
+		t.Errorf("certificate = %v, %v, expected renewed still", cert, err)
+	}
+}
+
+func TestInvalidTLSConfig(t *testing.T) {
+	certFile, keyFile, _ := writeCert(t, t.TempDir(), "pulse", time.Now())
+
+	tests := []struct {
+		name string
+		cfg  TLSConfig
+	}{
+		{name: "cert without key", cfg: TLSConfig{CertFile: certFile}},
+		{name: "key without cert", cfg: TLSConfig{KeyFile: keyFile}},
+		{name: "files and domains", cfg: TLSConfig{CertFile: certFile, KeyFile: keyFile, Domains: []string{"pulse.example.com"}}},
+		{name: "nothing", cfg: TLSConfig{}},
+		{name: "missing files", cfg: TLSConfig{CertFile: certFile + ".missing", KeyFile: keyFile}},
+		{name: "mismatching files", cfg: TLSConfig{CertFile: keyFile, KeyFile: certFile}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.cfg.build(); err == nil {
+				t.Errorf("build() expected an error")
+			}
+		})
+	}
+
+	if tlsConfig, err := (&TLSConfig{Domains: []string{"pulse.example.com"}, CacheDir: t.TempDir()}).build(); err != nil || tlsConfig.GetCertificate == nil {
+		t.Errorf("build() of autocert = %v, %v", tlsConfig, err)
+	}
+}
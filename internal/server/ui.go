@@ -0,0 +1,33 @@
+package server
+
+import (
+	"embed"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// uiFiles is the dashboard served under /ui. It's a static page calling the
+// admin API, the token is entered in the page rather than embedded.
+//
+//go:embed ui
+var uiFiles embed.FS
+
+// pulseJS is the browser client, served on /pulse.js.
+//
+//go:embed pulse.js
+var pulseJS []byte
+
+// pulseJSHandler serves the browser client.
+func pulseJSHandler(c echo.Context) error {
+	c.Response().Header().Set("Cache-Control", "public, max-age=3600")
+	return c.Blob(http.StatusOK, "text/javascript; charset=utf-8", pulseJS)
+}
+
+// registerUI serves the dashboard on /ui.
+func registerUI(e *echo.Echo) {
+	e.GET("/ui", func(c echo.Context) error {
+		return c.Redirect(http.StatusMovedPermanently, "/ui/")
+	})
+	e.StaticFS("/ui/", echo.MustSubFS(uiFiles, "ui"))
+}
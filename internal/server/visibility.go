@@ -0,0 +1,150 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+
+	"pulse/internal/database"
+)
+
+// visibilityTimeout bounds the visibility checks of a notification.
+const visibilityTimeout = 5 * time.Second
+
+// dropVisibilityFailed is why the rows whose visibility couldn't be checked
+// are dropped.
+const dropVisibilityFailed = "visibility_failed"
+
+// visibilityErrors logs the failed checks, which fail together when the
+// database is down.
+var visibilityErrors = newThrottle("Failed to check the visibility of a row", time.Second)
+
+// subscriber is who opened a connection, as authenticated.
+type subscriber struct {
+	grant *grant
+	// claims are its claims as a JSON object, which the visibility checks
+	// run with
+	claims string
+	// identity tells subscribers apart across connections and tokens, see
+	// identityOf
+	identity string
+}
+
+// subscriberOf returns the subscriber of c: granted the tables of its API
+// key, or what the policies grant its claims.
+func (s *Server) subscriberOf(c echo.Context) subscriber {
+	claims, _ := c.Get(claimsKey).(jwt.MapClaims)
+	encoded := "{}"
+	if claims != nil {
+		data, _ := json.Marshal(claims)
+		encoded = string(data)
+	}
+
+	if g, ok := c.Get(grantKey).(*grant); ok {
+		return subscriber{grant: g, claims: encoded, identity: identityOf(claims)}
+	}
+	return subscriber{grant: grantFor(s.policies, claims), claims: encoded, identity: identityOf(claims)}
+}
+
+// identityOf returns who claims are about: the name of their API key, their
+// subject, or else the claims themselves, minus those changing with every
+// token. Subscribers without claims share the empty identity.
+func identityOf(claims jwt.MapClaims) string {
+	if len(claims) == 0 {
+		return ""
+	}
+	if name, ok := claims["api_key"].(string); ok {
+		return "api_key:" + name
+	}
+	if subject, ok := claims["sub"].(string); ok && subject != "" {
+		return "sub:" + subject
+	}
+
+	lasting := make(map[string]interface{}, len(claims))
+	for name, value := range claims {
+		switch name {
+		case "exp", "iat", "nbf", "jti":
+		default:
+			lasting[name] = value
+		}
+	}
+	data, _ := json.Marshal(lasting)
+	return "claims:" + string(data)
+}
+
+// checksVisibility reports whether the visibility checks apply to n: rows
+// changed or snapshotted. Truncates remove every row, visible ones included.
+func checksVisibility(n database.DBNotification) bool {
+	switch n.Operation {
+	case "insert", "update", "delete", database.OperationSnapshot:
+		return true
+	default:
+		return false
+	}
+}
+
+// visibility holds which claims may receive a notification, as decided by
+// the visibility check of its database. A nil visibility restricts nothing.
+type visibility map[string]bool
+
+// allows reports whether cli may receive the notification.
+func (v visibility) allows(cli *client) bool {
+	return v == nil || v[cli.claims]
+}
+
+// visibilityOf runs the visibility check of the database of n for each of
+// claims. It's nil when n isn't checked, or comes from no database, like
+// published notifications.
+// Claims whose check failed are denied, rows are never leaked because the
+// database couldn't be asked.
+func (s *Server) visibilityOf(ctx context.Context, n database.DBNotification, claims []string) visibility {
+	if !s.visibilityChecks || !checksVisibility(n) {
+		return nil
+	}
+
+	var db database.Service
+	for _, candidate := range s.dbs {
+		if candidate.Source() == n.Source {
+			db = candidate
+		}
+	}
+	if db == nil {
+		return nil
+	}
+
+	v := make(visibility, len(claims))
+	if len(claims) == 0 {
+		return v
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, visibilityTimeout)
+	defer cancel()
+
+	visible, err := db.Visible(ctx, n, claims)
+	if errors.Is(err, database.ErrVisibilityDisabled) {
+		return nil
+	}
+	if err != nil {
+		droppedNotifications.WithLabelValues(dropVisibilityFailed).Inc()
+		visibilityErrors.log(err)
+		return v
+	}
+
+	for i, c := range claims {
+		v[c] = visible[i]
+	}
+	return v
+}
+
+// allows reports whether cli may receive msg, delivered to it alone, e.g.
+// replayed: whether it's granted and visible to it.
+func (s *Server) allows(ctx context.Context, cli *client, msg database.DBNotification) bool {
+	if !cli.grant.allows(msg) {
+		return false
+	}
+	return s.visibilityOf(ctx, msg, []string{cli.claims}).allows(cli)
+}
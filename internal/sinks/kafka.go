@@ -0,0 +1,208 @@
+package sinks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+
+	"pulse/internal/database"
+)
+
+const (
+	// kafkaLinger is how long records wait for others to batch with
+	kafkaLinger = 100 * time.Millisecond
+	// kafkaBufferSize is how many records wait to be produced before new
+	// notifications are dropped
+	kafkaBufferSize = 2000
+	// defaultKafkaTopicPrefix prefixes the tables' topics
+	defaultKafkaTopicPrefix = "pulse."
+)
+
+// KafkaConfig describes the producer built by NewKafka.
+type KafkaConfig struct {
+	// Brokers are the host:port of the brokers to bootstrap from
+	Brokers []string
+	// Topic receives every notification keyed by its table, so those of a
+	// table stay in order. Empty produces each table to its own topic
+	Topic string
+	// TopicPrefix prefixes the table's name to make its topic, when Topic is
+	// empty, "pulse." if empty too
+	TopicPrefix string
+	// Acks is how many replicas acknowledge a record before it's produced:
+	// "all" of the in-sync ones, the "leader" or "none". "all" if empty
+	Acks string
+	// Attempts is how many times a record is produced, 5 if zero
+	Attempts int
+	// Backoff is the delay before the first retry, doubled after every
+	// attempt up to a minute, a second if zero
+	Backoff time.Duration
+	// Options are passed on to the client, after those above, e.g. for TLS
+	// or SASL
+	Options []kgo.Opt
+}
+
+// kafkaFromEnv returns the producer set by PULSE_KAFKA_BROKERS, a comma
+// separated list, producing to PULSE_KAFKA_TOPIC or one topic per table
+// prefixed by PULSE_KAFKA_TOPIC_PREFIX, with the PULSE_KAFKA_ACKS acks.
+// It returns nil if it's unset.
+func kafkaFromEnv() (*Kafka, error) {
+	brokers := os.Getenv("PULSE_KAFKA_BROKERS")
+	if brokers == "" {
+		return nil, nil
+	}
+
+	return NewKafka(KafkaConfig{
+		Brokers:     strings.Split(brokers, ","),
+		Topic:       os.Getenv("PULSE_KAFKA_TOPIC"),
+		TopicPrefix: os.Getenv("PULSE_KAFKA_TOPIC_PREFIX"),
+		Acks:        os.Getenv("PULSE_KAFKA_ACKS"),
+	})
+}
+
+// Kafka produces every notification, as a JSON record, to the brokers with
+// the franz-go client. Records are batched per partition, and those a
+// broker fails are retried with exponential backoff. Notifications are
+// dropped while the client buffers too many records.
+// On a single topic records are keyed by table, on the tables' topics by the
+// row's id, and partitioned by their key, so the changes of a row land on
+// the same partition in order.
+type Kafka struct {
+	cfg    KafkaConfig
+	client *kgo.Client
+
+	mut    sync.RWMutex
+	closed bool
+}
+
+// NewKafka starts producing to the brokers of cfg, connecting on the first
+// notification.
+// It returns an error if there are no brokers, a topic name is invalid or
+// the acks aren't known.
+func NewKafka(cfg KafkaConfig) (*Kafka, error) {
+	brokers := make([]string, 0, len(cfg.Brokers))
+	for _, broker := range cfg.Brokers {
+		if broker = strings.TrimSpace(broker); broker == "" {
+			return nil, fmt.Errorf("kafka brokers %q has an empty address", strings.Join(cfg.Brokers, ","))
+		}
+		brokers = append(brokers, broker)
+	}
+	if len(brokers) == 0 {
+		return nil, fmt.Errorf("kafka needs at least one broker")
+	}
+	cfg.Brokers = brokers
+
+	if cfg.Topic == "" && cfg.TopicPrefix == "" {
+		cfg.TopicPrefix = defaultKafkaTopicPrefix
+	}
+	for _, name := range []string{cfg.Topic, cfg.TopicPrefix} {
+		if !validTopic(name) {
+			return nil, fmt.Errorf("invalid kafka topic %q", name)
+		}
+	}
+
+	if cfg.Attempts <= 0 {
+		cfg.Attempts = defaultAttempts
+	}
+	if cfg.Backoff <= 0 {
+		cfg.Backoff = defaultBackoff
+	}
+
+	opts := []kgo.Opt{
+		kgo.SeedBrokers(cfg.Brokers...),
+		kgo.ClientID("pulse"),
+		// Kafka's own murmur2 hashing of the keys
+		kgo.RecordPartitioner(kgo.StickyKeyPartitioner(nil)),
+		kgo.ProducerLinger(kafkaLinger),
+		kgo.MaxBufferedRecords(kafkaBufferSize),
+		kgo.RecordRetries(cfg.Attempts),
+		kgo.RetryBackoffFn(func(tries int) time.Duration {
+			backoff := cfg.Backoff
+			for i := 1; i < tries && backoff < maxBackoff; i++ {
+				backoff *= 2
+			}
+			return min(backoff, maxBackoff)
+		}),
+	}
+	switch cfg.Acks {
+	case "", "all":
+		opts = append(opts, kgo.RequiredAcks(kgo.AllISRAcks()))
+	case "leader":
+		// Idempotent writes need every in-sync replica to ack
+		opts = append(opts, kgo.RequiredAcks(kgo.LeaderAck()), kgo.DisableIdempotentWrite())
+	case "none":
+		opts = append(opts, kgo.RequiredAcks(kgo.NoAck()), kgo.DisableIdempotentWrite())
+	default:
+		return nil, fmt.Errorf("kafka acks %q must be all, leader or none", cfg.Acks)
+	}
+
+	client, err := kgo.NewClient(append(opts, cfg.Options...)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the kafka client: %w", err)
+	}
+
+	return &Kafka{cfg: cfg, client: client}, nil
+}
+
+// validTopic reports whether name only has the characters Kafka allows in
+// topic names. Table names always do.
+func validTopic(name string) bool {
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '_' || r == '-') {
+			return false
+		}
+	}
+	return len(name) <= 249
+}
+
+// Send hands n to the client for the next batch of its partition.
+func (k *Kafka) Send(n database.DBNotification) {
+	k.mut.RLock()
+	defer k.mut.RUnlock()
+	if k.closed {
+		return
+	}
+
+	value, err := json.Marshal(n)
+	if err != nil {
+		slog.Error("Failed to encode a kafka record", "operation", n.Operation, "table", n.Table, "error", err)
+		return
+	}
+
+	topic, key := k.cfg.Topic, n.Table
+	if topic == "" {
+		topic, key = k.cfg.TopicPrefix+n.Table, n.ID
+	}
+
+	record := &kgo.Record{Topic: topic, Key: []byte(key), Value: value}
+	k.client.TryProduce(context.Background(), record, func(r *kgo.Record, err error) {
+		switch {
+		case err == nil, errors.Is(err, kgo.ErrClientClosed):
+		case errors.Is(err, kgo.ErrMaxBuffered):
+			slog.Warn("Kafka buffer full, dropping a notification", "operation", n.Operation, "table", n.Table)
+		default:
+			slog.Error("Failed to produce a kafka record", "topic", r.Topic, "operation", n.Operation, "table", n.Table, "error", err)
+		}
+	})
+}
+
+// Close waits for the brokers to ack the records buffered and closes the
+// client. If ctx expires first, those left are dropped and ctx's error is
+// returned. Nothing is produced once it's called.
+func (k *Kafka) Close(ctx context.Context) error {
+	k.mut.Lock()
+	k.closed = true
+	k.mut.Unlock()
+
+	err := k.client.Flush(ctx)
+	k.client.Close()
+
+	return err
+}
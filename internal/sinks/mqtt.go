@@ -0,0 +1,259 @@
+package sinks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+
+	"pulse/internal/database"
+)
+
+const (
+	// mqttQueueSize is how many notifications wait to be published before
+	// new ones are dropped
+	mqttQueueSize = 1024
+	// defaultMQTTTopicPrefix is the first level of the topics
+	defaultMQTTTopicPrefix = "pulse"
+	// defaultMQTTTimeout bounds connecting, writing and waiting for the
+	// broker's acks
+	defaultMQTTTimeout = 5 * time.Second
+	// mqttKeepAlive is the keep alive announced to the broker, the client
+	// pings it in between
+	mqttKeepAlive = time.Minute
+)
+
+// MQTTConfig describes the publisher built by NewMQTT.
+type MQTTConfig struct {
+	// URL is the broker's, mqtt://[user[:password]@]host:port, or mqtts://
+	// to connect over TLS
+	URL string
+	// TopicPrefix is the first level of the topics, "pulse" if empty
+	TopicPrefix string
+	// QoS is the quality of service of the messages: 0 publishes at most
+	// once, 1 waits for the broker's ack and 2 for it to have the message
+	// exactly once
+	QoS int
+	// ClientID identifies the connection to the broker, a unique one is
+	// generated if empty
+	ClientID string
+	// Attempts is how many times a notification is published, 5 if zero
+	Attempts int
+	// Backoff is the delay before the first retry, doubled after every
+	// attempt up to a minute, a second if zero
+	Backoff time.Duration
+	// Timeout bounds connecting, writing and waiting for an ack, 5s if zero
+	Timeout time.Duration
+}
+
+// mqttFromEnv returns the publisher set by PULSE_MQTT_URL, publishing under
+// PULSE_MQTT_TOPIC_PREFIX with the quality of service PULSE_MQTT_QOS. It
+// returns nil if it's unset.
+func mqttFromEnv() (*MQTT, error) {
+	raw := os.Getenv("PULSE_MQTT_URL")
+	if raw == "" {
+		return nil, nil
+	}
+
+	cfg := MQTTConfig{URL: raw, TopicPrefix: os.Getenv("PULSE_MQTT_TOPIC_PREFIX")}
+	if qos := os.Getenv("PULSE_MQTT_QOS"); qos != "" {
+		var err error
+		if cfg.QoS, err = strconv.Atoi(qos); err != nil {
+			return nil, fmt.Errorf("PULSE_MQTT_QOS must be 0, 1 or 2")
+		}
+	}
+
+	return NewMQTT(cfg)
+}
+
+// MQTT publishes every notification, as JSON, to the topic
+// <prefix>/<table>/<operation>, in order, with the Eclipse Paho client.
+// Notifications are retried when the connection fails or, with a QoS above
+// 0, the broker doesn't ack them, reconnecting with exponential backoff. Notifications are dropped while its
+// queue is full.
+type MQTT struct {
+	cfg    MQTTConfig
+	broker *url.URL
+	queue  chan database.DBNotification
+	// ctx is cancelled once Close gives up
+	ctx context.Context
+
+	closer
+}
+
+// NewMQTT starts publishing to the broker of cfg, connecting on the first
+// notification.
+// It returns an error if its URL, topic prefix or QoS is invalid.
+func NewMQTT(cfg MQTTConfig) (*MQTT, error) {
+	broker, err := url.Parse(cfg.URL)
+	if err != nil || (broker.Scheme != "mqtt" && broker.Scheme != "mqtts") || broker.Host == "" {
+		return nil, fmt.Errorf("mqtt broker %q must be a mqtt or mqtts URL", cfg.URL)
+	}
+	if broker.Port() == "" {
+		port := "1883"
+		if broker.Scheme == "mqtts" {
+			port = "8883"
+		}
+		broker.Host = net.JoinHostPort(broker.Hostname(), port)
+	}
+
+	if cfg.TopicPrefix == "" {
+		cfg.TopicPrefix = defaultMQTTTopicPrefix
+	}
+	if strings.ContainsAny(cfg.TopicPrefix, "+#\x00") || strings.HasPrefix(cfg.TopicPrefix, "/") || strings.HasSuffix(cfg.TopicPrefix, "/") {
+		return nil, fmt.Errorf("invalid mqtt topic prefix %q", cfg.TopicPrefix)
+	}
+	if cfg.QoS < 0 || cfg.QoS > 2 {
+		return nil, fmt.Errorf("mqtt qos must be 0, 1 or 2")
+	}
+
+	if cfg.ClientID == "" {
+		cfg.ClientID = fmt.Sprintf("pulse-%x", time.Now().UnixNano())
+	}
+	if cfg.Attempts <= 0 {
+		cfg.Attempts = defaultAttempts
+	}
+	if cfg.Backoff <= 0 {
+		cfg.Backoff = defaultBackoff
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultMQTTTimeout
+	}
+
+	m := &MQTT{cfg: cfg, broker: broker, queue: make(chan database.DBNotification, mqttQueueSize)}
+	m.ctx, m.stop = context.WithCancel(context.Background())
+	m.queues = append(m.queues, m.queue)
+
+	m.workers.Add(1)
+	go m.run()
+
+	return m, nil
+}
+
+// Send queues n for publishing.
+func (m *MQTT) Send(msg database.DBNotification) {
+	m.mut.RLock()
+	defer m.mut.RUnlock()
+	if m.closed {
+		return
+	}
+
+	select {
+	case m.queue <- msg:
+	default:
+		slog.Warn("MQTT queue full, dropping a notification", "operation", msg.Operation, "table", msg.Table)
+	}
+}
+
+// run publishes the notifications queued until the queue is closed and
+// drained, keeping a connection open in between.
+func (m *MQTT) run() {
+	defer m.workers.Done()
+
+	var client mqtt.Client
+	defer func() {
+		if client != nil {
+			client.Disconnect(uint(m.cfg.Timeout / time.Millisecond))
+		}
+	}()
+
+	for msg := range m.queue {
+		if m.ctx.Err() != nil {
+			continue
+		}
+
+		topic := m.cfg.TopicPrefix + "/" + msg.Table + "/" + msg.Operation
+		payload, err := json.Marshal(msg)
+		if err != nil {
+			slog.Error("Failed to encode a notification", "operation", msg.Operation, "table", msg.Table, "error", err)
+			continue
+		}
+
+		err = retry(m.ctx, m.cfg.Attempts, m.cfg.Backoff, func() (bool, error) {
+			if client == nil {
+				var err error
+				if client, err = m.connect(); err != nil {
+					return !errors.Is(err, errMQTTRefused), err
+				}
+			}
+
+			// The session is clean, a message the broker didn't ack is
+			// published again on a new connection
+			if err := m.publish(client, topic, payload); err != nil {
+				client.Disconnect(0)
+				client = nil
+				return true, err
+			}
+			return false, nil
+		})
+		if err != nil {
+			slog.Error("Failed to publish to mqtt", "operation", msg.Operation, "table", msg.Table, "error", err)
+		}
+	}
+}
+
+// errMQTTRefused is returned when the broker refused the connection, e.g.
+// for bad credentials. It isn't worth retrying.
+var errMQTTRefused = errors.New("mqtt broker refused the connection")
+
+// connect connects to the broker with a clean session. The connection isn't
+// restored once lost, run publishes again on a new one.
+func (m *MQTT) connect() (mqtt.Client, error) {
+	opts := mqtt.NewClientOptions().
+		AddBroker(m.broker.Scheme + "://" + m.broker.Host).
+		SetClientID(m.cfg.ClientID).
+		SetCleanSession(true).
+		SetKeepAlive(mqttKeepAlive).
+		SetConnectTimeout(m.cfg.Timeout).
+		SetWriteTimeout(m.cfg.Timeout).
+		SetAutoReconnect(false)
+	if m.broker.User != nil {
+		opts.SetUsername(m.broker.User.Username())
+		if password, ok := m.broker.User.Password(); ok {
+			opts.SetPassword(password)
+		}
+	}
+
+	client := mqtt.NewClient(opts)
+	token := client.Connect()
+	if !token.WaitTimeout(m.cfg.Timeout) {
+		client.Disconnect(0)
+		return nil, errors.New("timed out connecting to the mqtt broker")
+	}
+	if err := token.Error(); err != nil {
+		switch token.(*mqtt.ConnectToken).ReturnCode() {
+		case packets.ErrRefusedBadProtocolVersion, packets.ErrRefusedIDRejected, packets.ErrRefusedBadUsernameOrPassword, packets.ErrRefusedNotAuthorised:
+			return nil, fmt.Errorf("%w: %w", errMQTTRefused, err)
+		}
+		return nil, err
+	}
+
+	return client, nil
+}
+
+// publish sends payload to topic and waits for the broker to ack it as the
+// QoS requires.
+func (m *MQTT) publish(client mqtt.Client, topic string, payload []byte) error {
+	token := client.Publish(topic, byte(m.cfg.QoS), false, payload)
+
+	timeout := time.NewTimer(m.cfg.Timeout)
+	defer timeout.Stop()
+	select {
+	case <-token.Done():
+		return token.Error()
+	case <-timeout.C:
+		return errors.New("timed out waiting for the mqtt broker's ack")
+	case <-m.ctx.Done():
+		return m.ctx.Err()
+	}
+}
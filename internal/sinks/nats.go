@@ -0,0 +1,234 @@
+package sinks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+
+	"pulse/internal/database"
+)
+
+const (
+	// natsQueueSize is how many notifications wait to be published before
+	// new ones are dropped
+	natsQueueSize = 1024
+	// defaultNATSSubjectPrefix is the first token of the subjects
+	defaultNATSSubjectPrefix = "pulse"
+	// defaultNATSTimeout bounds connecting, writing and waiting for the
+	// JetStream acks
+	defaultNATSTimeout = 5 * time.Second
+)
+
+// NATSConfig describes the publisher built by NewNATS.
+type NATSConfig struct {
+	// URL is the server's, nats://[user:password@]host:port, or tls:// to
+	// connect over TLS. A user without password is used as a token
+	URL string
+	// SubjectPrefix is the first token of the subjects, "pulse" if empty
+	SubjectPrefix string
+	// JetStream waits for a stream to ack every notification, it must
+	// capture the subjects
+	JetStream bool
+	// Attempts is how many times a notification is published, 5 if zero
+	Attempts int
+	// Backoff is the delay before the first retry, doubled after every
+	// attempt up to a minute, a second if zero
+	Backoff time.Duration
+	// Timeout bounds connecting, writing and waiting for an ack, 5s if zero
+	Timeout time.Duration
+}
+
+// natsFromEnv returns the publisher set by PULSE_NATS_URL, publishing under
+// PULSE_NATS_SUBJECT_PREFIX and to JetStream if PULSE_NATS_JETSTREAM is
+// true. It returns nil if it's unset.
+func natsFromEnv() (*NATS, error) {
+	raw := os.Getenv("PULSE_NATS_URL")
+	if raw == "" {
+		return nil, nil
+	}
+
+	cfg := NATSConfig{URL: raw, SubjectPrefix: os.Getenv("PULSE_NATS_SUBJECT_PREFIX")}
+	if jetStream := os.Getenv("PULSE_NATS_JETSTREAM"); jetStream != "" {
+		var err error
+		if cfg.JetStream, err = strconv.ParseBool(jetStream); err != nil {
+			return nil, fmt.Errorf("PULSE_NATS_JETSTREAM must be a boolean")
+		}
+	}
+
+	return NewNATS(cfg)
+}
+
+// NATS publishes every notification, as JSON, to the subject
+// <prefix>.<table>.<operation>, in order, with the nats.go client. With
+// JetStream a notification is retried with exponential backoff until a
+// stream acks it, otherwise the client holds it while it reconnects.
+// Notifications are dropped while its queue is full.
+type NATS struct {
+	cfg   NATSConfig
+	queue chan database.DBNotification
+	// ctx is cancelled once Close gives up
+	ctx context.Context
+
+	closer
+}
+
+// NewNATS starts publishing to the server of cfg, connecting on the first
+// notification.
+// It returns an error if its URL or subject prefix is invalid.
+func NewNATS(cfg NATSConfig) (*NATS, error) {
+	server, err := url.Parse(cfg.URL)
+	if err != nil || (server.Scheme != "nats" && server.Scheme != "tls") || server.Host == "" {
+		return nil, fmt.Errorf("nats server %q must be a nats or tls URL", cfg.URL)
+	}
+
+	if cfg.SubjectPrefix == "" {
+		cfg.SubjectPrefix = defaultNATSSubjectPrefix
+	}
+	if strings.ContainsAny(cfg.SubjectPrefix, " \t\r\n*>") || strings.HasPrefix(cfg.SubjectPrefix, ".") || strings.HasSuffix(cfg.SubjectPrefix, ".") {
+		return nil, fmt.Errorf("invalid nats subject prefix %q", cfg.SubjectPrefix)
+	}
+
+	if cfg.Attempts <= 0 {
+		cfg.Attempts = defaultAttempts
+	}
+	if cfg.Backoff <= 0 {
+		cfg.Backoff = defaultBackoff
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultNATSTimeout
+	}
+
+	n := &NATS{cfg: cfg, queue: make(chan database.DBNotification, natsQueueSize)}
+	n.ctx, n.stop = context.WithCancel(context.Background())
+	n.queues = append(n.queues, n.queue)
+
+	n.workers.Add(1)
+	go n.run()
+
+	return n, nil
+}
+
+// Send queues n for publishing.
+func (n *NATS) Send(msg database.DBNotification) {
+	n.mut.RLock()
+	defer n.mut.RUnlock()
+	if n.closed {
+		return
+	}
+
+	select {
+	case n.queue <- msg:
+	default:
+		slog.Warn("NATS queue full, dropping a notification", "operation", msg.Operation, "table", msg.Table)
+	}
+}
+
+// run publishes the notifications queued until the queue is closed and
+// drained, keeping a connection open in between.
+func (n *NATS) run() {
+	defer n.workers.Done()
+
+	var conn *nats.Conn
+	defer func() {
+		if conn == nil {
+			return
+		}
+		defer conn.Close()
+		if n.ctx.Err() != nil {
+			return
+		}
+
+		// Only then the server has handled the last ones
+		if err := conn.FlushTimeout(n.cfg.Timeout); err != nil {
+			slog.Error("Failed to flush nats", "error", err)
+		}
+	}()
+
+	for msg := range n.queue {
+		if n.ctx.Err() != nil {
+			continue
+		}
+
+		subject := n.cfg.SubjectPrefix + "." + msg.Table + "." + msg.Operation
+		payload, err := json.Marshal(msg)
+		if err != nil {
+			slog.Error("Failed to encode a notification", "operation", msg.Operation, "table", msg.Table, "error", err)
+			continue
+		}
+
+		err = retry(n.ctx, n.cfg.Attempts, n.cfg.Backoff, func() (bool, error) {
+			if conn == nil {
+				var err error
+				if conn, err = n.connect(); err != nil {
+					return true, err
+				}
+			}
+
+			err := n.publish(conn, subject, payload)
+			if errors.Is(err, errNATSRefused) {
+				return false, err
+			}
+			// The client reconnects on its own until it gives up
+			if err != nil && conn.IsClosed() {
+				conn = nil
+			}
+			return err != nil, err
+		})
+		if err != nil {
+			slog.Error("Failed to publish to nats", "operation", msg.Operation, "table", msg.Table, "error", err)
+		}
+	}
+}
+
+// connect connects to the server, which the client reconnects to whenever
+// the connection is lost, holding the notifications published meanwhile.
+func (n *NATS) connect() (*nats.Conn, error) {
+	return nats.Connect(n.cfg.URL,
+		nats.Name("pulse"),
+		nats.Timeout(n.cfg.Timeout),
+		nats.MaxReconnects(-1),
+		nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+			slog.Warn("NATS error", "error", err)
+		}),
+	)
+}
+
+// errNATSRefused is returned when JetStream refused a notification, e.g.
+// because no stream captures its subject.
+var errNATSRefused = errors.New("jetstream refused the notification")
+
+// publish sends payload to subject. With JetStream, it waits for the
+// stream's ack and returns an error wrapping errNATSRefused if it refused
+// it.
+func (n *NATS) publish(conn *nats.Conn, subject string, payload []byte) error {
+	if !n.cfg.JetStream {
+		return conn.Publish(subject, payload)
+	}
+
+	js, err := jetstream.New(conn)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(n.ctx, n.cfg.Timeout)
+	defer cancel()
+
+	_, err = js.Publish(ctx, subject, payload)
+	var refused *jetstream.APIError
+	if errors.As(err, &refused) || errors.Is(err, jetstream.ErrNoStreamResponse) {
+		return fmt.Errorf("%w: %w", errNATSRefused, err)
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return errors.New("timed out waiting for the jetstream ack")
+	}
+	return err
+}
@@ -0,0 +1,169 @@
+// Package sinks delivers the notifications to consumers other than the
+// websocket and event stream clients, e.g. webhooks, Kafka, NATS or MQTT.
+package sinks
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"pulse/internal/database"
+)
+
+const (
+	// defaultAttempts is how many times a sink tries to deliver a
+	// notification before giving up on it
+	defaultAttempts = 5
+	// defaultBackoff is the delay before the first retry, doubled after
+	// every attempt
+	defaultBackoff = time.Second
+	// maxBackoff caps the delay between two attempts
+	maxBackoff = time.Minute
+)
+
+// Sink receives every notification the server fans out.
+type Sink interface {
+	// Send hands n over for delivery. It never blocks, a sink falling behind
+	// drops notifications rather than slowing the clients down
+	Send(n database.DBNotification)
+
+	// Close delivers what's pending and stops the sink. If ctx expires
+	// first, pending notifications are dropped and ctx's error is returned
+	Close(ctx context.Context) error
+}
+
+// FromEnv returns the sinks configured by the environment, none by default.
+// It returns an error if any of their settings is invalid.
+func FromEnv() ([]Sink, error) {
+	var sinks []Sink
+
+	webhook, err := webhookFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	if webhook != nil {
+		sinks = append(sinks, webhook)
+	}
+
+	kafka, err := kafkaFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	if kafka != nil {
+		sinks = append(sinks, kafka)
+	}
+
+	nats, err := natsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	if nats != nil {
+		sinks = append(sinks, nats)
+	}
+
+	mqtt, err := mqttFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	if mqtt != nil {
+		sinks = append(sinks, mqtt)
+	}
+
+	return sinks, nil
+}
+
+// retry calls attempt until it succeeds, up to attempts times, waiting
+// backoff before the first retry and twice as long before each next one.
+// It returns the last error if every attempt failed, attempt said it's not
+// worth retrying or ctx is done.
+func retry(ctx context.Context, attempts int, backoff time.Duration, attempt func() (bool, error)) error {
+	for i := 1; ; i++ {
+		again, err := attempt()
+		if err == nil || !again {
+			return err
+		}
+		if i == attempts {
+			return fmt.Errorf("giving up after %d attempts: %w", i, err)
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// post sends body to target once, with header. It returns whether a failure
+// is worth retrying: network errors, server errors and rate limiting are.
+func post(ctx context.Context, client *http.Client, target string, header http.Header, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header = header
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		return true, fmt.Errorf("endpoint responded %s", resp.Status)
+	default:
+		return false, fmt.Errorf("endpoint responded %s", resp.Status)
+	}
+}
+
+// closer stops a sink whose workers deliver the notifications of queues.
+// Sinks hold mut to queue and don't once closed is set.
+type closer struct {
+	mut     sync.RWMutex
+	closed  bool
+	queues  []chan database.DBNotification
+	workers sync.WaitGroup
+	// stop cancels the deliveries in flight once Close gives up
+	stop context.CancelFunc
+}
+
+// Close lets the workers deliver the notifications queued and waits for
+// them. If ctx expires first, those left are dropped and ctx's error is
+// returned. Nothing can be queued once it's called.
+func (c *closer) Close(ctx context.Context) error {
+	c.mut.Lock()
+	if !c.closed {
+		c.closed = true
+		for _, queue := range c.queues {
+			close(queue)
+		}
+	}
+	c.mut.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		c.workers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		c.stop()
+		return nil
+	case <-ctx.Done():
+		c.stop()
+		<-done
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,211 @@
+package sinks
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	"pulse/internal/database"
+	"pulse/internal/tracing"
+)
+
+// AllTables is the table of the webhook endpoints receiving the
+// notifications of every table.
+const AllTables = "*"
+
+// SignatureHeader carries the HMAC-SHA256 of the body, hex encoded after
+// "sha256=", when the webhook has a secret.
+const SignatureHeader = "X-Pulse-Signature"
+
+// webhookQueueSize is how many notifications wait for each endpoint before
+// new ones are dropped.
+const webhookQueueSize = 1024
+
+// WebhookConfig describes the webhook built by NewWebhook.
+type WebhookConfig struct {
+	// Endpoints are the URLs receiving the notifications of each table,
+	// those of AllTables receive every notification
+	Endpoints map[string][]string
+	// Secret signs the bodies in SignatureHeader, empty sends them unsigned
+	Secret string
+	// Attempts is how many times a notification is posted, 5 if zero
+	Attempts int
+	// Backoff is the delay before the first retry, doubled after every
+	// attempt up to a minute, a second if zero
+	Backoff time.Duration
+	// Client posts the notifications, one with a 10s timeout if nil
+	Client *http.Client
+}
+
+// webhookFromEnv returns the webhook set by PULSE_WEBHOOKS, a JSON object
+// listing the URLs of each table, e.g.
+//
+//	{"orders": ["https://example.com/orders"], "*": ["https://example.com/all"]}
+//
+// signed with PULSE_WEBHOOK_SECRET. It returns nil if it's unset.
+func webhookFromEnv() (*Webhook, error) {
+	raw := os.Getenv("PULSE_WEBHOOKS")
+	if raw == "" {
+		return nil, nil
+	}
+
+	var endpoints map[string][]string
+	if err := json.Unmarshal([]byte(raw), &endpoints); err != nil {
+		return nil, fmt.Errorf("invalid PULSE_WEBHOOKS: %w", err)
+	}
+
+	return NewWebhook(WebhookConfig{Endpoints: endpoints, Secret: os.Getenv("PULSE_WEBHOOK_SECRET")})
+}
+
+// Webhook posts every notification, as JSON, to the endpoints of its table.
+// Each endpoint has its own queue and is posted to in order, a notification
+// failing with a network error, a 5xx or a 429 is retried with exponential
+// backoff. Notifications are dropped while an endpoint's queue is full.
+type Webhook struct {
+	endpoints map[string][]*endpoint
+	all       []*endpoint
+	// ctx is cancelled once Close gives up
+	ctx context.Context
+
+	closer
+}
+
+// endpoint is a URL the webhook posts to, with its queue.
+type endpoint struct {
+	url   string
+	queue chan database.DBNotification
+}
+
+// NewWebhook starts posting to the endpoints of cfg.
+// It returns an error if a URL isn't absolute http or https.
+func NewWebhook(cfg WebhookConfig) (*Webhook, error) {
+	if cfg.Attempts <= 0 {
+		cfg.Attempts = defaultAttempts
+	}
+	if cfg.Backoff <= 0 {
+		cfg.Backoff = defaultBackoff
+	}
+	if cfg.Client == nil {
+		cfg.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	w := &Webhook{endpoints: make(map[string][]*endpoint)}
+	w.ctx, w.stop = context.WithCancel(context.Background())
+
+	// The same URL gets a single queue, even when listed for several tables
+	byURL := make(map[string]*endpoint)
+	for table, urls := range cfg.Endpoints {
+		for _, raw := range urls {
+			u, err := url.Parse(raw)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				w.stop()
+				return nil, fmt.Errorf("webhook %q of %s must be an http or https URL", raw, table)
+			}
+
+			e := byURL[raw]
+			if e == nil {
+				e = &endpoint{url: raw, queue: make(chan database.DBNotification, webhookQueueSize)}
+				byURL[raw] = e
+				w.queues = append(w.queues, e.queue)
+			}
+
+			if table == AllTables {
+				w.all = append(w.all, e)
+			} else {
+				w.endpoints[table] = append(w.endpoints[table], e)
+			}
+		}
+	}
+
+	for _, e := range byURL {
+		w.workers.Add(1)
+		go w.run(e, cfg)
+	}
+
+	return w, nil
+}
+
+// Send queues n for the endpoints of its table and those of every table.
+func (w *Webhook) Send(n database.DBNotification) {
+	w.mut.RLock()
+	defer w.mut.RUnlock()
+	if w.closed {
+		return
+	}
+
+	sent := make(map[*endpoint]bool)
+	for _, endpoints := range [][]*endpoint{w.endpoints[n.Table], w.all} {
+		for _, e := range endpoints {
+			if sent[e] {
+				continue
+			}
+			sent[e] = true
+
+			select {
+			case e.queue <- n:
+			default:
+				slog.Warn("Webhook queue full, dropping a notification", "operation", n.Operation, "table", n.Table, "url", e.url)
+			}
+		}
+	}
+}
+
+// run posts the notifications queued for e until its queue is closed, or
+// the webhook stopped.
+func (w *Webhook) run(e *endpoint, cfg WebhookConfig) {
+	defer w.workers.Done()
+
+	for n := range e.queue {
+		if w.ctx.Err() != nil {
+			continue
+		}
+
+		if err := w.deliver(e, n, cfg); err != nil {
+			slog.Error("Failed to post to the webhook", "operation", n.Operation, "table", n.Table, "url", e.url, "error", err)
+		}
+	}
+}
+
+// deliver posts n to e, retrying up to cfg.Attempts times, under a
+// pulse.webhook span whose context goes in the traceparent header.
+// It returns the last error if every attempt failed or the endpoint refused
+// n for good.
+func (w *Webhook) deliver(e *endpoint, n database.DBNotification, cfg WebhookConfig) (err error) {
+	span := tracing.Start(n.TraceParent(), "pulse.webhook",
+		attribute.String("pulse.table", n.Table),
+		attribute.String("pulse.operation", n.Operation),
+		attribute.String("url.full", e.url))
+	defer func() {
+		tracing.SetError(span, err)
+		span.End()
+	}()
+
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+
+	header := http.Header{"Content-Type": {"application/json"}}
+	if cfg.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(cfg.Secret))
+		mac.Write(body)
+		header.Set(SignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	if traceparent := tracing.Traceparent(span.SpanContext()); traceparent != "" {
+		header.Set("traceparent", traceparent)
+	}
+
+	return retry(w.ctx, cfg.Attempts, cfg.Backoff, func() (bool, error) {
+		return post(w.ctx, cfg.Client, e.url, header, body)
+	})
+}
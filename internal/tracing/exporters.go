@@ -0,0 +1,29 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+)
+
+// FromEnv returns the exporter picked by OTEL_TRACES_EXPORTER, following the
+// OpenTelemetry variables: none (the default), console or otlp.
+// otlp sends OTLP over HTTP to OTEL_EXPORTER_OTLP_TRACES_ENDPOINT, or
+// OTEL_EXPORTER_OTLP_ENDPOINT followed by /v1/traces, configured by the
+// other OTEL_EXPORTER_OTLP_* variables.
+// It returns a nil Exporter when tracing is disabled.
+func FromEnv() (Exporter, error) {
+	switch name := os.Getenv("OTEL_TRACES_EXPORTER"); name {
+	case "", "none":
+		return nil, nil
+	case "console":
+		return stdouttrace.New()
+	case "otlp":
+		return otlptracehttp.New(context.Background())
+	default:
+		return nil, fmt.Errorf("unsupported OTEL_TRACES_EXPORTER %q", name)
+	}
+}
@@ -0,0 +1,182 @@
+// Package tracing records OpenTelemetry spans along the path of a
+// notification, from Postgres to the client write.
+//
+// Spans go through the OpenTelemetry SDK to the exporter set with
+// SetExporter, they're no-ops until one is set.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// scope is the instrumentation scope of pulse's spans.
+const scope = "pulse"
+
+// SpanContext is what a child span needs from its parent.
+type SpanContext = trace.SpanContext
+
+// Exporter receives the spans once they ended, in batches.
+type Exporter = sdktrace.SpanExporter
+
+// ParseTraceID parses a 32 characters hex trace id, like the ones carried by
+// the trigger payloads.
+func ParseTraceID(s string) (trace.TraceID, error) {
+	var id trace.TraceID
+	if len(s) != hex.EncodedLen(len(id)) {
+		return id, fmt.Errorf("trace id must have %d hex characters", hex.EncodedLen(len(id)))
+	}
+	if _, err := hex.Decode(id[:], []byte(s)); err != nil {
+		return id, err
+	}
+	return id, nil
+}
+
+// Root returns the parent of the root span of a new trace numbered id.
+func Root(id trace.TraceID) SpanContext {
+	return trace.NewSpanContext(trace.SpanContextConfig{TraceID: id})
+}
+
+// ParseTraceparent parses a W3C traceparent header, e.g.
+// 00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01, to continue the
+// trace of whoever sent it.
+func ParseTraceparent(s string) (SpanContext, error) {
+	ctx := propagation.TraceContext{}.Extract(context.Background(), propagation.MapCarrier{"traceparent": s})
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return SpanContext{}, fmt.Errorf("invalid traceparent %q", s)
+	}
+
+	return sc, nil
+}
+
+// Traceparent formats sc as a W3C traceparent header, for the next service
+// along the path to continue the trace. It's empty if sc has no span.
+func Traceparent(sc SpanContext) string {
+	carrier := propagation.MapCarrier{}
+	propagation.TraceContext{}.Inject(trace.ContextWithSpanContext(context.Background(), sc), carrier)
+
+	return carrier.Get("traceparent")
+}
+
+var (
+	mut sync.Mutex
+	// provider is the SDK provider of the exporter set, nil if there's none
+	provider *sdktrace.TracerProvider
+)
+
+// SetExporter makes e receive the spans from now on, nil disables tracing.
+// The spans ended so far are exported to the previous exporter first.
+func SetExporter(e Exporter) {
+	mut.Lock()
+	defer mut.Unlock()
+
+	previous := provider
+	provider = nil
+	if e == nil {
+		otel.SetTracerProvider(noop.NewTracerProvider())
+	} else {
+		provider = sdktrace.NewTracerProvider(
+			sdktrace.WithBatcher(e),
+			sdktrace.WithResource(serviceResource()),
+			sdktrace.WithIDGenerator(idGenerator{}),
+		)
+		otel.SetTracerProvider(provider)
+	}
+
+	if previous != nil {
+		if err := previous.Shutdown(context.Background()); err != nil {
+			slog.Error("Failed to shut the exporter down", "error", err)
+		}
+	}
+}
+
+// Flush exports the spans ended so far.
+func Flush(ctx context.Context) error {
+	mut.Lock()
+	defer mut.Unlock()
+
+	if provider == nil {
+		return nil
+	}
+	return provider.ForceFlush(ctx)
+}
+
+// serviceResource describes pulse, as OTEL_SERVICE_NAME and
+// OTEL_RESOURCE_ATTRIBUTES say or as the pulse service otherwise.
+func serviceResource() *resource.Resource {
+	res, err := resource.New(context.Background(),
+		resource.WithAttributes(attribute.String("service.name", "pulse")),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		slog.Error("Failed to describe the service of the spans", "error", err)
+	}
+	return res
+}
+
+// traceIDKey holds the trace id of the root span to start, see Root.
+type traceIDKey struct{}
+
+// idGenerator numbers spans randomly, like the SDK's, except for the root
+// spans of a trace id picked beforehand.
+type idGenerator struct{}
+
+func (idGenerator) NewIDs(ctx context.Context) (trace.TraceID, trace.SpanID) {
+	traceID, ok := ctx.Value(traceIDKey{}).(trace.TraceID)
+	if !ok {
+		rand.Read(traceID[:])
+	}
+	return traceID, idGenerator{}.NewSpanID(ctx, traceID)
+}
+
+func (idGenerator) NewSpanID(ctx context.Context, traceID trace.TraceID) trace.SpanID {
+	var spanID trace.SpanID
+	rand.Read(spanID[:])
+	return spanID
+}
+
+// Start starts a span child of parent, or the root span of a new trace if
+// parent has no trace id. Parents with a trace id but no span id start a
+// root span in that trace.
+func Start(parent SpanContext, name string, attributes ...attribute.KeyValue) trace.Span {
+	return StartAt(parent, name, time.Now(), attributes...)
+}
+
+// StartAt is Start for a span that started at start.
+func StartAt(parent SpanContext, name string, start time.Time, attributes ...attribute.KeyValue) trace.Span {
+	ctx := context.Background()
+	switch {
+	case parent.IsValid():
+		ctx = trace.ContextWithSpanContext(ctx, parent)
+	case parent.HasTraceID():
+		ctx = context.WithValue(ctx, traceIDKey{}, parent.TraceID())
+	}
+
+	_, span := otel.Tracer(scope).Start(ctx, name, trace.WithTimestamp(start), trace.WithAttributes(attributes...))
+	return span
+}
+
+// SetError marks span as failed because of err, if any.
+func SetError(span trace.Span, err error) {
+	if err == nil {
+		return
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
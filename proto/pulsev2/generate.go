@@ -0,0 +1,5 @@
+// Package pulsev2 is the code generated from proto/pulse.proto: the
+// Notification messages of ?encoding=protobuf and the Pulse gRPC service.
+package pulsev2
+
+//go:generate protoc --proto_path=.. --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative pulse.proto
@@ -0,0 +1,150 @@
+// Notifications sent with ?encoding=protobuf, one per binary websocket
+// message. Control messages, like snapshot_complete or the reason of a
+// close, stay JSON text messages.
+// The Pulse service is served on PULSE_GRPC_PORT.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.4.0
+// - protoc             (unknown)
+// source: pulse.proto
+
+package pulsev2
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.62.0 or later.
+const _ = grpc.SupportPackageIsVersion8
+
+const (
+	Pulse_Subscribe_FullMethodName = "/pulse.v2.Pulse/Subscribe"
+)
+
+// PulseClient is the client API for Pulse service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type PulseClient interface {
+	// Subscribe streams the notifications of a subscription until either side
+	// ends it. The stream ends with OK once the subscription is closed,
+	// UNAVAILABLE when the server shuts down or the client can't keep up with
+	// writes, RESOURCE_EXHAUSTED when it can't keep up with its queue.
+	Subscribe(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (Pulse_SubscribeClient, error)
+}
+
+type pulseClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewPulseClient(cc grpc.ClientConnInterface) PulseClient {
+	return &pulseClient{cc}
+}
+
+func (c *pulseClient) Subscribe(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (Pulse_SubscribeClient, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Pulse_ServiceDesc.Streams[0], Pulse_Subscribe_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &pulseSubscribeClient{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Pulse_SubscribeClient interface {
+	Recv() (*Message, error)
+	grpc.ClientStream
+}
+
+type pulseSubscribeClient struct {
+	grpc.ClientStream
+}
+
+func (x *pulseSubscribeClient) Recv() (*Message, error) {
+	m := new(Message)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// PulseServer is the server API for Pulse service.
+// All implementations must embed UnimplementedPulseServer
+// for forward compatibility
+type PulseServer interface {
+	// Subscribe streams the notifications of a subscription until either side
+	// ends it. The stream ends with OK once the subscription is closed,
+	// UNAVAILABLE when the server shuts down or the client can't keep up with
+	// writes, RESOURCE_EXHAUSTED when it can't keep up with its queue.
+	Subscribe(*SubscribeRequest, Pulse_SubscribeServer) error
+	mustEmbedUnimplementedPulseServer()
+}
+
+// UnimplementedPulseServer must be embedded to have forward compatible implementations.
+type UnimplementedPulseServer struct {
+}
+
+func (UnimplementedPulseServer) Subscribe(*SubscribeRequest, Pulse_SubscribeServer) error {
+	return status.Errorf(codes.Unimplemented, "method Subscribe not implemented")
+}
+func (UnimplementedPulseServer) mustEmbedUnimplementedPulseServer() {}
+
+// UnsafePulseServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to PulseServer will
+// result in compilation errors.
+type UnsafePulseServer interface {
+	mustEmbedUnimplementedPulseServer()
+}
+
+func RegisterPulseServer(s grpc.ServiceRegistrar, srv PulseServer) {
+	s.RegisterService(&Pulse_ServiceDesc, srv)
+}
+
+func _Pulse_Subscribe_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(SubscribeRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(PulseServer).Subscribe(m, &pulseSubscribeServer{ServerStream: stream})
+}
+
+type Pulse_SubscribeServer interface {
+	Send(*Message) error
+	grpc.ServerStream
+}
+
+type pulseSubscribeServer struct {
+	grpc.ServerStream
+}
+
+func (x *pulseSubscribeServer) Send(m *Message) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// Pulse_ServiceDesc is the grpc.ServiceDesc for Pulse service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Pulse_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "pulse.v2.Pulse",
+	HandlerType: (*PulseServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Subscribe",
+			Handler:       _Pulse_Subscribe_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "pulse.proto",
+}
@@ -0,0 +1,158 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http/httptest"
+	"pulse/client"
+	"pulse/internal/database"
+	"pulse/internal/server"
+	"testing"
+	"time"
+)
+
+// receiveNotification waits for the next notification on conn.
+func receiveNotification(t *testing.T, conn *client.Conn) client.Notification {
+	t.Helper()
+
+	select {
+	case n := <-conn.Notifications():
+		return n
+	case <-time.After(2 * time.Second):
+		t.Fatalf("no notification received")
+		return client.Notification{}
+	}
+}
+
+func TestClientSubscribe(t *testing.T) {
+	db := newFakeDB()
+	_, ts := startServer(t, db)
+
+	conn, err := client.Dial(context.Background(), ts.URL, nil)
+	if err != nil {
+		t.Fatalf("Dial error = %v", err)
+	}
+	defer conn.Close()
+
+	if err := conn.Subscribe("orders", client.Operations("insert"), client.Where("amount > 10"), client.Fields("amount")); err != nil {
+		t.Fatalf("Subscribe error = %v", err)
+	}
+	if err := conn.Subscribe("orders", client.Where("amount >")); err == nil {
+		t.Errorf("Subscribe with an invalid filter succeeded")
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	db.notifications <- database.DBNotification{Operation: "update", Table: "orders", ID: "1", Data: map[string]interface{}{"amount": float64(50)}}
+	db.notifications <- database.DBNotification{Operation: "insert", Table: "orders", ID: "2", Data: map[string]interface{}{"amount": float64(5)}}
+	db.notifications <- database.DBNotification{Operation: "insert", Table: "users", ID: "3", Data: map[string]interface{}{"amount": float64(50)}}
+	db.notifications <- database.DBNotification{Operation: "insert", Table: "orders", ID: "4", Data: map[string]interface{}{"amount": float64(50), "status": "paid"}}
+
+	n := receiveNotification(t, conn)
+	if n.ID != "4" || n.Source != "fake" {
+		t.Errorf("received %v, expected the matching insert", n)
+	}
+	if row := n.Data.(map[string]interface{}); len(row) != 1 || row["amount"] == nil {
+		t.Errorf("data = %v, expected only amount", row)
+	}
+}
+
+func TestClientDecode(t *testing.T) {
+	type order struct {
+		ID     int64   `json:"id"`
+		Amount float64 `json:"amount"`
+		Status string  `json:"status"`
+	}
+
+	db := newFakeDB()
+	_, ts := startServer(t, db)
+
+	conn, err := client.Dial(context.Background(), ts.URL, nil)
+	if err != nil {
+		t.Fatalf("Dial error = %v", err)
+	}
+	defer conn.Close()
+
+	if err := conn.Subscribe("orders"); err != nil {
+		t.Fatalf("Subscribe error = %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	// Large ids keep their precision
+	db.notifications <- database.DBNotification{Operation: "insert", Table: "orders", ID: "9007199254740993", Data: json.RawMessage(`{"id":9007199254740993,"amount":12.5,"status":"paid"}`)}
+
+	n := receiveNotification(t, conn)
+	got, err := client.Decode[order](n)
+	if err != nil || got != (order{ID: 9007199254740993, Amount: 12.5, Status: "paid"}) {
+		t.Errorf("Decode() = %+v, %v", got, err)
+	}
+
+	if _, err := client.Decode[order](client.Notification{Operation: "event_lost"}); err == nil {
+		t.Errorf("Decode() of a notification without a row succeeded")
+	}
+	if _, err := client.Decode[[]string](n); err == nil {
+		t.Errorf("Decode() into a mismatching type succeeded")
+	}
+}
+
+func TestClientReconnectsAndResumes(t *testing.T) {
+	t.Setenv("PULSE_DRAIN_RETRY_AFTER", "50ms")
+
+	db := newFakeDB()
+	s, err := server.New(db)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	ts := httptest.NewServer(s.RegisterRoutes())
+	addr := ts.Listener.Addr().String()
+
+	conn, err := client.Dial(context.Background(), ts.URL, &client.Options{ReconnectDelay: 50 * time.Millisecond, Resume: true})
+	if err != nil {
+		t.Fatalf("Dial error = %v", err)
+	}
+	defer conn.Close()
+
+	if err := conn.Subscribe("orders"); err != nil {
+		t.Fatalf("Subscribe error = %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	db.notifications <- database.DBNotification{Operation: "insert", Table: "orders", ID: "1"}
+	if n := receiveNotification(t, conn); n.ID != "1" {
+		t.Fatalf("received %v, expected row 1", n)
+	}
+
+	// Restart the server on the same address, missing a change meanwhile
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown error = %v", err)
+	}
+	ts.Close()
+
+	time.Sleep(10 * time.Millisecond)
+	db.persist(database.DBNotification{Operation: "insert", Table: "orders", ID: "2", Source: "fake"})
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("listen error = %v", err)
+	}
+	if s, err = server.New(db); err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	ts = httptest.NewUnstartedServer(s.RegisterRoutes())
+	ts.Listener.Close()
+	ts.Listener = listener
+	ts.Start()
+	defer ts.Close()
+
+	if n := receiveNotification(t, conn); n.ID != "2" {
+		t.Fatalf("received %v, expected the missed row 2", n)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	db.notifications <- database.DBNotification{Operation: "insert", Table: "orders", ID: "3"}
+	if n := receiveNotification(t, conn); n.ID != "3" {
+		t.Errorf("received %v, expected row 3", n)
+	}
+}
@@ -0,0 +1,154 @@
+package tests
+
+import (
+	"os"
+	"path/filepath"
+	"pulse/internal/config"
+	"pulse/internal/database"
+	"pulse/internal/server"
+	"reflect"
+	"testing"
+)
+
+// writeConfig writes content to a config file named name and returns its path.
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("write error = %v", err)
+	}
+	return path
+}
+
+const testConfigFile = `# Tables pulse watches
+schemas: [public, "billing"]
+exclude:
+  - sessions
+  - billing.ledger   # too hot
+tables:
+  users:
+    columns:
+    - id
+    - email
+  posts:
+    condition: "NOT OLD.is_published AND NEW.is_published"
+  audit_log:
+    bulk: true
+routes:
+  firehose: false
+`
+
+func TestLoadConfigFile(t *testing.T) {
+	file, err := config.Load(writeConfig(t, "pulse.yaml", testConfigFile))
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	disabled := false
+	expected := config.File{
+		Schemas: []string{"public", "billing"},
+		Exclude: []string{"sessions", "billing.ledger"},
+		Tables: map[string]config.Table{
+			"users":     {Columns: []string{"id", "email"}},
+			"posts":     {Condition: "NOT OLD.is_published AND NEW.is_published"},
+			"audit_log": {Bulk: true},
+		},
+		Routes: config.Routes{Firehose: &disabled},
+	}
+	if !reflect.DeepEqual(file, expected) {
+		t.Errorf("Load() = %+v, expected %+v", file, expected)
+	}
+
+	json, err := config.Load(writeConfig(t, "pulse.json", `{"capture": "replication", "schemas": ["public"], "tables": {"users": {"columns": ["id"]}}}`))
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if json.Capture != "replication" || len(json.Schemas) != 1 || len(json.Tables["users"].Columns) != 1 {
+		t.Errorf("Load() = %+v", json)
+	}
+}
+
+func TestLoadConfigFileReadsAnyYAML(t *testing.T) {
+	file, err := config.Load(writeConfig(t, "pulse.yaml", `
+schemas: &schemas [public]
+tables: {audit_log: {bulk: true}}
+include: *schemas
+---
+`))
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if !reflect.DeepEqual(file.Include, []string{"public"}) || !file.Tables["audit_log"].Bulk {
+		t.Errorf("Load() = %+v", file)
+	}
+
+	file, err = config.Load(writeConfig(t, "pulse.yaml", "tables:\n  posts:\n    condition: >\n      NOT OLD.is_published\n      AND NEW.is_published\n"))
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if condition := file.Tables["posts"].Condition; condition != "NOT OLD.is_published AND NEW.is_published\n" {
+		t.Errorf("condition = %q", condition)
+	}
+
+	if _, err := config.Load(writeConfig(t, "pulse.yaml", "")); err != nil {
+		t.Errorf("Load() of an empty file error = %v", err)
+	}
+}
+
+func TestLoadConfigFileErrors(t *testing.T) {
+	for name, content := range map[string]string{
+		"unknown setting":       "schema: public\n",
+		"tabs":                  "tables:\n\tusers: {}\n",
+		"unknown table setting": "tables: {users: {bulk: true, colums: [id]}}\n",
+		"indentation":           "tables:\n  users:\n    bulk: true\n   posts: {}\n",
+		"duplicate":             "schemas: [public]\nschemas: [billing]\n",
+		"type":                  "schemas: public\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := config.Load(writeConfig(t, "pulse.yaml", content)); err == nil {
+				t.Errorf("Load() expected an error")
+			}
+		})
+	}
+}
+
+func TestConfigFileFeedsDatabaseConfig(t *testing.T) {
+	t.Setenv("PULSE_CONFIG", writeConfig(t, "pulse.yaml", testConfigFile))
+	// Variables win over the file
+	t.Setenv("PULSE_TABLE_COLUMNS", `{"users": ["id"]}`)
+
+	cfg, err := database.ConfigFromEnv()
+	if err != nil {
+		t.Fatalf("ConfigFromEnv() error = %v", err)
+	}
+
+	if !reflect.DeepEqual(cfg.Schemas, []string{"public", "billing"}) || !reflect.DeepEqual(cfg.Exclude, []string{"sessions", "billing.ledger"}) {
+		t.Errorf("schemas = %v, exclude = %v", cfg.Schemas, cfg.Exclude)
+	}
+	if !reflect.DeepEqual(cfg.TableColumns, map[string][]string{"users": {"id"}}) {
+		t.Errorf("columns = %v, expected the variable's", cfg.TableColumns)
+	}
+	if cfg.TriggerConditions["posts"] == "" || !reflect.DeepEqual(cfg.BulkTables, []string{"audit_log"}) {
+		t.Errorf("conditions = %v, bulk = %v", cfg.TriggerConditions, cfg.BulkTables)
+	}
+
+	serverConfig, err := server.ConfigFromEnv()
+	if err != nil {
+		t.Fatalf("server ConfigFromEnv() error = %v", err)
+	}
+	if serverConfig.Firehose == nil || *serverConfig.Firehose {
+		t.Errorf("firehose = %v, expected disabled by the file", serverConfig.Firehose)
+	}
+
+	t.Setenv("PULSE_ENABLE_FIREHOSE", "true")
+	if serverConfig, _ = server.ConfigFromEnv(); serverConfig.Firehose != nil {
+		t.Errorf("firehose = %v, expected the variable to decide", *serverConfig.Firehose)
+	}
+
+	t.Setenv("PULSE_INCLUDE_TABLES", "orders, billing.*")
+	t.Setenv("PULSE_EXCLUDE_TABLES", "audit_*")
+	if cfg, _ = database.ConfigFromEnv(); !reflect.DeepEqual(cfg.Include, []string{"orders", "billing.*"}) || !reflect.DeepEqual(cfg.Exclude, []string{"audit_*"}) {
+		t.Errorf("include = %v, exclude = %v, expected the variables'", cfg.Include, cfg.Exclude)
+	}
+}
@@ -0,0 +1,184 @@
+package tests
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"pulse/internal/filter"
+	"pulse/internal/server"
+	"testing"
+)
+
+func TestFilter(t *testing.T) {
+	row := map[string]interface{}{
+		"amount":    float64(150),
+		"status":    "shipped",
+		"paid":      true,
+		"coupon":    nil,
+		"reference": "it's",
+	}
+
+	tests := []struct {
+		expr     string
+		expected bool
+	}{
+		{expr: "amount > 100", expected: true},
+		{expr: "amount > 200", expected: false},
+		{expr: "amount >= 150 AND amount <= 150", expected: true},
+		{expr: "status IN ('pending', 'shipped')", expected: true},
+		{expr: "status NOT IN ('pending', 'shipped')", expected: false},
+		{expr: "status = 'pending' OR (paid = true AND NOT amount < 100)", expected: true},
+		{expr: "coupon IS NULL", expected: true},
+		{expr: "coupon IS NOT NULL", expected: false},
+		{expr: "reference = 'it''s'", expected: true},
+		{expr: "missing = 1", expected: false},
+		{expr: "status > 1", expected: false},
+		{expr: "status <> 'shipped'", expected: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			predicate, err := filter.Parse(tt.expr)
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			if actual := predicate(row); actual != tt.expected {
+				t.Errorf("predicate() = %v, expected %v", actual, tt.expected)
+			}
+		})
+	}
+}
+
+func TestFilterParameters(t *testing.T) {
+	row := map[string]interface{}{"tenant_id": "acme", "level": float64(3)}
+	params := map[string]interface{}{"tenant_id": "acme", "level": float64(2), "quote": "' OR 1 = 1 OR 'a' = '"}
+
+	predicate, err := filter.ParseWith("tenant_id = :tenant_id AND level > :level", params)
+	if err != nil {
+		t.Fatalf("ParseWith() error = %v", err)
+	}
+	if !predicate(row) {
+		t.Errorf("predicate() = false, expected true")
+	}
+
+	// Values are bound, never parsed as part of the expression
+	predicate, err = filter.ParseWith("tenant_id = :quote", params)
+	if err != nil {
+		t.Fatalf("ParseWith() error = %v", err)
+	}
+	if predicate(row) {
+		t.Errorf("predicate() = true, expected false")
+	}
+
+	for _, expr := range []string{"tenant_id = :missing", "tenant_id = :", "tenant_id = :list"} {
+		if _, err := filter.ParseWith(expr, map[string]interface{}{"list": []interface{}{"a"}}); err == nil {
+			t.Errorf("ParseWith(%q) expected an error", expr)
+		}
+	}
+
+	if _, err := filter.Parse("tenant_id = :tenant_id"); err == nil {
+		t.Errorf("Parse() expected an error for an unbound parameter")
+	}
+}
+
+func TestWhere(t *testing.T) {
+	row := map[string]interface{}{
+		"amount":    float64(150),
+		"status":    "shipped",
+		"paid":      true,
+		"coupon":    nil,
+		"reference": "a,b (c)",
+	}
+
+	tests := []struct {
+		where    string
+		expected bool
+	}{
+		{where: "status=eq.shipped", expected: true},
+		{where: "status=neq.shipped", expected: false},
+		{where: "amount=gt.100", expected: true},
+		{where: "amount=gte.150,amount=lte.150", expected: true},
+		{where: "amount=lt.100", expected: false},
+		{where: "amount=gt.100,status=eq.pending", expected: false},
+		{where: "status=in.(pending,shipped)", expected: true},
+		{where: "status=not.in.(pending,shipped)", expected: false},
+		{where: "amount=in.(100,150)", expected: true},
+		{where: "paid=eq.true", expected: true},
+		{where: "paid=is.false", expected: false},
+		{where: "coupon=is.null", expected: true},
+		{where: "coupon=not.is.null", expected: false},
+		{where: "status=like.ship*", expected: true},
+		{where: "status=like.SHIP*", expected: false},
+		{where: "status=ilike.*IPP*", expected: true},
+		{where: `reference=eq."a,b (c)"`, expected: true},
+		{where: `reference=in.("a,b (c)",d)`, expected: true},
+		{where: "missing=eq.1", expected: false},
+		{where: "status=gt.pending", expected: true},
+		{where: "amount=eq.shipped", expected: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.where, func(t *testing.T) {
+			predicate, err := filter.ParseWhere(tt.where)
+			if err != nil {
+				t.Fatalf("ParseWhere() error = %v", err)
+			}
+			if actual := predicate(row); actual != tt.expected {
+				t.Errorf("predicate() = %v, expected %v", actual, tt.expected)
+			}
+		})
+	}
+}
+
+func TestWhereRejectsInvalidConditions(t *testing.T) {
+	for _, where := range []string{
+		"",
+		"status",
+		"status=shipped",
+		"status=equals.shipped",
+		"status=eq.a,b",
+		"status=in.pending",
+		"status=in.()",
+		"status=in.(a",
+		`status=eq."unterminated`,
+		"coupon=is.empty",
+		"lower(status)=eq.a",
+	} {
+		t.Run(where, func(t *testing.T) {
+			if _, err := filter.ParseWhere(where); err == nil {
+				t.Errorf("ParseWhere(%q) expected an error", where)
+			}
+		})
+	}
+}
+
+func TestFilterRejectsInvalidExpressions(t *testing.T) {
+	for _, expr := range []string{
+		"amount >",
+		"amount > 1; DROP TABLE users",
+		"amount > 1 --",
+		"status IN ()",
+		"status IN ('a'",
+		"lower(status) = 'a'",
+		"(amount > 1",
+		"amount = 'unterminated",
+		"AND = 1",
+	} {
+		t.Run(expr, func(t *testing.T) {
+			if _, err := filter.Parse(expr); err == nil {
+				t.Errorf("Parse(%q) expected an error", expr)
+			}
+		})
+	}
+
+	s := &server.Server{}
+	handler := s.RegisterRoutes()
+
+	req := httptest.NewRequest(http.MethodGet, "/ws/orders?filter="+url.QueryEscape("amount > 1; DROP TABLE users"), nil)
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+
+	if resp.Code != http.StatusBadRequest {
+		t.Errorf("invalid filter status = %v, expected %v", resp.Code, http.StatusBadRequest)
+	}
+}
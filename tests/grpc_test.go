@@ -0,0 +1,160 @@
+package tests
+
+import (
+	"context"
+	"net"
+	"pulse/internal/database"
+	"pulse/internal/server"
+	"pulse/proto/pulsev2"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// startGRPCServer serves the gRPC service of a server watching dbs and
+// returns a client connected to it.
+func startGRPCServer(t *testing.T, dbs ...database.Service) (*server.Server, *grpc.ClientConn) {
+	t.Helper()
+
+	s, err := server.New(dbs...)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	srv := s.GRPCServer()
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return s, conn
+}
+
+// grpcSubscribe calls Subscribe and waits for the server to register the
+// subscription. The messages received are sent on the returned channel,
+// which is closed when the stream ends, with its status sent on the other.
+func grpcSubscribe(t *testing.T, conn *grpc.ClientConn, req *pulsev2.SubscribeRequest) (chan *pulsev2.Message, chan error) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	stream, err := pulsev2.NewPulseClient(conn).Subscribe(ctx, req)
+	if err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+
+	messages, end := make(chan *pulsev2.Message, 16), make(chan error, 1)
+	go func() {
+		defer close(messages)
+
+		for {
+			message, err := stream.Recv()
+			if err != nil {
+				end <- err
+				return
+			}
+			messages <- message
+		}
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	return messages, end
+}
+
+// nextMessage returns the next message, failing after a second.
+func nextMessage(t *testing.T, messages chan *pulsev2.Message) *pulsev2.Message {
+	t.Helper()
+
+	select {
+	case message, ok := <-messages:
+		if !ok {
+			t.Fatalf("stream ended")
+		}
+		return message
+	case <-time.After(time.Second):
+		t.Fatalf("no message received")
+		return nil
+	}
+}
+
+func TestGRPCSubscribe(t *testing.T) {
+	db := newFakeDB()
+	s, conn := startGRPCServer(t, db)
+	messages, end := grpcSubscribe(t, conn, &pulsev2.SubscribeRequest{Table: "orders", Params: map[string]string{"where": "status=eq.paid"}})
+
+	db.notifications <- database.DBNotification{Operation: "insert", Table: "orders", ID: "1", Data: map[string]interface{}{"status": "pending"}}
+	db.notifications <- database.DBNotification{Operation: "insert", Table: "orders", ID: "2", Data: map[string]interface{}{"status": "paid"}}
+
+	notification := nextMessage(t, messages).GetNotification()
+	if notification.GetOperation() != "insert" || notification.GetTable() != "orders" || notification.GetId() != "2" {
+		t.Errorf("notification = %v, expected the insert of order 2", notification)
+	}
+	if paid := notification.GetData().GetStructValue().GetFields()["status"].GetStringValue(); paid != "paid" {
+		t.Errorf("notification status = %q, expected paid", paid)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- s.Shutdown(ctx) }()
+
+	// Control messages are Structs
+	if control := nextMessage(t, messages).GetControl(); control.GetFields()["operation"].GetStringValue() != "draining" {
+		t.Errorf("control message = %v, expected draining", control)
+	}
+	if control := nextMessage(t, messages).GetControl(); !strings.Contains(control.String(), "server_shutdown") {
+		t.Errorf("control message = %v, expected server_shutdown", control)
+	}
+
+	for range messages {
+	}
+	if code := status.Code(<-end); code != codes.Unavailable {
+		t.Errorf("status = %v, expected Unavailable once the server shuts down", code)
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("Shutdown() error = %v", err)
+	}
+}
+
+func TestGRPCRejectsInvalidRequests(t *testing.T) {
+	t.Setenv("PULSE_ENABLE_FIREHOSE", "false")
+	_, conn := startGRPCServer(t, newFakeDB())
+
+	for _, tc := range []struct {
+		req  *pulsev2.SubscribeRequest
+		code codes.Code
+	}{
+		{&pulsev2.SubscribeRequest{Table: "orders", Params: map[string]string{"filter": "status"}}, codes.InvalidArgument},
+		{&pulsev2.SubscribeRequest{Table: "orders", Params: map[string]string{"encoding": "msgpack"}}, codes.InvalidArgument},
+		{&pulsev2.SubscribeRequest{Table: "bad table"}, codes.InvalidArgument},
+		{&pulsev2.SubscribeRequest{Table: "*"}, codes.InvalidArgument},
+	} {
+		messages, end := grpcSubscribe(t, conn, tc.req)
+		for range messages {
+		}
+
+		if code := status.Code(<-end); code != tc.code {
+			t.Errorf("Subscribe(%v) status = %v, expected %v", tc.req, code, tc.code)
+		}
+	}
+
+	// Only Subscribe is served
+	err := conn.Invoke(context.Background(), "/pulse.v2.Pulse/Publish", &pulsev2.SubscribeRequest{}, &pulsev2.Message{})
+	if code := status.Code(err); code != codes.Unimplemented {
+		t.Errorf("Publish status = %v, expected Unimplemented", code)
+	}
+}
@@ -0,0 +1,416 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"pulse/internal/database"
+	"pulse/internal/server"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+// fakeDB is an in-memory database.Service whose notifications are pushed by tests.
+// Raw trigger payloads can be pushed too, they're decoded like Watch does.
+type fakeDB struct {
+	source        string
+	notifications chan database.DBNotification
+	payloads      chan string
+
+	// Every notification watched is persisted with the time it went through
+	mut    sync.Mutex
+	events []fakeEvent
+	// replays counts the calls to Replay
+	replays int
+	// replaying, unless nil, is sent to twice by Replay before it reads
+	// the events: once it's called, and to go on
+	replaying chan struct{}
+	// rows are the current rows returned by Snapshot, in id order
+	rows []database.DBNotification
+	// scanned is the snapshot ScanTable returns, and scanning is called by
+	// the next ScanTable while it pages, like writes made meanwhile
+	scanned  database.TxSnapshot
+	scanning func()
+	// columns are the allowlists of the tables, like PULSE_TABLE_COLUMNS
+	columns map[string][]string
+	// deadLetters are the notifications passed to DeadLetter
+	deadLetters []fakeDeadLetter
+	// recorded is the replay log, it's disabled unless replayLog is set
+	replayLog bool
+	recorded  []database.DBNotification
+	// relayed are the notifications passed to Relay, it's disabled unless
+	// cluster is set
+	cluster bool
+	relayed []database.DBNotification
+	// apiKeys are the keys of pulse_api_keys by key, it's disabled unless
+	// they're set
+	apiKeys map[string]database.APIKey
+	// visible stands for the visibility check, given the claims as JSON
+	// and the notification, it's disabled unless it's set. checked counts
+	// the claims it was called with
+	visible func(claims map[string]interface{}, n database.DBNotification) bool
+	checked int
+	// stall holds the visibility checks until it's closed, like a slow
+	// database, unless it's nil
+	stall chan struct{}
+	// down is returned by Health, as if the database couldn't be reached
+	down error
+
+	synced    atomic.Bool
+	listening atomic.Bool
+	closed    atomic.Bool
+}
+
+type fakeEvent struct {
+	at  time.Time
+	msg database.DBNotification
+}
+
+type fakeDeadLetter struct {
+	reason string
+	msg    database.DBNotification
+}
+
+func newFakeDB() *fakeDB {
+	return &fakeDB{
+		source:        "fake",
+		notifications: make(chan database.DBNotification),
+		payloads:      make(chan string),
+	}
+}
+
+func (f *fakeDB) Health(ctx context.Context) (map[string]string, error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	if f.down != nil {
+		return map[string]string{"status": "down", "error": f.down.Error()}, f.down
+	}
+	return map[string]string{"status": "up"}, nil
+}
+
+func (f *fakeDB) Close() error {
+	f.closed.Store(true)
+	return nil
+}
+
+func (f *fakeDB) Watch(ctx context.Context, ch chan database.DBNotification) error {
+	f.listening.Store(true)
+	defer f.listening.Store(false)
+
+	for {
+		select {
+		case msg := <-f.notifications:
+			msg.Source = f.source
+			ch <- f.persist(msg)
+		case payload := <-f.payloads:
+			msg := database.Decode(payload)
+			msg.Source = f.source
+			ch <- f.persist(msg)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (f *fakeDB) SyncTables(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	f.synced.Store(true)
+	return nil
+}
+
+func (f *fakeDB) RemoveTriggers(ctx context.Context, tables ...string) ([]string, error) {
+	return nil, nil
+}
+
+func (f *fakeDB) Unwatched(ctx context.Context) ([]string, error) {
+	return nil, nil
+}
+
+func (f *fakeDB) Ready() bool {
+	return f.synced.Load() && f.listening.Load()
+}
+
+func (f *fakeDB) Source() string {
+	return f.source
+}
+
+// persist numbers msg like pulse_events and keeps it, it returns msg with
+// its number.
+func (f *fakeDB) persist(msg database.DBNotification) database.DBNotification {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	msg.Persisted = int64(len(f.events) + 1)
+	f.events = append(f.events, fakeEvent{at: time.Now(), msg: msg})
+	return msg
+}
+
+func (f *fakeDB) Replay(ctx context.Context, table string, since time.Time) ([]database.DBNotification, error) {
+	if f.replaying != nil {
+		f.replaying <- struct{}{}
+		f.replaying <- struct{}{}
+	}
+
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	f.replays++
+
+	var notifications []database.DBNotification
+	for _, event := range f.events {
+		// Like the database, the emitted time wins over the persisted one
+		at := event.at
+		if !event.msg.EmittedAt.IsZero() {
+			at = event.msg.EmittedAt
+		}
+		if !at.Before(since) && (table == "" || event.msg.Table == table) {
+			notifications = append(notifications, event.msg)
+		}
+	}
+
+	return notifications, nil
+}
+
+func (f *fakeDB) Snapshot(ctx context.Context, table, after string, limit int) ([]database.DBNotification, error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	var rows []database.DBNotification
+	started := after == ""
+	for _, row := range f.rows {
+		if row.Table != table && row.Schema+"."+row.Table != table {
+			continue
+		}
+		if started && len(rows) < limit {
+			row.Operation = database.OperationSnapshot
+			row.Source = f.source
+			rows = append(rows, row)
+		}
+		started = started || row.ID == after
+	}
+
+	return rows, nil
+}
+
+func (f *fakeDB) ScanTable(ctx context.Context, table string, limit int, page func([]database.DBNotification) error) (database.TxSnapshot, error) {
+	f.mut.Lock()
+	scanning, scanned := f.scanning, f.scanned
+	f.scanning = nil
+	f.mut.Unlock()
+
+	after := ""
+	for {
+		rows, _ := f.Snapshot(ctx, table, after, limit)
+		if err := page(rows); err != nil {
+			return database.TxSnapshot{}, err
+		}
+		if scanning != nil {
+			scanning()
+			scanning = nil
+		}
+
+		if len(rows) < limit {
+			return scanned, nil
+		}
+		after = rows[len(rows)-1].ID
+	}
+}
+
+func (f *fakeDB) Record(ctx context.Context, msg database.DBNotification) error {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	if !f.replayLog {
+		return database.ErrReplayLogDisabled
+	}
+	f.recorded = append(f.recorded, msg)
+	return nil
+}
+
+func (f *fakeDB) Recorded(ctx context.Context, after int64) ([]database.DBNotification, error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	if !f.replayLog {
+		return nil, database.ErrReplayLogDisabled
+	}
+
+	var notifications []database.DBNotification
+	for _, msg := range f.recorded {
+		if msg.Seq > after {
+			notifications = append(notifications, msg)
+		}
+	}
+	return notifications, nil
+}
+
+func (f *fakeDB) LastRecorded(ctx context.Context) (int64, error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	if !f.replayLog {
+		return 0, database.ErrReplayLogDisabled
+	}
+	if len(f.recorded) == 0 {
+		return 0, nil
+	}
+	return f.recorded[len(f.recorded)-1].Seq, nil
+}
+
+func (f *fakeDB) Relay(ctx context.Context, msg database.DBNotification) error {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	if !f.cluster {
+		return database.ErrClusterDisabled
+	}
+	f.relayed = append(f.relayed, msg)
+	return nil
+}
+
+func (f *fakeDB) ColumnAllowed(table, column string) bool {
+	allowed, ok := f.columns[table]
+	return !ok || slices.Contains(allowed, column)
+}
+
+func (f *fakeDB) DeadLetter(ctx context.Context, reason string, msg database.DBNotification) error {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	f.deadLetters = append(f.deadLetters, fakeDeadLetter{reason: reason, msg: msg})
+	return nil
+}
+
+func (f *fakeDB) LookupAPIKey(ctx context.Context, key string) (database.APIKey, error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	if f.down != nil {
+		return database.APIKey{}, f.down
+	}
+	if f.apiKeys == nil {
+		return database.APIKey{}, database.ErrAPIKeysDisabled
+	}
+	apiKey, ok := f.apiKeys[key]
+	if !ok {
+		return database.APIKey{}, database.ErrUnknownAPIKey
+	}
+	return apiKey, nil
+}
+
+func (f *fakeDB) Visible(ctx context.Context, n database.DBNotification, claims []string) ([]bool, error) {
+	if f.stall != nil {
+		select {
+		case <-f.stall:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	if f.down != nil {
+		return nil, f.down
+	}
+	if f.visible == nil {
+		return nil, database.ErrVisibilityDisabled
+	}
+
+	visible := make([]bool, len(claims))
+	for i, c := range claims {
+		var decoded map[string]interface{}
+		if err := json.Unmarshal([]byte(c), &decoded); err != nil {
+			return nil, err
+		}
+		visible[i] = f.visible(decoded, n)
+	}
+	f.checked += len(claims)
+	return visible, nil
+}
+
+// startServer serves a Server backed by dbs until the test ends.
+func startServer(t *testing.T, dbs ...database.Service) (*server.Server, *httptest.Server) {
+	t.Helper()
+
+	s, err := server.New(dbs...)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	ts := httptest.NewServer(s.RegisterRoutes())
+	t.Cleanup(ts.Close)
+
+	return s, ts
+}
+
+// dial opens a pulse.v2 websocket to path on ts and waits for the server to register it.
+func dial(t *testing.T, ts *httptest.Server, path string) *websocket.Conn {
+	t.Helper()
+
+	return dialProtocol(t, ts, path, "pulse.v2")
+}
+
+// dialProtocol is dial negotiating the given subprotocols, if any.
+func dialProtocol(t *testing.T, ts *httptest.Server, path string, subprotocols ...string) *websocket.Conn {
+	t.Helper()
+
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + path
+	conn, _, err := websocket.Dial(context.Background(), url, &websocket.DialOptions{Subprotocols: subprotocols})
+	if err != nil {
+		t.Fatalf("dial %s error = %v", path, err)
+	}
+	t.Cleanup(func() { conn.CloseNow() })
+
+	// The client is registered right after the handshake completes
+	time.Sleep(50 * time.Millisecond)
+
+	return conn
+}
+
+// read returns the next text frame from conn, failing after a second.
+func read(t *testing.T, conn *websocket.Conn) []byte {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	_, data, err := conn.Read(ctx)
+	if err != nil {
+		t.Fatalf("read error = %v", err)
+	}
+
+	return data
+}
+
+// readUntilIdle decodes notifications from conn until none arrive for idle.
+// The connection is closed once it returns.
+// It's safe to call from a goroutine other than the test's.
+func readUntilIdle(t *testing.T, conn *websocket.Conn, idle time.Duration) []database.DBNotification {
+	t.Helper()
+
+	var received []database.DBNotification
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), idle)
+		_, data, err := conn.Read(ctx)
+		cancel()
+		if err != nil {
+			return received
+		}
+
+		var msg database.DBNotification
+		if err := json.Unmarshal(data, &msg); err != nil {
+			t.Errorf("decode error = %v", err)
+			return received
+		}
+		received = append(received, msg)
+	}
+}
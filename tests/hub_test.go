@@ -0,0 +1,1780 @@
+package tests
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"pulse/internal/database"
+	"pulse/internal/server"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/crypto/hkdf"
+	"nhooyr.io/websocket"
+)
+
+func TestForcedCloseSendsReason(t *testing.T) {
+	db := newFakeDB()
+	_, ts := startServer(t, db)
+	conn := dial(t, ts, "/ws/users/1")
+
+	db.notifications <- database.DBNotification{Operation: "delete", Table: "users", ID: "1"}
+
+	var msg database.DBNotification
+	if err := json.Unmarshal(read(t, conn), &msg); err != nil || msg.Operation != "delete" {
+		t.Fatalf("expected delete notification, got %v (err %v)", msg, err)
+	}
+
+	var control map[string]string
+	if err := json.Unmarshal(read(t, conn), &control); err != nil {
+		t.Fatalf("final frame is not valid JSON: %v", err)
+	}
+	if control["reason"] == "" {
+		t.Errorf("final frame has no reason: %v", control)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, _, err := conn.Read(ctx); websocket.CloseStatus(err) != websocket.StatusNormalClosure {
+		t.Errorf("expected normal closure, got %v", err)
+	}
+}
+
+func TestMultipleSources(t *testing.T) {
+	first, second := newFakeDB(), newFakeDB()
+	first.source, second.source = "shard-1", "shard-2"
+
+	_, ts := startServer(t, first, second)
+	all := dial(t, ts, "/ws/all")
+	filtered := dial(t, ts, "/ws/users?source=shard-2")
+
+	first.notifications <- database.DBNotification{Operation: "insert", Table: "users", ID: "1"}
+	second.notifications <- database.DBNotification{Operation: "insert", Table: "users", ID: "2"}
+
+	sources := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		var msg database.DBNotification
+		if err := json.Unmarshal(read(t, all), &msg); err != nil {
+			t.Fatalf("decode error = %v", err)
+		}
+		sources[msg.Source] = true
+	}
+	if !sources["shard-1"] || !sources["shard-2"] {
+		t.Errorf("expected notifications from both sources, got %v", sources)
+	}
+
+	var msg database.DBNotification
+	if err := json.Unmarshal(read(t, filtered), &msg); err != nil {
+		t.Fatalf("decode error = %v", err)
+	}
+	if msg.Source != "shard-2" || msg.ID != "2" {
+		t.Errorf("source filter delivered %v, expected shard-2 row 2", msg)
+	}
+}
+
+func TestNamedDatabaseRoutes(t *testing.T) {
+	eu, us := newFakeDB(), newFakeDB()
+	eu.source, us.source = "eu", "us"
+
+	_, ts := startServer(t, eu, us)
+	euOrders := dial(t, ts, "/ws/eu/orders")
+	// The route wins over ?source=
+	usOrder := dial(t, ts, "/ws/us/orders/2?source=eu")
+	// Routes of tables named like a database still work
+	order := dial(t, ts, "/ws/orders/2")
+
+	eu.notifications <- database.DBNotification{Operation: "insert", Table: "orders", ID: "1"}
+	eu.notifications <- database.DBNotification{Operation: "insert", Table: "orders", ID: "2"}
+	us.notifications <- database.DBNotification{Operation: "insert", Table: "orders", ID: "2"}
+
+	received := readUntilIdle(t, euOrders, 200*time.Millisecond)
+	if len(received) != 2 || received[0].Source != "eu" || received[1].Source != "eu" {
+		t.Errorf("/ws/eu/orders received %v, expected eu orders 1 and 2", received)
+	}
+	if received := readUntilIdle(t, usOrder, 200*time.Millisecond); len(received) != 1 || received[0].Source != "us" {
+		t.Errorf("/ws/us/orders/2 received %v, expected us order 2", received)
+	}
+	if received := readUntilIdle(t, order, 200*time.Millisecond); len(received) != 2 {
+		t.Errorf("/ws/orders/2 received %v, expected order 2 of both", received)
+	}
+
+	// Event streams are scoped too
+	resp, err := http.Get(ts.URL + "/sse/us/orders")
+	if err != nil {
+		t.Fatalf("GET error = %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, expected %d", resp.StatusCode, http.StatusOK)
+	}
+}
+
+func TestShutdownDrainsQueuedNotifications(t *testing.T) {
+	db := newFakeDB()
+	s, ts := startServer(t, db)
+	conn := dial(t, ts, "/ws/users")
+
+	for i := 0; i < 5; i++ {
+		db.notifications <- database.DBNotification{Operation: "insert", Table: "users", ID: strconv.Itoa(i)}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- s.Shutdown(ctx) }()
+
+	// The draining message is written concurrently with the queued ones
+	inserts, draining := 0, 0
+	for inserts < 5 {
+		var msg database.DBNotification
+		if err := json.Unmarshal(read(t, conn), &msg); err != nil {
+			t.Fatalf("decode error = %v", err)
+		}
+		switch msg.Operation {
+		case "insert":
+			inserts++
+		case "draining":
+			draining++
+		default:
+			t.Fatalf("received %v after %d queued notifications, expected the rest", msg, inserts)
+		}
+	}
+
+	var control map[string]interface{}
+	if err := json.Unmarshal(read(t, conn), &control); err == nil && control["operation"] == "draining" {
+		draining++
+		err = json.Unmarshal(read(t, conn), &control)
+	}
+	if control["reason"] != "server_shutdown" {
+		t.Errorf("expected server_shutdown control message, got %v", control)
+	}
+	if draining != 1 {
+		t.Errorf("received %d draining messages, expected 1", draining)
+	}
+
+	conn.Read(ctx)
+	if err := <-shutdown; err != nil {
+		t.Errorf("Shutdown() error = %v", err)
+	}
+}
+
+func TestShutdownSendsDrainingBeforeClose(t *testing.T) {
+	t.Setenv("PULSE_DRAIN_RETRY_AFTER", "250ms")
+
+	s, ts := startServer(t, newFakeDB())
+	conn := dial(t, ts, "/ws/users")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- s.Shutdown(ctx) }()
+
+	var draining map[string]interface{}
+	if err := json.Unmarshal(read(t, conn), &draining); err != nil || draining["operation"] != "draining" || draining["retry_after_ms"] != float64(250) {
+		t.Fatalf("expected draining control message, got %v (err %v)", draining, err)
+	}
+
+	var control map[string]string
+	if err := json.Unmarshal(read(t, conn), &control); err != nil || control["reason"] != "server_shutdown" {
+		t.Errorf("expected server_shutdown control message, got %v (err %v)", control, err)
+	}
+
+	if _, _, err := conn.Read(ctx); websocket.CloseStatus(err) != websocket.StatusGoingAway {
+		t.Errorf("read error = %v, expected a going away close frame", err)
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("Shutdown() error = %v", err)
+	}
+}
+
+func TestShutdownDeliversHeldNotifications(t *testing.T) {
+	tests := []struct {
+		name          string
+		path          string
+		notifications []database.DBNotification
+		expected      []string
+	}{
+		{
+			name: "transaction batch",
+			path: "/ws/orders?batch=transaction",
+			notifications: []database.DBNotification{
+				{Operation: "insert", Table: "orders", ID: "1", Txid: 10},
+				{Operation: "insert", Table: "orders", ID: "2", Txid: 10},
+			},
+			expected: []string{"begin", "insert 1", "insert 2", "commit"},
+		},
+		{
+			name: "rate limited updates",
+			path: "/ws/orders?max_rate=0.1",
+			notifications: []database.DBNotification{
+				{Operation: "update", Table: "orders", ID: "1"},
+				{Operation: "update", Table: "orders", ID: "2"},
+				{Operation: "update", Table: "orders", ID: "3"},
+			},
+			expected: []string{"update 1", "update 2", "update 3"},
+		},
+		{
+			name: "coalesced updates",
+			path: "/ws/orders?coalesce=1m",
+			notifications: []database.DBNotification{
+				{Operation: "update", Table: "orders", ID: "1"},
+				{Operation: "update", Table: "orders", ID: "1"},
+				{Operation: "update", Table: "orders", ID: "2"},
+			},
+			expected: []string{"update 1", "update 2"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newFakeDB()
+			s, ts := startServer(t, db)
+			conn := dial(t, ts, tt.path)
+
+			for _, n := range tt.notifications {
+				db.notifications <- n
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			shutdown := make(chan error, 1)
+			go func() { shutdown <- s.Shutdown(ctx) }()
+
+			// Everything held is delivered ahead of the close
+			var received []string
+			for {
+				var msg map[string]interface{}
+				if err := json.Unmarshal(read(t, conn), &msg); err != nil {
+					t.Fatal(err)
+				}
+				switch msg["operation"] {
+				case "draining":
+					continue
+				case "error", "close":
+				case "begin", "commit":
+					received = append(received, msg["operation"].(string))
+					continue
+				default:
+					received = append(received, fmt.Sprintf("%v %v", msg["operation"], msg["id"]))
+					continue
+				}
+				break
+			}
+
+			if !reflect.DeepEqual(received, tt.expected) {
+				t.Errorf("received %v before the close, expected %v", received, tt.expected)
+			}
+
+			conn.Read(ctx)
+			if err := <-shutdown; err != nil {
+				t.Errorf("Shutdown() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestSampling(t *testing.T) {
+	// Notifications are pushed faster than they're read, don't evict the client
+	t.Setenv("PULSE_CLIENT_QUEUE_SIZE", "2048")
+
+	tests := []struct {
+		sample   string
+		inserts  int
+		min, max int
+	}{
+		{sample: "0", inserts: 10, min: 0, max: 0},
+		{sample: "1", inserts: 10, min: 10, max: 10},
+		{sample: "0.5", inserts: 1000, min: 400, max: 600},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.sample, func(t *testing.T) {
+			db := newFakeDB()
+			_, ts := startServer(t, db)
+			conn := dial(t, ts, "/ws/users?sample="+tt.sample)
+
+			go func() {
+				for i := 0; i < tt.inserts; i++ {
+					db.notifications <- database.DBNotification{Operation: "insert", Table: "users", ID: strconv.Itoa(i)}
+				}
+				db.notifications <- database.DBNotification{Operation: "delete", Table: "users", ID: "0"}
+			}()
+
+			// Deletes are never sampled out, the last one ends the stream
+			inserts := 0
+			for {
+				var msg database.DBNotification
+				if err := json.Unmarshal(read(t, conn), &msg); err != nil {
+					t.Fatalf("decode error = %v", err)
+				}
+				if msg.Operation == "delete" {
+					break
+				}
+				inserts++
+			}
+
+			if inserts < tt.min || inserts > tt.max {
+				t.Errorf("inserts delivered = %d, expected between %d and %d", inserts, tt.min, tt.max)
+			}
+		})
+	}
+}
+
+func TestProtocolVersions(t *testing.T) {
+	tests := []struct {
+		name         string
+		subprotocols []string
+		expected     []string
+	}{
+		{name: "default", subprotocols: nil, expected: []string{"operation", "table", "id", "seq", "ts", "data"}},
+		{name: "v1", subprotocols: []string{"pulse.v1"}, expected: []string{"operation", "table", "id", "seq", "ts", "data"}},
+		{name: "v2", subprotocols: []string{"pulse.v2"}, expected: []string{"operation", "table", "id", "seq", "txid", "source", "ts", "data"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newFakeDB()
+			_, ts := startServer(t, db)
+			conn := dialProtocol(t, ts, "/ws/users", tt.subprotocols...)
+
+			db.notifications <- database.DBNotification{Operation: "insert", Table: "users", ID: "1", Txid: 7}
+
+			var actual map[string]interface{}
+			if err := json.Unmarshal(read(t, conn), &actual); err != nil {
+				t.Fatalf("decode error = %v", err)
+			}
+			if len(actual) != len(tt.expected) {
+				t.Errorf("payload = %v, expected fields %v", actual, tt.expected)
+			}
+			for _, field := range tt.expected {
+				if _, ok := actual[field]; !ok {
+					t.Errorf("payload = %v, missing field %q", actual, field)
+				}
+			}
+		})
+	}
+}
+
+func TestBreakerPausesAfterFailedWrites(t *testing.T) {
+	t.Setenv("PULSE_BREAKER_COOLDOWN", "2s")
+	t.Setenv("PULSE_WRITE_TIMEOUT", "100ms")
+
+	db := newFakeDB()
+	_, ts := startServer(t, db)
+
+	// None of them reads, so a row bigger than the socket buffers times out
+	for i := 0; i < 12; i++ {
+		dial(t, ts, "/ws/users")
+	}
+	db.notifications <- database.DBNotification{Operation: "insert", Table: "users", ID: "1", Data: strings.Repeat("x", 8<<20)}
+	time.Sleep(time.Second)
+
+	// Reading with a timeout closes the socket, keep a second one for later
+	paused, conn := dial(t, ts, "/ws/users"), dial(t, ts, "/ws/users")
+	db.notifications <- database.DBNotification{Operation: "insert", Table: "users", ID: "2"}
+	if received := readUntilIdle(t, paused, 100*time.Millisecond); len(received) != 0 {
+		t.Fatalf("delivered %v while the breaker is open", received)
+	}
+
+	time.Sleep(2 * time.Second)
+	db.notifications <- database.DBNotification{Operation: "insert", Table: "users", ID: "3"}
+
+	var msg database.DBNotification
+	if err := json.Unmarshal(read(t, conn), &msg); err != nil || msg.ID != "3" {
+		t.Errorf("expected delivery after cooldown, got %v (err %v)", msg, err)
+	}
+}
+
+func TestCorruptPayloadSignalsLoss(t *testing.T) {
+	data := `{"id":1,"name":"a"}`
+	sum := md5.Sum([]byte(data))
+	checksum := hex.EncodeToString(sum[:])
+
+	tests := []struct {
+		name      string
+		payload   string
+		operation string
+	}{
+		{name: "valid", payload: `{"operation":"update","table":"users","id":"1","checksum":"` + checksum + `","data":` + data + `}`, operation: "update"},
+		{name: "truncated", payload: `{"operation":"update","table":"users","id":"1","checksum":"` + checksum + `","data":{"id":1,"na`, operation: "event_lost"},
+		{name: "checksum mismatch", payload: `{"operation":"update","table":"users","id":"1","checksum":"` + checksum + `","data":{"id":1,"name":"b"}}`, operation: "event_lost"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newFakeDB()
+			_, ts := startServer(t, db)
+			conn := dial(t, ts, "/ws/users/1")
+
+			db.payloads <- tt.payload
+
+			var msg database.DBNotification
+			if err := json.Unmarshal(read(t, conn), &msg); err != nil {
+				t.Fatalf("decode error = %v", err)
+			}
+			if msg.Operation != tt.operation {
+				t.Errorf("operation = %v, expected %v", msg.Operation, tt.operation)
+			}
+		})
+	}
+}
+
+func TestOverflowStrategies(t *testing.T) {
+	t.Setenv("PULSE_CLIENT_QUEUE_SIZE", "4")
+
+	const total = 40
+
+	tests := []struct {
+		overflow     string
+		disconnected bool
+		keepsLatest  bool
+	}{
+		{overflow: "", disconnected: true},
+		{overflow: "disconnect", disconnected: true},
+		{overflow: "drop_newest", disconnected: false, keepsLatest: false},
+		{overflow: "drop_oldest", disconnected: false, keepsLatest: true},
+	}
+
+	for _, tt := range tests {
+		t.Run("overflow="+tt.overflow, func(t *testing.T) {
+			db := newFakeDB()
+			_, ts := startServer(t, db)
+			conn := dial(t, ts, "/ws/users?overflow="+tt.overflow)
+			conn.SetReadLimit(-1)
+
+			// Rows bigger than the socket buffers stall the writer until we read
+			row := strings.Repeat("x", 1<<20)
+			for i := 0; i < total; i++ {
+				db.notifications <- database.DBNotification{Operation: "insert", Table: "users", ID: strconv.Itoa(i), Data: row}
+			}
+			time.Sleep(200 * time.Millisecond)
+
+			// The last read either times out or fails early because we were evicted
+			var ids []int
+			var disconnected bool
+			for {
+				ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+				_, data, err := conn.Read(ctx)
+				timedOut := ctx.Err() != nil
+				cancel()
+				if err != nil {
+					disconnected = !timedOut
+					break
+				}
+
+				var msg database.DBNotification
+				if err := json.Unmarshal(data, &msg); err != nil {
+					t.Fatalf("decode error = %v", err)
+				}
+				id, _ := strconv.Atoi(msg.ID)
+				ids = append(ids, id)
+			}
+
+			if disconnected != tt.disconnected {
+				t.Fatalf("disconnected = %v, expected %v", disconnected, tt.disconnected)
+			}
+			if len(ids) == 0 || len(ids) == total {
+				t.Fatalf("received %d of %d notifications, expected some to be dropped", len(ids), total)
+			}
+			if tt.disconnected {
+				if evicted := scrape(t, ts, `pulse_clients_evicted_total{reason="slow_client"}`); evicted < 1 {
+					t.Errorf("evicted clients = %v, expected the slow one counted", evicted)
+				}
+				return
+			}
+
+			if latest := ids[len(ids)-1] == total-1; latest != tt.keepsLatest {
+				t.Errorf("received ids %v, expected latest kept = %v", ids, tt.keepsLatest)
+			}
+			for i := 1; i < len(ids); i++ {
+				if ids[i] <= ids[i-1] {
+					t.Errorf("received ids %v out of order", ids)
+				}
+			}
+		})
+	}
+}
+
+func TestFilteredSubscription(t *testing.T) {
+	db := newFakeDB()
+	_, ts := startServer(t, db)
+	conn := dial(t, ts, "/ws/orders?filter="+url.QueryEscape("amount > 100"))
+
+	db.notifications <- database.DBNotification{Operation: "insert", Table: "orders", ID: "1", Data: map[string]interface{}{"amount": float64(50)}}
+	db.notifications <- database.DBNotification{Operation: "insert", Table: "orders", ID: "2", Data: map[string]interface{}{"amount": float64(150)}}
+
+	var msg database.DBNotification
+	if err := json.Unmarshal(read(t, conn), &msg); err != nil || msg.ID != "2" {
+		t.Errorf("expected only order 2, got %v (err %v)", msg, err)
+	}
+}
+
+func TestBigintIDRoundTrip(t *testing.T) {
+	const id = "9007199254740993" // 2^53 + 1, not representable as float64
+
+	db := newFakeDB()
+	_, ts := startServer(t, db)
+	conn := dial(t, ts, "/ws/events/"+id+"?filter="+url.QueryEscape("id = "+id))
+
+	data := `{"id":` + id + `,"parent_id":9007199254740995}`
+	db.payloads <- `{"operation":"insert","table":"events","id":"` + id + `","data":` + data + `}`
+
+	frame := read(t, conn)
+	var msg struct {
+		ID   string          `json:"id"`
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(frame, &msg); err != nil {
+		t.Fatalf("decode error = %v", err)
+	}
+	if msg.ID != id {
+		t.Errorf("id = %v, expected %v", msg.ID, id)
+	}
+	if string(msg.Data) != data {
+		t.Errorf("data = %s, expected %s", msg.Data, data)
+	}
+}
+
+func TestReplaySinceTime(t *testing.T) {
+	db := newFakeDB()
+	_, ts := startServer(t, db)
+
+	db.notifications <- database.DBNotification{Operation: "insert", Table: "orders", ID: "0"}
+	time.Sleep(10 * time.Millisecond)
+	since := time.Now()
+
+	for i := 1; i <= 3; i++ {
+		db.notifications <- database.DBNotification{Operation: "insert", Table: "orders", ID: strconv.Itoa(i)}
+		db.notifications <- database.DBNotification{Operation: "insert", Table: "users", ID: strconv.Itoa(i)}
+	}
+
+	conn := dial(t, ts, "/ws/orders?since_time="+url.QueryEscape(since.Format(time.RFC3339Nano)))
+	db.notifications <- database.DBNotification{Operation: "insert", Table: "orders", ID: "4"}
+
+	for _, expected := range []string{"1", "2", "3", "4"} {
+		var msg database.DBNotification
+		if err := json.Unmarshal(read(t, conn), &msg); err != nil {
+			t.Fatalf("decode error = %v", err)
+		}
+		if msg.Table != "orders" || msg.ID != expected {
+			t.Errorf("received %v, expected orders row %v", msg, expected)
+		}
+	}
+}
+
+func TestReplaySkipsLiveNotificationsReplayed(t *testing.T) {
+	db := newFakeDB()
+	db.replaying = make(chan struct{})
+	_, ts := startServer(t, db)
+	watcher := dial(t, ts, "/ws/orders")
+
+	since := time.Now()
+	db.notifications <- database.DBNotification{Operation: "insert", Table: "orders", ID: "1"}
+	read(t, watcher)
+
+	conn := dial(t, ts, "/ws/orders?since_time="+url.QueryEscape(since.Format(time.RFC3339Nano)))
+
+	// Registered, the client queues it live while it's persisted already
+	<-db.replaying
+	db.notifications <- database.DBNotification{Operation: "insert", Table: "orders", ID: "2"}
+	read(t, watcher)
+	<-db.replaying
+
+	db.notifications <- database.DBNotification{Operation: "insert", Table: "orders", ID: "3"}
+
+	for _, expected := range []string{"1", "2", "3"} {
+		var msg database.DBNotification
+		if err := json.Unmarshal(read(t, conn), &msg); err != nil {
+			t.Fatalf("decode error = %v", err)
+		}
+		if msg.ID != expected {
+			t.Errorf("received %v, expected orders row %v", msg, expected)
+		}
+	}
+	if received := readUntilIdle(t, conn, 100*time.Millisecond); len(received) != 0 {
+		t.Errorf("received %v again", received)
+	}
+}
+
+// readSeqs decodes n notifications from conn and returns their operation or
+// id, and their seq.
+func readSeqs(t *testing.T, conn *websocket.Conn, n int) ([]string, []int64) {
+	t.Helper()
+
+	var received []string
+	var seqs []int64
+	for i := 0; i < n; i++ {
+		var msg database.DBNotification
+		if err := json.Unmarshal(read(t, conn), &msg); err != nil {
+			t.Fatalf("decode error = %v", err)
+		}
+		if msg.ID != "" {
+			received = append(received, msg.ID)
+		} else {
+			received = append(received, msg.Operation)
+		}
+		seqs = append(seqs, msg.Seq)
+	}
+	return received, seqs
+}
+
+func TestResumeSinceSeq(t *testing.T) {
+	db := newFakeDB()
+	_, ts := startServer(t, db)
+
+	conn := dial(t, ts, "/ws/orders")
+	db.notifications <- database.DBNotification{Operation: "insert", Table: "orders", ID: "1"}
+	_, seqs := readSeqs(t, conn, 1)
+	conn.CloseNow()
+
+	for i := 2; i <= 3; i++ {
+		db.notifications <- database.DBNotification{Operation: "insert", Table: "orders", ID: strconv.Itoa(i)}
+		db.notifications <- database.DBNotification{Operation: "insert", Table: "users", ID: strconv.Itoa(i)}
+	}
+
+	conn = dial(t, ts, "/ws/orders?since="+strconv.FormatInt(seqs[0], 10))
+	db.notifications <- database.DBNotification{Operation: "insert", Table: "orders", ID: "4"}
+
+	received, resumed := readSeqs(t, conn, 3)
+	if !reflect.DeepEqual(received, []string{"2", "3", "4"}) {
+		t.Errorf("received %v, expected orders 2, 3 and 4", received)
+	}
+	if resumed[0] <= seqs[0] || resumed[1] <= resumed[0] || resumed[2] <= resumed[1] {
+		t.Errorf("seqs %v after %d aren't increasing", resumed, seqs[0])
+	}
+}
+
+func TestResumeBeyondBufferSignalsLoss(t *testing.T) {
+	t.Setenv("PULSE_REPLAY_BUFFER", "2")
+
+	db := newFakeDB()
+	_, ts := startServer(t, db)
+
+	for i := 1; i <= 5; i++ {
+		db.notifications <- database.DBNotification{Operation: "insert", Table: "orders", ID: strconv.Itoa(i)}
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	conn := dial(t, ts, "/ws/orders?since=1")
+	if received, _ := readSeqs(t, conn, 3); !reflect.DeepEqual(received, []string{database.OperationEventLost, "4", "5"}) {
+		t.Errorf("received %v, expected event_lost then the buffered rows", received)
+	}
+
+	// A seq from before a restart is unknown
+	conn = dial(t, ts, "/ws/orders?since=100")
+	if received, _ := readSeqs(t, conn, 1); received[0] != database.OperationEventLost {
+		t.Errorf("received %v, expected event_lost", received)
+	}
+}
+
+func TestResumeFromReplayLog(t *testing.T) {
+	t.Setenv("PULSE_REPLAY_BUFFER", "0")
+
+	db := newFakeDB()
+	db.replayLog = true
+	s, ts := startServer(t, db)
+
+	for i := 1; i <= 3; i++ {
+		db.notifications <- database.DBNotification{Operation: "insert", Table: "orders", ID: strconv.Itoa(i)}
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	conn := dial(t, ts, "/ws/orders?since=1")
+	if received, _ := readSeqs(t, conn, 2); !reflect.DeepEqual(received, []string{"2", "3"}) {
+		t.Errorf("received %v, expected the recorded rows 2 and 3", received)
+	}
+
+	// Numbering carries on once restarted
+	conn.CloseNow()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	s.Shutdown(ctx)
+
+	restarted := newFakeDB()
+	restarted.replayLog = true
+	restarted.recorded = db.recorded
+	_, ts = startServer(t, restarted)
+
+	conn = dial(t, ts, "/ws/orders")
+	restarted.notifications <- database.DBNotification{Operation: "insert", Table: "orders", ID: "4"}
+	if _, seqs := readSeqs(t, conn, 1); seqs[0] != 4 {
+		t.Errorf("seq = %d after a restart, expected 4", seqs[0])
+	}
+}
+
+func TestResumeRejectsInvalidSeqs(t *testing.T) {
+	_, ts := startServer(t, newFakeDB())
+
+	for _, query := range []string{"since=abc", "since=-1", "since=1&aggregate=count"} {
+		url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws/orders?" + query
+		if conn, _, err := websocket.Dial(context.Background(), url, nil); err == nil {
+			conn.CloseNow()
+			t.Errorf("dial with %q succeeded, expected it rejected", query)
+		}
+	}
+}
+
+func TestDedupDropsRepeatedChanges(t *testing.T) {
+	db := newFakeDB()
+	_, ts := startServer(t, db)
+	conn := dial(t, ts, "/ws/users?dedup=true")
+
+	update := database.DBNotification{Operation: "update", Table: "users", ID: "1", Txid: 42}
+	db.notifications <- update
+	db.notifications <- update
+	db.notifications <- database.DBNotification{Operation: "update", Table: "users", ID: "1", Txid: 43}
+
+	received := readUntilIdle(t, conn, 200*time.Millisecond)
+	if len(received) != 2 || received[0].Txid != 42 || received[1].Txid != 43 {
+		t.Errorf("received %v, expected one notification per transaction", received)
+	}
+}
+
+func TestIdleConnectionStaysOpen(t *testing.T) {
+	t.Setenv("PULSE_PING_INTERVAL", "100ms")
+	t.Setenv("PULSE_WRITE_TIMEOUT", "500ms")
+
+	db := newFakeDB()
+	s, err := server.New(db)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	// Far shorter than the idle period, they must not apply to websockets
+	ts := httptest.NewUnstartedServer(s.RegisterRoutes())
+	ts.Config.IdleTimeout = 200 * time.Millisecond
+	ts.Config.ReadTimeout = 200 * time.Millisecond
+	ts.Config.WriteTimeout = 200 * time.Millisecond
+	ts.Start()
+	t.Cleanup(ts.Close)
+
+	conn := dial(t, ts, "/ws/orders")
+
+	// Reading answers the pings, no notification arrives meanwhile
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	go func() {
+		time.Sleep(1500 * time.Millisecond)
+		db.notifications <- database.DBNotification{Operation: "insert", Table: "orders", ID: "1"}
+	}()
+
+	_, data, err := conn.Read(ctx)
+	if err != nil {
+		t.Fatalf("idle connection was closed: %v", err)
+	}
+
+	var msg database.DBNotification
+	if err := json.Unmarshal(data, &msg); err != nil {
+		t.Fatalf("decode error = %v", err)
+	}
+	if msg.ID != "1" {
+		t.Errorf("received %v, expected the insert", msg)
+	}
+}
+
+func TestBroadcastReachesEveryClient(t *testing.T) {
+	t.Setenv("PULSE_BROADCAST_WORKERS", "4")
+	// Dialing takes a while, clients don't answer pings until they read
+	t.Setenv("PULSE_PING_INTERVAL", "1m")
+
+	db := newFakeDB()
+	_, ts := startServer(t, db)
+
+	// Enough clients to span several work items
+	var orders, users []*websocket.Conn
+	for i := 0; i < 70; i++ {
+		orders = append(orders, dial(t, ts, "/ws/orders"))
+		users = append(users, dial(t, ts, "/ws/users"))
+	}
+
+	db.notifications <- database.DBNotification{Operation: "insert", Table: "orders", ID: "1"}
+	db.notifications <- database.DBNotification{Operation: "insert", Table: "users", ID: "2"}
+
+	for i, conn := range append(orders, users...) {
+		expected := "1"
+		if i >= len(orders) {
+			expected = "2"
+		}
+
+		var msg database.DBNotification
+		if err := json.Unmarshal(read(t, conn), &msg); err != nil {
+			t.Fatalf("decode error = %v", err)
+		}
+		if msg.ID != expected {
+			t.Errorf("client %d received %v, expected row %s", i, msg, expected)
+		}
+	}
+}
+
+func TestClientIDRestoresSubscription(t *testing.T) {
+	db := newFakeDB()
+	_, ts := startServer(t, db)
+
+	conn := dial(t, ts, "/ws/orders?operations=insert&fields=id,status&filter=amount%20%3E%2010&client_id=abc")
+	conn.Close(websocket.StatusNormalClosure, "")
+
+	// Only the id is sent back, the subscription is restored
+	conn = dial(t, ts, "/ws/all?client_id=abc")
+
+	db.notifications <- database.DBNotification{Operation: "insert", Table: "users", ID: "1", Data: map[string]interface{}{"amount": float64(50)}}
+	db.notifications <- database.DBNotification{Operation: "update", Table: "orders", ID: "2", Data: map[string]interface{}{"amount": float64(50)}}
+	db.notifications <- database.DBNotification{Operation: "insert", Table: "orders", ID: "3", Data: map[string]interface{}{"amount": float64(5)}}
+	db.notifications <- database.DBNotification{Operation: "insert", Table: "orders", ID: "4", Data: map[string]interface{}{"id": float64(4), "amount": float64(50), "status": "paid"}}
+
+	var msg database.DBNotification
+	if err := json.Unmarshal(read(t, conn), &msg); err != nil {
+		t.Fatalf("decode error = %v", err)
+	}
+	if msg.ID != "4" {
+		t.Fatalf("received %v, expected the only matching insert", msg)
+	}
+	if row := msg.Data.(map[string]interface{}); len(row) != 2 || row["status"] != "paid" {
+		t.Errorf("data = %v, expected the projected id and status", row)
+	}
+	conn.Close(websocket.StatusNormalClosure, "")
+
+	// New parameters replace the saved subscription
+	conn = dial(t, ts, "/ws/users?client_id=abc")
+	conn.Close(websocket.StatusNormalClosure, "")
+	conn = dial(t, ts, "/ws/all?client_id=abc")
+
+	db.notifications <- database.DBNotification{Operation: "update", Table: "users", ID: "5"}
+	if err := json.Unmarshal(read(t, conn), &msg); err != nil {
+		t.Fatalf("decode error = %v", err)
+	}
+	if msg.ID != "5" {
+		t.Errorf("received %v, expected the users update", msg)
+	}
+}
+
+func TestClientIDWithoutFirehose(t *testing.T) {
+	t.Setenv("PULSE_ENABLE_FIREHOSE", "false")
+
+	db := newFakeDB()
+	_, ts := startServer(t, db)
+
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws/all?client_id=unknown"
+	if _, _, err := websocket.Dial(context.Background(), url, nil); err == nil {
+		t.Errorf("restoring an unknown client_id opened the firehose")
+	}
+
+	conn := dial(t, ts, "/ws/orders?client_id=abc")
+	conn.Close(websocket.StatusNormalClosure, "")
+	conn = dial(t, ts, "/ws/all?client_id=abc")
+
+	db.notifications <- database.DBNotification{Operation: "insert", Table: "orders", ID: "1"}
+	read(t, conn)
+}
+
+func TestClientIDIsBoundToTheSubscriber(t *testing.T) {
+	t.Setenv("PULSE_ENABLE_FIREHOSE", "false")
+	t.Setenv("PULSE_JWT_SECRET", "s3cret")
+
+	db := newFakeDB()
+	_, ts := startServer(t, db)
+
+	token := func(subject string, issued time.Time) string {
+		return signToken(t, "s3cret", jwt.MapClaims{"sub": subject, "iat": issued.Unix(), "exp": issued.Add(time.Hour).Unix()})
+	}
+
+	conn := dial(t, ts, "/ws/orders?client_id=abc&access_token="+token("alice", time.Now().Add(-time.Minute)))
+	conn.Close(websocket.StatusNormalClosure, "")
+
+	// Another subscriber knowing the id doesn't get the subscription
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws/all?client_id=abc&access_token=" + token("bob", time.Now())
+	if conn, _, err := websocket.Dial(context.Background(), url, nil); err == nil {
+		conn.CloseNow()
+		t.Errorf("bob restored the subscription alice saved")
+	}
+
+	// Its owner does, with a token issued later
+	conn = dial(t, ts, "/ws/all?client_id=abc&access_token="+token("alice", time.Now()))
+	db.notifications <- database.DBNotification{Operation: "insert", Table: "orders", ID: "1"}
+	read(t, conn)
+}
+
+func TestDiffSendsPatch(t *testing.T) {
+	db := newFakeDB()
+	_, ts := startServer(t, db)
+	diff := dial(t, ts, "/ws/orders?diff=true")
+	legacy := dialProtocol(t, ts, "/ws/orders?diff=true", "pulse.v1")
+
+	// Two of the five columns changed
+	db.notifications <- database.DBNotification{
+		Operation: "update",
+		Table:     "orders",
+		ID:        "1",
+		Changed:   []string{"status", "amount"},
+		Old:       map[string]interface{}{"status": "pending", "amount": float64(10)},
+		Data: map[string]interface{}{
+			"id":       float64(1),
+			"status":   "paid",
+			"amount":   float64(20),
+			"customer": "alice",
+			"notes":    nil,
+		},
+	}
+
+	var msg map[string]interface{}
+	if err := json.Unmarshal(read(t, diff), &msg); err != nil {
+		t.Fatalf("decode error = %v", err)
+	}
+	if _, ok := msg["data"]; ok {
+		t.Errorf("payload = %v, expected no data", msg)
+	}
+
+	expected := []interface{}{
+		map[string]interface{}{"op": "replace", "path": "/status", "value": "paid"},
+		map[string]interface{}{"op": "replace", "path": "/amount", "value": float64(20)},
+	}
+	if !reflect.DeepEqual(msg["patch"], expected) {
+		t.Errorf("patch = %v, expected %v", msg["patch"], expected)
+	}
+
+	// pulse.v1 has no patches, the row is sent whole
+	if err := json.Unmarshal(read(t, legacy), &msg); err != nil {
+		t.Fatalf("decode error = %v", err)
+	}
+	if row, ok := msg["data"].(map[string]interface{}); !ok || len(row) != 5 {
+		t.Errorf("pulse.v1 payload = %v, expected the whole row", msg)
+	}
+}
+
+func TestHotTableDoesNotStarveOthers(t *testing.T) {
+	t.Setenv("PULSE_TABLE_QUEUE_SIZE", "8")
+
+	db := newFakeDB()
+	_, ts := startServer(t, db)
+	hot := dial(t, ts, "/ws/audit_log?overflow=drop_newest")
+	rare := dial(t, ts, "/ws/orders")
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case db.notifications <- database.DBNotification{Operation: "insert", Table: "audit_log", ID: strconv.Itoa(i)}:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	go readUntilIdle(t, hot, time.Second)
+	time.Sleep(100 * time.Millisecond)
+
+	sent := time.Now()
+	db.notifications <- database.DBNotification{Operation: "insert", Table: "orders", ID: "1"}
+
+	var msg database.DBNotification
+	if err := json.Unmarshal(read(t, rare), &msg); err != nil {
+		t.Fatalf("decode error = %v", err)
+	}
+	if delay := time.Since(sent); delay > 200*time.Millisecond {
+		t.Errorf("orders was delivered after %v while audit_log was flooded", delay)
+	}
+}
+
+func TestDebeziumEnvelope(t *testing.T) {
+	emitted := time.UnixMilli(1700000000000)
+
+	tests := []struct {
+		name     string
+		msg      database.DBNotification
+		expected string
+	}{
+		{
+			name:     "insert",
+			msg:      database.DBNotification{Operation: "insert", Table: "orders", ID: "1", Txid: 7, EmittedAt: emitted, Data: map[string]interface{}{"id": float64(1), "status": "pending"}},
+			expected: `{"op":"c","table":"orders","key":{"id":"1"},"before":null,"after":{"id":1,"status":"pending"},"source":{"name":"fake","table":"orders","txId":7,"ts_ms":1700000000000}}`,
+		},
+		{
+			name: "update",
+			msg: database.DBNotification{
+				Operation: "update", Table: "orders", ID: "1", Txid: 8, EmittedAt: emitted,
+				Changed: []string{"status"},
+				Old:     map[string]interface{}{"status": "pending"},
+				Data:    map[string]interface{}{"id": float64(1), "status": "paid"},
+			},
+			expected: `{"op":"u","table":"orders","key":{"id":"1"},"before":{"id":1,"status":"pending"},"after":{"id":1,"status":"paid"},"source":{"name":"fake","table":"orders","txId":8,"ts_ms":1700000000000}}`,
+		},
+		{
+			name:     "delete",
+			msg:      database.DBNotification{Operation: "delete", Table: "orders", ID: "1", Txid: 9, EmittedAt: emitted, Data: map[string]interface{}{"id": float64(1), "status": "paid"}},
+			expected: `{"op":"d","table":"orders","key":{"id":"1"},"before":{"id":1,"status":"paid"},"after":null,"source":{"name":"fake","table":"orders","txId":9,"ts_ms":1700000000000}}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newFakeDB()
+			_, ts := startServer(t, db)
+			conn := dial(t, ts, "/ws/orders?envelope=debezium")
+
+			db.notifications <- tt.msg
+
+			var actual, expected map[string]interface{}
+			if err := json.Unmarshal(read(t, conn), &actual); err != nil {
+				t.Fatalf("decode error = %v", err)
+			}
+			json.Unmarshal([]byte(tt.expected), &expected)
+
+			if tsMs, ok := actual["ts_ms"].(float64); !ok || tsMs < float64(time.Now().Add(-time.Minute).UnixMilli()) {
+				t.Errorf("ts_ms = %v, expected the processing time", actual["ts_ms"])
+			}
+			delete(actual, "ts_ms")
+
+			if !reflect.DeepEqual(actual, expected) {
+				t.Errorf("envelope = %v, expected %v", actual, expected)
+			}
+		})
+	}
+}
+
+// panickingRow panics when marshalled, standing in for a bug in the write path.
+type panickingRow struct{}
+
+func (panickingRow) MarshalJSON() ([]byte, error) {
+	panic("broken row")
+}
+
+func TestPanicInWritePathClosesOnlyThatClient(t *testing.T) {
+	db := newFakeDB()
+	_, ts := startServer(t, db)
+	broken := dial(t, ts, "/ws/broken")
+	healthy := dial(t, ts, "/ws/orders")
+
+	db.notifications <- database.DBNotification{Operation: "insert", Table: "broken", ID: "1", Data: panickingRow{}}
+
+	var control map[string]string
+	if err := json.Unmarshal(read(t, broken), &control); err != nil {
+		t.Fatalf("decode error = %v", err)
+	}
+	if control["operation"] != "error" || control["reason"] != "internal_error" {
+		t.Errorf("control message = %v, expected an internal_error", control)
+	}
+
+	db.notifications <- database.DBNotification{Operation: "insert", Table: "orders", ID: "2"}
+
+	var msg database.DBNotification
+	if err := json.Unmarshal(read(t, healthy), &msg); err != nil {
+		t.Fatalf("decode error = %v", err)
+	}
+	if msg.ID != "2" {
+		t.Errorf("received %v, expected row 2", msg)
+	}
+}
+
+func TestEncryptedSubscriberReceivesCiphertext(t *testing.T) {
+	db := newFakeDB()
+	_, ts := startServer(t, db)
+
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	conn := dial(t, ts, "/ws/orders?encrypt=true&key="+base64.RawURLEncoding.EncodeToString(private.PublicKey().Bytes()))
+
+	var handshake map[string]string
+	if err := json.Unmarshal(read(t, conn), &handshake); err != nil || handshake["operation"] != "key" {
+		t.Fatalf("expected the key message, got %v (err %v)", handshake, err)
+	}
+
+	// Derive the session key like a client would
+	serverKey, _ := base64.RawURLEncoding.DecodeString(handshake["key"])
+	peer, err := ecdh.X25519().NewPublicKey(serverKey)
+	if err != nil {
+		t.Fatalf("server key error = %v", err)
+	}
+	secret, _ := private.ECDH(peer)
+	key := make([]byte, 32)
+	io.ReadFull(hkdf.New(sha256.New, secret, nil, []byte("pulse encrypt")), key)
+	block, _ := aes.NewCipher(key)
+	aead, _ := cipher.NewGCM(block)
+
+	row := map[string]interface{}{"id": float64(1), "card": "4242"}
+	db.notifications <- database.DBNotification{Operation: "update", Table: "orders", ID: "1", Data: row, Old: map[string]interface{}{"card": "1111"}}
+
+	var msg struct {
+		database.DBNotification
+		Data string `json:"data"`
+	}
+	if err := json.Unmarshal(read(t, conn), &msg); err != nil {
+		t.Fatalf("expected data as a string, got err %v", err)
+	}
+	if strings.Contains(msg.Data, "4242") || msg.Old != nil {
+		t.Errorf("received %+v, expected the row encrypted", msg)
+	}
+
+	sealed, _ := base64.StdEncoding.DecodeString(msg.Data)
+	if len(sealed) < aead.NonceSize() {
+		t.Fatalf("ciphertext %q is too short", msg.Data)
+	}
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		t.Fatalf("decrypt error = %v", err)
+	}
+
+	var decrypted map[string]interface{}
+	json.Unmarshal(plaintext, &decrypted)
+	if !reflect.DeepEqual(decrypted, row) {
+		t.Errorf("decrypted %v, expected %v", decrypted, row)
+	}
+}
+
+func TestEncryptRejectsInvalidKeys(t *testing.T) {
+	_, ts := startServer(t, newFakeDB())
+
+	for _, query := range []string{"encrypt=true", "encrypt=true&key=short", "encrypt=yes", "encrypt=true&diff=true&key=" + base64.RawURLEncoding.EncodeToString(make([]byte, 32))} {
+		url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws/orders?" + query
+		if conn, _, err := websocket.Dial(context.Background(), url, nil); err == nil {
+			conn.CloseNow()
+			t.Errorf("dial with %q succeeded, expected it rejected", query)
+		}
+	}
+}
+
+// readAggregate decodes the next aggregate message from conn.
+func readAggregate(t *testing.T, conn *websocket.Conn) float64 {
+	t.Helper()
+
+	var msg struct {
+		Operation string  `json:"operation"`
+		Value     float64 `json:"value"`
+	}
+	if err := json.Unmarshal(read(t, conn), &msg); err != nil || msg.Operation != "aggregate" {
+		t.Fatalf("expected an aggregate message, got %+v (err %v)", msg, err)
+	}
+
+	return msg.Value
+}
+
+func TestAggregateCountTracksRows(t *testing.T) {
+	t.Setenv("PULSE_AGGREGATE_INTERVAL", "10ms")
+
+	db := newFakeDB()
+	db.rows = []database.DBNotification{
+		{Table: "orders", ID: "1", Data: map[string]interface{}{"id": float64(1)}},
+		{Table: "orders", ID: "2", Data: map[string]interface{}{"id": float64(2)}},
+		{Table: "users", ID: "1", Data: map[string]interface{}{"id": float64(1)}},
+	}
+	_, ts := startServer(t, db)
+	conn := dial(t, ts, "/ws/orders?aggregate=count")
+
+	if count := readAggregate(t, conn); count != 2 {
+		t.Fatalf("seeded count = %v, expected 2", count)
+	}
+
+	db.notifications <- database.DBNotification{Operation: "insert", Table: "orders", ID: "3", Data: map[string]interface{}{"id": float64(3)}}
+	if count := readAggregate(t, conn); count != 3 {
+		t.Errorf("count after insert = %v, expected 3", count)
+	}
+
+	db.notifications <- database.DBNotification{Operation: "delete", Table: "orders", ID: "1", Data: map[string]interface{}{"id": float64(1)}}
+	db.notifications <- database.DBNotification{Operation: "delete", Table: "orders", ID: "2", Data: map[string]interface{}{"id": float64(2)}}
+	db.notifications <- database.DBNotification{Operation: "insert", Table: "users", ID: "2", Data: map[string]interface{}{"id": float64(2)}}
+	time.Sleep(50 * time.Millisecond)
+	if count := readAggregate(t, conn); count != 1 {
+		t.Errorf("count after deletes = %v, expected 1", count)
+	}
+}
+
+func TestAggregateSumFollowsFilter(t *testing.T) {
+	t.Setenv("PULSE_AGGREGATE_INTERVAL", "10ms")
+
+	db := newFakeDB()
+	db.rows = []database.DBNotification{
+		{Table: "orders", ID: "1", Data: map[string]interface{}{"id": float64(1), "amount": float64(10), "status": "paid"}},
+		{Table: "orders", ID: "2", Data: map[string]interface{}{"id": float64(2), "amount": float64(5), "status": "pending"}},
+	}
+	_, ts := startServer(t, db)
+	conn := dial(t, ts, "/ws/orders?aggregate=sum(amount)&filter="+url.QueryEscape("status = 'paid'"))
+
+	if sum := readAggregate(t, conn); sum != 10 {
+		t.Fatalf("seeded sum = %v, expected 10", sum)
+	}
+
+	// Entering the filter
+	db.notifications <- database.DBNotification{
+		Operation: "update", Table: "orders", ID: "2", Changed: []string{"status"},
+		Old:  map[string]interface{}{"status": "pending"},
+		Data: map[string]interface{}{"id": float64(2), "amount": float64(5), "status": "paid"},
+	}
+	if sum := readAggregate(t, conn); sum != 15 {
+		t.Errorf("sum after update = %v, expected 15", sum)
+	}
+
+	// Leaving it
+	db.notifications <- database.DBNotification{
+		Operation: "update", Table: "orders", ID: "1", Changed: []string{"status"},
+		Old:  map[string]interface{}{"status": "paid"},
+		Data: map[string]interface{}{"id": float64(1), "amount": float64(10), "status": "refunded"},
+	}
+	if sum := readAggregate(t, conn); sum != 5 {
+		t.Errorf("sum after refund = %v, expected 5", sum)
+	}
+}
+
+func TestAggregateSumIsExact(t *testing.T) {
+	t.Setenv("PULSE_AGGREGATE_INTERVAL", "10ms")
+
+	db := newFakeDB()
+	db.rows = []database.DBNotification{
+		{Table: "ledger", ID: "1", Data: map[string]interface{}{"id": json.Number("1"), "amount": json.Number("9007199254740993")}},
+		{Table: "ledger", ID: "2", Data: map[string]interface{}{"id": json.Number("2"), "amount": json.Number("0.1")}},
+		{Table: "ledger", ID: "3", Data: map[string]interface{}{"id": json.Number("3"), "amount": json.Number("0.2")}},
+	}
+	_, ts := startServer(t, db)
+	conn := dial(t, ts, "/ws/ledger?aggregate=sum(amount)")
+
+	// Bigints and numerics don't go through floats
+	var msg struct {
+		Value json.RawMessage `json:"value"`
+	}
+	if err := json.Unmarshal(read(t, conn), &msg); err != nil || string(msg.Value) != "9007199254740993.3" {
+		t.Errorf("sum = %s (err %v), expected 9007199254740993.3", msg.Value, err)
+	}
+}
+
+func TestAggregateRejectsColumnsLeftOut(t *testing.T) {
+	db := newFakeDB()
+	db.columns = map[string][]string{"users": {"id", "email"}}
+	_, ts := startServer(t, db)
+
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws/users?aggregate=sum(balance)"
+	if conn, _, err := websocket.Dial(context.Background(), url, nil); err == nil {
+		conn.CloseNow()
+		t.Errorf("summing a column left out of the notifications was accepted")
+	}
+
+	dial(t, ts, "/ws/users?aggregate=sum(id)")
+}
+
+func TestAggregateSkipsChangesItWasSeededWith(t *testing.T) {
+	t.Setenv("PULSE_AGGREGATE_INTERVAL", "10ms")
+
+	db := newFakeDB()
+	// Order 3 was inserted by transaction 100, which the scan saw, while 101
+	// was still in progress
+	db.rows = []database.DBNotification{
+		{Table: "orders", ID: "1", Data: map[string]interface{}{"id": float64(1)}},
+		{Table: "orders", ID: "2", Data: map[string]interface{}{"id": float64(2)}},
+		{Table: "orders", ID: "3", Data: map[string]interface{}{"id": float64(3)}},
+	}
+	db.scanned = database.TxSnapshot{Xmin: 100, Xmax: 102, Xip: []int64{101}}
+	db.scanning = func() {
+		db.notifications <- database.DBNotification{Operation: "insert", Table: "orders", ID: "3", Txid: 100, Data: map[string]interface{}{"id": float64(3)}}
+		db.notifications <- database.DBNotification{Operation: "insert", Table: "orders", ID: "4", Txid: 101, Data: map[string]interface{}{"id": float64(4)}}
+	}
+	_, ts := startServer(t, db)
+	conn := dial(t, ts, "/ws/orders?aggregate=count")
+
+	if count := readAggregate(t, conn); count != 3 {
+		t.Fatalf("seeded count = %v, expected 3", count)
+	}
+
+	db.notifications <- database.DBNotification{Operation: "insert", Table: "orders", ID: "5", Txid: 102, Data: map[string]interface{}{"id": float64(5)}}
+
+	// 4 and 5 are counted once each, 3 isn't counted again
+	var counts []float64
+	for {
+		count := readAggregate(t, conn)
+		counts = append(counts, count)
+		if count > 5 {
+			t.Fatalf("counts = %v, expected to settle at 5", counts)
+		}
+		if count == 5 {
+			break
+		}
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	db.notifications <- database.DBNotification{Operation: "delete", Table: "orders", ID: "1", Txid: 103, Data: map[string]interface{}{"id": float64(1)}}
+	if count := readAggregate(t, conn); count != 4 {
+		t.Errorf("count after delete = %v, expected 4", count)
+	}
+}
+
+func TestFailedWriteIsDeadLettered(t *testing.T) {
+	t.Setenv("PULSE_WRITE_TIMEOUT", "100ms")
+	t.Setenv("PULSE_PING_INTERVAL", "1m")
+
+	db := newFakeDB()
+	_, ts := startServer(t, db)
+	// Never read, the row can't fit in the socket buffers
+	dial(t, ts, "/ws/orders")
+
+	db.notifications <- database.DBNotification{Operation: "insert", Table: "orders", ID: "1", Data: strings.Repeat("a", 32<<20)}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		db.mut.Lock()
+		deadLetters := db.deadLetters
+		db.mut.Unlock()
+
+		if len(deadLetters) > 0 {
+			if deadLetters[0].reason != "write_failed" || deadLetters[0].msg.ID != "1" {
+				t.Errorf("dead letter = %s %+v, expected row 1 for write_failed", deadLetters[0].reason, deadLetters[0].msg.ID)
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("the failed notification wasn't dead-lettered")
+}
+
+func TestShutdownClosesDatabases(t *testing.T) {
+	db := newFakeDB()
+	s, ts := startServer(t, db)
+	conn := dial(t, ts, "/ws/users")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- s.Shutdown(ctx) }()
+
+	// Reading lets the close handshake complete
+	for {
+		if _, _, err := conn.Read(ctx); err != nil {
+			break
+		}
+	}
+	if err := <-shutdown; err != nil {
+		t.Fatalf("Shutdown() error = %v", err)
+	}
+
+	if !db.closed.Load() {
+		t.Error("expected the database to be closed")
+	}
+}
+
+// snapshotRows are the current rows of the fake database in the snapshot tests.
+var snapshotRows = []database.DBNotification{
+	{Table: "orders", ID: "1", Data: map[string]interface{}{"id": float64(1), "status": "paid"}},
+	{Table: "orders", ID: "2", Data: map[string]interface{}{"id": float64(2), "status": "pending"}},
+	{Table: "orders", ID: "3", Data: map[string]interface{}{"id": float64(3), "status": "paid"}},
+	{Table: "users", ID: "1", Data: map[string]interface{}{"id": float64(1)}},
+}
+
+// readSnapshot reads the snapshot rows sent on conn and the message ending
+// them.
+func readSnapshot(t *testing.T, conn *websocket.Conn) ([]string, map[string]interface{}) {
+	t.Helper()
+
+	var ids []string
+	for {
+		var msg map[string]interface{}
+		if err := json.Unmarshal(read(t, conn), &msg); err != nil {
+			t.Fatalf("decode error = %v", err)
+		}
+		if msg["operation"] != database.OperationSnapshot {
+			return ids, msg
+		}
+		ids = append(ids, msg["id"].(string))
+	}
+}
+
+func TestSnapshotThenLiveNotifications(t *testing.T) {
+	db := newFakeDB()
+	db.rows = snapshotRows
+	_, ts := startServer(t, db)
+
+	conn := dial(t, ts, "/ws/orders?snapshot=true&operations=insert&filter="+url.QueryEscape("status = 'paid'"))
+	db.notifications <- database.DBNotification{Operation: "insert", Table: "orders", ID: "4", Data: map[string]interface{}{"id": float64(4), "status": "paid"}}
+
+	ids, done := readSnapshot(t, conn)
+	if !reflect.DeepEqual(ids, []string{"1", "3"}) {
+		t.Errorf("snapshot = %v, expected the paid orders", ids)
+	}
+	if done["operation"] != "snapshot_complete" || done["table"] != "orders" || done["count"] != float64(2) || done["cursor"] != nil {
+		t.Errorf("received %v, expected the end of the snapshot", done)
+	}
+
+	var msg database.DBNotification
+	if err := json.Unmarshal(read(t, conn), &msg); err != nil || msg.Operation != "insert" || msg.ID != "4" {
+		t.Errorf("received %v, expected the live insert", msg)
+	}
+}
+
+func TestSnapshotPagesWithCursor(t *testing.T) {
+	db := newFakeDB()
+	db.rows = snapshotRows
+	_, ts := startServer(t, db)
+
+	conn := dial(t, ts, "/ws/orders?snapshot=true&snapshot_limit=2")
+	ids, done := readSnapshot(t, conn)
+	if !reflect.DeepEqual(ids, []string{"1", "2"}) || done["cursor"] != "2" {
+		t.Fatalf("snapshot = %v then %v, expected rows 1 and 2 and a cursor", ids, done)
+	}
+
+	conn = dial(t, ts, "/ws/orders?snapshot=true&snapshot_limit=2&snapshot_after=2")
+	ids, done = readSnapshot(t, conn)
+	if !reflect.DeepEqual(ids, []string{"3"}) || done["cursor"] != nil {
+		t.Errorf("snapshot = %v then %v, expected row 3 only", ids, done)
+	}
+}
+
+func TestSnapshotOfSchemaQualifiedTable(t *testing.T) {
+	db := newFakeDB()
+	db.rows = []database.DBNotification{
+		{Table: "orders", Schema: "tenant_a", ID: "1", Data: map[string]interface{}{"id": float64(1)}},
+		{Table: "orders", Schema: "tenant_b", ID: "2", Data: map[string]interface{}{"id": float64(2)}},
+	}
+	_, ts := startServer(t, db)
+
+	conn := dial(t, ts, "/ws/tenant_b.orders?snapshot=true")
+	db.notifications <- database.DBNotification{Operation: "insert", Table: "orders", Schema: "tenant_a", ID: "3"}
+	db.notifications <- database.DBNotification{Operation: "insert", Table: "orders", Schema: "tenant_b", ID: "4"}
+
+	ids, done := readSnapshot(t, conn)
+	if !reflect.DeepEqual(ids, []string{"2"}) || done["table"] != "tenant_b.orders" {
+		t.Errorf("snapshot = %v then %v, expected the orders of tenant_b", ids, done)
+	}
+
+	var msg database.DBNotification
+	if err := json.Unmarshal(read(t, conn), &msg); err != nil || msg.ID != "4" {
+		t.Errorf("received %v, expected the live insert of tenant_b", msg)
+	}
+}
+
+func TestSnapshotRejectsInvalidParameters(t *testing.T) {
+	_, ts := startServer(t, newFakeDB())
+
+	for _, path := range []string{
+		"/ws/orders?snapshot=yes",
+		"/ws/all?snapshot=true",
+		"/ws/tenant_*.orders?snapshot=true",
+		"/ws/orders?snapshot=true&snapshot_limit=0",
+		"/ws/orders?snapshot=true&aggregate=count",
+		"/ws/orders?snapshot=true&since=1",
+	} {
+		url := "ws" + strings.TrimPrefix(ts.URL, "http") + path
+		if conn, _, err := websocket.Dial(context.Background(), url, nil); err == nil {
+			conn.CloseNow()
+			t.Errorf("dial %s succeeded, expected it rejected", path)
+		}
+	}
+}
+
+func TestBinaryEncodings(t *testing.T) {
+	db := newFakeDB()
+	_, ts := startServer(t, db)
+	msgpack := dialProtocol(t, ts, "/ws/orders?encoding=msgpack", "pulse.v2")
+	protobuf := dialProtocol(t, ts, "/ws/orders?encoding=protobuf", "pulse.v2")
+
+	db.notifications <- database.DBNotification{Operation: "insert", Table: "orders", ID: "1", Data: map[string]interface{}{"id": float64(1)}}
+
+	for name, conn := range map[string]*websocket.Conn{"msgpack": msgpack, "protobuf": protobuf} {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		typ, data, err := conn.Read(ctx)
+		cancel()
+		if err != nil {
+			t.Fatalf("%s read error = %v", name, err)
+		}
+
+		if typ != websocket.MessageBinary {
+			t.Errorf("%s notification sent as %v, expected a binary message", name, typ)
+		}
+		if !bytes.Contains(data, []byte("orders")) || json.Valid(data) {
+			t.Errorf("%s notification = %q, expected it binary encoded", name, data)
+		}
+	}
+
+	// operation and table come first in protobuf
+	db.notifications <- database.DBNotification{Operation: "delete", Table: "orders", ID: "2"}
+	if data := read(t, protobuf); !bytes.HasPrefix(data, []byte("\x0a\x06delete\x12\x06orders")) {
+		t.Errorf("protobuf notification = % x, expected the operation and table first", data)
+	}
+}
+
+func TestEncodingRejectsInvalidParameters(t *testing.T) {
+	_, ts := startServer(t, newFakeDB())
+
+	for _, path := range []string{
+		"/ws/orders?encoding=xml",
+		"/ws/orders?encoding=protobuf&envelope=debezium",
+		"/ws/orders?encoding=msgpack&aggregate=count",
+	} {
+		url := "ws" + strings.TrimPrefix(ts.URL, "http") + path
+		if conn, _, err := websocket.Dial(context.Background(), url, nil); err == nil {
+			conn.CloseNow()
+			t.Errorf("dial %s succeeded, expected it rejected", path)
+		}
+	}
+
+	// Server-sent events and /ws messages are text
+	resp, err := http.Get(ts.URL + "/sse/orders?encoding=msgpack")
+	if err != nil {
+		t.Fatalf("GET error = %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("server-sent events with an encoding status = %d, expected %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	row := map[string]interface{}{"id": float64(1), "notes": strings.Repeat("wide row ", 1000)}
+
+	for _, mode := range []string{"", "no_context_takeover", "context_takeover"} {
+		t.Run(cmp.Or(mode, "disabled"), func(t *testing.T) {
+			t.Setenv("PULSE_WS_COMPRESSION", mode)
+
+			db := newFakeDB()
+			_, ts := startServer(t, db)
+
+			url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws/orders"
+			conn, resp, err := websocket.Dial(context.Background(), url, &websocket.DialOptions{
+				Subprotocols:    []string{"pulse.v2"},
+				CompressionMode: websocket.CompressionContextTakeover,
+			})
+			if err != nil {
+				t.Fatalf("dial error = %v", err)
+			}
+			defer conn.CloseNow()
+
+			negotiated := strings.Contains(resp.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate")
+			if negotiated != (mode != "") {
+				t.Errorf("permessage-deflate negotiated = %v, expected %v", negotiated, mode != "")
+			}
+
+			db.notifications <- database.DBNotification{Operation: "insert", Table: "orders", ID: "1", Data: row}
+
+			var msg database.DBNotification
+			if err := json.Unmarshal(read(t, conn), &msg); err != nil {
+				t.Fatalf("decode error = %v", err)
+			}
+			if !reflect.DeepEqual(msg.Data, row) {
+				t.Errorf("data = %.50v, expected the whole row", msg.Data)
+			}
+		})
+	}
+}
+
+func TestBatchDeliversTransactionsTogether(t *testing.T) {
+	db := newFakeDB()
+	_, ts := startServer(t, db)
+
+	conn := dial(t, ts, "/ws/orders?batch=transaction")
+	db.notifications <- database.DBNotification{Operation: "insert", Table: "orders", ID: "1", Txid: 10}
+	db.notifications <- database.DBNotification{Operation: "insert", Table: "orders", ID: "2", Txid: 11}
+	db.notifications <- database.DBNotification{Operation: "update", Table: "orders", ID: "1", Txid: 10}
+	db.notifications <- database.DBNotification{Operation: "insert", Table: "orders", ID: "3"}
+
+	var received []string
+	for len(received) < 8 {
+		var msg map[string]interface{}
+		if err := json.Unmarshal(read(t, conn), &msg); err != nil {
+			t.Fatal(err)
+		}
+		switch msg["operation"] {
+		case "begin":
+			received = append(received, fmt.Sprintf("begin %v %v", msg["txid"], msg["count"]))
+		case "commit":
+			received = append(received, fmt.Sprintf("commit %v", msg["txid"]))
+		default:
+			received = append(received, fmt.Sprintf("%v %v", msg["operation"], msg["id"]))
+		}
+	}
+
+	expected := []string{"begin 10 2", "insert 1", "update 1", "commit 10", "begin 11 1", "insert 2", "commit 11", "insert 3"}
+	if !reflect.DeepEqual(received, expected) {
+		t.Errorf("received %v, expected %v", received, expected)
+	}
+}
+
+func TestBatchRejectsInvalidParameters(t *testing.T) {
+	_, ts := startServer(t, newFakeDB())
+
+	for _, path := range []string{
+		"/ws/orders?batch=statement",
+		"/ws/orders?batch=transaction&aggregate=count",
+		"/ws/orders?batch=transaction&envelope=debezium",
+	} {
+		url := "ws" + strings.TrimPrefix(ts.URL, "http") + path
+		if conn, _, err := websocket.Dial(context.Background(), url, nil); err == nil {
+			conn.CloseNow()
+			t.Errorf("dial %s succeeded, expected it rejected", path)
+		}
+	}
+}
+
+func TestHeartbeatWhileIdle(t *testing.T) {
+	t.Setenv("PULSE_MIN_HEARTBEAT", "10ms")
+	_, ts := startServer(t, newFakeDB())
+
+	conn := dial(t, ts, "/ws/orders?heartbeat=20ms")
+	for i := 0; i < 2; i++ {
+		var msg map[string]interface{}
+		if err := json.Unmarshal(read(t, conn), &msg); err != nil || msg["operation"] != "heartbeat" || msg["ts"] == nil {
+			t.Fatalf("received %v, expected a heartbeat", msg)
+		}
+	}
+}
+
+func TestHeartbeatRejectsIntervalsOutOfBounds(t *testing.T) {
+	t.Setenv("PULSE_MAX_HEARTBEAT", "1m")
+	_, ts := startServer(t, newFakeDB())
+
+	for _, path := range []string{
+		"/ws/orders?heartbeat=soon",
+		"/ws/orders?heartbeat=100ms",
+		"/ws/orders?heartbeat=2m",
+	} {
+		url := "ws" + strings.TrimPrefix(ts.URL, "http") + path
+		if conn, _, err := websocket.Dial(context.Background(), url, nil); err == nil {
+			conn.CloseNow()
+			t.Errorf("dial %s succeeded, expected it rejected", path)
+		}
+	}
+}
+
+// readOperations reads n notifications from conn and describes each as its
+// operation, id and the status of its row.
+func readOperations(t *testing.T, conn *websocket.Conn, n int) []string {
+	t.Helper()
+
+	var received []string
+	for len(received) < n {
+		var msg database.DBNotification
+		if err := json.Unmarshal(read(t, conn), &msg); err != nil {
+			t.Fatal(err)
+		}
+		row, _ := msg.Data.(map[string]interface{})
+		received = append(received, fmt.Sprintf("%s %s %v", msg.Operation, msg.ID, row["status"]))
+	}
+	return received
+}
+
+func TestMaxRateCoalescesUpdates(t *testing.T) {
+	db := newFakeDB()
+	_, ts := startServer(t, db)
+
+	conn := dial(t, ts, "/ws/orders?max_rate=2")
+	for i, status := range []string{"new", "paid", "shipped", "delivered"} {
+		db.notifications <- database.DBNotification{
+			Operation: "update", Table: "orders", ID: "1", Txid: int64(i),
+			Changed: []string{"status", fmt.Sprint("column", i)},
+			Data:    map[string]interface{}{"id": "1", "status": status},
+		}
+	}
+	db.notifications <- database.DBNotification{Operation: "insert", Table: "orders", ID: "2", Data: map[string]interface{}{"id": "2", "status": "new"}}
+
+	// The first two go through, the others wait for the rate to allow them
+	received := readOperations(t, conn, 4)
+	expected := []string{"update 1 new", "update 1 paid", "insert 2 new", "update 1 delivered"}
+	if !reflect.DeepEqual(received, expected) {
+		t.Errorf("received %v, expected %v", received, expected)
+	}
+}
+
+func TestMaxRateCoalescedUpdateGoesBeforeDelete(t *testing.T) {
+	db := newFakeDB()
+	_, ts := startServer(t, db)
+
+	conn := dial(t, ts, "/ws/orders?max_rate=1")
+	db.notifications <- database.DBNotification{Operation: "update", Table: "orders", ID: "1", Changed: []string{"status"}, Data: map[string]interface{}{"status": "new"}}
+	db.notifications <- database.DBNotification{Operation: "update", Table: "orders", ID: "1", Changed: []string{"amount"}, Data: map[string]interface{}{"status": "new"}}
+	db.notifications <- database.DBNotification{Operation: "update", Table: "orders", ID: "1", Changed: []string{"status"}, Data: map[string]interface{}{"status": "paid"}}
+	db.notifications <- database.DBNotification{Operation: "delete", Table: "orders", ID: "1", Data: map[string]interface{}{"status": "paid"}}
+
+	read(t, conn)
+	var held database.DBNotification
+	if err := json.Unmarshal(read(t, conn), &held); err != nil || held.Operation != "update" || !reflect.DeepEqual(held.Changed, []string{"amount", "status"}) {
+		t.Errorf("received %+v, expected the held update with the columns changed by both", held)
+	}
+	if received := readOperations(t, conn, 1); received[0] != "delete 1 paid" {
+		t.Errorf("received %v, expected the delete", received)
+	}
+}
+
+func TestMaxRateDropsUpdates(t *testing.T) {
+	db := newFakeDB()
+	_, ts := startServer(t, db)
+
+	conn := dial(t, ts, "/ws/orders?max_rate=2&rate_mode=drop")
+	for _, status := range []string{"new", "paid", "shipped"} {
+		db.notifications <- database.DBNotification{Operation: "update", Table: "orders", ID: "1", Data: map[string]interface{}{"status": status}}
+	}
+	db.notifications <- database.DBNotification{Operation: "delete", Table: "orders", ID: "2", Data: map[string]interface{}{"status": "new"}}
+
+	received := readOperations(t, conn, 3)
+	expected := []string{"update 1 new", "update 1 paid", "delete 2 new"}
+	if !reflect.DeepEqual(received, expected) {
+		t.Errorf("received %v, expected %v", received, expected)
+	}
+}
+
+func TestMaxRateRejectsInvalidParameters(t *testing.T) {
+	_, ts := startServer(t, newFakeDB())
+
+	for _, path := range []string{
+		"/ws/orders?max_rate=0",
+		"/ws/orders?max_rate=fast",
+		"/ws/orders?rate_mode=drop",
+		"/ws/orders?max_rate=10&rate_mode=latest",
+		"/ws/orders?max_rate=10&aggregate=count",
+		"/ws/orders?max_rate=10&batch=transaction",
+	} {
+		url := "ws" + strings.TrimPrefix(ts.URL, "http") + path
+		if conn, _, err := websocket.Dial(context.Background(), url, nil); err == nil {
+			conn.CloseNow()
+			t.Errorf("dial %s succeeded, expected it rejected", path)
+		}
+	}
+}
+
+func TestCoalesceDeliversLatestUpdatePerRow(t *testing.T) {
+	db := newFakeDB()
+	_, ts := startServer(t, db)
+
+	conn := dial(t, ts, "/ws/orders?coalesce=50ms")
+	for _, status := range []string{"new", "paid", "shipped"} {
+		db.notifications <- database.DBNotification{Operation: "update", Table: "orders", ID: "1", Data: map[string]interface{}{"status": status}}
+		db.notifications <- database.DBNotification{Operation: "update", Table: "orders", ID: "2", Data: map[string]interface{}{"status": status}}
+	}
+	db.notifications <- database.DBNotification{Operation: "update", Table: "orders", ID: "3", Data: map[string]interface{}{"status": "new"}}
+	db.notifications <- database.DBNotification{Operation: "delete", Table: "orders", ID: "3", Data: map[string]interface{}{"status": "new"}}
+
+	received := readOperations(t, conn, 4)
+	expected := []string{"update 3 new", "delete 3 new", "update 1 shipped", "update 2 shipped"}
+	if !reflect.DeepEqual(received, expected) {
+		t.Errorf("received %v, expected %v", received, expected)
+	}
+}
+
+func TestCoalesceRejectsInvalidParameters(t *testing.T) {
+	_, ts := startServer(t, newFakeDB())
+
+	for _, path := range []string{
+		"/ws/orders?coalesce=soon",
+		"/ws/orders?coalesce=0s",
+		"/ws/orders?coalesce=1h",
+		"/ws/orders?coalesce=1s&max_rate=10",
+		"/ws/orders?coalesce=1s&aggregate=count",
+	} {
+		url := "ws" + strings.TrimPrefix(ts.URL, "http") + path
+		if conn, _, err := websocket.Dial(context.Background(), url, nil); err == nil {
+			conn.CloseNow()
+			t.Errorf("dial %s succeeded, expected it rejected", path)
+		}
+	}
+}
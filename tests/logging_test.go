@@ -0,0 +1,62 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"pulse/internal/logging"
+	"strings"
+	"testing"
+)
+
+func TestLoggerLevelsAndFormats(t *testing.T) {
+	var out bytes.Buffer
+	logger, err := logging.New(&out, "warn", "json")
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	logger.Info("skipped")
+	logger.Warn("Lost the connection, reconnecting", "source", "db")
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &line); err != nil {
+		t.Fatalf("logged %q, expected a single JSON line: %v", out.String(), err)
+	}
+	if line["level"] != "WARN" || line["msg"] != "Lost the connection, reconnecting" || line["source"] != "db" {
+		t.Errorf("logged %v, expected the warning with its attributes", line)
+	}
+
+	out.Reset()
+	if logger, err = logging.New(&out, "", ""); err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	logger.Debug("skipped")
+	logger.Info("Disconnected from the database", "source", "db")
+	if text := out.String(); !strings.Contains(text, "level=INFO") || !strings.Contains(text, "source=db") || strings.Contains(text, "skipped") {
+		t.Errorf("logged %q, expected a text line at info", text)
+	}
+
+	for _, tc := range []struct{ level, format string }{
+		{level: "verbose"},
+		{format: "xml"},
+	} {
+		if _, err := logging.New(&out, tc.level, tc.format); err == nil {
+			t.Errorf("New(%q, %q) succeeded, expected an error", tc.level, tc.format)
+		}
+	}
+}
+
+func TestResponsesCarryRequestID(t *testing.T) {
+	_, ts := startServer(t, newFakeDB())
+
+	resp, err := http.Get(ts.URL + "/livez")
+	if err != nil {
+		t.Fatalf("GET /livez error = %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.Header.Get("X-Request-ID") == "" {
+		t.Errorf("response has no X-Request-ID header")
+	}
+}
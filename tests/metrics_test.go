@@ -0,0 +1,107 @@
+package tests
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"pulse/internal/database"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+// scrape returns the value of the given sample on /metrics.
+func scrape(t *testing.T, ts *httptest.Server, sample string) float64 {
+	t.Helper()
+
+	v, ok := scrapeSample(t, ts, sample)
+	if !ok {
+		t.Fatalf("%s not found", sample)
+	}
+	return v
+}
+
+// scrapeSample returns the value of the given sample on /metrics, and false
+// if it isn't there, like the counters of labels not counted yet.
+func scrapeSample(t *testing.T, ts *httptest.Server, sample string) (float64, bool) {
+	t.Helper()
+
+	resp, err := http.Get(ts.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("scrape error = %v", err)
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(scanner.Text(), sample+" "); ok {
+			v, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				t.Fatalf("invalid %s value %q", sample, value)
+			}
+			return v, true
+		}
+	}
+
+	return 0, false
+}
+
+func TestDeliveryLatency(t *testing.T) {
+	db := newFakeDB()
+	_, ts := startServer(t, db)
+	conn := dial(t, ts, "/ws/orders")
+
+	count := scrape(t, ts, "pulse_notification_latency_seconds_count")
+	sum := scrape(t, ts, "pulse_notification_latency_seconds_sum")
+
+	emitted := time.Now().Add(-10 * time.Millisecond)
+	db.notifications <- database.DBNotification{Operation: "insert", Table: "orders", ID: "1", EmittedAt: emitted}
+	read(t, conn)
+	elapsed := time.Since(emitted).Seconds()
+
+	// The histogram is observed right after the write
+	time.Sleep(50 * time.Millisecond)
+
+	if observed := scrape(t, ts, "pulse_notification_latency_seconds_count") - count; observed != 1 {
+		t.Fatalf("observed %v latencies, expected 1", observed)
+	}
+	latency := scrape(t, ts, "pulse_notification_latency_seconds_sum") - sum
+	if latency < 0.01 || latency > elapsed {
+		t.Errorf("latency = %vs, expected between 0.01s and %vs", latency, elapsed)
+	}
+}
+
+func TestHubMetrics(t *testing.T) {
+	db := newFakeDB()
+	_, ts := startServer(t, db)
+	conn := dial(t, ts, "/ws/metrics_orders")
+
+	if connected := scrape(t, ts, `pulse_connected_clients{table="metrics_orders"}`); connected != 1 {
+		t.Errorf("connected clients = %v, expected 1", connected)
+	}
+	fanouts := scrape(t, ts, "pulse_fanout_duration_seconds_count")
+	// The counters are global to the process, earlier runs counted too
+	before, _ := scrapeSample(t, ts, `pulse_notifications_received_total{table="metrics_orders"}`)
+
+	db.notifications <- database.DBNotification{Operation: "insert", Table: "metrics_orders", ID: "1"}
+	read(t, conn)
+
+	if received := scrape(t, ts, `pulse_notifications_received_total{table="metrics_orders"}`) - before; received != 1 {
+		t.Errorf("received = %v, expected 1", received)
+	}
+	if observed := scrape(t, ts, "pulse_fanout_duration_seconds_count") - fanouts; observed != 1 {
+		t.Errorf("observed %v fan-outs, expected 1", observed)
+	}
+
+	conn.Close(websocket.StatusNormalClosure, "")
+	deadline := time.Now().Add(time.Second)
+	for scrape(t, ts, `pulse_connected_clients{table="metrics_orders"}`) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("the client is still counted once disconnected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
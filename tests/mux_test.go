@@ -0,0 +1,174 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"pulse/internal/database"
+	"testing"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+// muxMessage is a message received on /ws: either a reply, with an
+// operation, or one wrapping what a subscription sent.
+type muxMessage struct {
+	Operation    string          `json:"operation"`
+	Subscription string          `json:"subscription"`
+	Reason       string          `json:"reason"`
+	Message      json.RawMessage `json:"message"`
+}
+
+// request sends req on conn and returns the next message.
+func request(t *testing.T, conn *websocket.Conn, req map[string]interface{}) muxMessage {
+	t.Helper()
+
+	jsonData, _ := json.Marshal(req)
+	if err := conn.Write(context.Background(), websocket.MessageText, jsonData); err != nil {
+		t.Fatalf("write error = %v", err)
+	}
+
+	return readMux(t, conn)
+}
+
+// readMux decodes the next message from conn.
+func readMux(t *testing.T, conn *websocket.Conn) muxMessage {
+	t.Helper()
+
+	var msg muxMessage
+	if err := json.Unmarshal(read(t, conn), &msg); err != nil {
+		t.Fatalf("decode error = %v", err)
+	}
+	return msg
+}
+
+func TestMuxTagsNotificationsWithSubscription(t *testing.T) {
+	db := newFakeDB()
+	_, ts := startServer(t, db)
+	conn := dial(t, ts, "/ws")
+
+	if reply := request(t, conn, map[string]interface{}{"action": "subscribe", "table": "orders", "id": "42", "subscription": "order"}); reply.Operation != "subscribed" || reply.Subscription != "order" {
+		t.Fatalf("reply = %+v, expected subscribed", reply)
+	}
+	users := request(t, conn, map[string]interface{}{"action": "subscribe", "table": "users", "params": map[string]string{"operations": "insert"}})
+	if users.Operation != "subscribed" || users.Subscription == "" {
+		t.Fatalf("reply = %+v, expected an id picked by the server", users)
+	}
+
+	db.notifications <- database.DBNotification{Operation: "update", Table: "orders", ID: "41"}
+	db.notifications <- database.DBNotification{Operation: "update", Table: "orders", ID: "42"}
+	db.notifications <- database.DBNotification{Operation: "delete", Table: "users", ID: "7"}
+	db.notifications <- database.DBNotification{Operation: "insert", Table: "users", ID: "7"}
+
+	received := map[string]string{}
+	for i := 0; i < 2; i++ {
+		msg := readMux(t, conn)
+
+		var n database.DBNotification
+		if err := json.Unmarshal(msg.Message, &n); err != nil {
+			t.Fatalf("decode error = %v", err)
+		}
+		received[msg.Subscription] = n.Operation + " " + n.Table + "/" + n.ID
+	}
+	if received["order"] != "update orders/42" || received[users.Subscription] != "insert users/7" {
+		t.Errorf("received %v", received)
+	}
+
+	if reply := request(t, conn, map[string]interface{}{"action": "unsubscribe", "subscription": "order"}); reply.Operation != "unsubscribed" || reply.Subscription != "order" {
+		t.Fatalf("reply = %+v, expected unsubscribed", reply)
+	}
+
+	db.notifications <- database.DBNotification{Operation: "update", Table: "orders", ID: "42"}
+	db.notifications <- database.DBNotification{Operation: "insert", Table: "users", ID: "8"}
+	if msg := readMux(t, conn); msg.Subscription != users.Subscription {
+		t.Errorf("received %+v after unsubscribing", msg)
+	}
+}
+
+func TestMuxRejectsInvalidRequests(t *testing.T) {
+	_, ts := startServer(t, newFakeDB())
+	conn := dial(t, ts, "/ws")
+
+	request(t, conn, map[string]interface{}{"action": "subscribe", "table": "orders", "subscription": "a"})
+
+	for name, req := range map[string]map[string]interface{}{
+		"unknown action":       {"action": "watch", "table": "orders"},
+		"invalid table":        {"action": "subscribe", "table": "orders;drop"},
+		"invalid params":       {"action": "subscribe", "table": "orders", "params": map[string]string{"overflow": "never"}},
+		"duplicate id":         {"action": "subscribe", "table": "users", "subscription": "a"},
+		"unknown subscription": {"action": "unsubscribe", "subscription": "b"},
+	} {
+		if reply := request(t, conn, req); reply.Operation != "error" || reply.Reason == "" {
+			t.Errorf("%s: reply = %+v, expected an error", name, reply)
+		}
+	}
+}
+
+func TestMuxRowDeletedEndsOnlyThatSubscription(t *testing.T) {
+	db := newFakeDB()
+	_, ts := startServer(t, db)
+	conn := dial(t, ts, "/ws")
+
+	request(t, conn, map[string]interface{}{"action": "subscribe", "table": "orders", "id": "1", "subscription": "row"})
+	request(t, conn, map[string]interface{}{"action": "subscribe", "table": "orders", "subscription": "table"})
+
+	db.notifications <- database.DBNotification{Operation: "delete", Table: "orders", ID: "1"}
+
+	closed := false
+	for i := 0; i < 3; i++ {
+		msg := readMux(t, conn)
+
+		var control map[string]interface{}
+		json.Unmarshal(msg.Message, &control)
+		if msg.Subscription == "row" && control["reason"] == "row_deleted" {
+			closed = true
+		}
+	}
+	if !closed {
+		t.Fatalf("expected the row subscription to be closed")
+	}
+
+	// The socket and the other subscription stay open
+	db.notifications <- database.DBNotification{Operation: "insert", Table: "orders", ID: "2"}
+	if msg := readMux(t, conn); msg.Subscription != "table" {
+		t.Errorf("received %+v, expected the table subscription's insert", msg)
+	}
+}
+
+func TestMuxShutdownClosesSocket(t *testing.T) {
+	s, ts := startServer(t, newFakeDB())
+	idle := dial(t, ts, "/ws")
+	conn := dial(t, ts, "/ws")
+	request(t, conn, map[string]interface{}{"action": "subscribe", "table": "orders"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- s.Shutdown(ctx) }()
+
+	for _, c := range []*websocket.Conn{conn, idle} {
+		var reason string
+		for {
+			_, data, err := c.Read(ctx)
+			if err != nil {
+				if websocket.CloseStatus(err) != websocket.StatusGoingAway {
+					t.Errorf("read error = %v, expected a going away close frame", err)
+				}
+				break
+			}
+
+			var msg muxMessage
+			json.Unmarshal(data, &msg)
+			if msg.Subscription == "" {
+				reason = msg.Reason
+			}
+		}
+		if reason != "server_shutdown" {
+			t.Errorf("expected server_shutdown control message, got %q", reason)
+		}
+	}
+
+	if err := <-shutdown; err != nil {
+		t.Errorf("Shutdown() error = %v", err)
+	}
+}
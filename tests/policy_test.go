@@ -0,0 +1,242 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"pulse/internal/database"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"nhooyr.io/websocket"
+)
+
+const testPolicies = `[
+	{"when": {"role": "admin"}, "tables": {"*": ""}},
+	{"when": {"roles": "support"}, "tables": {"tickets": ""}},
+	{"tables": {"orders": "tenant_id = :tenant_id", "products": ""}}
+]`
+
+// tenantToken signs a token for a subscriber of tenant with the given extra claims.
+func tenantToken(t *testing.T, tenant string, extra jwt.MapClaims) string {
+	t.Helper()
+
+	claims := jwt.MapClaims{"tenant_id": tenant, "exp": time.Now().Add(time.Hour).Unix()}
+	for key, value := range extra {
+		claims[key] = value
+	}
+	return signToken(t, "s3cret", claims)
+}
+
+func TestPoliciesRestrictTables(t *testing.T) {
+	t.Setenv("PULSE_JWT_SECRET", "s3cret")
+	t.Setenv("PULSE_POLICIES", testPolicies)
+
+	_, ts := startServer(t, newFakeDB())
+
+	tests := []struct {
+		name     string
+		path     string
+		token    string
+		expected int
+	}{
+		{name: "granted table", path: "/ws/orders", token: tenantToken(t, "acme", nil), expected: http.StatusSwitchingProtocols},
+		{name: "other table", path: "/ws/users", token: tenantToken(t, "acme", nil), expected: http.StatusForbidden},
+		{name: "tables param", path: "/ws/all?tables=orders,users", token: tenantToken(t, "acme", nil), expected: http.StatusForbidden},
+		{name: "admin", path: "/ws/users", token: tenantToken(t, "acme", jwt.MapClaims{"role": "admin"}), expected: http.StatusSwitchingProtocols},
+		{name: "role list", path: "/ws/tickets", token: tenantToken(t, "acme", jwt.MapClaims{"roles": []string{"billing", "support"}}), expected: http.StatusSwitchingProtocols},
+		{name: "restricted aggregate", path: "/ws/orders?aggregate=count", token: tenantToken(t, "acme", nil), expected: http.StatusForbidden},
+		{name: "aggregate", path: "/ws/products?aggregate=count", token: tenantToken(t, "acme", nil), expected: http.StatusSwitchingProtocols},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := tt.path + "?access_token=" + tt.token
+			if strings.Contains(tt.path, "?") {
+				path = tt.path + "&access_token=" + tt.token
+			}
+
+			conn, resp, err := websocket.Dial(context.Background(), "ws"+strings.TrimPrefix(ts.URL, "http")+path, nil)
+			if err == nil {
+				conn.CloseNow()
+			}
+
+			if resp == nil || resp.StatusCode != tt.expected {
+				t.Errorf("dial response = %v (err %v), expected status %d", resp, err, tt.expected)
+			}
+		})
+	}
+}
+
+func TestPoliciesFilterRowsBeforeFanout(t *testing.T) {
+	t.Setenv("PULSE_JWT_SECRET", "s3cret")
+	t.Setenv("PULSE_POLICIES", testPolicies)
+
+	db := newFakeDB()
+	_, ts := startServer(t, db)
+	acme := dial(t, ts, "/ws/all?access_token="+tenantToken(t, "acme", nil))
+	admin := dial(t, ts, "/ws/all?access_token="+tenantToken(t, "globex", jwt.MapClaims{"role": "admin"}))
+
+	notifications := []database.DBNotification{
+		{Operation: "insert", Table: "orders", ID: "1", Data: map[string]interface{}{"tenant_id": "globex"}},
+		{Operation: "insert", Table: "orders", ID: "2", Data: map[string]interface{}{"tenant_id": "acme"}},
+		{Operation: "insert", Table: "users", ID: "1", Data: map[string]interface{}{"tenant_id": "acme"}},
+		{Operation: "update", Table: "orders", Bulk: true, Count: 2, IDs: []string{"1", "2"}},
+		{Operation: "insert", Table: "products", ID: "1", Data: map[string]interface{}{}},
+	}
+	for _, n := range notifications {
+		db.notifications <- n
+	}
+
+	// Tables take turns, they aren't ordered between them
+	received := readUntilIdle(t, acme, 200*time.Millisecond)
+	got := map[string]bool{}
+	for _, n := range received {
+		got[n.Table+" "+n.ID] = true
+	}
+	if len(received) != 2 || !got["orders 2"] || !got["products 1"] {
+		t.Errorf("acme received %v, expected orders 2 and products 1", received)
+	}
+
+	if received := readUntilIdle(t, admin, 200*time.Millisecond); len(received) != len(notifications) {
+		t.Errorf("admin received %d notifications, expected %d", len(received), len(notifications))
+	}
+}
+
+func TestPoliciesLetTruncatesThrough(t *testing.T) {
+	t.Setenv("PULSE_JWT_SECRET", "s3cret")
+	t.Setenv("PULSE_POLICIES", testPolicies)
+
+	db := newFakeDB()
+	_, ts := startServer(t, db)
+	acme := dial(t, ts, "/ws/orders?access_token="+tenantToken(t, "acme", nil))
+
+	// The rows granted are gone too, though the truncate has none to check
+	db.notifications <- database.DBNotification{Operation: database.OperationTruncate, Table: "orders"}
+
+	received := readUntilIdle(t, acme, 200*time.Millisecond)
+	if len(received) != 1 || received[0].Operation != database.OperationTruncate {
+		t.Errorf("acme received %v, expected the truncate of orders", received)
+	}
+}
+
+func TestPoliciesWithoutMatchingRule(t *testing.T) {
+	t.Setenv("PULSE_POLICIES", `[{"when": {"role": "admin"}, "tables": {"*": ""}}]`)
+
+	_, ts := startServer(t, newFakeDB())
+
+	// Without PULSE_JWT_SECRET there are no claims, only rules without
+	// conditions can match
+	_, resp, err := websocket.Dial(context.Background(), "ws"+strings.TrimPrefix(ts.URL, "http")+"/ws/orders", nil)
+	if resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("dial response = %v (err %v), expected status %d", resp, err, http.StatusForbidden)
+	}
+}
+
+// sameTenant is the visibility check of the tests, rows are visible to the
+// subscribers of their tenant.
+func sameTenant(claims map[string]interface{}, n database.DBNotification) bool {
+	row, _ := n.Data.(map[string]interface{})
+	return row != nil && row["tenant_id"] == claims["tenant_id"]
+}
+
+func TestVisibilityCheckFiltersRows(t *testing.T) {
+	t.Setenv("PULSE_JWT_SECRET", "s3cret")
+	t.Setenv("PULSE_VISIBILITY_CHECK", "data->>'tenant_id' = claims->>'tenant_id'")
+
+	db := newFakeDB()
+	db.visible = sameTenant
+	_, ts := startServer(t, db)
+
+	exp := time.Now().Add(time.Hour).Unix()
+	acmeToken := signToken(t, "s3cret", jwt.MapClaims{"tenant_id": "acme", "exp": exp})
+	acme := dial(t, ts, "/ws/orders?access_token="+acmeToken)
+	acmeAll := dial(t, ts, "/ws/all?access_token="+acmeToken)
+	globex := dial(t, ts, "/ws/orders?access_token="+signToken(t, "s3cret", jwt.MapClaims{"tenant_id": "globex", "exp": exp}))
+
+	notifications := []database.DBNotification{
+		{Operation: "insert", Table: "orders", ID: "1", Source: "fake", Data: map[string]interface{}{"tenant_id": "globex"}},
+		{Operation: "insert", Table: "orders", ID: "2", Source: "fake", Data: map[string]interface{}{"tenant_id": "acme"}},
+		{Operation: database.OperationTruncate, Table: "orders", Source: "fake"},
+	}
+	for _, n := range notifications {
+		db.notifications <- n
+	}
+
+	received := readUntilIdle(t, acme, 200*time.Millisecond)
+	if len(received) != 2 || received[0].ID != "2" || received[1].Operation != database.OperationTruncate {
+		t.Errorf("acme received %v, expected orders 2 and the truncate", received)
+	}
+	if received := readUntilIdle(t, acmeAll, 200*time.Millisecond); len(received) != 2 || received[0].ID != "2" {
+		t.Errorf("acme received %v on /ws/all, expected orders 2 and the truncate", received)
+	}
+	received = readUntilIdle(t, globex, 200*time.Millisecond)
+	if len(received) != 2 || received[0].ID != "1" {
+		t.Errorf("globex received %v, expected orders 1 and the truncate", received)
+	}
+
+	// Once per row for each distinct claims, truncates aren't checked
+	db.mut.Lock()
+	checked := db.checked
+	db.mut.Unlock()
+	if checked != 4 {
+		t.Errorf("checked %d claims, expected 4", checked)
+	}
+
+	// Resuming is checked too
+	resumed := dial(t, ts, "/ws/orders?since=0&access_token="+acmeToken)
+	if received := readUntilIdle(t, resumed, 200*time.Millisecond); len(received) != 2 || received[0].ID != "2" {
+		t.Errorf("resumed acme received %v, expected orders 2 and the truncate", received)
+	}
+}
+
+func TestVisibilityCheckFailureDeniesRows(t *testing.T) {
+	t.Setenv("PULSE_JWT_SECRET", "s3cret")
+	t.Setenv("PULSE_VISIBILITY_CHECK", "data->>'tenant_id' = claims->>'tenant_id'")
+
+	db := newFakeDB()
+	db.visible = sameTenant
+	db.down = errors.New("connection refused")
+	_, ts := startServer(t, db)
+	acme := dial(t, ts, "/ws/orders?access_token="+tenantToken(t, "acme", nil))
+
+	db.notifications <- database.DBNotification{Operation: "insert", Table: "orders", ID: "1", Source: "fake", Data: map[string]interface{}{"tenant_id": "acme"}}
+	// Unchecked notifications still go through
+	db.notifications <- database.DBNotification{Operation: database.OperationTruncate, Table: "orders", Source: "fake"}
+
+	if received := readUntilIdle(t, acme, 200*time.Millisecond); len(received) != 1 || received[0].Operation != database.OperationTruncate {
+		t.Errorf("received %v, expected only the truncate while the check fails", received)
+	}
+}
+
+func TestSlowVisibilityCheckDoesNotStallOtherTables(t *testing.T) {
+	t.Setenv("PULSE_JWT_SECRET", "s3cret")
+	t.Setenv("PULSE_VISIBILITY_CHECK", "data->>'tenant_id' = claims->>'tenant_id'")
+
+	db := newFakeDB()
+	db.visible = sameTenant
+	db.stall = make(chan struct{})
+	_, ts := startServer(t, db)
+	acme := dial(t, ts, "/ws/all?access_token="+tenantToken(t, "acme", nil))
+
+	db.notifications <- database.DBNotification{Operation: "insert", Table: "orders", ID: "1", Source: "fake", Data: map[string]interface{}{"tenant_id": "acme"}}
+	db.notifications <- database.DBNotification{Operation: "insert", Table: "orders", ID: "2", Source: "fake", Data: map[string]interface{}{"tenant_id": "acme"}}
+	db.notifications <- database.DBNotification{Operation: database.OperationTruncate, Table: "users", Source: "fake"}
+
+	// The truncate isn't checked, it doesn't wait for the orders
+	var msg database.DBNotification
+	if err := json.Unmarshal(read(t, acme), &msg); err != nil || msg.Table != "users" {
+		t.Fatalf("received %v (err %v) while the check of orders stalls, expected the users truncate", msg, err)
+	}
+
+	// The orders keep their order once checked
+	close(db.stall)
+	for _, id := range []string{"1", "2"} {
+		if err := json.Unmarshal(read(t, acme), &msg); err != nil || msg.Table != "orders" || msg.ID != id {
+			t.Errorf("received %v (err %v), expected orders %s", msg, err, id)
+		}
+	}
+}
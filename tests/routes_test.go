@@ -0,0 +1,1036 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"pulse/internal/database"
+	"pulse/internal/server"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"nhooyr.io/websocket"
+)
+
+func TestFirehoseToggle(t *testing.T) {
+	tests := []struct {
+		name     string
+		env      string
+		expected bool
+	}{
+		{name: "default", env: "", expected: true},
+		{name: "enabled", env: "true", expected: true},
+		{name: "disabled", env: "false", expected: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("PULSE_ENABLE_FIREHOSE", tt.env)
+
+			s := &server.Server{}
+			handler := s.RegisterRoutes()
+
+			req := httptest.NewRequest(http.MethodGet, "/ws/all", nil)
+			resp := httptest.NewRecorder()
+			handler.ServeHTTP(resp, req)
+
+			registered := resp.Code != http.StatusNotFound
+			if registered != tt.expected {
+				t.Errorf("/ws/all registered = %v, expected = %v (status %v)", registered, tt.expected, resp.Code)
+			}
+		})
+	}
+}
+
+func TestPatternsOfEveryTableNeedTheFirehose(t *testing.T) {
+	t.Setenv("PULSE_ENABLE_FIREHOSE", "false")
+	db := newFakeDB()
+	_, ts := startServer(t, db)
+
+	for _, path := range []string{"/ws/*", "/ws/public.*"} {
+		url := "ws" + strings.TrimPrefix(ts.URL, "http") + path
+		if conn, _, err := websocket.Dial(context.Background(), url, nil); err == nil {
+			conn.CloseNow()
+			t.Errorf("dial %s opened the firehose", path)
+		}
+	}
+	for _, path := range []string{"/sse/*", "/events?table=*"} {
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatalf("GET error = %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("GET %s status = %d, expected %d", path, resp.StatusCode, http.StatusBadRequest)
+		}
+	}
+
+	conn := dial(t, ts, "/ws")
+	if reply := request(t, conn, map[string]interface{}{"action": "subscribe", "table": "*"}); reply.Operation != "error" {
+		t.Errorf("mux reply = %+v, expected an error", reply)
+	}
+
+	// Patterns of some tables don't need it
+	conn = dial(t, ts, "/ws/orders_*")
+	db.notifications <- database.DBNotification{Operation: "insert", Table: "secrets", ID: "1"}
+	db.notifications <- database.DBNotification{Operation: "insert", Table: "orders_eu", ID: "2"}
+	var msg database.DBNotification
+	if err := json.Unmarshal(read(t, conn), &msg); err != nil || msg.Table != "orders_eu" {
+		t.Errorf("received %+v (err %v), expected the orders_eu insert", msg, err)
+	}
+}
+
+func TestPublish(t *testing.T) {
+	t.Setenv("PULSE_PUBLISH_TOKEN", "secret")
+
+	db := newFakeDB()
+	_, ts := startServer(t, db)
+	conn := dial(t, ts, "/ws/deploys")
+
+	tests := []struct {
+		name     string
+		token    string
+		body     string
+		expected int
+	}{
+		{name: "no token", token: "", body: `{"operation":"started","table":"deploys"}`, expected: http.StatusBadRequest},
+		{name: "wrong token", token: "nope", body: `{"operation":"started","table":"deploys"}`, expected: http.StatusUnauthorized},
+		{name: "no table", token: "secret", body: `{"operation":"started"}`, expected: http.StatusBadRequest},
+		{name: "reserved operation", token: "secret", body: `{"operation":"delete","table":"deploys"}`, expected: http.StatusBadRequest},
+		{name: "custom event", token: "secret", body: `{"operation":"started","table":"deploys","data":{"version":"1.2.3"}}`, expected: http.StatusAccepted},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodPost, ts.URL+"/publish", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("publish error = %v", err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.expected {
+				t.Errorf("publish status = %v, expected %v", resp.StatusCode, tt.expected)
+			}
+		})
+	}
+
+	var msg database.DBNotification
+	if err := json.Unmarshal(read(t, conn), &msg); err != nil {
+		t.Fatalf("decode error = %v", err)
+	}
+	if msg.Operation != "started" || msg.Table != "deploys" {
+		t.Errorf("received %v, expected the published event", msg)
+	}
+}
+
+func TestPublishDuringShutdown(t *testing.T) {
+	t.Setenv("PULSE_PUBLISH_TOKEN", "secret")
+
+	db := newFakeDB()
+	s, ts := startServer(t, db)
+
+	// Publishes racing Shutdown are either accepted or turned away, never
+	// sent to the closed broadcast channel
+	statuses := make(chan int, 1000)
+	stop := make(chan struct{})
+	var publishers sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		publishers.Add(1)
+		go func() {
+			defer publishers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				req, _ := http.NewRequest(http.MethodPost, ts.URL+"/publish", strings.NewReader(`{"operation":"started","table":"deploys"}`))
+				req.Header.Set("Content-Type", "application/json")
+				req.Header.Set("Authorization", "Bearer secret")
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					continue
+				}
+				resp.Body.Close()
+
+				select {
+				case statuses <- resp.StatusCode:
+				default:
+				}
+			}
+		}()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown() error = %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(stop)
+	publishers.Wait()
+	close(statuses)
+
+	for status := range statuses {
+		if status != http.StatusAccepted && status != http.StatusServiceUnavailable {
+			t.Fatalf("publish status = %v, expected %v or %v", status, http.StatusAccepted, http.StatusServiceUnavailable)
+		}
+	}
+}
+
+func TestPublishRelaysToReplicas(t *testing.T) {
+	t.Setenv("PULSE_PUBLISH_TOKEN", "secret")
+
+	db := newFakeDB()
+	db.cluster = true
+	_, ts := startServer(t, db)
+	conn := dial(t, ts, "/ws/deploys")
+
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+"/publish", strings.NewReader(`{"operation":"started","table":"deploys"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("publish error = %v", err)
+	}
+	resp.Body.Close()
+
+	// Delivered locally too
+	var msg database.DBNotification
+	if err := json.Unmarshal(read(t, conn), &msg); err != nil || msg.Operation != "started" {
+		t.Fatalf("received %v (err %v), expected the published event", msg, err)
+	}
+
+	db.mut.Lock()
+	defer db.mut.Unlock()
+	if len(db.relayed) != 1 || db.relayed[0].Operation != "started" || db.relayed[0].Source != "publish" {
+		t.Errorf("relayed %+v, expected the published event", db.relayed)
+	}
+}
+
+func TestInjectedTableRejected(t *testing.T) {
+	db := newFakeDB()
+	_, ts := startServer(t, db)
+
+	path := "/ws/" + url.PathEscape("orders; DROP TABLE orders") + "?since_time=2024-01-01T00:00:00Z"
+	resp, err := http.Get(ts.URL + path)
+	if err != nil {
+		t.Fatalf("request error = %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("status = %v, expected %v", resp.StatusCode, http.StatusBadRequest)
+	}
+
+	db.mut.Lock()
+	defer db.mut.Unlock()
+	if db.replays != 0 {
+		t.Errorf("Replay was called %d times, expected none", db.replays)
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	db := newFakeDB()
+	_, ts := startServer(t, db)
+	time.Sleep(50 * time.Millisecond)
+
+	status := func(path string) int {
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatalf("GET %s error = %v", path, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := status("/livez"); code != http.StatusOK {
+		t.Errorf("/livez = %v, expected %v", code, http.StatusOK)
+	}
+	if code := status("/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz before sync = %v, expected %v", code, http.StatusServiceUnavailable)
+	}
+
+	db.SyncTables(context.Background())
+
+	if code := status("/readyz"); code != http.StatusOK {
+		t.Errorf("/readyz after sync = %v, expected %v", code, http.StatusOK)
+	}
+}
+
+func TestHealthReportsDownDatabases(t *testing.T) {
+	db := newFakeDB()
+	_, ts := startServer(t, db)
+
+	health := func() (int, map[string]string) {
+		resp, err := http.Get(ts.URL + "/health")
+		if err != nil {
+			t.Fatalf("GET /health error = %v", err)
+		}
+		defer resp.Body.Close()
+
+		var stats map[string]string
+		json.NewDecoder(resp.Body).Decode(&stats)
+		return resp.StatusCode, stats
+	}
+
+	if code, stats := health(); code != http.StatusOK || stats["status"] != "up" {
+		t.Errorf("/health = %v %v, expected the database up", code, stats)
+	}
+
+	db.mut.Lock()
+	db.down = errors.New("connection refused")
+	db.mut.Unlock()
+
+	// A transient outage is reported, the server keeps serving
+	if code, stats := health(); code != http.StatusServiceUnavailable || stats["status"] != "down" {
+		t.Errorf("/health = %v %v, expected the database down", code, stats)
+	}
+
+	db.mut.Lock()
+	db.down = nil
+	db.mut.Unlock()
+
+	if code, _ := health(); code != http.StatusOK {
+		t.Errorf("/health = %v once back, expected %v", code, http.StatusOK)
+	}
+}
+
+func TestNewRejectsInvalidSettings(t *testing.T) {
+	t.Setenv("PULSE_POLICIES", "not json")
+
+	if _, err := server.New(newFakeDB()); err == nil {
+		t.Errorf("New() succeeded with invalid policies, expected an error")
+	}
+
+	t.Setenv("PULSE_POLICIES", "")
+	for _, origins := range []string{"app.example.com", "https://app.example.com/path", "ftp://files.example.com"} {
+		t.Setenv("ALLOWED_ORIGINS", origins)
+		if _, err := server.New(newFakeDB()); err == nil {
+			t.Errorf("New() succeeded with ALLOWED_ORIGINS=%s, expected an error", origins)
+		}
+	}
+
+	t.Setenv("ALLOWED_ORIGINS", "")
+	for _, keys := range []string{
+		"not json",
+		`[{"name": "billing", "tables": ["orders"]}]`,
+		`[{"key": "k3y", "tables": ["orders"]}]`,
+		`[{"name": "billing", "key": "k3y"}, {"name": "shipping", "key": "k3y"}]`,
+		`[{"name": "billing", "key": "k3y", "tables": ["orders; DROP"]}]`,
+	} {
+		t.Setenv("PULSE_API_KEYS", keys)
+		if _, err := server.New(newFakeDB()); err == nil {
+			t.Errorf("New() succeeded with PULSE_API_KEYS=%s, expected an error", keys)
+		}
+	}
+}
+
+// signToken signs claims with secret using HS256.
+func signToken(t *testing.T, secret string, claims jwt.MapClaims) string {
+	t.Helper()
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+	if err != nil {
+		t.Fatalf("sign error = %v", err)
+	}
+	return token
+}
+
+func TestJWTAuthentication(t *testing.T) {
+	t.Setenv("PULSE_JWT_SECRET", "s3cret")
+	t.Setenv("PULSE_JWT_ISSUER", "auth.example.com")
+
+	valid := jwt.MapClaims{"iss": "auth.example.com", "sub": "user-1", "exp": time.Now().Add(time.Hour).Unix()}
+	unsigned, _ := jwt.NewWithClaims(jwt.SigningMethodNone, valid).SignedString(jwt.UnsafeAllowNoneSignatureType)
+
+	tests := []struct {
+		name     string
+		header   string
+		query    string
+		expected int
+	}{
+		{name: "missing", expected: http.StatusUnauthorized},
+		{name: "header", header: "Bearer " + signToken(t, "s3cret", valid), expected: http.StatusSwitchingProtocols},
+		{name: "query", query: "access_token=" + signToken(t, "s3cret", valid), expected: http.StatusSwitchingProtocols},
+		{name: "wrong secret", header: "Bearer " + signToken(t, "other", valid), expected: http.StatusUnauthorized},
+		{name: "unsigned", header: "Bearer " + unsigned, expected: http.StatusUnauthorized},
+		{
+			name:     "expired",
+			header:   "Bearer " + signToken(t, "s3cret", jwt.MapClaims{"iss": "auth.example.com", "exp": time.Now().Add(-time.Minute).Unix()}),
+			expected: http.StatusUnauthorized,
+		},
+		{
+			name:     "no expiry",
+			header:   "Bearer " + signToken(t, "s3cret", jwt.MapClaims{"iss": "auth.example.com", "sub": "user-1"}),
+			expected: http.StatusUnauthorized,
+		},
+		{
+			name:     "other issuer",
+			header:   "Bearer " + signToken(t, "s3cret", jwt.MapClaims{"iss": "evil.example.com", "exp": time.Now().Add(time.Hour).Unix()}),
+			expected: http.StatusUnauthorized,
+		},
+	}
+
+	_, ts := startServer(t, newFakeDB())
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			if tt.header != "" {
+				header.Set("Authorization", tt.header)
+			}
+
+			url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws/orders?" + tt.query
+			conn, resp, err := websocket.Dial(context.Background(), url, &websocket.DialOptions{HTTPHeader: header})
+			if err == nil {
+				conn.CloseNow()
+			}
+
+			if resp == nil || resp.StatusCode != tt.expected {
+				t.Errorf("dial response = %v (err %v), expected status %d", resp, err, tt.expected)
+			}
+		})
+	}
+
+	// Event streams are authenticated too
+	resp, err := http.Get(ts.URL + "/sse/orders")
+	if err != nil {
+		t.Fatalf("GET error = %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("status = %d, expected %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+}
+
+func TestAPIKeyAuthentication(t *testing.T) {
+	t.Setenv("PULSE_JWT_SECRET", "s3cret")
+	t.Setenv("PULSE_API_KEYS", `[{"name": "billing", "key": "b1lling", "tables": ["orders", "invoices"]}, {"name": "ops", "key": "0ps", "tables": ["*"]}, {"name": "reports", "key": "rep0rts", "tables": ["billing.invoices"]}]`)
+	t.Setenv("PULSE_API_KEYS_TABLE", "true")
+
+	db := newFakeDB()
+	db.apiKeys = map[string]database.APIKey{"sh1pping": {Name: "shipping", Tables: []string{"shipments"}}}
+	_, ts := startServer(t, db)
+
+	token := signToken(t, "s3cret", jwt.MapClaims{"sub": "user-1", "exp": time.Now().Add(time.Hour).Unix()})
+
+	tests := []struct {
+		name     string
+		path     string
+		header   http.Header
+		expected int
+	}{
+		{name: "header", path: "/ws/orders", header: http.Header{"X-Api-Key": {"b1lling"}}, expected: http.StatusSwitchingProtocols},
+		{name: "query", path: "/ws/invoices?apikey=b1lling", expected: http.StatusSwitchingProtocols},
+		{name: "table not granted", path: "/ws/users?apikey=b1lling", expected: http.StatusForbidden},
+		{name: "every table", path: "/ws/users?apikey=0ps", expected: http.StatusSwitchingProtocols},
+		{name: "schema qualified grant", path: "/ws/billing.invoices?apikey=rep0rts", expected: http.StatusSwitchingProtocols},
+		{name: "table of another schema", path: "/ws/public.invoices?apikey=rep0rts", expected: http.StatusForbidden},
+		{name: "table of every schema", path: "/ws/invoices?apikey=rep0rts", expected: http.StatusForbidden},
+		{name: "bare grant of a schema qualified table", path: "/ws/billing.invoices?apikey=b1lling", expected: http.StatusSwitchingProtocols},
+		{name: "database key", path: "/ws/shipments?apikey=sh1pping", expected: http.StatusSwitchingProtocols},
+		{name: "database key table not granted", path: "/ws/orders?apikey=sh1pping", expected: http.StatusForbidden},
+		{name: "unknown key", path: "/ws/orders?apikey=wrong", expected: http.StatusUnauthorized},
+		{name: "token still accepted", path: "/ws/users?access_token=" + token, expected: http.StatusSwitchingProtocols},
+		{name: "neither", path: "/ws/orders", expected: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			url := "ws" + strings.TrimPrefix(ts.URL, "http") + tt.path
+			conn, resp, err := websocket.Dial(context.Background(), url, &websocket.DialOptions{HTTPHeader: tt.header})
+			if err == nil {
+				conn.CloseNow()
+			}
+
+			if resp == nil || resp.StatusCode != tt.expected {
+				t.Errorf("dial response = %v (err %v), expected status %d", resp, err, tt.expected)
+			}
+		})
+	}
+
+	// Keys are checked against every database, one that can't be asked
+	// fails the request rather than rejecting the key
+	db.mut.Lock()
+	db.down = errors.New("connection refused")
+	db.mut.Unlock()
+
+	resp, err := http.Get(ts.URL + "/sse/orders?apikey=sh1pping")
+	if err != nil {
+		t.Fatalf("GET error = %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, expected %d", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+}
+
+func TestAPIKeysWithoutJWT(t *testing.T) {
+	t.Setenv("PULSE_API_KEYS", `[{"name": "billing", "key": "b1lling", "tables": ["orders"]}]`)
+
+	db := newFakeDB()
+	_, ts := startServer(t, db)
+
+	// Keys are required once there are some, even without PULSE_JWT_SECRET
+	resp, err := http.Get(ts.URL + "/sse/orders")
+	if err != nil {
+		t.Fatalf("GET error = %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("status = %d, expected %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+
+	conn := dial(t, ts, "/ws/all?apikey=b1lling")
+	db.notifications <- database.DBNotification{Operation: "insert", Table: "users", ID: "1", Data: map[string]interface{}{}}
+	db.notifications <- database.DBNotification{Operation: "insert", Table: "orders", ID: "2", Data: map[string]interface{}{}}
+
+	received := readUntilIdle(t, conn, 200*time.Millisecond)
+	if len(received) != 1 || received[0].Table != "orders" {
+		t.Errorf("received %v, expected orders 2 only", received)
+	}
+}
+
+func TestAPIKeysGrantSchemaQualifiedTables(t *testing.T) {
+	t.Setenv("PULSE_API_KEYS", `[{"name": "reports", "key": "rep0rts", "tables": ["billing.invoices", "orders"]}]`)
+
+	db := newFakeDB()
+	_, ts := startServer(t, db)
+
+	conn := dial(t, ts, "/ws/all?apikey=rep0rts")
+	db.notifications <- database.DBNotification{Operation: "insert", Schema: "public", Table: "invoices", ID: "1", Data: map[string]interface{}{}}
+	db.notifications <- database.DBNotification{Operation: "insert", Schema: "billing", Table: "invoices", ID: "2", Data: map[string]interface{}{}}
+	db.notifications <- database.DBNotification{Operation: "insert", Schema: "billing", Table: "orders", ID: "3", Data: map[string]interface{}{}}
+
+	// Tables are fanned out independently, in any order
+	var ids []string
+	for _, n := range readUntilIdle(t, conn, 200*time.Millisecond) {
+		ids = append(ids, n.ID)
+	}
+	if slices.Sort(ids); !slices.Equal(ids, []string{"2", "3"}) {
+		t.Errorf("received %v, expected the invoice of billing and the order", ids)
+	}
+
+	t.Setenv("PULSE_API_KEYS", `[{"name": "reports", "key": "rep0rts", "tables": ["billing."]}]`)
+	if _, err := server.ConfigFromEnv(); err == nil {
+		t.Errorf("ConfigFromEnv() expected an error for an invalid schema qualified table")
+	}
+}
+
+func TestServerConfigFromEnv(t *testing.T) {
+	t.Setenv("PORT", "9090")
+	t.Setenv("DATABASE_URLS", "postgres://a/one, postgres://b/two")
+	t.Setenv("PULSE_DEAD_LETTERS", "log")
+
+	cfg, err := server.ConfigFromEnv()
+	if err != nil {
+		t.Fatalf("ConfigFromEnv() error = %v", err)
+	}
+	if cfg.Port != 9090 || len(cfg.Databases) != 2 {
+		t.Fatalf("cfg = %+v", cfg)
+	}
+	if cfg.Databases[1].URL != "postgres://b/two" || cfg.Databases[1].DeadLetters != "log" {
+		t.Errorf("second database = %+v", cfg.Databases[1])
+	}
+
+	t.Setenv("PULSE_POLICIES", "{}")
+	if _, err := server.ConfigFromEnv(); err == nil {
+		t.Errorf("ConfigFromEnv() expected an error for invalid policies")
+	}
+}
+
+func TestNamedDatabasesFromEnv(t *testing.T) {
+	t.Setenv("DATABASE_URLS", "eu=postgres://a/one?sslmode=disable, postgres://b/two, us-east=postgres://c/three")
+
+	configs, err := database.ConfigsFromEnv()
+	if err != nil {
+		t.Fatalf("ConfigsFromEnv() error = %v", err)
+	}
+	expected := []struct{ name, url string }{
+		{"eu", "postgres://a/one?sslmode=disable"},
+		{"", "postgres://b/two"},
+		{"us-east", "postgres://c/three"},
+	}
+	for i, want := range expected {
+		if configs[i].Name != want.name || configs[i].URL != want.url {
+			t.Errorf("database %d = %q %q, expected %q %q", i, configs[i].Name, configs[i].URL, want.name, want.url)
+		}
+	}
+
+	for _, urls := range []string{"eu=postgres://a/one,eu=postgres://b/two", "all=postgres://a/one", "e.u=postgres://a/one"} {
+		t.Setenv("DATABASE_URLS", urls)
+		if _, err := database.ConfigsFromEnv(); err == nil {
+			t.Errorf("ConfigsFromEnv() succeeded with DATABASE_URLS=%s, expected an error", urls)
+		}
+	}
+}
+
+func TestServerTLSConfigFromEnv(t *testing.T) {
+	if cfg, err := server.ConfigFromEnv(); err != nil || cfg.TLS != nil {
+		t.Fatalf("ConfigFromEnv() = %+v, %v, expected no TLS", cfg.TLS, err)
+	}
+
+	t.Setenv("TLS_AUTOCERT_DOMAINS", "pulse.example.com, ws.example.com")
+	t.Setenv("TLS_AUTOCERT_EMAIL", "ops@example.com")
+	cfg, err := server.ConfigFromEnv()
+	if err != nil {
+		t.Fatalf("ConfigFromEnv() error = %v", err)
+	}
+	if cfg.TLS == nil || len(cfg.TLS.Domains) != 2 || cfg.TLS.Domains[1] != "ws.example.com" || cfg.TLS.Email != "ops@example.com" {
+		t.Errorf("cfg.TLS = %+v", cfg.TLS)
+	}
+
+	t.Setenv("TLS_CERT", "/etc/pulse/cert.pem")
+	if _, err := server.ConfigFromEnv(); err == nil {
+		t.Errorf("ConfigFromEnv() expected an error for a cert without key, along with domains")
+	}
+
+	// Checked before connecting to any database
+	if _, err := server.NewServerWithConfig(server.Config{TLS: &server.TLSConfig{CertFile: "/missing/cert.pem", KeyFile: "/missing/key.pem"}}); err == nil {
+		t.Errorf("NewServerWithConfig() expected an error for missing cert files")
+	}
+}
+
+// dialStatus dials path on ts and returns the status of the response.
+func dialStatus(t *testing.T, ts *httptest.Server, path string) *http.Response {
+	t.Helper()
+
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + path
+	conn, resp, err := websocket.Dial(context.Background(), url, nil)
+	if err == nil {
+		t.Cleanup(func() { conn.CloseNow() })
+	}
+	if resp == nil {
+		t.Fatalf("dial %s error = %v, expected a response", path, err)
+	}
+	return resp
+}
+
+func TestConnectionLimits(t *testing.T) {
+	tests := []struct {
+		name     string
+		env      map[string]string
+		expected int
+	}{
+		{name: "total", env: map[string]string{"PULSE_MAX_CONNECTIONS": "2"}, expected: http.StatusServiceUnavailable},
+		{name: "per ip", env: map[string]string{"PULSE_MAX_CONNECTIONS_PER_IP": "2"}, expected: http.StatusTooManyRequests},
+		{name: "rate", env: map[string]string{"PULSE_CONNECTION_RATE": "0.1", "PULSE_CONNECTION_BURST": "2"}, expected: http.StatusTooManyRequests},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for variable, value := range tt.env {
+				t.Setenv(variable, value)
+			}
+			_, ts := startServer(t, newFakeDB())
+
+			for i := 0; i < 2; i++ {
+				if resp := dialStatus(t, ts, "/ws/orders"); resp.StatusCode != http.StatusSwitchingProtocols {
+					t.Fatalf("dial %d status = %d, expected the connection accepted", i, resp.StatusCode)
+				}
+			}
+
+			resp := dialStatus(t, ts, "/ws/orders")
+			if resp.StatusCode != tt.expected || resp.Header.Get("Retry-After") == "" {
+				t.Errorf("status = %d with Retry-After %q, expected %d and a delay", resp.StatusCode, resp.Header.Get("Retry-After"), tt.expected)
+			}
+		})
+	}
+}
+
+func TestInvalidConnectionLimits(t *testing.T) {
+	tests := map[string]string{
+		"PULSE_MAX_CONNECTIONS":        "1O0",
+		"PULSE_MAX_CONNECTIONS_PER_IP": "-1",
+		"PULSE_CONNECTION_RATE":        "fast",
+		"PULSE_CONNECTION_BURST":       "5",
+	}
+
+	for variable, value := range tests {
+		t.Run(variable, func(t *testing.T) {
+			t.Setenv(variable, value)
+
+			// A typo mustn't disable the limit
+			if _, err := server.New(newFakeDB()); err == nil {
+				t.Errorf("New() with %s=%s succeeded, expected an error", variable, value)
+			}
+			if _, err := server.ConfigFromEnv(); err == nil {
+				t.Errorf("ConfigFromEnv() with %s=%s succeeded, expected an error", variable, value)
+			}
+		})
+	}
+}
+
+func TestConnectionLimitFreedOnClose(t *testing.T) {
+	t.Setenv("PULSE_MAX_CONNECTIONS_PER_IP", "1")
+	_, ts := startServer(t, newFakeDB())
+
+	conn := dial(t, ts, "/ws/orders")
+	if resp := dialStatus(t, ts, "/sse/orders"); resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, expected the second connection turned away", resp.StatusCode)
+	}
+	conn.Close(websocket.StatusNormalClosure, "")
+
+	deadline := time.Now().Add(2 * time.Second)
+	for dialStatus(t, ts, "/ws/orders").StatusCode != http.StatusSwitchingProtocols {
+		if time.Now().After(deadline) {
+			t.Fatal("the slot of the closed connection was never freed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// getEvents polls /events with query until it returns n notifications.
+func getEvents(t *testing.T, ts *httptest.Server, query string, n int) ([]database.DBNotification, string) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		resp, err := http.Get(ts.URL + "/events?" + query)
+		if err != nil {
+			t.Fatalf("GET error = %v", err)
+		}
+
+		var body struct {
+			Events []database.DBNotification `json:"events"`
+			Next   string                    `json:"next"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || err != nil {
+			t.Fatalf("GET /events?%s status = %d (err %v), expected %d", query, resp.StatusCode, err, http.StatusOK)
+		}
+
+		if len(body.Events) >= n || time.Now().After(deadline) {
+			return body.Events, body.Next
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestEventsAfterSeq(t *testing.T) {
+	db := newFakeDB()
+	_, ts := startServer(t, db)
+
+	for i := 1; i <= 3; i++ {
+		db.notifications <- database.DBNotification{Operation: "insert", Table: "orders", ID: strconv.Itoa(i)}
+		db.notifications <- database.DBNotification{Operation: "insert", Table: "users", ID: strconv.Itoa(i)}
+	}
+
+	events, _ := getEvents(t, ts, "table=orders", 3)
+	if len(events) != 3 || events[0].ID != "1" || events[2].ID != "3" {
+		t.Fatalf("events = %v, expected the 3 orders", events)
+	}
+
+	page, next := getEvents(t, ts, "table=orders&limit=2", 2)
+	if len(page) != 2 || next != strconv.FormatInt(page[1].Seq, 10) {
+		t.Errorf("page = %v then %q, expected 2 orders and the seq of the last", page, next)
+	}
+
+	page, next = getEvents(t, ts, "table=orders&since="+next, 1)
+	if len(page) != 1 || page[0].ID != "3" {
+		t.Errorf("page = %v, expected the last order", page)
+	}
+
+	if page, _ = getEvents(t, ts, "table=orders&since="+next, 0); len(page) != 0 {
+		t.Errorf("page = %v, expected nothing new", page)
+	}
+}
+
+func TestEventsSinceTime(t *testing.T) {
+	db := newFakeDB()
+	_, ts := startServer(t, db)
+
+	db.notifications <- database.DBNotification{Operation: "insert", Table: "orders", ID: "1", EmittedAt: time.Now().Add(-time.Hour)}
+	since := time.Now().Add(-time.Minute)
+	db.notifications <- database.DBNotification{Operation: "insert", Table: "orders", ID: "2", EmittedAt: time.Now().Add(-time.Second)}
+	db.notifications <- database.DBNotification{Operation: "insert", Table: "users", ID: "3", EmittedAt: time.Now()}
+
+	events, next := getEvents(t, ts, "since="+url.QueryEscape(since.Format(time.RFC3339)), 2)
+	if len(events) != 2 || events[0].ID != "2" || events[1].ID != "3" {
+		t.Fatalf("events = %v, expected those emitted since", events)
+	}
+
+	if events, _ = getEvents(t, ts, "since="+url.QueryEscape(next), 0); len(events) != 0 {
+		t.Errorf("events = %v, expected nothing after next", events)
+	}
+}
+
+func TestEventsRejectsInvalidParameters(t *testing.T) {
+	// Every table needs the firehose
+	t.Setenv("PULSE_ENABLE_FIREHOSE", "false")
+	_, ts := startServer(t, newFakeDB())
+
+	for _, query := range []string{"", "table=orders&since=yesterday", "table=orders&limit=0", "table=orders&aggregate=count"} {
+		resp, err := http.Get(ts.URL + "/events?" + query)
+		if err != nil {
+			t.Fatalf("GET error = %v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("GET /events?%s status = %d, expected %d", query, resp.StatusCode, http.StatusBadRequest)
+		}
+	}
+}
+
+// admin sends a request to the admin API of ts with token, decoding the
+// response into v if it's set, and returns its status.
+func admin(t *testing.T, ts *httptest.Server, method, path, token string, v any) int {
+	t.Helper()
+
+	req, _ := http.NewRequest(method, ts.URL+path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s error = %v", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	if v != nil && resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("decode %s error = %v", path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestAdminAPI(t *testing.T) {
+	t.Setenv("PULSE_ADMIN_TOKEN", "secret")
+
+	db := newFakeDB()
+	_, ts := startServer(t, db)
+	conn := dial(t, ts, "/ws/orders?client_id=dashboard")
+
+	if status := admin(t, ts, http.MethodGet, "/admin/clients", "", nil); status != http.StatusBadRequest {
+		t.Errorf("no token status = %d, expected %d", status, http.StatusBadRequest)
+	}
+	if status := admin(t, ts, http.MethodGet, "/admin/clients", "nope", nil); status != http.StatusUnauthorized {
+		t.Errorf("wrong token status = %d, expected %d", status, http.StatusUnauthorized)
+	}
+
+	var clients struct {
+		Clients []struct {
+			ID       uint64   `json:"id"`
+			ClientID string   `json:"client_id"`
+			Tables   []string `json:"tables"`
+			Protocol string   `json:"protocol"`
+		} `json:"clients"`
+	}
+	if status := admin(t, ts, http.MethodGet, "/admin/clients", "secret", &clients); status != http.StatusOK {
+		t.Fatalf("clients status = %d", status)
+	}
+	if len(clients.Clients) != 1 || clients.Clients[0].ClientID != "dashboard" || clients.Clients[0].Tables[0] != "orders" || clients.Clients[0].Protocol != "pulse.v2" {
+		t.Fatalf("clients = %+v, expected the dashboard on orders", clients.Clients)
+	}
+
+	db.notifications <- database.DBNotification{Operation: "insert", Table: "orders", ID: "1"}
+	read(t, conn)
+
+	var tables struct {
+		Tables []struct {
+			Table     string  `json:"table"`
+			Total     int64   `json:"total"`
+			PerSecond float64 `json:"per_second"`
+		} `json:"tables"`
+	}
+	if status := admin(t, ts, http.MethodGet, "/admin/tables", "secret", &tables); status != http.StatusOK {
+		t.Fatalf("tables status = %d", status)
+	}
+	if len(tables.Tables) != 1 || tables.Tables[0].Table != "orders" || tables.Tables[0].Total != 1 || tables.Tables[0].PerSecond <= 0 {
+		t.Errorf("tables = %+v, expected a notification of orders", tables.Tables)
+	}
+
+	db.synced.Store(false)
+	var synced map[string][]string
+	if status := admin(t, ts, http.MethodPost, "/admin/sync", "secret", &synced); status != http.StatusOK || len(synced["synced"]) != 1 || !db.synced.Load() {
+		t.Errorf("sync status = %d, synced = %v, expected fake synced", status, synced)
+	}
+
+	path := "/admin/clients/" + strconv.FormatUint(clients.Clients[0].ID, 10)
+	if status := admin(t, ts, http.MethodDelete, path, "secret", nil); status != http.StatusNoContent {
+		t.Fatalf("disconnect status = %d, expected %d", status, http.StatusNoContent)
+	}
+
+	var control map[string]string
+	if err := json.Unmarshal(read(t, conn), &control); err != nil || control["reason"] != "disconnected_by_admin" {
+		t.Errorf("control = %v, %v, expected disconnected_by_admin", control, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, _, err := conn.Read(ctx); websocket.CloseStatus(err) != websocket.StatusPolicyViolation {
+		t.Errorf("read error = %v, expected a policy violation close", err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if status := admin(t, ts, http.MethodDelete, path, "secret", nil); status != http.StatusNotFound {
+		t.Errorf("disconnect again status = %d, expected %d", status, http.StatusNotFound)
+	}
+}
+
+func TestAdminAPIDisabledWithoutToken(t *testing.T) {
+	_, ts := startServer(t, newFakeDB())
+
+	for _, path := range []string{"/admin/clients", "/ui/"} {
+		if status := admin(t, ts, http.MethodGet, path, "secret", nil); status != http.StatusNotFound {
+			t.Errorf("%s status = %d, expected %d", path, status, http.StatusNotFound)
+		}
+	}
+}
+
+func TestAdminDatabases(t *testing.T) {
+	t.Setenv("PULSE_ADMIN_TOKEN", "secret")
+
+	db := newFakeDB()
+	_, ts := startServer(t, db)
+
+	var databases struct {
+		Databases []struct {
+			Source    string            `json:"source"`
+			Health    map[string]string `json:"health"`
+			Unwatched []string          `json:"unwatched"`
+		} `json:"databases"`
+	}
+	db.mut.Lock()
+	db.down = errors.New("connection refused")
+	db.mut.Unlock()
+
+	if status := admin(t, ts, http.MethodGet, "/admin/databases", "secret", &databases); status != http.StatusOK {
+		t.Fatalf("databases status = %d, expected %d while down", status, http.StatusOK)
+	}
+	if len(databases.Databases) != 1 || databases.Databases[0].Source != "fake" || databases.Databases[0].Health["status"] != "down" || databases.Databases[0].Unwatched == nil {
+		t.Errorf("databases = %+v, expected fake down", databases.Databases)
+	}
+}
+
+func TestDashboard(t *testing.T) {
+	t.Setenv("PULSE_ADMIN_TOKEN", "secret")
+	_, ts := startServer(t, newFakeDB())
+
+	// Served without the token, which is entered in the page
+	resp, err := http.Get(ts.URL + "/ui")
+	if err != nil {
+		t.Fatalf("GET /ui error = %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(resp.Header.Get("Content-Type"), "text/html") || !strings.Contains(string(body), "/admin/") {
+		t.Errorf("GET /ui = %d %s, expected the dashboard", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+}
+
+func TestBrowserClientIsServed(t *testing.T) {
+	_, ts := startServer(t, newFakeDB())
+
+	resp, err := http.Get(ts.URL + "/pulse.js")
+	if err != nil {
+		t.Fatalf("GET /pulse.js error = %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/javascript") || !strings.Contains(string(body), "pulse.v2") {
+		t.Errorf("GET /pulse.js = %d %s, expected the client", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+}
+
+// dialOrigin opens a websocket to path on ts from the page of origin, and
+// returns the status of the handshake.
+func dialOrigin(t *testing.T, ts *httptest.Server, path, origin string) int {
+	t.Helper()
+
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + path
+	conn, resp, err := websocket.Dial(context.Background(), url, &websocket.DialOptions{HTTPHeader: http.Header{"Origin": {origin}}})
+	if err == nil {
+		conn.CloseNow()
+	}
+	if resp == nil {
+		t.Fatalf("dial %s error = %v", path, err)
+	}
+	return resp.StatusCode
+}
+
+func TestAllowedOrigins(t *testing.T) {
+	t.Setenv("ALLOWED_ORIGINS", "https://app.example.com, https://*.example.org")
+
+	_, ts := startServer(t, newFakeDB())
+
+	tests := []struct {
+		origin  string
+		allowed bool
+	}{
+		{origin: "https://app.example.com", allowed: true},
+		{origin: "https://admin.example.org", allowed: true},
+		{origin: "https://evil.com", allowed: false},
+		{origin: "http://app.example.com.evil.com", allowed: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.origin, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodOptions, ts.URL+"/events", nil)
+			req.Header.Set("Origin", tt.origin)
+			req.Header.Set("Access-Control-Request-Method", http.MethodGet)
+			req.Header.Set("Access-Control-Request-Headers", "authorization")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("preflight error = %v", err)
+			}
+			resp.Body.Close()
+
+			allowed := resp.Header.Get("Access-Control-Allow-Origin") == tt.origin
+			if allowed != tt.allowed {
+				t.Errorf("preflight Access-Control-Allow-Origin = %q, expected allowed = %v", resp.Header.Get("Access-Control-Allow-Origin"), tt.allowed)
+			}
+
+			status := dialOrigin(t, ts, "/ws/orders", tt.origin)
+			if (status == http.StatusSwitchingProtocols) != tt.allowed {
+				t.Errorf("websocket handshake status = %d, expected allowed = %v", status, tt.allowed)
+			}
+		})
+	}
+}
+
+func TestOtherOriginsRejectedByDefault(t *testing.T) {
+	_, ts := startServer(t, newFakeDB())
+
+	if status := dialOrigin(t, ts, "/ws/orders", "https://app.example.com"); status != http.StatusForbidden {
+		t.Errorf("websocket handshake status = %d, expected %d", status, http.StatusForbidden)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/health", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET /health error = %v", err)
+	}
+	resp.Body.Close()
+	if origin := resp.Header.Get("Access-Control-Allow-Origin"); origin != "" {
+		t.Errorf("Access-Control-Allow-Origin = %q, expected none", origin)
+	}
+
+	t.Setenv("ALLOWED_ORIGINS", "*")
+	_, ts = startServer(t, newFakeDB())
+	if status := dialOrigin(t, ts, "/ws/orders", "https://anything.test"); status != http.StatusSwitchingProtocols {
+		t.Errorf("websocket handshake status = %d with every origin allowed", status)
+	}
+}
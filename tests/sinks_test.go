@@ -0,0 +1,780 @@
+package tests
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"pulse/internal/database"
+	"pulse/internal/sinks"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+)
+
+// webhookReceiver records the notifications posted to it, failing the first
+// failures requests with status.
+type webhookReceiver struct {
+	mut        sync.Mutex
+	failures   int
+	status     int
+	attempts   int
+	received   []database.DBNotification
+	signatures []string
+	// traceparents are the traceparent headers received
+	traceparents []string
+	delivered    chan struct{}
+}
+
+func newWebhookReceiver(t *testing.T, failures, status int) (*webhookReceiver, *httptest.Server) {
+	r := &webhookReceiver{failures: failures, status: status, delivered: make(chan struct{}, 16)}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+
+		r.mut.Lock()
+		defer r.mut.Unlock()
+
+		r.attempts++
+		if r.attempts <= r.failures {
+			w.WriteHeader(r.status)
+			return
+		}
+
+		var n database.DBNotification
+		if err := json.Unmarshal(body, &n); err != nil {
+			t.Errorf("decode error = %v", err)
+		}
+		r.received = append(r.received, n)
+		r.signatures = append(r.signatures, req.Header.Get(sinks.SignatureHeader))
+		r.traceparents = append(r.traceparents, req.Header.Get("traceparent"))
+		r.delivered <- struct{}{}
+	}))
+	t.Cleanup(ts.Close)
+
+	return r, ts
+}
+
+// wait waits for n deliveries.
+func (r *webhookReceiver) wait(t *testing.T, n int) {
+	t.Helper()
+
+	for i := 0; i < n; i++ {
+		select {
+		case <-r.delivered:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for delivery %d", i+1)
+		}
+	}
+}
+
+func TestWebhookPostsSignedNotificationsOfItsTables(t *testing.T) {
+	r, ts := newWebhookReceiver(t, 0, 0)
+
+	webhook, err := sinks.NewWebhook(sinks.WebhookConfig{
+		Endpoints: map[string][]string{"orders": {ts.URL}},
+		Secret:    "s3cret",
+	})
+	if err != nil {
+		t.Fatalf("NewWebhook() error = %v", err)
+	}
+
+	webhook.Send(database.DBNotification{Operation: "insert", Table: "users", ID: "1"})
+	webhook.Send(database.DBNotification{Operation: "insert", Table: "orders", ID: "2"})
+	if err := webhook.Close(context.Background()); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	if len(r.received) != 1 || r.received[0].ID != "2" {
+		t.Fatalf("received %+v, expected only the order", r.received)
+	}
+
+	body, _ := json.Marshal(database.DBNotification{Operation: "insert", Table: "orders", ID: "2"})
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(body)
+	if expected := "sha256=" + hex.EncodeToString(mac.Sum(nil)); r.signatures[0] != expected {
+		t.Errorf("signature = %q, expected %q", r.signatures[0], expected)
+	}
+}
+
+func TestWebhookRetriesFailures(t *testing.T) {
+	for name, tc := range map[string]struct {
+		status    int
+		attempts  int
+		delivered bool
+	}{
+		"server error":   {status: http.StatusBadGateway, attempts: 3, delivered: true},
+		"rate limited":   {status: http.StatusTooManyRequests, attempts: 3, delivered: true},
+		"refused":        {status: http.StatusBadRequest, attempts: 1},
+		"never succeeds": {status: http.StatusServiceUnavailable, attempts: 4},
+	} {
+		t.Run(name, func(t *testing.T) {
+			failures := 2
+			if !tc.delivered {
+				failures = 10
+			}
+			r, ts := newWebhookReceiver(t, failures, tc.status)
+
+			webhook, err := sinks.NewWebhook(sinks.WebhookConfig{
+				Endpoints: map[string][]string{sinks.AllTables: {ts.URL}},
+				Attempts:  4,
+				Backoff:   time.Millisecond,
+			})
+			if err != nil {
+				t.Fatalf("NewWebhook() error = %v", err)
+			}
+
+			webhook.Send(database.DBNotification{Operation: "update", Table: "orders", ID: "1"})
+			if err := webhook.Close(context.Background()); err != nil {
+				t.Fatalf("Close() error = %v", err)
+			}
+
+			r.mut.Lock()
+			defer r.mut.Unlock()
+			if r.attempts != tc.attempts || (len(r.received) == 1) != tc.delivered {
+				t.Errorf("attempts = %d, received %d, expected %d attempts", r.attempts, len(r.received), tc.attempts)
+			}
+		})
+	}
+}
+
+func TestWebhookRejectsInvalidURLs(t *testing.T) {
+	for _, raw := range []string{"example.com/hook", "ftp://example.com/hook", "http://"} {
+		if _, err := sinks.NewWebhook(sinks.WebhookConfig{Endpoints: map[string][]string{"orders": {raw}}}); err == nil {
+			t.Errorf("NewWebhook(%q) expected an error", raw)
+		}
+	}
+
+	t.Setenv("PULSE_WEBHOOKS", `["http://example.com"]`)
+	if _, err := sinks.FromEnv(); err == nil {
+		t.Errorf("FromEnv() expected an error for a list")
+	}
+}
+
+func TestServerSendsNotificationsToWebhooks(t *testing.T) {
+	r, ts := newWebhookReceiver(t, 0, 0)
+	t.Setenv("PULSE_WEBHOOKS", `{"orders": ["`+ts.URL+`"]}`)
+
+	db := newFakeDB()
+	s, _ := startServer(t, db)
+
+	db.notifications <- database.DBNotification{Operation: "insert", Table: "orders", ID: "1"}
+	r.wait(t, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown() error = %v", err)
+	}
+
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	if r.received[0].Seq == 0 {
+		t.Errorf("received %+v, expected it numbered", r.received[0])
+	}
+}
+
+// kafkaBroker is a fake Kafka broker, the only one of its cluster, leading
+// the two partitions of every topic. It records the records produced to it,
+// failing the first failures produce requests as if a replica was missing.
+type kafkaBroker struct {
+	mut      sync.Mutex
+	addr     string
+	failures int
+	produces int
+	// records are the operations produced by topic and key, partitions
+	// are those every key was produced to
+	records    map[string]map[string][]string
+	partitions map[string]map[int32]bool
+}
+
+func newKafkaBroker(t *testing.T, failures int) *kafkaBroker {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error = %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	b := &kafkaBroker{addr: l.Addr().String(), failures: failures, records: make(map[string]map[string][]string), partitions: make(map[string]map[int32]bool)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(t, conn)
+		}
+	}()
+
+	return b
+}
+
+// serve answers the requests of conn the client needs to produce:
+// ApiVersions, Metadata, InitProducerID and Produce.
+func (b *kafkaBroker) serve(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		var size int32
+		if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+			return
+		}
+		msg := make([]byte, size)
+		if _, err := io.ReadFull(conn, msg); err != nil {
+			return
+		}
+
+		// The header is the key, version, correlation id and client id,
+		// followed by tags once the request is flexible
+		key, version := int16(binary.BigEndian.Uint16(msg)), int16(binary.BigEndian.Uint16(msg[2:]))
+		correlation := msg[4:8]
+		body := msg[10+int(int16(binary.BigEndian.Uint16(msg[8:]))):]
+
+		req := kmsg.RequestForKey(key)
+		if req == nil {
+			t.Errorf("unexpected kafka request %d", key)
+			return
+		}
+		req.SetVersion(version)
+		if req.IsFlexible() {
+			body = body[1:]
+		}
+		if err := req.ReadFrom(body); err != nil {
+			t.Errorf("decode kafka request %d error = %v", key, err)
+			return
+		}
+
+		resp := b.handle(t, req)
+		if resp == nil {
+			continue
+		}
+		resp.SetVersion(version)
+		out := append([]byte{0, 0, 0, 0}, correlation...)
+		if resp.IsFlexible() && key != 18 {
+			out = append(out, 0)
+		}
+		out = resp.AppendTo(out)
+		binary.BigEndian.PutUint32(out, uint32(len(out)-4))
+		if _, err := conn.Write(out); err != nil {
+			return
+		}
+	}
+}
+
+func (b *kafkaBroker) handle(t *testing.T, req kmsg.Request) kmsg.Response {
+	switch req := req.(type) {
+	case *kmsg.ApiVersionsRequest:
+		resp := kmsg.NewPtrApiVersionsResponse()
+		for _, api := range [][3]int16{{0, 3, 7}, {3, 1, 8}, {18, 0, 3}, {22, 0, 1}} {
+			resp.ApiKeys = append(resp.ApiKeys, kmsg.ApiVersionsResponseApiKey{ApiKey: api[0], MinVersion: api[1], MaxVersion: api[2]})
+		}
+		return resp
+
+	case *kmsg.MetadataRequest:
+		host, port, _ := net.SplitHostPort(b.addr)
+		number, _ := strconv.Atoi(port)
+		resp := kmsg.NewPtrMetadataResponse()
+		resp.Brokers = []kmsg.MetadataResponseBroker{{NodeID: 0, Host: host, Port: int32(number)}}
+		for _, topic := range req.Topics {
+			partitions := []kmsg.MetadataResponseTopicPartition{
+				{Partition: 0, Replicas: []int32{0}, ISR: []int32{0}},
+				{Partition: 1, Replicas: []int32{0}, ISR: []int32{0}},
+			}
+			resp.Topics = append(resp.Topics, kmsg.MetadataResponseTopic{Topic: topic.Topic, Partitions: partitions})
+		}
+		return resp
+
+	case *kmsg.InitProducerIDRequest:
+		resp := kmsg.NewPtrInitProducerIDResponse()
+		resp.ProducerID = 1
+		return resp
+
+	case *kmsg.ProduceRequest:
+		b.mut.Lock()
+		defer b.mut.Unlock()
+		b.produces++
+		failed := b.produces <= b.failures
+
+		resp := kmsg.NewPtrProduceResponse()
+		for _, topic := range req.Topics {
+			produced := kmsg.ProduceResponseTopic{Topic: topic.Topic}
+			for _, partition := range topic.Partitions {
+				if failed {
+					produced.Partitions = append(produced.Partitions, kmsg.ProduceResponseTopicPartition{Partition: partition.Partition, ErrorCode: 19})
+					continue
+				}
+				b.record(t, topic.Topic, partition.Partition, partition.Records)
+				produced.Partitions = append(produced.Partitions, kmsg.ProduceResponseTopicPartition{Partition: partition.Partition})
+			}
+			resp.Topics = append(resp.Topics, produced)
+		}
+		// Nothing answers a request without acks
+		if req.Acks == 0 {
+			return nil
+		}
+		return resp
+	}
+
+	t.Errorf("unexpected kafka request %T", req)
+	return nil
+}
+
+// record decodes the uncompressed batch of records produced to partition.
+func (b *kafkaBroker) record(t *testing.T, topic string, partition int32, records []byte) {
+	var batch kmsg.RecordBatch
+	if err := batch.ReadFrom(records); err != nil {
+		t.Errorf("decode record batch error = %v", err)
+		return
+	}
+
+	raw := batch.Records
+	for i := int32(0); i < batch.NumRecords; i++ {
+		length, n := binary.Varint(raw)
+		var r kmsg.Record
+		if err := r.ReadFrom(raw[:n+int(length)]); err != nil {
+			t.Errorf("decode record error = %v", err)
+			return
+		}
+		raw = raw[n+int(length):]
+
+		var notification database.DBNotification
+		if err := json.Unmarshal(r.Value, &notification); err != nil {
+			t.Errorf("decode record value error = %v", err)
+		}
+		if b.records[topic] == nil {
+			b.records[topic] = make(map[string][]string)
+		}
+		b.records[topic][string(r.Key)] = append(b.records[topic][string(r.Key)], notification.Operation)
+		if b.partitions[string(r.Key)] == nil {
+			b.partitions[string(r.Key)] = make(map[int32]bool)
+		}
+		b.partitions[string(r.Key)][partition] = true
+	}
+}
+
+// produceToKafka sends notifications to a producer of cfg to broker and
+// closes it.
+func produceToKafka(t *testing.T, broker *kafkaBroker, cfg sinks.KafkaConfig, notifications []database.DBNotification) {
+	t.Helper()
+
+	cfg.Brokers = []string{broker.addr}
+	cfg.Backoff = time.Millisecond
+	// The client refreshes the metadata before retrying, at most every 5s
+	// by default
+	cfg.Options = append(cfg.Options, kgo.ProducerBatchCompression(kgo.NoCompression()), kgo.MetadataMinAge(10*time.Millisecond))
+	kafka, err := sinks.NewKafka(cfg)
+	if err != nil {
+		t.Fatalf("NewKafka() error = %v", err)
+	}
+	for _, n := range notifications {
+		kafka.Send(n)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := kafka.Close(ctx); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+}
+
+func TestKafkaProducesToTopics(t *testing.T) {
+	notifications := []database.DBNotification{
+		{Operation: "insert", Table: "orders", ID: "1"},
+		{Operation: "update", Table: "users", ID: "7"},
+		{Operation: "update", Table: "orders", ID: "1"},
+	}
+
+	for name, tc := range map[string]struct {
+		cfg      sinks.KafkaConfig
+		expected map[string]map[string][]string
+	}{
+		"single topic": {
+			cfg:      sinks.KafkaConfig{Topic: "changes"},
+			expected: map[string]map[string][]string{"changes": {"orders": {"insert", "update"}, "users": {"update"}}},
+		},
+		"topic per table": {
+			cfg:      sinks.KafkaConfig{},
+			expected: map[string]map[string][]string{"pulse.orders": {"1": {"insert", "update"}}, "pulse.users": {"7": {"update"}}},
+		},
+		"leader acks": {
+			cfg:      sinks.KafkaConfig{Topic: "changes", Acks: "leader"},
+			expected: map[string]map[string][]string{"changes": {"orders": {"insert", "update"}, "users": {"update"}}},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			broker := newKafkaBroker(t, 0)
+			produceToKafka(t, broker, tc.cfg, notifications)
+
+			broker.mut.Lock()
+			defer broker.mut.Unlock()
+			if !reflect.DeepEqual(broker.records, tc.expected) {
+				t.Errorf("produced %v, expected %v", broker.records, tc.expected)
+			}
+			// A key always goes to the same partition
+			for key, partitions := range broker.partitions {
+				if len(partitions) != 1 {
+					t.Errorf("key %s produced to partitions %v, expected a single one", key, partitions)
+				}
+			}
+		})
+	}
+}
+
+func TestKafkaRetriesFailedRecords(t *testing.T) {
+	broker := newKafkaBroker(t, 2)
+	produceToKafka(t, broker, sinks.KafkaConfig{Topic: "changes"}, []database.DBNotification{
+		{Operation: "insert", Table: "orders", ID: "1"},
+	})
+
+	broker.mut.Lock()
+	defer broker.mut.Unlock()
+	if expected := map[string][]string{"orders": {"insert"}}; !reflect.DeepEqual(broker.records["changes"], expected) || broker.produces != 3 {
+		t.Errorf("produced %v in %d requests, expected %v in 3", broker.records["changes"], broker.produces, expected)
+	}
+}
+
+func TestKafkaRejectsInvalidConfig(t *testing.T) {
+	for name, cfg := range map[string]sinks.KafkaConfig{
+		"no brokers":    {},
+		"empty broker":  {Brokers: []string{"localhost:9092", " "}},
+		"invalid topic": {Brokers: []string{"localhost:9092"}, Topic: "pulse changes"},
+		"unknown acks":  {Brokers: []string{"localhost:9092"}, Acks: "some"},
+	} {
+		if _, err := sinks.NewKafka(cfg); err == nil {
+			t.Errorf("%s: NewKafka() expected an error", name)
+		}
+	}
+
+	t.Setenv("PULSE_KAFKA_BROKERS", "localhost:9092,")
+	if _, err := sinks.FromEnv(); err == nil {
+		t.Errorf("FromEnv() expected an error for PULSE_KAFKA_BROKERS")
+	}
+}
+
+// natsServer is a fake NATS server recording the messages published to it.
+// With jetStream it acks them, refusing the subjects under refuse.
+type natsServer struct {
+	mut       sync.Mutex
+	connects  []string
+	published []string
+	jetStream bool
+	refuse    string
+}
+
+func newNATSServer(t *testing.T, jetStream bool) (*natsServer, string) {
+	s := &natsServer{jetStream: jetStream}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error = %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+
+	return s, "nats://token@" + l.Addr().String()
+}
+
+func (s *natsServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "INFO {\"server_id\":\"fake\",\"max_payload\":1048576}\r\n")
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		op, args, _ := strings.Cut(strings.TrimSpace(line), " ")
+		switch op {
+		case "CONNECT":
+			s.mut.Lock()
+			s.connects = append(s.connects, args)
+			s.mut.Unlock()
+		case "PING":
+			fmt.Fprintf(conn, "PONG\r\n")
+		case "PUB":
+			fields := strings.Fields(args)
+			size, _ := strconv.Atoi(fields[len(fields)-1])
+			payload := make([]byte, size+2)
+			io.ReadFull(r, payload)
+
+			var n database.DBNotification
+			json.Unmarshal(payload[:size], &n)
+
+			s.mut.Lock()
+			s.published = append(s.published, fields[0]+" "+n.ID)
+			s.mut.Unlock()
+
+			if s.jetStream && len(fields) == 3 {
+				ack := `{"stream":"PULSE","seq":1}`
+				if s.refuse != "" && strings.HasPrefix(fields[0], s.refuse) {
+					ack = `{"error":{"code":503,"description":"no responders"}}`
+				}
+				fmt.Fprintf(conn, "MSG %s 1 %d\r\n%s\r\n", fields[1], len(ack), ack)
+			}
+		}
+	}
+}
+
+func TestNATSPublishesToSubjects(t *testing.T) {
+	for _, jetStream := range []bool{false, true} {
+		t.Run(fmt.Sprintf("jetstream=%t", jetStream), func(t *testing.T) {
+			s, url := newNATSServer(t, jetStream)
+			s.refuse = "pulse.users."
+
+			nats, err := sinks.NewNATS(sinks.NATSConfig{URL: url, JetStream: jetStream, Backoff: time.Millisecond})
+			if err != nil {
+				t.Fatalf("NewNATS() error = %v", err)
+			}
+			nats.Send(database.DBNotification{Operation: "insert", Table: "orders", ID: "1"})
+			nats.Send(database.DBNotification{Operation: "delete", Table: "users", ID: "7"})
+			nats.Send(database.DBNotification{Operation: "update", Table: "orders", ID: "1"})
+			if err := nats.Close(context.Background()); err != nil {
+				t.Fatalf("Close() error = %v", err)
+			}
+
+			s.mut.Lock()
+			defer s.mut.Unlock()
+			// A refused notification isn't retried
+			expected := []string{"pulse.orders.insert 1", "pulse.users.delete 7", "pulse.orders.update 1"}
+			if !reflect.DeepEqual(s.published, expected) {
+				t.Errorf("published %v, expected %v", s.published, expected)
+			}
+			if len(s.connects) != 1 || !strings.Contains(s.connects[0], `"auth_token":"token"`) {
+				t.Errorf("connects = %v, expected a single one with the token", s.connects)
+			}
+		})
+	}
+}
+
+func TestNATSRetriesUnacked(t *testing.T) {
+	s, url := newNATSServer(t, false)
+
+	// The server doesn't ack, as if no stream captured the subject
+	nats, err := sinks.NewNATS(sinks.NATSConfig{URL: url, JetStream: true, Attempts: 3, Backoff: time.Millisecond, Timeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("NewNATS() error = %v", err)
+	}
+	nats.Send(database.DBNotification{Operation: "insert", Table: "orders", ID: "1"})
+	if err := nats.Close(context.Background()); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if len(s.published) != 3 {
+		t.Errorf("published %v, expected 3 attempts", s.published)
+	}
+}
+
+func TestNATSRejectsInvalidConfig(t *testing.T) {
+	for name, cfg := range map[string]sinks.NATSConfig{
+		"no server":      {},
+		"http URL":       {URL: "http://localhost:4222"},
+		"wildcard":       {URL: "nats://localhost", SubjectPrefix: "pulse.*"},
+		"trailing token": {URL: "nats://localhost", SubjectPrefix: "pulse."},
+	} {
+		if _, err := sinks.NewNATS(cfg); err == nil {
+			t.Errorf("%s: NewNATS() expected an error", name)
+		}
+	}
+
+	t.Setenv("PULSE_NATS_URL", "nats://localhost")
+	t.Setenv("PULSE_NATS_JETSTREAM", "maybe")
+	if _, err := sinks.FromEnv(); err == nil {
+		t.Errorf("FromEnv() expected an error for PULSE_NATS_JETSTREAM")
+	}
+}
+
+// mqttBroker is a fake MQTT broker recording the messages published to it,
+// acking them as their QoS requires. The first publish is left unacked when
+// dropFirst is set. Clients disconnecting are signaled on disconnects.
+type mqttBroker struct {
+	mut         sync.Mutex
+	connects    [][]byte
+	published   []string
+	dropFirst   bool
+	disconnects chan struct{}
+}
+
+func newMQTTBroker(t *testing.T) (*mqttBroker, string) {
+	b := &mqttBroker{disconnects: make(chan struct{}, 16)}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error = %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+
+	return b, "mqtt://device:secret@" + l.Addr().String()
+}
+
+func (b *mqttBroker) serve(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	for {
+		header, err := r.ReadByte()
+		if err != nil {
+			return
+		}
+		size, _ := binary.ReadUvarint(r)
+		body := make([]byte, size)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return
+		}
+
+		switch header >> 4 {
+		case 1:
+			b.mut.Lock()
+			b.connects = append(b.connects, body)
+			b.mut.Unlock()
+			conn.Write([]byte{0x20, 2, 0, 0})
+		case 3:
+			qos := header >> 1 & 3
+			topicSize := int(binary.BigEndian.Uint16(body))
+			topic, rest := string(body[2:2+topicSize]), body[2+topicSize:]
+			var id []byte
+			if qos > 0 {
+				id, rest = rest[:2], rest[2:]
+			}
+
+			var n database.DBNotification
+			json.Unmarshal(rest, &n)
+			b.mut.Lock()
+			b.published = append(b.published, fmt.Sprintf("%s %s qos=%d", topic, n.ID, qos))
+			drop := b.dropFirst && len(b.published) == 1
+			b.mut.Unlock()
+
+			switch {
+			case drop:
+			case qos == 1:
+				conn.Write(append([]byte{0x40, 2}, id...))
+			case qos == 2:
+				conn.Write(append([]byte{0x50, 2}, id...))
+			}
+		case 6:
+			conn.Write(append([]byte{0x70, 2}, body...))
+		case 14:
+			b.disconnects <- struct{}{}
+			return
+		}
+	}
+}
+
+func TestMQTTPublishesToTopics(t *testing.T) {
+	for _, qos := range []int{0, 1, 2} {
+		t.Run(fmt.Sprintf("qos=%d", qos), func(t *testing.T) {
+			b, url := newMQTTBroker(t)
+
+			mqtt, err := sinks.NewMQTT(sinks.MQTTConfig{URL: url, QoS: qos, ClientID: "pulse-test", Backoff: time.Millisecond})
+			if err != nil {
+				t.Fatalf("NewMQTT() error = %v", err)
+			}
+			mqtt.Send(database.DBNotification{Operation: "insert", Table: "orders", ID: "1"})
+			mqtt.Send(database.DBNotification{Operation: "delete", Table: "users", ID: "7"})
+			if err := mqtt.Close(context.Background()); err != nil {
+				t.Fatalf("Close() error = %v", err)
+			}
+
+			// Nothing acks QoS 0, only then the broker read everything
+			select {
+			case <-b.disconnects:
+			case <-time.After(time.Second):
+				t.Fatalf("the client didn't disconnect")
+			}
+
+			b.mut.Lock()
+			defer b.mut.Unlock()
+			expected := []string{fmt.Sprintf("pulse/orders/insert 1 qos=%d", qos), fmt.Sprintf("pulse/users/delete 7 qos=%d", qos)}
+			if !reflect.DeepEqual(b.published, expected) {
+				t.Errorf("published %v, expected %v", b.published, expected)
+			}
+			if len(b.connects) != 1 {
+				t.Fatalf("connected %d times, expected once", len(b.connects))
+			}
+			for _, field := range []string{"MQTT", "pulse-test", "device", "secret"} {
+				if !strings.Contains(string(b.connects[0]), field) {
+					t.Errorf("CONNECT %q is missing %s", b.connects[0], field)
+				}
+			}
+		})
+	}
+}
+
+func TestMQTTRepublishesUnacked(t *testing.T) {
+	b, url := newMQTTBroker(t)
+	b.dropFirst = true
+
+	mqtt, err := sinks.NewMQTT(sinks.MQTTConfig{URL: url, TopicPrefix: "site/pulse", QoS: 1, Backoff: time.Millisecond, Timeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("NewMQTT() error = %v", err)
+	}
+	mqtt.Send(database.DBNotification{Operation: "insert", Table: "orders", ID: "1"})
+	if err := mqtt.Close(context.Background()); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	expected := []string{"site/pulse/orders/insert 1 qos=1", "site/pulse/orders/insert 1 qos=1"}
+	if !reflect.DeepEqual(b.published, expected) || len(b.connects) != 2 {
+		t.Errorf("published %v over %d connections, expected %v over a new one", b.published, len(b.connects), expected)
+	}
+}
+
+func TestMQTTRejectsInvalidConfig(t *testing.T) {
+	for name, cfg := range map[string]sinks.MQTTConfig{
+		"no broker":      {},
+		"http URL":       {URL: "http://localhost:1883"},
+		"wildcard":       {URL: "mqtt://localhost", TopicPrefix: "pulse/#"},
+		"trailing level": {URL: "mqtt://localhost", TopicPrefix: "pulse/"},
+		"qos":            {URL: "mqtt://localhost", QoS: 3},
+	} {
+		if _, err := sinks.NewMQTT(cfg); err == nil {
+			t.Errorf("%s: NewMQTT() expected an error", name)
+		}
+	}
+
+	t.Setenv("PULSE_MQTT_URL", "mqtt://localhost")
+	t.Setenv("PULSE_MQTT_QOS", "once")
+	if _, err := sinks.FromEnv(); err == nil {
+		t.Errorf("FromEnv() expected an error for PULSE_MQTT_QOS")
+	}
+}
@@ -0,0 +1,138 @@
+package tests
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"pulse/internal/database"
+	"strings"
+	"testing"
+	"time"
+)
+
+// subscribeSSE opens an event stream to path on ts and waits for the server
+// to register it. The events' data are sent on the returned channel, which is
+// closed when the stream ends.
+func subscribeSSE(t *testing.T, ts *httptest.Server, path string) (*http.Response, chan string) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+path, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET %s error = %v", path, err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+
+	events := make(chan string, 16)
+	go func() {
+		defer close(events)
+
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+				events <- data
+			}
+		}
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	return resp, events
+}
+
+// next returns the next event, failing after a second.
+func next(t *testing.T, events chan string) string {
+	t.Helper()
+
+	select {
+	case event, ok := <-events:
+		if !ok {
+			t.Fatalf("stream ended")
+		}
+		return event
+	case <-time.After(time.Second):
+		t.Fatalf("no event received")
+		return ""
+	}
+}
+
+func TestSSEStreamsNotifications(t *testing.T) {
+	db := newFakeDB()
+	_, ts := startServer(t, db)
+	resp, events := subscribeSSE(t, ts, "/sse/orders?operations=insert")
+
+	if contentType := resp.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Errorf("Content-Type = %s, expected text/event-stream", contentType)
+	}
+
+	db.notifications <- database.DBNotification{Operation: "update", Table: "orders", ID: "1"}
+	db.notifications <- database.DBNotification{Operation: "insert", Table: "users", ID: "1"}
+	db.notifications <- database.DBNotification{Operation: "insert", Table: "orders", ID: "2", Data: map[string]interface{}{"id": float64(2)}}
+
+	var msg database.DBNotification
+	if err := json.Unmarshal([]byte(next(t, events)), &msg); err != nil || msg.ID != "2" || msg.Source != "fake" {
+		t.Errorf("received %+v (err %v), expected the insert of order 2 in the pulse.v2 shape", msg, err)
+	}
+}
+
+func TestSSEClosesWithReason(t *testing.T) {
+	db := newFakeDB()
+	_, ts := startServer(t, db)
+	_, events := subscribeSSE(t, ts, "/sse/orders/1")
+
+	db.notifications <- database.DBNotification{Operation: "delete", Table: "orders", ID: "1"}
+	next(t, events)
+
+	var control map[string]string
+	if err := json.Unmarshal([]byte(next(t, events)), &control); err != nil || control["operation"] != "close" || control["reason"] != "row_deleted" {
+		t.Errorf("expected row_deleted control message, got %v (err %v)", control, err)
+	}
+
+	select {
+	case _, ok := <-events:
+		if ok {
+			t.Errorf("received an event after the close")
+		}
+	case <-time.After(time.Second):
+		t.Errorf("stream still open after the close")
+	}
+}
+
+func TestSSEFirehoseToggle(t *testing.T) {
+	t.Setenv("PULSE_ENABLE_FIREHOSE", "false")
+	_, ts := startServer(t, newFakeDB())
+
+	resp, err := http.Get(ts.URL + "/sse/all")
+	if err != nil {
+		t.Fatalf("GET error = %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("status = %d, expected %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestSSEShutdown(t *testing.T) {
+	db := newFakeDB()
+	s, ts := startServer(t, db)
+	_, events := subscribeSSE(t, ts, "/sse/orders")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown() error = %v", err)
+	}
+
+	for _, expected := range []string{"draining", "error"} {
+		var control map[string]interface{}
+		if err := json.Unmarshal([]byte(next(t, events)), &control); err != nil || control["operation"] != expected {
+			t.Errorf("received %v (err %v), expected the %s control message", control, err, expected)
+		}
+	}
+}
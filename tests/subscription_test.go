@@ -0,0 +1,192 @@
+package tests
+
+import (
+	"net/url"
+	"pulse/internal/database"
+	"pulse/internal/server"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSubscriptionAccept(t *testing.T) {
+	update := database.DBNotification{
+		Operation: "update",
+		Table:     "orders",
+		ID:        "1",
+		Source:    "fake",
+		Changed:   []string{"status"},
+		Data:      map[string]interface{}{"id": float64(1), "status": "paid", "amount": float64(50)},
+	}
+
+	bulk := database.DBNotification{Operation: "update", Table: "orders", Source: "fake", Bulk: true, Count: 2, IDs: []string{"1", "2"}}
+	truncated := database.DBNotification{Operation: "update", Table: "orders", Source: "fake", Bulk: true, Count: 500, IDs: []string{"1", "2"}}
+	customer := map[string]interface{}{"name": "Ada", "email": "ada@example.com"}
+	nested := database.DBNotification{Operation: "insert", Table: "orders", ID: "1", Source: "fake", Data: map[string]interface{}{"id": float64(1), "total": float64(10), "customer": customer}}
+	tenant := database.DBNotification{Operation: "insert", Table: "orders_12", Schema: "tenant_12", ID: "1", Source: "fake"}
+	truncate := database.DBNotification{Operation: database.OperationTruncate, Table: "orders", Source: "fake"}
+
+	tests := []struct {
+		name     string
+		table    string
+		id       string
+		query    string
+		msg      database.DBNotification
+		accepted bool
+		data     interface{}
+	}{
+		{name: "everything", msg: update, accepted: true, data: update.Data},
+		{name: "route table", table: "orders", msg: update, accepted: true, data: update.Data},
+		{name: "other route table", table: "users", msg: update},
+		{name: "route row", table: "orders", id: "2", msg: update},
+		{name: "tables", query: "tables=users,orders", msg: update, accepted: true, data: update.Data},
+		{name: "route table pattern", table: "orders_*", msg: tenant, accepted: true},
+		{name: "tables pattern", query: "tables=users,orders_??", msg: tenant, accepted: true},
+		{name: "pattern of other tables", query: "tables=orders_?", msg: tenant},
+		{name: "patterns match whole names", table: "rders*", msg: update},
+		{name: "schema pattern", query: "tables=tenant_*.*", msg: tenant, accepted: true},
+		{name: "schema pattern of other schemas", query: "tables=billing.*", msg: tenant},
+		{name: "qualified table", table: "tenant_12.orders_12", msg: tenant, accepted: true},
+		{name: "ids", query: "ids=2,3", msg: update},
+		{name: "truncate of route row", table: "orders", id: "2", msg: truncate, accepted: true},
+		{name: "truncate and where", table: "orders", query: "where=status=eq.paid", msg: truncate, accepted: true},
+		{name: "truncate of other tables", table: "users", msg: truncate},
+		{name: "truncate and operations", table: "orders", query: "operations=insert", msg: truncate},
+		{name: "operations", query: "operations=insert,delete", msg: update},
+		{name: "ops", query: "ops=insert,update", msg: update, accepted: true, data: update.Data},
+		{name: "other ops", table: "orders", query: "ops=delete", msg: update},
+		{name: "watched column changed", query: "columns=amount,status", msg: update, accepted: true, data: update.Data},
+		{name: "watched column unchanged", query: "columns=amount", msg: update},
+		{name: "operations and columns", query: "operations=update&columns=status", msg: update, accepted: true, data: update.Data},
+		{name: "operations and other columns", query: "operations=update&columns=amount", msg: update},
+		{
+			name:     "fields",
+			query:    "fields=id,status,missing",
+			msg:      update,
+			accepted: true,
+			data:     map[string]interface{}{"id": float64(1), "status": "paid"},
+		},
+		{
+			name:     "fields and filter",
+			table:    "orders",
+			query:    "fields=status&filter=amount > 10&operations=update",
+			msg:      update,
+			accepted: true,
+			data:     map[string]interface{}{"status": "paid"},
+		},
+		{name: "where", table: "orders", query: "where=status=eq.paid&where=amount=gt.10", msg: update, accepted: true, data: update.Data},
+		{name: "where and filter", table: "orders", query: "where=status=eq.paid&filter=amount > 100", msg: update},
+		{name: "select", query: "select=id,total", msg: nested, accepted: true, data: map[string]interface{}{"id": float64(1), "total": float64(10)}},
+		{
+			name:     "select nested field",
+			query:    "select=id,customer.name",
+			msg:      nested,
+			accepted: true,
+			data:     map[string]interface{}{"id": float64(1), "customer": map[string]interface{}{"name": "Ada"}},
+		},
+		{name: "select object and its field", query: "fields=customer.name,customer", msg: nested, accepted: true, data: map[string]interface{}{"customer": customer}},
+		{name: "select missing nested field", query: "select=id,customer.phone,total.value", msg: nested, accepted: true, data: map[string]interface{}{"id": float64(1)}},
+		{name: "filter on projected out column", query: "fields=status&filter=amount > 100", msg: update},
+		{name: "other source", query: "source=other", msg: update},
+		{name: "bulk bypasses the row filters", table: "orders", query: "filter=amount > 100&columns=amount", msg: bulk, accepted: true},
+		{name: "bulk with the subscribed id", table: "orders", id: "2", msg: bulk, accepted: true},
+		{name: "bulk without the subscribed id", table: "orders", id: "9", msg: bulk},
+		{name: "truncated bulk", table: "orders", id: "9", msg: truncated, accepted: true},
+		{
+			name:     "losses bypass the row filters",
+			table:    "orders",
+			id:       "2",
+			query:    "operations=insert&filter=amount > 100",
+			msg:      database.DBNotification{Operation: database.OperationEventLost, Source: "fake"},
+			accepted: true,
+		},
+		{
+			name:     "losses of the route table",
+			table:    "orders",
+			id:       "2",
+			query:    "operations=insert",
+			msg:      database.DBNotification{Operation: database.OperationEventLost, Table: "orders", Source: "fake"},
+			accepted: true,
+		},
+		{
+			name:  "losses of other tables",
+			table: "users",
+			msg:   database.DBNotification{Operation: database.OperationEventLost, Table: "orders", Source: "fake"},
+		},
+		{
+			name:     "resubscriptions bypass the row filters",
+			table:    "orders",
+			query:    "operations=insert&filter=amount > 100",
+			msg:      database.DBNotification{Operation: database.OperationResubscribed, Source: "fake"},
+			accepted: true,
+		},
+		{
+			name:  "resubscriptions of another source",
+			table: "orders",
+			query: "source=other",
+			msg:   database.DBNotification{Operation: database.OperationResubscribed, Source: "fake"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, _ := url.ParseQuery(tt.query)
+			sub, err := server.NewSubscription(tt.table, tt.id, query)
+			if err != nil {
+				t.Fatalf("NewSubscription error = %v", err)
+			}
+
+			msg, accepted := sub.Accept(tt.msg)
+			if accepted != tt.accepted {
+				t.Fatalf("Accept = %v, expected %v", accepted, tt.accepted)
+			}
+			if accepted && !reflect.DeepEqual(msg.Data, tt.data) {
+				t.Errorf("data = %v, expected %v", msg.Data, tt.data)
+			}
+		})
+	}
+
+	// The notification is shared by every subscriber
+	if len(update.Data.(map[string]interface{})) != 3 || len(customer) != 2 {
+		t.Errorf("Accept modified the notification: %v, %v", update.Data, customer)
+	}
+}
+
+func TestSubscriptionRejectsInvalidParameters(t *testing.T) {
+	tests := []struct {
+		name  string
+		table string
+		id    string
+		query string
+	}{
+		{name: "sample", query: "sample=2"},
+		{name: "filter", query: "filter=amount >"},
+		{name: "dedup", query: "dedup=maybe"},
+		{name: "where", query: "where=status=is.paid"},
+		{name: "select and fields", query: "select=id&fields=id"},
+		{name: "empty field in path", query: "select=customer..name"},
+		{name: "ops and operations", query: "ops=insert&operations=delete"},
+		{name: "tables excluding the route", table: "orders", query: "tables=users"},
+		{name: "ids excluding the route", table: "orders", id: "1", query: "ids=2"},
+		{name: "injected route table", table: "orders; DROP TABLE orders"},
+		{name: "injected tables", query: "tables=orders,users%22%3B%20DROP%20TABLE%20users"},
+		{name: "long table", table: strings.Repeat("a", 64)},
+		{name: "pattern with a class", query: "tables=orders_[0-9]"},
+		{name: "pattern with two dots", query: "tables=a.b.*"},
+		{name: "pattern with an empty schema", table: ".orders"},
+		{name: "aggregate of a pattern", table: "orders_*", query: "aggregate=count"},
+		{name: "aggregate function", table: "orders", query: "aggregate=avg(amount)"},
+		{name: "aggregate without column", table: "orders", query: "aggregate=sum()"},
+		{name: "aggregate without table", query: "aggregate=count"},
+		{name: "aggregate with fields", table: "orders", query: "aggregate=count&fields=id"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, _ := url.ParseQuery(tt.query)
+			if _, err := server.NewSubscription(tt.table, tt.id, query); err == nil {
+				t.Errorf("NewSubscription(%q) succeeded, expected an error", tt.query)
+			}
+		})
+	}
+}
@@ -0,0 +1,195 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"pulse/internal/database"
+	"pulse/internal/sinks"
+	"pulse/internal/tracing"
+	"strings"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"nhooyr.io/websocket"
+)
+
+// recordSpans makes a new in-memory exporter receive the spans for the
+// rest of the test.
+func recordSpans(t *testing.T) *tracetest.InMemoryExporter {
+	t.Helper()
+
+	exporter := tracetest.NewInMemoryExporter()
+	tracing.SetExporter(exporter)
+	t.Cleanup(func() { tracing.SetExporter(nil) })
+
+	return exporter
+}
+
+// exportedSpans returns the spans ended so far.
+func exportedSpans(t *testing.T, exporter *tracetest.InMemoryExporter) tracetest.SpanStubs {
+	t.Helper()
+
+	if err := tracing.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+	return exporter.GetSpans()
+}
+
+func TestSpanPerDeliveredNotification(t *testing.T) {
+	exporter := recordSpans(t)
+
+	db := newFakeDB()
+	_, ts := startServer(t, db)
+	first := dial(t, ts, "/ws/orders")
+	second := dial(t, ts, "/ws/orders")
+
+	traceID := "0af7651916cd43dd8448eb211c80319c"
+	db.payloads <- `{"operation":"insert","table":"orders","id":"1","trace_id":"` + traceID + `","data":{"id":1}}`
+
+	for _, conn := range []*websocket.Conn{first, second} {
+		var msg database.DBNotification
+		if err := json.Unmarshal(read(t, conn), &msg); err != nil || msg.TraceID != traceID {
+			t.Fatalf("received %+v (err %v), expected the trace id %s", msg, err, traceID)
+		}
+	}
+
+	// Spans end right after the write
+	time.Sleep(50 * time.Millisecond)
+
+	var fanout *tracetest.SpanStub
+	var delivered []tracetest.SpanStub
+	for _, span := range exportedSpans(t, exporter) {
+		if span.SpanContext.TraceID().String() != traceID {
+			t.Errorf("span %s has trace %s, expected %s", span.Name, span.SpanContext.TraceID(), traceID)
+		}
+
+		switch span.Name {
+		case "pulse.fanout":
+			span := span
+			fanout = &span
+		case "pulse.deliver":
+			delivered = append(delivered, span)
+		}
+	}
+
+	if fanout == nil {
+		t.Fatalf("no fanout span recorded")
+	}
+	if len(delivered) != 2 {
+		t.Fatalf("recorded %d deliver spans, expected one per client", len(delivered))
+	}
+	for _, span := range delivered {
+		if span.Parent.SpanID() != fanout.SpanContext.SpanID() || span.EndTime.Before(span.StartTime) {
+			t.Errorf("deliver span %+v, expected a child of the fanout span %s", span, fanout.SpanContext.SpanID())
+		}
+	}
+}
+
+func TestNoSpansWithoutExporter(t *testing.T) {
+	if span := tracing.Start(tracing.SpanContext{}, "pulse.deliver"); span.IsRecording() {
+		t.Errorf("Start() = %+v without an exporter, expected a no-op span", span)
+	}
+}
+
+func TestTraceparent(t *testing.T) {
+	traceparent := "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	sc, err := tracing.ParseTraceparent(traceparent)
+	if err != nil {
+		t.Fatalf("ParseTraceparent() error = %v", err)
+	}
+	if sc.TraceID().String() != "0af7651916cd43dd8448eb211c80319c" || sc.SpanID().String() != "b7ad6b7169203331" {
+		t.Errorf("ParseTraceparent() = %+v", sc)
+	}
+	if formatted := tracing.Traceparent(sc); formatted != traceparent {
+		t.Errorf("Traceparent() = %q, expected %q", formatted, traceparent)
+	}
+	if formatted := tracing.Traceparent(tracing.SpanContext{}); formatted != "" {
+		t.Errorf("Traceparent() = %q without a span, expected it empty", formatted)
+	}
+
+	for _, invalid := range []string{
+		"",
+		"0af7651916cd43dd8448eb211c80319c",
+		"ff-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+		"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01-extra",
+		"00-00000000000000000000000000000000-b7ad6b7169203331-01",
+		"00-0af7651916cd43dd8448eb211c80319c-0000000000000000-01",
+		"00-0af7651916cd43dd8448eb211c80319c-b7ad6b71692033-01",
+		"00-0af7651916cd43dd8448eb211c80319c-zzad6b7169203331-01",
+	} {
+		if _, err := tracing.ParseTraceparent(invalid); err == nil {
+			t.Errorf("ParseTraceparent(%q) succeeded, expected an error", invalid)
+		}
+	}
+}
+
+func TestPublishContinuesTraceparent(t *testing.T) {
+	t.Setenv("PULSE_PUBLISH_TOKEN", "secret")
+	exporter := recordSpans(t)
+
+	db := newFakeDB()
+	_, ts := startServer(t, db)
+	conn := dial(t, ts, "/ws/deploys")
+
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+"/publish", strings.NewReader(`{"operation":"started","table":"deploys"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("publish error = %v", err)
+	}
+	resp.Body.Close()
+
+	var msg database.DBNotification
+	if err := json.Unmarshal(read(t, conn), &msg); err != nil || msg.TraceID != "0af7651916cd43dd8448eb211c80319c" {
+		t.Fatalf("received %+v (err %v), expected the publisher's trace id", msg, err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	byName := make(map[string]tracetest.SpanStub)
+	for _, span := range exportedSpans(t, exporter) {
+		byName[span.Name] = span
+	}
+	publish, fanout := byName["pulse.publish"], byName["pulse.fanout"]
+	if publish.Parent.SpanID().String() != "b7ad6b7169203331" || publish.SpanContext.TraceID().String() != "0af7651916cd43dd8448eb211c80319c" {
+		t.Errorf("publish span %+v, expected a child of the publisher's span", publish)
+	}
+	if fanout.Parent.SpanID() != publish.SpanContext.SpanID() {
+		t.Errorf("fanout span %+v, expected a child of the publish span %s", fanout, publish.SpanContext.SpanID())
+	}
+}
+
+func TestWebhookContinuesTrace(t *testing.T) {
+	exporter := recordSpans(t)
+
+	r, ts := newWebhookReceiver(t, 1, http.StatusServiceUnavailable)
+	webhook, err := sinks.NewWebhook(sinks.WebhookConfig{
+		Endpoints: map[string][]string{sinks.AllTables: {ts.URL}},
+		Backoff:   time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewWebhook() error = %v", err)
+	}
+
+	parent, _ := tracing.ParseTraceparent("00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	webhook.Send(database.DBNotification{Operation: "insert", Table: "orders", ID: "1", Span: parent})
+	if err := webhook.Close(context.Background()); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	spans := exportedSpans(t, exporter)
+	if len(spans) != 1 || spans[0].Name != "pulse.webhook" || spans[0].Parent.SpanID() != parent.SpanID() || spans[0].Status.Code == codes.Error {
+		t.Fatalf("recorded %+v, expected a successful webhook span, child of the notification's", spans)
+	}
+
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	if expected := tracing.Traceparent(spans[0].SpanContext); len(r.traceparents) != 1 || r.traceparents[0] != expected {
+		t.Errorf("traceparent headers = %q, expected %q", r.traceparents, expected)
+	}
+}